@@ -0,0 +1,270 @@
+package immutable
+
+import (
+	"fmt"
+	"sort"
+)
+
+// MapEntry represents a key/value pair passed to Map.SetMany.
+type MapEntry struct {
+	Key   interface{}
+	Value interface{}
+}
+
+// SetMany returns a map with each entry's key set to its value. If a key
+// appears more than once then the last entry wins.
+//
+// Keys are hashed and sorted by their position in the trie before being applied
+// in a single pass so each branch node is copied at most once per batch. This
+// is much faster than calling Set() for each entry when setting many keys.
+// Returns the original map if no keys are changed.
+func (m *Map) SetMany(entries []MapEntry) *Map {
+	if len(entries) == 0 {
+		return m
+	}
+
+	// Set a hasher on the first value if one does not already exist.
+	hasher := m.hasher
+	if hasher == nil {
+		if hasher = defaultHasher(entries[0].Key); hasher == nil {
+			panic(fmt.Sprintf("immutable.Map.SetMany: must set hasher for %T type", entries[0].Key))
+		}
+	}
+
+	ops := make([]mapBatchOp, len(entries))
+	for i, e := range entries {
+		ops[i] = mapBatchOp{key: e.Key, value: e.Value, index: i}
+	}
+	return m.applyBatch(ops, hasher)
+}
+
+// DeleteMany returns a map with the given keys removed. Keys are applied in a
+// single pass over the trie in the same way as SetMany. Returns the original
+// map if none of the keys exist.
+func (m *Map) DeleteMany(keys []interface{}) *Map {
+	if m.root == nil || len(keys) == 0 {
+		return m
+	}
+
+	ops := make([]mapBatchOp, len(keys))
+	for i, key := range keys {
+		ops[i] = mapBatchOp{key: key, index: i, delete: true}
+	}
+	return m.applyBatch(ops, m.hasher)
+}
+
+// applyBatch hashes & sorts ops and applies them to the map in a single pass.
+func (m *Map) applyBatch(ops []mapBatchOp, hasher Hasher) *Map {
+	for i := range ops {
+		ops[i].keyHash = hashKey(hasher, ops[i].key)
+		ops[i].path = mapHashPath(ops[i].keyHash)
+	}
+
+	// Order by trie position. Ties are broken by index so later ops for the
+	// same key are applied after earlier ones.
+	sort.Slice(ops, func(i, j int) bool {
+		if ops[i].path != ops[j].path {
+			return ops[i].path < ops[j].path
+		}
+		return ops[i].index < ops[j].index
+	})
+
+	root := m.root
+	if root == nil {
+		root = &mapArrayNode{}
+	}
+
+	var delta int
+	newRoot := applyMapBatch(root, ops, 0, hasher, m.equaler, &delta)
+	if newRoot == root {
+		return m
+	} else if n, ok := newRoot.(*mapArrayNode); ok && len(n.entries) == 0 {
+		newRoot = nil
+	}
+	return &Map{
+		size:    m.size + delta,
+		root:    newRoot,
+		hasher:  hasher,
+		equaler: m.equaler,
+	}
+}
+
+// mapBatchOp represents a single set or delete within a batch.
+type mapBatchOp struct {
+	key     interface{}
+	value   interface{}
+	keyHash uint64
+	path    uint64 // keyHash with fragments reversed, see mapHashPath()
+	index   int    // position within the batch
+	delete  bool
+}
+
+// update returns the value to set for the op. Implements mapUpdateFunc.
+func (op *mapBatchOp) update(old interface{}, exists bool) (interface{}, bool) {
+	return op.value, !op.delete
+}
+
+// mapHashPath returns keyHash with its 5-bit fragments in reverse order so that
+// sorting by path orders keys by their position in the trie. The first
+// fragment used by the trie becomes the most significant bits of the path.
+func mapHashPath(keyHash uint64) uint64 {
+	var path uint64
+	for shift := uint(0); shift < 64; shift += mapNodeBits {
+		n := uint(mapNodeBits)
+		if shift+n > 64 {
+			n = 64 - shift
+		}
+		path = path<<n | (keyHash>>shift)&(1<<n-1)
+	}
+	return path
+}
+
+// applyMapBatch applies ops to n and returns the new node. If n is nil then a
+// value node is created for the first set op. Ops must be sorted by path.
+func applyMapBatch(n mapNode, ops []mapBatchOp, shift uint, h Hasher, eq ValueEqualer, delta *int) mapNode {
+	// Skip deletes of keys that do not exist until a key is set.
+	for n == nil {
+		if len(ops) == 0 {
+			return nil
+		} else if !ops[0].delete {
+			n = newMapValueNode(ops[0].keyHash, ops[0].key, ops[0].value)
+			*delta++
+		}
+		ops = ops[1:]
+	}
+
+	if len(ops) == 0 {
+		return n
+	}
+	return n.updateMany(ops, shift, h, eq, delta)
+}
+
+// updateMany applies ops to the array node one at a time. Once the node
+// expands into a branch node the remaining ops are applied to the branch.
+func (n *mapArrayNode) updateMany(ops []mapBatchOp, shift uint, h Hasher, eq ValueEqualer, delta *int) mapNode {
+	return applyMapBatchSequential(n, ops, shift, h, eq, delta)
+}
+
+// updateMany applies ops to the children of the node. The node is copied once.
+func (n *mapBitmapIndexedNode) updateMany(ops []mapBatchOp, shift uint, h Hasher, eq ValueEqualer, delta *int) mapNode {
+	var children [mapNodeSize]mapNode
+	for i := range children {
+		children[i] = mapBranchChild(n, i)
+	}
+	if !updateMapBranchChildren(&children, ops, shift, h, eq, delta) {
+		return n
+	}
+	return newMapBranchNode(&children)
+}
+
+// updateMany applies ops to the children of the node. The node is copied once.
+func (n *mapHashArrayNode) updateMany(ops []mapBatchOp, shift uint, h Hasher, eq ValueEqualer, delta *int) mapNode {
+	children := n.nodes
+	if !updateMapBranchChildren(&children, ops, shift, h, eq, delta) {
+		return n
+	}
+	return newMapBranchNode(&children)
+}
+
+// updateMany applies ops to the value node. See updateMapLeafMany().
+func (n *mapValueNode) updateMany(ops []mapBatchOp, shift uint, h Hasher, eq ValueEqualer, delta *int) mapNode {
+	return updateMapLeafMany(n, ops, shift, h, eq, delta)
+}
+
+// updateMany applies ops to the collision node. See updateMapLeafMany().
+func (n *mapHashCollisionNode) updateMany(ops []mapBatchOp, shift uint, h Hasher, eq ValueEqualer, delta *int) mapNode {
+	return updateMapLeafMany(n, ops, shift, h, eq, delta)
+}
+
+// updateMapLeafMany applies ops to a value or collision node. If all ops share
+// the node's key hash then they are applied one at a time. Otherwise the node
+// is placed in a branch node so the ops can be split between its children.
+func updateMapLeafMany(n mapLeafNode, ops []mapBatchOp, shift uint, h Hasher, eq ValueEqualer, delta *int) mapNode {
+	keyHash := n.keyHashValue()
+	for i := range ops {
+		if ops[i].keyHash == keyHash {
+			continue
+		}
+
+		// Wrap the leaf in a branch and apply the ops to the branch. Unwrap the
+		// leaf again if no other keys were added.
+		branch := &mapBitmapIndexedNode{bitmap: 1 << ((keyHash >> shift) & mapNodeMask), nodes: []mapNode{n}}
+		other := branch.updateMany(ops, shift, h, eq, delta)
+		if other == branch {
+			return n
+		} else if other, ok := other.(*mapBitmapIndexedNode); ok && len(other.nodes) == 1 {
+			if leaf, ok := other.nodes[0].(mapLeafNode); ok {
+				return leaf
+			}
+		}
+		return other
+	}
+	return applyMapBatchSequential(n, ops, shift, h, eq, delta)
+}
+
+// applyMapBatchSequential applies ops to n one at a time using update(). If n
+// becomes a branch node or is removed then the remaining ops are applied as a
+// batch instead.
+func applyMapBatchSequential(n mapNode, ops []mapBatchOp, shift uint, h Hasher, eq ValueEqualer, delta *int) mapNode {
+	for i := range ops {
+		if n == nil && shift == 0 {
+			n = &mapArrayNode{} // the root is always an array or branch node
+		} else if n == nil || isMapBranchNode(n) {
+			return applyMapBatch(n, ops[i:], shift, h, eq, delta)
+		}
+
+		var d int
+		n = n.update(ops[i].key, shift, ops[i].keyHash, h, eq, ops[i].update, &d)
+		*delta += d
+	}
+	return n
+}
+
+// updateMapBranchChildren applies ops to the children of a branch node. Ops
+// are grouped by their hash fragment at shift and each group is applied to the
+// child in that slot. Returns false if no children changed.
+func updateMapBranchChildren(children *[mapNodeSize]mapNode, ops []mapBatchOp, shift uint, h Hasher, eq ValueEqualer, delta *int) bool {
+	var changed bool
+	for len(ops) > 0 {
+		frag := (ops[0].keyHash >> shift) & mapNodeMask
+		j := 1
+		for j < len(ops) && (ops[j].keyHash>>shift)&mapNodeMask == frag {
+			j++
+		}
+
+		child := children[frag]
+		if newChild := applyMapBatch(child, ops[:j], shift+mapNodeBits, h, eq, delta); newChild != child {
+			children[frag], changed = newChild, true
+		}
+		ops = ops[j:]
+	}
+	return changed
+}
+
+// newMapBranchNode returns a branch node for children indexed by hash fragment.
+// A bitmap indexed node is used unless there are too many children. Returns
+// nil if there are no children.
+func newMapBranchNode(children *[mapNodeSize]mapNode) mapNode {
+	var count uint
+	for _, child := range children {
+		if child != nil {
+			count++
+		}
+	}
+
+	switch {
+	case count == 0:
+		return nil
+	case count > maxBitmapIndexedSize:
+		return &mapHashArrayNode{count: count, nodes: *children}
+	}
+
+	other := &mapBitmapIndexedNode{nodes: make([]mapNode, 0, count)}
+	for i, child := range children {
+		if child != nil {
+			other.bitmap |= 1 << uint(i)
+			other.nodes = append(other.nodes, child)
+		}
+	}
+	return other
+}
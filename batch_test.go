@@ -0,0 +1,227 @@
+package immutable
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func TestMap_SetMany(t *testing.T) {
+	t.Run("Empty", func(t *testing.T) {
+		m := NewMap(nil)
+		if other := m.SetMany(nil); other != m {
+			t.Fatal("expected same map")
+		}
+		m = m.SetMany([]MapEntry{{"foo", 1}, {"bar", 2}, {"foo", 3}})
+		if m.Len() != 2 {
+			t.Fatalf("unexpected len: %d", m.Len())
+		} else if v, ok := m.Get("foo"); !ok || v != 3 {
+			t.Fatalf("unexpected value: <%v,%v>", v, ok)
+		} else if v, ok := m.Get("bar"); !ok || v != 2 {
+			t.Fatalf("unexpected value: <%v,%v>", v, ok)
+		}
+	})
+
+	t.Run("Identical", func(t *testing.T) {
+		var entries []MapEntry
+		for i := 0; i < 1000; i++ {
+			entries = append(entries, MapEntry{i, i})
+		}
+		m := NewMap(nil).SetMany(entries)
+		if other := m.SetMany(entries); other != m {
+			t.Fatal("expected same map")
+		}
+	})
+
+	t.Run("LimitedHash", func(t *testing.T) {
+		h := mockHasher{
+			hash:  func(value interface{}) uint32 { return hashUint64(uint64(value.(int))) % 0xFF },
+			equal: func(a, b interface{}) bool { return a.(int) == b.(int) },
+		}
+		m := NewMap(&h)
+
+		var entries []MapEntry
+		for i := 0; i < 10000; i++ {
+			entries = append(entries, MapEntry{i, i})
+		}
+		m = m.SetMany(entries)
+		if m.Len() != 10000 {
+			t.Fatalf("unexpected len: %d", m.Len())
+		}
+		for i := 0; i < 10000; i++ {
+			if v, ok := m.Get(i); !ok || v != i {
+				t.Fatalf("Get(%d)=<%v,%v>", i, v, ok)
+			}
+		}
+
+		var keys []interface{}
+		for i := 0; i < 10000; i += 2 {
+			keys = append(keys, i)
+		}
+		m = m.DeleteMany(keys)
+		if m.Len() != 5000 {
+			t.Fatalf("unexpected len: %d", m.Len())
+		}
+		for i := 0; i < 10000; i++ {
+			if v, ok := m.Get(i); ok != (i%2 == 1) {
+				t.Fatalf("Get(%d)=<%v,%v>", i, v, ok)
+			}
+		}
+	})
+
+	RunRandom(t, "Random", func(t *testing.T, rand *rand.Rand) {
+		m := NewTestMap()
+		for i := 0; i < 100; i++ {
+			var entries []MapEntry
+			var deletes []interface{}
+			for j, n := 0, rand.Intn(500); j < n; j++ {
+				switch rand.Intn(4) {
+				case 0: // overwrite
+					entries = append(entries, MapEntry{m.ExistingKey(rand), rand.Intn(10000)})
+				case 1: // delete existing key
+					deletes = append(deletes, m.ExistingKey(rand))
+				case 2: // delete non-existent key
+					deletes = append(deletes, m.NewKey(rand))
+				default: // set new key
+					entries = append(entries, MapEntry{m.NewKey(rand), rand.Intn(10000)})
+				}
+			}
+
+			if rand.Intn(2) == 0 {
+				m.SetMany(entries)
+			} else {
+				m.DeleteMany(deletes)
+			}
+			if m.im.Len() != len(m.std) {
+				t.Fatalf("unexpected len: %d, expected %d", m.im.Len(), len(m.std))
+			} else if err := m.Validate(); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// Delete all and verify they are gone.
+		keys := make([]interface{}, len(m.keys))
+		for i := range m.keys {
+			keys[i] = m.keys[i]
+		}
+		m.DeleteMany(keys)
+		if m.im.Len() != 0 {
+			t.Fatalf("unexpected len: %d", m.im.Len())
+		} else if err := m.Validate(); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+// Ensure a batch produces the same iteration order as individual writes.
+func TestMap_SetMany_IteratorOrder(t *testing.T) {
+	h := NewStringHasher(0)
+	a, b := NewMap(h), NewMap(h)
+
+	var entries []MapEntry
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key%d", i)
+		a = a.Set(key, i)
+		entries = append(entries, MapEntry{key, i})
+	}
+	b = b.SetMany(entries)
+
+	if ka, kb := mapKeys(a), mapKeys(b); fmt.Sprint(ka) != fmt.Sprint(kb) {
+		t.Fatalf("iteration order mismatch:\n%v\n%v", ka, kb)
+	} else if !a.Equal(b, nil) {
+		t.Fatal("expected maps to be equal")
+	}
+}
+
+func (m *TestMap) SetMany(entries []MapEntry) {
+	m.prev = m.im
+	m.im = m.im.SetMany(entries)
+	for _, e := range entries {
+		k, v := e.Key.(int), e.Value.(int)
+		if _, ok := m.std[k]; !ok {
+			m.keys = append(m.keys, k)
+		}
+		m.std[k] = v
+	}
+}
+
+func (m *TestMap) DeleteMany(keys []interface{}) {
+	m.prev = m.im
+	m.im = m.im.DeleteMany(keys)
+	for _, key := range keys {
+		k := key.(int)
+		if _, ok := m.std[k]; !ok {
+			continue
+		}
+		delete(m.std, k)
+		for i := range m.keys {
+			if m.keys[i] == k {
+				m.keys = append(m.keys[:i], m.keys[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+func BenchmarkMap_SetMany(b *testing.B) {
+	const n = 10000
+
+	m := NewMap(nil)
+	for i := 0; i < 100000; i++ {
+		m = m.Set(i, i)
+	}
+	entries := make([]MapEntry, n)
+	for i := range entries {
+		entries[i] = MapEntry{rand.Intn(200000), i}
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		m.SetMany(entries) // Do not update map, always operate on original
+	}
+}
+
+func BenchmarkMap_SetMany_Set(b *testing.B) {
+	const n = 10000
+
+	m := NewMap(nil)
+	for i := 0; i < 100000; i++ {
+		m = m.Set(i, i)
+	}
+	entries := make([]MapEntry, n)
+	for i := range entries {
+		entries[i] = MapEntry{rand.Intn(200000), i}
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		other := m
+		for _, e := range entries {
+			other = other.Set(e.Key, e.Value)
+		}
+	}
+}
+
+func ExampleMap_SetMany() {
+	m := NewMap(nil)
+	m = m.SetMany([]MapEntry{
+		{Key: "foo", Value: 1},
+		{Key: "bar", Value: 2},
+		{Key: "baz", Value: 3},
+	})
+	m = m.DeleteMany([]interface{}{"bar", "bat"})
+
+	fmt.Println(m.Len())
+
+	v, ok := m.Get("foo")
+	fmt.Println("foo", v, ok)
+
+	v, ok = m.Get("bar")
+	fmt.Println("bar", v, ok)
+	// Output:
+	// 2
+	// foo 1 true
+	// bar <nil> false
+}
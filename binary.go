@@ -0,0 +1,187 @@
+package immutable
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+)
+
+// binaryVersion is the version of the format written by MarshalBinary.
+const binaryVersion = 1
+
+// Collection kinds stored in the binary format header.
+const (
+	binaryKindList = iota + 1
+	binaryKindMap
+	binaryKindSortedMap
+)
+
+// binaryEntry is the gob-encoded form of a key/value pair. List elements only
+// use the Value field. Interface values must be registered with gob.Register
+// unless they are one of gob's built-in types.
+type binaryEntry struct {
+	Key   interface{}
+	Value interface{}
+}
+
+// MarshalBinary encodes the list into a binary form. Elements are encoded
+// with encoding/gob.
+func (l *List) MarshalBinary() ([]byte, error) {
+	entries := make([]binaryEntry, 0, l.Len())
+	for itr := l.Iterator(); !itr.Done(); {
+		_, v := itr.Next()
+		entries = append(entries, binaryEntry{Value: v})
+	}
+	return marshalBinary(binaryKindList, "", entries)
+}
+
+// UnmarshalBinary decodes a list encoded by MarshalBinary. The list is
+// replaced so this should only be used on a newly allocated list.
+func (l *List) UnmarshalBinary(data []byte) error {
+	_, entries, err := unmarshalBinary(data, binaryKindList)
+	if err != nil {
+		return err
+	}
+
+	other := NewList()
+	for _, entry := range entries {
+		other = other.Append(entry.Value)
+	}
+	*l = *other
+	return nil
+}
+
+// GobEncode implements gob.GobEncoder. It is equivalent to MarshalBinary.
+func (l *List) GobEncode() ([]byte, error) { return l.MarshalBinary() }
+
+// GobDecode implements gob.GobDecoder. It is equivalent to UnmarshalBinary.
+func (l *List) GobDecode(data []byte) error { return l.UnmarshalBinary(data) }
+
+// MarshalBinary encodes the map into a binary form. Keys and values are
+// encoded with encoding/gob. The type of the map's hasher is recorded so that
+// decoding can restore a built-in hasher or verify a custom one.
+func (m *Map) MarshalBinary() ([]byte, error) {
+	entries := make([]binaryEntry, 0, m.Len())
+	for itr := m.Iterator(); !itr.Done(); {
+		k, v := itr.Next()
+		entries = append(entries, binaryEntry{Key: k, Value: v})
+	}
+	return marshalBinary(binaryKindMap, typeName(m.hasher), entries)
+}
+
+// UnmarshalBinary decodes a map encoded by MarshalBinary. If the map has a
+// hasher then it must be the same type as the hasher used by the encoded map.
+// Otherwise the built-in hasher is restored. Returns an error if the encoded
+// map used a custom hasher and no hasher is set.
+//
+// The map is replaced so this should only be used on a newly allocated map.
+func (m *Map) UnmarshalBinary(data []byte) error {
+	name, entries, err := unmarshalBinary(data, binaryKindMap)
+	if err != nil {
+		return err
+	}
+
+	hasher := m.hasher
+	if hasher == nil && len(entries) > 0 {
+		hasher = defaultHasher(entries[0].Key)
+	}
+	if len(entries) > 0 && typeName(hasher) != name {
+		return fmt.Errorf("immutable.Map.UnmarshalBinary: hasher mismatch: encoded with %s", name)
+	}
+
+	other := NewMap(hasher)
+	for _, entry := range entries {
+		other = other.Set(entry.Key, entry.Value)
+	}
+	*m = *other
+	return nil
+}
+
+// GobEncode implements gob.GobEncoder. It is equivalent to MarshalBinary.
+func (m *Map) GobEncode() ([]byte, error) { return m.MarshalBinary() }
+
+// GobDecode implements gob.GobDecoder. It is equivalent to UnmarshalBinary.
+func (m *Map) GobDecode(data []byte) error { return m.UnmarshalBinary(data) }
+
+// MarshalBinary encodes the map into a binary form. Keys and values are
+// encoded with encoding/gob. The type of the map's comparer is recorded so
+// that decoding can restore a built-in comparer or verify a custom one.
+func (m *SortedMap) MarshalBinary() ([]byte, error) {
+	entries := make([]binaryEntry, 0, m.Len())
+	for itr := m.Iterator(); !itr.Done(); {
+		k, v := itr.Next()
+		entries = append(entries, binaryEntry{Key: k, Value: v})
+	}
+	return marshalBinary(binaryKindSortedMap, typeName(m.comparer), entries)
+}
+
+// UnmarshalBinary decodes a map encoded by MarshalBinary. If the map has a
+// comparer then it must be the same type as the comparer used by the encoded
+// map. Otherwise the built-in comparer is restored. Returns an error if the
+// encoded map used a custom comparer and no comparer is set.
+//
+// The map is replaced so this should only be used on a newly allocated map.
+func (m *SortedMap) UnmarshalBinary(data []byte) error {
+	name, entries, err := unmarshalBinary(data, binaryKindSortedMap)
+	if err != nil {
+		return err
+	}
+
+	comparer := m.comparer
+	if comparer == nil && len(entries) > 0 {
+		comparer = defaultComparer(entries[0].Key)
+	}
+	if len(entries) > 0 && typeName(comparer) != name {
+		return fmt.Errorf("immutable.SortedMap.UnmarshalBinary: comparer mismatch: encoded with %s", name)
+	}
+
+	other := NewSortedMap(comparer)
+	for _, entry := range entries {
+		other = other.Set(entry.Key, entry.Value)
+	}
+	*m = *other
+	return nil
+}
+
+// GobEncode implements gob.GobEncoder. It is equivalent to MarshalBinary.
+func (m *SortedMap) GobEncode() ([]byte, error) { return m.MarshalBinary() }
+
+// GobDecode implements gob.GobDecoder. It is equivalent to UnmarshalBinary.
+func (m *SortedMap) GobDecode(data []byte) error { return m.UnmarshalBinary(data) }
+
+// marshalBinary encodes a header containing the format version, the kind of
+// collection, and the hasher or comparer name followed by gob-encoded entries.
+func marshalBinary(kind byte, name string, entries []binaryEntry) ([]byte, error) {
+	buf := bytes.NewBuffer([]byte{binaryVersion, kind})
+	buf.Write(appendString(nil, name))
+	if err := gob.NewEncoder(buf).Encode(entries); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// unmarshalBinary decodes the header & entries written by marshalBinary.
+// Returns an error if the version is unsupported or the kind does not match.
+func unmarshalBinary(data []byte, kind byte) (name string, entries []binaryEntry, err error) {
+	if len(data) < 2 {
+		return "", nil, errors.New("immutable: binary data too short")
+	} else if data[0] != binaryVersion {
+		return "", nil, fmt.Errorf("immutable: unsupported binary version %d", data[0])
+	} else if data[1] != kind {
+		return "", nil, fmt.Errorf("immutable: unexpected binary collection kind %d", data[1])
+	}
+	data = data[2:]
+
+	n, sz := binary.Uvarint(data)
+	if sz <= 0 || uint64(len(data)-sz) < n {
+		return "", nil, errors.New("immutable: invalid binary header")
+	}
+	name, data = string(data[sz:sz+int(n)]), data[sz+int(n):]
+
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&entries); err != nil {
+		return "", nil, err
+	}
+	return name, entries, nil
+}
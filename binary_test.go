@@ -0,0 +1,195 @@
+package immutable
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestList_MarshalBinary(t *testing.T) {
+	l := NewList().Append(1).Append(nil).Append("foo").Append([]byte("bar"))
+	data, err := l.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var other List
+	if err := other.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	} else if got, exp := listValues(&other), []interface{}{1, nil, "foo", []byte("bar")}; !reflect.DeepEqual(got, exp) {
+		t.Fatalf("unexpected values: %#v", got)
+	}
+
+	t.Run("Empty", func(t *testing.T) {
+		data, err := NewList().MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var other List
+		if err := other.UnmarshalBinary(data); err != nil {
+			t.Fatal(err)
+		} else if other.Len() != 0 {
+			t.Fatalf("unexpected len: %d", other.Len())
+		}
+	})
+
+	t.Run("ErrUnexpectedKind", func(t *testing.T) {
+		data, err := NewMap(nil).MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var other List
+		if err := other.UnmarshalBinary(data); err == nil || err.Error() != `immutable: unexpected binary collection kind 2` {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("ErrUnsupportedVersion", func(t *testing.T) {
+		var other List
+		if err := other.UnmarshalBinary([]byte{100, binaryKindList}); err == nil || err.Error() != `immutable: unsupported binary version 100` {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestMap_MarshalBinary(t *testing.T) {
+	t.Run("Builtin", func(t *testing.T) {
+		m := NewMap(nil)
+		for i := 0; i < 1000; i++ {
+			m = m.Set(fmt.Sprint(i), i)
+		}
+		data, err := m.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var other Map
+		if err := other.UnmarshalBinary(data); err != nil {
+			t.Fatal(err)
+		} else if _, ok := other.hasher.(*stringHasher); !ok {
+			t.Fatalf("unexpected hasher: %T", other.hasher)
+		} else if other.Len() != 1000 {
+			t.Fatalf("unexpected len: %d", other.Len())
+		}
+		for i := 0; i < 1000; i++ {
+			if v, _ := other.Get(fmt.Sprint(i)); v != i {
+				t.Fatalf("unexpected value: %#v", v)
+			}
+		}
+	})
+
+	t.Run("Custom", func(t *testing.T) {
+		h := &mockHasher{
+			hash:  func(value interface{}) uint32 { return uint32(value.(int)) },
+			equal: func(a, b interface{}) bool { return a.(int) == b.(int) },
+		}
+		data, err := NewMap(h).Set(1, "foo").MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		other := NewMap(h)
+		if err := other.UnmarshalBinary(data); err != nil {
+			t.Fatal(err)
+		} else if v, _ := other.Get(1); v != "foo" {
+			t.Fatalf("unexpected value: %#v", v)
+		}
+
+		// Decoding without the custom hasher is rejected.
+		var m Map
+		if err := m.UnmarshalBinary(data); err == nil || err.Error() != `immutable.Map.UnmarshalBinary: hasher mismatch: encoded with *immutable.mockHasher` {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("ErrHasherMismatch", func(t *testing.T) {
+		data, err := NewMap(nil).Set("foo", 1).MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := NewMap(&mockHasher{}).UnmarshalBinary(data); err == nil || err.Error() != `immutable.Map.UnmarshalBinary: hasher mismatch: encoded with *immutable.stringHasher` {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestSortedMap_MarshalBinary(t *testing.T) {
+	m := NewSortedMap(nil).Set(3, "c").Set(1, "a").Set(2, nil)
+	data, err := m.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var other SortedMap
+	if err := other.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	} else if _, ok := other.comparer.(*intComparer); !ok {
+		t.Fatalf("unexpected comparer: %T", other.comparer)
+	} else if changes := diffSortedMapsChanges(m, &other); len(changes) != 0 {
+		t.Fatalf("unexpected changes: %v", changes)
+	}
+
+	t.Run("ErrComparerMismatch", func(t *testing.T) {
+		if err := NewSortedMap(&mockComparer{}).UnmarshalBinary(data); err == nil || err.Error() != `immutable.SortedMap.UnmarshalBinary: comparer mismatch: encoded with *immutable.intComparer` {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+// Ensure collections can be used as fields in gob-encoded structs.
+func TestGob(t *testing.T) {
+	type snapshot struct {
+		L *List
+		M *Map
+		S *SortedMap
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(snapshot{
+		L: NewList().Append("foo"),
+		M: NewMap(nil).Set("bar", 1),
+		S: NewSortedMap(nil).Set(2, "baz"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var v snapshot
+	if err := gob.NewDecoder(&buf).Decode(&v); err != nil {
+		t.Fatal(err)
+	} else if got := v.L.Get(0); got != "foo" {
+		t.Fatalf("unexpected list value: %v", got)
+	} else if got, _ := v.M.Get("bar"); got != 1 {
+		t.Fatalf("unexpected map value: %v", got)
+	} else if got, _ := v.S.Get(2); got != "baz" {
+		t.Fatalf("unexpected sorted map value: %v", got)
+	}
+}
+
+func BenchmarkMap_MarshalBinary(b *testing.B) {
+	m := NewMap(nil)
+	for i := 0; i < 1000; i++ {
+		m = m.Set(i, i)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := m.MarshalBinary(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func ExampleMap_MarshalBinary() {
+	m := NewMap(nil).Set("foo", "bar")
+	data, _ := m.MarshalBinary()
+
+	var other Map
+	other.UnmarshalBinary(data)
+	v, _ := other.Get("foo")
+	fmt.Println(v)
+	// Output:
+	// bar
+}
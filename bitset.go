@@ -0,0 +1,680 @@
+package immutable
+
+import (
+	"math/bits"
+	"sort"
+)
+
+// Constants for bit shifts used for levels in the BitSet trie.
+//
+// Leaf nodes cover a range of 4096 values. The remaining 20 bits of a value are
+// consumed 5 bits at a time by branch nodes so every leaf sits at the same
+// depth below the root.
+const (
+	bitSetLeafBits  = 12
+	bitSetLeafSize  = 1 << bitSetLeafBits
+	bitSetLeafMask  = bitSetLeafSize - 1
+	bitSetLeafWords = bitSetLeafSize / 64
+
+	// Leaves with up to this many values are stored as a sorted array, which
+	// is never larger than the bitmap it replaces.
+	bitSetArrayMax = bitSetLeafWords * 64 / 16
+
+	bitSetNodeBits = 5
+	bitSetNodeSize = 1 << bitSetNodeBits
+	bitSetNodeMask = bitSetNodeSize - 1
+
+	bitSetRootShift = 32 - bitSetNodeBits
+	bitSetMaxDepth  = (32-bitSetLeafBits)/bitSetNodeBits + 1
+)
+
+// BitSet represents an immutable set of uint32 values. Adding or removing
+// values returns a new set while the original set remains unchanged.
+//
+// It is implemented as a trie of bitmap-indexed branch nodes over leaves that
+// each cover a range of 4096 values. Leaves with few values store them in a
+// sorted array of 2 bytes per value and are converted to a 512-byte bitmap
+// once the array would be larger. Dense sets cost roughly one bit per value
+// and sparse sets cost a few dozen bytes per value. Only non-empty leaves are
+// stored. Set operations between two sets share any leaves that are
+// unaffected by the operation.
+type BitSet struct {
+	root bitSetNode // root node, nil if empty
+}
+
+// NewBitSet returns a new empty instance of BitSet.
+func NewBitSet() *BitSet {
+	return &BitSet{}
+}
+
+// Cardinality returns the number of values in the set.
+func (s *BitSet) Cardinality() int {
+	if s.root == nil {
+		return 0
+	}
+	return s.root.count()
+}
+
+// Contains returns true if v exists in the set.
+func (s *BitSet) Contains(v uint32) bool {
+	if s.root == nil {
+		return false
+	}
+	return s.root.contains(v, bitSetRootShift)
+}
+
+// Add returns a set with v added. Returns the original set if v already exists.
+func (s *BitSet) Add(v uint32) *BitSet {
+	root := s.root
+	if root == nil {
+		root = &bitSetBranchNode{}
+	}
+
+	newRoot := root.add(v, bitSetRootShift)
+	if newRoot == s.root {
+		return s
+	}
+	return &BitSet{root: newRoot}
+}
+
+// Remove returns a set with v removed. Returns the original set if v does not exist.
+func (s *BitSet) Remove(v uint32) *BitSet {
+	if s.root == nil {
+		return s
+	}
+
+	newRoot := s.root.remove(v, bitSetRootShift)
+	if newRoot == s.root {
+		return s
+	}
+	return &BitSet{root: newRoot}
+}
+
+// And returns the intersection of s and other.
+func (s *BitSet) And(other *BitSet) *BitSet {
+	return s.combine(other, bitSetAnd)
+}
+
+// Or returns the union of s and other.
+func (s *BitSet) Or(other *BitSet) *BitSet {
+	return s.combine(other, bitSetOr)
+}
+
+// AndNot returns the values in s that do not exist in other.
+func (s *BitSet) AndNot(other *BitSet) *BitSet {
+	return s.combine(other, bitSetAndNot)
+}
+
+// Xor returns the values that exist in exactly one of s and other.
+func (s *BitSet) Xor(other *BitSet) *BitSet {
+	return s.combine(other, bitSetXor)
+}
+
+// combine returns the result of op applied to s and other. If the result is
+// the same as either input then that input is returned.
+func (s *BitSet) combine(other *BitSet, op bitSetOp) *BitSet {
+	root := combineBitSetNodes(s.root, other.root, bitSetRootShift, op)
+	if root == s.root {
+		return s
+	} else if root == other.root {
+		return other
+	}
+	return &BitSet{root: root}
+}
+
+// Iterator returns a new iterator for this set positioned at the lowest value.
+func (s *BitSet) Iterator() *BitSetIterator {
+	itr := &BitSetIterator{s: s}
+	itr.First()
+	return itr
+}
+
+// bitSetOp represents a binary operation between two sets.
+type bitSetOp int
+
+const (
+	bitSetAnd bitSetOp = iota
+	bitSetOr
+	bitSetAndNot
+	bitSetXor
+)
+
+// bitSetNode represents either a branch or leaf node in a BitSet.
+type bitSetNode interface {
+	count() int
+	contains(v uint32, shift uint) bool
+	add(v uint32, shift uint) bitSetNode
+	remove(v uint32, shift uint) bitSetNode
+}
+
+// bitSetLeaf represents either leaf node type in a BitSet.
+type bitSetLeaf interface {
+	bitSetNode
+	nextSet(pos int) int
+	fill(words *[bitSetLeafWords]uint64)
+}
+
+var _ bitSetNode = (*bitSetBranchNode)(nil)
+var _ bitSetLeaf = (*bitSetLeafNode)(nil)
+var _ bitSetLeaf = (*bitSetArrayNode)(nil)
+
+// newBitSetChildNode returns an empty child node for a branch at the given shift.
+func newBitSetChildNode(shift uint) bitSetNode {
+	if shift == bitSetLeafBits {
+		return &bitSetArrayNode{}
+	}
+	return &bitSetBranchNode{}
+}
+
+// bitSetBranchNode represents a branch node with a variable number of child
+// slots indexed using a bitmap, similar to mapBitmapIndexedNode.
+type bitSetBranchNode struct {
+	bitmap uint32
+	nodes  []bitSetNode
+	n      int // total number of values under this node
+}
+
+// count returns the total number of values under the node.
+func (n *bitSetBranchNode) count() int { return n.n }
+
+// contains returns true if v exists under the node.
+func (n *bitSetBranchNode) contains(v uint32, shift uint) bool {
+	bit := uint32(1) << ((v >> shift) & bitSetNodeMask)
+	if (n.bitmap & bit) == 0 {
+		return false
+	}
+	return n.nodes[bits.OnesCount32(n.bitmap&(bit-1))].contains(v, shift-bitSetNodeBits)
+}
+
+// add returns a copy of the node with v added. Returns the same node if v exists.
+func (n *bitSetBranchNode) add(v uint32, shift uint) bitSetNode {
+	bit := uint32(1) << ((v >> shift) & bitSetNodeMask)
+	idx := bits.OnesCount32(n.bitmap & (bit - 1))
+	exists := (n.bitmap & bit) != 0
+
+	// Delegate to existing child or create a new child node.
+	var child bitSetNode
+	if exists {
+		child = n.nodes[idx]
+	} else {
+		child = newBitSetChildNode(shift)
+	}
+	newChild := child.add(v, shift-bitSetNodeBits)
+	if newChild == child {
+		return n
+	}
+
+	// Copy node and either replace or insert the child node.
+	other := &bitSetBranchNode{bitmap: n.bitmap | bit, n: n.n + 1}
+	if exists {
+		other.nodes = make([]bitSetNode, len(n.nodes))
+		copy(other.nodes, n.nodes)
+		other.nodes[idx] = newChild
+	} else {
+		other.nodes = make([]bitSetNode, len(n.nodes)+1)
+		copy(other.nodes, n.nodes[:idx])
+		other.nodes[idx] = newChild
+		copy(other.nodes[idx+1:], n.nodes[idx:])
+	}
+	return other
+}
+
+// remove returns a copy of the node with v removed. Returns the same node if
+// v does not exist. Returns nil if the last value is removed.
+func (n *bitSetBranchNode) remove(v uint32, shift uint) bitSetNode {
+	bit := uint32(1) << ((v >> shift) & bitSetNodeMask)
+	if (n.bitmap & bit) == 0 {
+		return n
+	}
+	idx := bits.OnesCount32(n.bitmap & (bit - 1))
+
+	// Return original node if value doesn't exist in child.
+	child := n.nodes[idx]
+	newChild := child.remove(v, shift-bitSetNodeBits)
+	if newChild == child {
+		return n
+	}
+
+	// Remove child if it is now empty.
+	if newChild == nil {
+		if len(n.nodes) == 1 {
+			return nil
+		}
+		other := &bitSetBranchNode{bitmap: n.bitmap ^ bit, nodes: make([]bitSetNode, len(n.nodes)-1), n: n.n - 1}
+		copy(other.nodes[:idx], n.nodes[:idx])
+		copy(other.nodes[idx:], n.nodes[idx+1:])
+		return other
+	}
+
+	// Return copy with child updated.
+	other := &bitSetBranchNode{bitmap: n.bitmap, nodes: make([]bitSetNode, len(n.nodes)), n: n.n - 1}
+	copy(other.nodes, n.nodes)
+	other.nodes[idx] = newChild
+	return other
+}
+
+// bitSetLeafNode represents a fixed-size bitmap of values at the bottom of the
+// trie. It holds more than bitSetArrayMax values.
+type bitSetLeafNode struct {
+	words [bitSetLeafWords]uint64
+	n     int // number of set bits
+}
+
+// count returns the number of set bits in the leaf.
+func (n *bitSetLeafNode) count() int { return n.n }
+
+// contains returns true if the bit for v is set.
+func (n *bitSetLeafNode) contains(v uint32, shift uint) bool {
+	i := v & bitSetLeafMask
+	return n.words[i/64]&(uint64(1)<<(i%64)) != 0
+}
+
+// add returns a copy of the leaf with the bit for v set.
+// Returns the same node if the bit is already set.
+func (n *bitSetLeafNode) add(v uint32, shift uint) bitSetNode {
+	i := v & bitSetLeafMask
+	if n.words[i/64]&(uint64(1)<<(i%64)) != 0 {
+		return n
+	}
+	other := &bitSetLeafNode{words: n.words, n: n.n + 1}
+	other.words[i/64] |= uint64(1) << (i % 64)
+	return other
+}
+
+// remove returns a copy of the leaf with the bit for v cleared. Returns the
+// same node if the bit is not set. Converts to an array node once the leaf
+// holds few enough values.
+func (n *bitSetLeafNode) remove(v uint32, shift uint) bitSetNode {
+	i := v & bitSetLeafMask
+	if n.words[i/64]&(uint64(1)<<(i%64)) == 0 {
+		return n
+	}
+	other := &bitSetLeafNode{words: n.words, n: n.n - 1}
+	other.words[i/64] &^= uint64(1) << (i % 64)
+	return newBitSetLeaf(&other.words, other.n)
+}
+
+// fill sets the bits of the leaf's values in words.
+func (n *bitSetLeafNode) fill(words *[bitSetLeafWords]uint64) {
+	*words = n.words
+}
+
+// nextSet returns the position of the first set bit at or after pos.
+// Returns -1 if no bits are set at or after pos.
+func (n *bitSetLeafNode) nextSet(pos int) int {
+	for i := pos / 64; i < len(n.words); i++ {
+		w := n.words[i]
+		if i == pos/64 {
+			w &= ^uint64(0) << uint(pos%64)
+		}
+		if w != 0 {
+			return i*64 + bits.TrailingZeros64(w)
+		}
+	}
+	return -1
+}
+
+// bitSetArrayNode represents a sorted array of values at the bottom of the
+// trie. Only the low bits of each value within the leaf's range are stored.
+// It holds at most bitSetArrayMax values.
+type bitSetArrayNode struct {
+	values []uint16
+}
+
+// count returns the number of values in the leaf.
+func (n *bitSetArrayNode) count() int { return len(n.values) }
+
+// contains returns true if v exists in the leaf.
+func (n *bitSetArrayNode) contains(v uint32, shift uint) bool {
+	_, ok := n.search(v)
+	return ok
+}
+
+// search returns the index of the first value not less than the low bits of
+// v and whether that value equals v.
+func (n *bitSetArrayNode) search(v uint32) (int, bool) {
+	x := uint16(v & bitSetLeafMask)
+	i := sort.Search(len(n.values), func(i int) bool { return n.values[i] >= x })
+	return i, i < len(n.values) && n.values[i] == x
+}
+
+// add returns a copy of the leaf with v added. Returns the same node if v
+// exists. Converts to a bitmap leaf once the array is full.
+func (n *bitSetArrayNode) add(v uint32, shift uint) bitSetNode {
+	i, ok := n.search(v)
+	if ok {
+		return n
+	} else if len(n.values) == bitSetArrayMax {
+		other := &bitSetLeafNode{n: len(n.values)}
+		n.fill(&other.words)
+		return other.add(v, shift)
+	}
+
+	other := &bitSetArrayNode{values: make([]uint16, len(n.values)+1)}
+	copy(other.values, n.values[:i])
+	other.values[i] = uint16(v & bitSetLeafMask)
+	copy(other.values[i+1:], n.values[i:])
+	return other
+}
+
+// remove returns a copy of the leaf with v removed. Returns the same node if
+// v does not exist. Returns nil if the last value is removed.
+func (n *bitSetArrayNode) remove(v uint32, shift uint) bitSetNode {
+	i, ok := n.search(v)
+	if !ok {
+		return n
+	} else if len(n.values) == 1 {
+		return nil
+	}
+
+	other := &bitSetArrayNode{values: make([]uint16, len(n.values)-1)}
+	copy(other.values, n.values[:i])
+	copy(other.values[i:], n.values[i+1:])
+	return other
+}
+
+// nextSet returns the first value at or after pos.
+// Returns -1 if no values exist at or after pos.
+func (n *bitSetArrayNode) nextSet(pos int) int {
+	if pos >= bitSetLeafSize {
+		return -1
+	} else if i, _ := n.search(uint32(pos)); i < len(n.values) {
+		return int(n.values[i])
+	}
+	return -1
+}
+
+// fill sets the bits of the leaf's values in words.
+func (n *bitSetArrayNode) fill(words *[bitSetLeafWords]uint64) {
+	for _, v := range n.values {
+		words[v/64] |= uint64(1) << (v % 64)
+	}
+}
+
+// newBitSetLeaf returns a leaf holding the n values set in words, using an
+// array node if n is small enough. Returns nil if n is zero.
+func newBitSetLeaf(words *[bitSetLeafWords]uint64, n int) bitSetNode {
+	if n == 0 {
+		return nil
+	} else if n > bitSetArrayMax {
+		return &bitSetLeafNode{words: *words, n: n}
+	}
+
+	other := &bitSetArrayNode{values: make([]uint16, 0, n)}
+	for i, w := range words {
+		for ; w != 0; w &= w - 1 {
+			other.values = append(other.values, uint16(i*64+bits.TrailingZeros64(w)))
+		}
+	}
+	return other
+}
+
+// combineBitSetNodes returns the result of op applied to nodes a & b at the
+// given shift. Either input node is returned whenever the result is identical
+// to it so that unaffected chunks are shared with the inputs.
+func combineBitSetNodes(a, b bitSetNode, shift uint, op bitSetOp) bitSetNode {
+	// Handle identical and missing nodes without descending.
+	if a == b {
+		switch op {
+		case bitSetAnd, bitSetOr:
+			return a
+		default:
+			return nil
+		}
+	} else if a == nil {
+		switch op {
+		case bitSetOr, bitSetXor:
+			return b
+		default:
+			return nil
+		}
+	} else if b == nil {
+		switch op {
+		case bitSetAnd:
+			return nil
+		default:
+			return a
+		}
+	}
+
+	// Both nodes are at the same depth so they are either both branches or
+	// both leaves, although leaves may use different representations.
+	switch a := a.(type) {
+	case *bitSetBranchNode:
+		return combineBitSetBranchNodes(a, b.(*bitSetBranchNode), shift, op)
+	default:
+		return combineBitSetLeafNodes(a.(bitSetLeaf), b.(bitSetLeaf), op)
+	}
+}
+
+// combineBitSetBranchNodes returns the result of op applied to each child slot.
+func combineBitSetBranchNodes(a, b *bitSetBranchNode, shift uint, op bitSetOp) bitSetNode {
+	bitmap := a.bitmap | b.bitmap
+	if op == bitSetAnd {
+		bitmap = a.bitmap & b.bitmap
+	} else if op == bitSetAndNot {
+		bitmap = a.bitmap
+	}
+
+	other := &bitSetBranchNode{nodes: make([]bitSetNode, 0, bits.OnesCount32(bitmap))}
+	sameAsA, sameAsB := true, true
+	for ; bitmap != 0; bitmap &= bitmap - 1 {
+		bit := bitmap & -bitmap
+
+		var childA, childB bitSetNode
+		if a.bitmap&bit != 0 {
+			childA = a.nodes[bits.OnesCount32(a.bitmap&(bit-1))]
+		}
+		if b.bitmap&bit != 0 {
+			childB = b.nodes[bits.OnesCount32(b.bitmap&(bit-1))]
+		}
+
+		child := combineBitSetNodes(childA, childB, shift-bitSetNodeBits, op)
+		sameAsA = sameAsA && child == childA
+		sameAsB = sameAsB && child == childB
+		if child == nil {
+			continue
+		}
+
+		other.bitmap |= bit
+		other.nodes = append(other.nodes, child)
+		other.n += child.count()
+	}
+
+	// Share original nodes if every child slot is unchanged.
+	if sameAsA && other.bitmap == a.bitmap {
+		return a
+	} else if sameAsB && other.bitmap == b.bitmap {
+		return b
+	} else if len(other.nodes) == 0 {
+		return nil
+	}
+	return other
+}
+
+// combineBitSetLeafNodes returns the result of op applied to each bitmap word.
+// Leaves of either type are expanded to bitmaps to be combined.
+func combineBitSetLeafNodes(a, b bitSetLeaf, op bitSetOp) bitSetNode {
+	var wordsA, wordsB, words [bitSetLeafWords]uint64
+	a.fill(&wordsA)
+	b.fill(&wordsB)
+
+	var n int
+	for i := range words {
+		switch op {
+		case bitSetAnd:
+			words[i] = wordsA[i] & wordsB[i]
+		case bitSetOr:
+			words[i] = wordsA[i] | wordsB[i]
+		case bitSetAndNot:
+			words[i] = wordsA[i] &^ wordsB[i]
+		case bitSetXor:
+			words[i] = wordsA[i] ^ wordsB[i]
+		}
+		n += bits.OnesCount64(words[i])
+	}
+
+	if n == 0 {
+		return nil
+	} else if words == wordsA {
+		return a
+	} else if words == wordsB {
+		return b
+	}
+	return newBitSetLeaf(&words, n)
+}
+
+// BitSetIterator represents an iterator over a BitSet in ascending order.
+type BitSetIterator struct {
+	s *BitSet // source set
+
+	stack [bitSetMaxDepth]bitSetIteratorElem // search stack
+	depth int                                // stack depth
+}
+
+// Done returns true if no more values remain in the iterator.
+func (itr *BitSetIterator) Done() bool {
+	return itr.depth == -1
+}
+
+// First positions the iterator on the lowest value in the set.
+func (itr *BitSetIterator) First() {
+	if itr.s.root == nil {
+		itr.depth = -1
+		return
+	}
+	itr.stack[0] = bitSetIteratorElem{node: itr.s.root}
+	itr.depth = 0
+	itr.first()
+}
+
+// Seek moves the iterator position to the given value. If the value does not
+// exist then the next highest value is used. If no more values exist then the
+// iterator is marked as done.
+func (itr *BitSetIterator) Seek(v uint32) {
+	if itr.s.root == nil {
+		itr.depth = -1
+		return
+	}
+	itr.stack[0] = bitSetIteratorElem{node: itr.s.root}
+	itr.depth = 0
+	itr.seek(v)
+}
+
+// Next returns the current value and moves the iterator forward.
+// Returns false if there are no more values to return.
+func (itr *BitSetIterator) Next() (v uint32, ok bool) {
+	if itr.Done() {
+		return 0, false
+	}
+
+	elem := &itr.stack[itr.depth]
+	v = elem.prefix | uint32(elem.index)
+	itr.next()
+	return v, true
+}
+
+// next moves to the next set value. If no values remain then depth is set to -1.
+func (itr *BitSetIterator) next() {
+	for ; itr.depth >= 0; itr.depth-- {
+		elem := &itr.stack[itr.depth]
+
+		switch node := elem.node.(type) {
+		case bitSetLeaf:
+			if elem.index < bitSetLeafSize-1 {
+				if i := node.nextSet(elem.index + 1); i != -1 {
+					elem.index = i
+					return
+				}
+			}
+		case *bitSetBranchNode:
+			if elem.index < len(node.nodes)-1 {
+				elem.index++
+				itr.push()
+				itr.first()
+				return
+			}
+		}
+	}
+}
+
+// first positions the stack on the lowest value from the current depth.
+// Elements and indexes below the current depth are assumed to be correct.
+func (itr *BitSetIterator) first() {
+	for {
+		elem := &itr.stack[itr.depth]
+
+		switch node := elem.node.(type) {
+		case *bitSetBranchNode:
+			elem.index = 0
+			itr.push()
+		case bitSetLeaf:
+			elem.index = node.nextSet(0)
+			return
+		}
+	}
+}
+
+// seek positions the stack on the lowest value greater than or equal to v
+// from the current depth.
+func (itr *BitSetIterator) seek(v uint32) {
+	for {
+		elem := &itr.stack[itr.depth]
+
+		switch node := elem.node.(type) {
+		case *bitSetBranchNode:
+			bit := uint32(1) << ((v >> itr.shift()) & bitSetNodeMask)
+			elem.index = bits.OnesCount32(node.bitmap & (bit - 1))
+
+			// If the child doesn't exist then move to the next child, if any.
+			if node.bitmap&bit == 0 {
+				elem.index--
+				itr.next()
+				return
+			}
+			itr.push()
+
+		case bitSetLeaf:
+			elem.index = int(v & bitSetLeafMask)
+			if !node.contains(v, 0) {
+				elem.index--
+				itr.next()
+			}
+			return
+		}
+	}
+}
+
+// push adds the child at the current branch's index to the top of the stack.
+func (itr *BitSetIterator) push() {
+	elem := &itr.stack[itr.depth]
+	node := elem.node.(*bitSetBranchNode)
+	frag := bitSetNthBit(node.bitmap, elem.index)
+
+	itr.stack[itr.depth+1] = bitSetIteratorElem{
+		node:   node.nodes[elem.index],
+		prefix: elem.prefix | uint32(frag)<<itr.shift(),
+	}
+	itr.depth++
+}
+
+// shift returns the bit shift for the branch at the current depth.
+func (itr *BitSetIterator) shift() uint {
+	return bitSetRootShift - uint(itr.depth)*bitSetNodeBits
+}
+
+// bitSetIteratorElem represents a node/index pair in the BitSetIterator stack.
+// The prefix holds the high bits shared by all values under the node.
+type bitSetIteratorElem struct {
+	node   bitSetNode
+	index  int
+	prefix uint32
+}
+
+// bitSetNthBit returns the position of the nth set bit in bitmap.
+func bitSetNthBit(bitmap uint32, n int) int {
+	for ; n > 0; n-- {
+		bitmap &= bitmap - 1
+	}
+	return bits.TrailingZeros32(bitmap)
+}
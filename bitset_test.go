@@ -0,0 +1,402 @@
+package immutable
+
+import (
+	"fmt"
+	"math/rand"
+	"runtime"
+	"sort"
+	"testing"
+)
+
+func TestBitSet(t *testing.T) {
+	t.Run("Empty", func(t *testing.T) {
+		s := NewBitSet()
+		if n := s.Cardinality(); n != 0 {
+			t.Fatalf("unexpected cardinality: %d", n)
+		} else if s.Contains(0) {
+			t.Fatal("expected no value")
+		} else if other := s.Remove(100); other != s {
+			t.Fatal("expected same set")
+		} else if itr := s.Iterator(); !itr.Done() {
+			t.Fatal("expected iterator done")
+		}
+	})
+
+	t.Run("Simple", func(t *testing.T) {
+		s := NewBitSet()
+		s = s.Add(100)
+		s = s.Add(0)
+		s = s.Add(0xFFFFFFFF)
+		if n := s.Cardinality(); n != 3 {
+			t.Fatalf("unexpected cardinality: %d", n)
+		}
+		for _, v := range []uint32{0, 100, 0xFFFFFFFF} {
+			if !s.Contains(v) {
+				t.Fatalf("expected value: %d", v)
+			}
+		}
+		if s.Contains(101) {
+			t.Fatal("expected no value")
+		}
+	})
+
+	t.Run("AddExisting", func(t *testing.T) {
+		s := NewBitSet().Add(100)
+		if other := s.Add(100); other != s {
+			t.Fatal("expected same set")
+		}
+	})
+
+	t.Run("RemoveNonExistent", func(t *testing.T) {
+		s := NewBitSet().Add(100)
+		if other := s.Remove(101); other != s {
+			t.Fatal("expected same set")
+		} else if other := s.Remove(1 << 20); other != s {
+			t.Fatal("expected same set")
+		}
+	})
+
+	t.Run("RemoveLast", func(t *testing.T) {
+		s := NewBitSet().Add(100).Remove(100)
+		if n := s.Cardinality(); n != 0 {
+			t.Fatalf("unexpected cardinality: %d", n)
+		} else if s.root != nil {
+			t.Fatal("expected nil root")
+		}
+	})
+
+	t.Run("Immutable", func(t *testing.T) {
+		s0 := NewBitSet().Add(1)
+		s1 := s0.Add(2)
+		if s0.Contains(2) {
+			t.Fatal("expected original set to be unchanged")
+		} else if !s1.Contains(1) || !s1.Contains(2) {
+			t.Fatal("expected values")
+		}
+	})
+
+	// Ensure leaves convert between arrays and bitmaps as they grow & shrink.
+	t.Run("Containers", func(t *testing.T) {
+		leaf := func(s *BitSet) bitSetNode {
+			n := s.root
+			for branch, ok := n.(*bitSetBranchNode); ok; branch, ok = n.(*bitSetBranchNode) {
+				n = branch.nodes[0]
+			}
+			return n
+		}
+
+		s := NewTBitSet()
+		for v := uint32(0); v < bitSetArrayMax; v++ {
+			s.Add(v * 3)
+		}
+		if _, ok := leaf(s.im).(*bitSetArrayNode); !ok {
+			t.Fatalf("unexpected leaf type: %T", leaf(s.im))
+		}
+
+		s.Add(1)
+		if _, ok := leaf(s.im).(*bitSetLeafNode); !ok {
+			t.Fatalf("unexpected leaf type: %T", leaf(s.im))
+		} else if err := s.Validate(); err != nil {
+			t.Fatal(err)
+		}
+
+		s.Remove(3)
+		if _, ok := leaf(s.im).(*bitSetArrayNode); !ok {
+			t.Fatalf("unexpected leaf type: %T", leaf(s.im))
+		} else if err := s.Validate(); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	// Ensure widely spaced values do not allocate a bitmap per value.
+	t.Run("SparseMemory", func(t *testing.T) {
+		const n = 10000
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+
+		s := NewBitSet()
+		for i := uint32(0); i < n; i++ {
+			s = s.Add(i * 100003)
+		}
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+
+		if perValue := (after.HeapAlloc - before.HeapAlloc) / n; perValue > 128 {
+			t.Fatalf("unexpected memory per value: %d bytes", perValue)
+		} else if s.Cardinality() != n {
+			t.Fatalf("unexpected cardinality: %d", s.Cardinality())
+		}
+	})
+
+	RunRandom(t, "Random", func(t *testing.T, rand *rand.Rand) {
+		s := NewTBitSet()
+		for i := 0; i < 10000; i++ {
+			switch rand.Intn(4) {
+			case 0:
+				s.Remove(s.ExistingValue(rand))
+			case 1:
+				s.Remove(s.NewValue(rand))
+			default:
+				s.Add(s.NewValue(rand))
+			}
+		}
+		if err := s.Validate(); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestBitSet_Ops(t *testing.T) {
+	t.Run("Identical", func(t *testing.T) {
+		s := NewBitSet().Add(1).Add(100000)
+		if other := s.And(s); other != s {
+			t.Fatal("expected same set for And")
+		} else if other := s.Or(s); other != s {
+			t.Fatal("expected same set for Or")
+		} else if other := s.AndNot(s); other.Cardinality() != 0 {
+			t.Fatalf("unexpected AndNot cardinality: %d", other.Cardinality())
+		} else if other := s.Xor(s); other.Cardinality() != 0 {
+			t.Fatalf("unexpected Xor cardinality: %d", other.Cardinality())
+		}
+	})
+
+	t.Run("Empty", func(t *testing.T) {
+		s := NewBitSet().Add(1).Add(100000)
+		empty := NewBitSet()
+		if other := s.Or(empty); other != s {
+			t.Fatal("expected same set for Or")
+		} else if other := empty.Or(s); other != s {
+			t.Fatal("expected same set for Or")
+		} else if other := s.AndNot(empty); other != s {
+			t.Fatal("expected same set for AndNot")
+		} else if other := s.And(empty); other.Cardinality() != 0 {
+			t.Fatalf("unexpected And cardinality: %d", other.Cardinality())
+		}
+	})
+
+	// Ensure chunks untouched by an operation are shared with the inputs.
+	t.Run("SharedChunks", func(t *testing.T) {
+		a := NewBitSet().Add(1).Add(2)
+		b := NewBitSet().Add(1 << 30)
+
+		other := a.Or(b)
+		root := other.root.(*bitSetBranchNode)
+		if got, exp := len(root.nodes), 2; got != exp {
+			t.Fatalf("len(nodes)=%d, expected %d", got, exp)
+		} else if root.nodes[0] != a.root.(*bitSetBranchNode).nodes[0] {
+			t.Fatal("expected shared chunk from a")
+		} else if root.nodes[1] != b.root.(*bitSetBranchNode).nodes[0] {
+			t.Fatal("expected shared chunk from b")
+		}
+	})
+
+	RunRandom(t, "Random", func(t *testing.T, rand *rand.Rand) {
+		a, b := NewTBitSet(), NewTBitSet()
+		for i := 0; i < 2000; i++ {
+			v := a.NewValue(rand)
+			switch rand.Intn(3) {
+			case 0:
+				a.Add(v)
+			case 1:
+				b.Add(v)
+			default:
+				a.Add(v)
+				b.Add(v)
+			}
+		}
+
+		for _, tt := range []struct {
+			name string
+			op   func(a, b *BitSet) *BitSet
+			fn   func(a, b bool) bool
+		}{
+			{"And", (*BitSet).And, func(a, b bool) bool { return a && b }},
+			{"Or", (*BitSet).Or, func(a, b bool) bool { return a || b }},
+			{"AndNot", (*BitSet).AndNot, func(a, b bool) bool { return a && !b }},
+			{"Xor", (*BitSet).Xor, func(a, b bool) bool { return a != b }},
+		} {
+			other := NewTBitSet()
+			other.im = tt.op(a.im, b.im)
+			for v := range a.std {
+				if tt.fn(true, b.std[v]) {
+					other.std[v] = true
+				}
+			}
+			for v := range b.std {
+				if tt.fn(a.std[v], true) {
+					other.std[v] = true
+				}
+			}
+			for v := range other.std {
+				other.values = append(other.values, v)
+			}
+			if err := other.Validate(); err != nil {
+				t.Fatalf("%s: %s", tt.name, err)
+			}
+		}
+	})
+}
+
+func TestBitSetIterator_Seek(t *testing.T) {
+	s := NewBitSet()
+	for _, v := range []uint32{10, 20, 5000, 1 << 20, 1 << 31} {
+		s = s.Add(v)
+	}
+
+	for _, tt := range []struct {
+		seek uint32
+		exp  []uint32
+	}{
+		{0, []uint32{10, 20, 5000, 1 << 20, 1 << 31}},
+		{10, []uint32{10, 20, 5000, 1 << 20, 1 << 31}},
+		{11, []uint32{20, 5000, 1 << 20, 1 << 31}},
+		{4096, []uint32{5000, 1 << 20, 1 << 31}},
+		{5001, []uint32{1 << 20, 1 << 31}},
+		{1<<31 + 1, nil},
+	} {
+		itr := s.Iterator()
+		itr.Seek(tt.seek)
+
+		var a []uint32
+		for !itr.Done() {
+			v, _ := itr.Next()
+			a = append(a, v)
+		}
+		if fmt.Sprint(a) != fmt.Sprint(tt.exp) {
+			t.Fatalf("Seek(%d): got %v, expected %v", tt.seek, a, tt.exp)
+		} else if v, ok := itr.Next(); ok {
+			t.Fatalf("Seek(%d): unexpected value after done: %d", tt.seek, v)
+		}
+	}
+}
+
+// TBitSet represents a combined immutable and stdlib set.
+type TBitSet struct {
+	im     *BitSet
+	std    map[uint32]bool
+	values []uint32
+}
+
+func NewTBitSet() *TBitSet {
+	return &TBitSet{
+		im:  NewBitSet(),
+		std: make(map[uint32]bool),
+	}
+}
+
+// NewValue returns a random value clustered around a few regions so that
+// both sparse and dense chunks are exercised.
+func (s *TBitSet) NewValue(rand *rand.Rand) uint32 {
+	for {
+		v := uint32(rand.Intn(4))<<28 | uint32(rand.Intn(20000))
+		if !s.std[v] {
+			return v
+		}
+	}
+}
+
+func (s *TBitSet) ExistingValue(rand *rand.Rand) uint32 {
+	if len(s.values) == 0 {
+		return 0
+	}
+	return s.values[rand.Intn(len(s.values))]
+}
+
+func (s *TBitSet) Add(v uint32) {
+	s.im = s.im.Add(v)
+	if !s.std[v] {
+		s.values = append(s.values, v)
+	}
+	s.std[v] = true
+}
+
+func (s *TBitSet) Remove(v uint32) {
+	s.im = s.im.Remove(v)
+	delete(s.std, v)
+
+	for i := range s.values {
+		if s.values[i] == v {
+			s.values = append(s.values[:i], s.values[i+1:]...)
+			break
+		}
+	}
+}
+
+func (s *TBitSet) Validate() error {
+	if got, exp := s.im.Cardinality(), len(s.std); got != exp {
+		return fmt.Errorf("Cardinality()=%d, expected %d", got, exp)
+	}
+	for _, v := range s.values {
+		if !s.im.Contains(v) {
+			return fmt.Errorf("value not found: %d", v)
+		}
+	}
+
+	values := make([]uint32, len(s.values))
+	copy(values, s.values)
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+
+	itr := s.im.Iterator()
+	for i, exp := range values {
+		if got, ok := itr.Next(); !ok || got != exp {
+			return fmt.Errorf("%d. BitSetIterator.Next()=<%d,%v>, expected %d", i, got, ok, exp)
+		}
+	}
+	if !itr.Done() {
+		return fmt.Errorf("BitSetIterator.Done()=false, expected true")
+	}
+	return nil
+}
+
+func BenchmarkBitSet_Add(b *testing.B) {
+	b.ReportAllocs()
+	s := NewBitSet()
+	for i := 0; i < b.N; i++ {
+		s = s.Add(uint32(i))
+	}
+}
+
+func BenchmarkBitSet_Or(b *testing.B) {
+	const n = 100000
+	s0, s1 := NewBitSet(), NewBitSet()
+	for i := 0; i < n; i++ {
+		s0 = s0.Add(uint32(i * 2))
+		s1 = s1.Add(uint32(i * 3))
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		s0.Or(s1)
+	}
+}
+
+func ExampleBitSet_Add() {
+	s := NewBitSet()
+	s = s.Add(10)
+	s = s.Add(2)
+	s = s.Add(1000000)
+
+	fmt.Println(s.Cardinality())
+	fmt.Println(s.Contains(2))
+	fmt.Println(s.Contains(3))
+	// Output:
+	// 3
+	// true
+	// false
+}
+
+func ExampleBitSet_Iterator() {
+	a := NewBitSet().Add(1).Add(2).Add(3)
+	b := NewBitSet().Add(2).Add(3).Add(4)
+
+	itr := a.Xor(b).Iterator()
+	for !itr.Done() {
+		v, _ := itr.Next()
+		fmt.Println(v)
+	}
+	// Output:
+	// 1
+	// 4
+}
@@ -0,0 +1,301 @@
+package immutable
+
+import (
+	"unicode"
+	"unicode/utf8"
+)
+
+// Collation is a set of flags that control how strings are ordered and
+// compared by NewCollationComparer and NewCollationHasher.
+//
+// Strings that are equivalent under a collation are treated as the same key.
+// For example, "Foo" and "foo" are the same key with CollationIgnoreCase.
+type Collation uint8
+
+const (
+	// CollationIgnoreCase compares letters without regard to case.
+	CollationIgnoreCase Collation = 1 << iota
+
+	// CollationNormalize treats canonically equivalent strings as equal, such
+	// as a precomposed "é" and "e" followed by a combining acute accent.
+	// Characters are decomposed and combining marks are put in canonical
+	// order before comparing. Decomposition is supported for the Latin,
+	// Greek, and Cyrillic blocks.
+	CollationNormalize
+
+	// CollationIgnoreAccents compares letters without regard to accents and
+	// other combining marks. Implies CollationNormalize.
+	CollationIgnoreAccents
+
+	// CollationNatural compares runs of digits by their numeric value so that
+	// "file2" sorts before "file10". Leading zeros are ignored.
+	CollationNatural
+)
+
+// NewCollationComparer returns a comparer for string keys that orders strings
+// by the given collation. Strings are compared rune by rune after applying the
+// collation so the order is consistent with NewCollationHasher.
+//
+// Without CollationNormalize or CollationIgnoreAccents, strings are compared
+// by code point, so the same text in different Unicode normal forms is not
+// equal. Keys must then all use the same normal form, such as NFC.
+func NewCollationComparer(c Collation) Comparer {
+	return &collationComparer{c: c}
+}
+
+// NewCollationHasher returns a hasher for string keys that is consistent with
+// NewCollationComparer for the same collation. It uses a random seed. See
+// NewStringHasher for details about seeding.
+func NewCollationHasher(c Collation) Hasher {
+	return NewCollationHasherWithSeed(c, newHasherSeed())
+}
+
+// NewCollationHasherWithSeed returns a hasher like NewCollationHasher that uses
+// the given seed.
+func NewCollationHasherWithSeed(c Collation, seed uint64) Hasher {
+	return &collationHasher{collationComparer: collationComparer{c: c}, s: seed, key: newSipKey(seed)}
+}
+
+// collationComparer compares strings using a collation. Implements Comparer.
+type collationComparer struct {
+	c Collation
+}
+
+// Compare returns -1 if a is less than b, returns 1 if a is greater than b, and
+// returns 0 if a is equal to b. Panics if a or b is not a string.
+func (c *collationComparer) Compare(a, b interface{}) int {
+	x, y := newCollationReader(a.(string), c.c), newCollationReader(b.(string), c.c)
+	for {
+		ch0, ok0 := x.peek()
+		ch1, ok1 := y.peek()
+		switch {
+		case !ok0 && !ok1:
+			return 0
+		case !ok0:
+			return -1
+		case !ok1:
+			return 1
+		}
+
+		// Compare digit runs numerically in natural order.
+		if c.c&CollationNatural != 0 && isDigit(ch0) && isDigit(ch1) {
+			if cmp := compareDigitRuns(&x, &y); cmp != 0 {
+				return cmp
+			}
+			continue
+		}
+
+		if ch0 < ch1 {
+			return -1
+		} else if ch0 > ch1 {
+			return 1
+		}
+		x.next()
+		y.next()
+	}
+}
+
+// compareDigitRuns compares the numeric values of the digit runs at the start
+// of x & y and advances both readers past them.
+func compareDigitRuns(x, y *collationReader) int {
+	skipZeros(x)
+	skipZeros(y)
+
+	// Numbers with more significant digits are larger. Otherwise the first
+	// differing digit determines the order.
+	var cmp int
+	for {
+		ch0, ok0 := x.peek()
+		ch1, ok1 := y.peek()
+		d0, d1 := ok0 && isDigit(ch0), ok1 && isDigit(ch1)
+		switch {
+		case !d0 && !d1:
+			return cmp
+		case !d0:
+			return -1
+		case !d1:
+			return 1
+		}
+
+		if cmp == 0 && ch0 < ch1 {
+			cmp = -1
+		} else if cmp == 0 && ch0 > ch1 {
+			cmp = 1
+		}
+		x.next()
+		y.next()
+	}
+}
+
+// skipZeros advances r past leading zeros.
+func skipZeros(r *collationReader) {
+	for ch, ok := r.peek(); ok && ch == '0'; ch, ok = r.peek() {
+		r.next()
+	}
+}
+
+// isDigit returns true if ch is an ASCII digit.
+func isDigit(ch rune) bool {
+	return ch >= '0' && ch <= '9'
+}
+
+// collationHasher implements Hasher for string keys using a collation.
+type collationHasher struct {
+	collationComparer
+	s   uint64
+	key sipKey
+}
+
+// Hash returns a hash for key.
+func (h *collationHasher) Hash(key interface{}) uint32 {
+	return fold64(h.Hash64(key))
+}
+
+// Hash64 returns a 64-bit hash for key.
+func (h *collationHasher) Hash64(key interface{}) uint64 {
+	var buf [64]byte
+	return h.key.hashBytes64(appendCollationKey(buf[:0], key.(string), h.c))
+}
+
+// Equal returns true if a is equal to b under the collation. Otherwise returns false.
+// Panics if a and b are not strings.
+func (h *collationHasher) Equal(a, b interface{}) bool {
+	return h.Compare(a, b) == 0
+}
+
+// seed returns the seed used to create the hasher.
+func (h *collationHasher) seed() uint64 { return h.s }
+
+// appendCollationKey appends the runes of s after applying the collation to
+// dst. Strings that compare as equal produce the same key.
+func appendCollationKey(dst []byte, s string, c Collation) []byte {
+	r := newCollationReader(s, c)
+	for {
+		ch, ok := r.peek()
+		if !ok {
+			return dst
+		} else if c&CollationNatural != 0 && isDigit(ch) {
+			skipZeros(&r)
+			if ch, ok = r.peek(); !ok || !isDigit(ch) {
+				dst = append(dst, '0') // run of zeros
+			}
+			for ch, ok = r.peek(); ok && isDigit(ch); ch, ok = r.peek() {
+				dst = append(dst, byte(ch))
+				r.next()
+			}
+			continue
+		}
+
+		var b [utf8.UTFMax]byte
+		dst = append(dst, b[:utf8.EncodeRune(b[:], ch)]...)
+		r.next()
+	}
+}
+
+// collationSegmentSize is the maximum number of runes in a normalized segment.
+// Longer runs of combining marks are split into multiple segments, similar to
+// the Stream-Safe Text Format limit of 30 combining marks.
+const collationSegmentSize = 32
+
+// collationReader reads the runes of a string after applying a collation.
+type collationReader struct {
+	s    string                     // remaining input
+	seg  [collationSegmentSize]rune // decomposed & reordered runes
+	segN int                        // number of runes in seg
+	segI int                        // index of the next rune in seg
+	c    Collation                  // flags
+	ch   rune                       // next rune, if ok
+	ok   bool                       // true if ch is set
+}
+
+// newCollationReader returns a reader for s.
+func newCollationReader(s string, c Collation) collationReader {
+	if c&CollationIgnoreAccents != 0 {
+		c |= CollationNormalize
+	}
+	return collationReader{s: s, c: c}
+}
+
+// peek returns the next rune without advancing. Returns false at the end.
+func (r *collationReader) peek() (rune, bool) {
+	if !r.ok {
+		r.ch, r.ok = r.read()
+	}
+	return r.ch, r.ok
+}
+
+// next advances past the rune returned by peek.
+func (r *collationReader) next() {
+	r.ok = false
+}
+
+// read returns the next rune after applying the collation.
+func (r *collationReader) read() (rune, bool) {
+	for {
+		var ch rune
+		if r.segI < r.segN {
+			ch = r.seg[r.segI]
+			r.segI++
+		} else if r.s == "" {
+			return 0, false
+		} else if r.c&CollationNormalize != 0 && !(r.s[0] < utf8.RuneSelf && (len(r.s) == 1 || r.s[1] < utf8.RuneSelf)) {
+			// Normalize unless the next two characters are ASCII, in which case
+			// the next character cannot be followed by a combining mark.
+			r.readSegment()
+			continue
+		} else {
+			var sz int
+			ch, sz = utf8.DecodeRuneInString(r.s)
+			r.s = r.s[sz:]
+		}
+
+		if r.c&CollationIgnoreAccents != 0 && ch >= utf8.RuneSelf && unicode.Is(unicode.Mn, ch) {
+			continue
+		}
+		if r.c&CollationIgnoreCase != 0 {
+			if ch >= 'A' && ch <= 'Z' {
+				ch += 'a' - 'A'
+			} else if ch >= utf8.RuneSelf {
+				ch = unicode.ToLower(ch)
+			}
+		}
+		return ch, true
+	}
+}
+
+// readSegment reads the next character and any combining marks that follow
+// it into seg. Precomposed characters are expanded into their decomposition
+// and combining marks are sorted by their canonical combining class so that
+// canonically equivalent strings produce the same runes.
+func (r *collationReader) readSegment() {
+	r.segN, r.segI = 0, 0
+	for r.s != "" {
+		ch, sz := utf8.DecodeRuneInString(r.s)
+		if r.segN > 0 && (combiningClass(ch) == 0 || r.segN+utf8.UTFMax > len(r.seg)) {
+			break
+		}
+		r.s = r.s[sz:]
+
+		if d, ok := decompositions[ch]; ok {
+			for _, ch := range d {
+				r.seg[r.segN] = ch
+				r.segN++
+			}
+			continue
+		}
+		r.seg[r.segN] = ch
+		r.segN++
+	}
+
+	// Stable insertion sort of marks. Starters, with a class of zero, are
+	// never reordered.
+	for i := 1; i < r.segN; i++ {
+		ccc := combiningClass(r.seg[i])
+		for j := i; j > 0 && ccc != 0; j-- {
+			if prev := combiningClass(r.seg[j-1]); prev == 0 || prev <= ccc {
+				break
+			}
+			r.seg[j-1], r.seg[j] = r.seg[j], r.seg[j-1]
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package immutable
+
+// decompositions maps precomposed characters to their canonical decomposition
+// (NFD) as defined by Unicode 14.0.0. It covers the Latin, Greek, and Cyrillic
+// blocks, which include the accented letters used by most European languages
+// and Vietnamese.
+var decompositions = map[rune]string{
+	0x00c0: "A\u0300", 0x00c1: "A\u0301", 0x00c2: "A\u0302", 0x00c3: "A\u0303",
+	0x00c4: "A\u0308", 0x00c5: "A\u030a", 0x00c7: "C\u0327", 0x00c8: "E\u0300",
+	0x00c9: "E\u0301", 0x00ca: "E\u0302", 0x00cb: "E\u0308", 0x00cc: "I\u0300",
+	0x00cd: "I\u0301", 0x00ce: "I\u0302", 0x00cf: "I\u0308", 0x00d1: "N\u0303",
+	0x00d2: "O\u0300", 0x00d3: "O\u0301", 0x00d4: "O\u0302", 0x00d5: "O\u0303",
+	0x00d6: "O\u0308", 0x00d9: "U\u0300", 0x00da: "U\u0301", 0x00db: "U\u0302",
+	0x00dc: "U\u0308", 0x00dd: "Y\u0301", 0x00e0: "a\u0300", 0x00e1: "a\u0301",
+	0x00e2: "a\u0302", 0x00e3: "a\u0303", 0x00e4: "a\u0308", 0x00e5: "a\u030a",
+	0x00e7: "c\u0327", 0x00e8: "e\u0300", 0x00e9: "e\u0301", 0x00ea: "e\u0302",
+	0x00eb: "e\u0308", 0x00ec: "i\u0300", 0x00ed: "i\u0301", 0x00ee: "i\u0302",
+	0x00ef: "i\u0308", 0x00f1: "n\u0303", 0x00f2: "o\u0300", 0x00f3: "o\u0301",
+	0x00f4: "o\u0302", 0x00f5: "o\u0303", 0x00f6: "o\u0308", 0x00f9: "u\u0300",
+	0x00fa: "u\u0301", 0x00fb: "u\u0302", 0x00fc: "u\u0308", 0x00fd: "y\u0301",
+	0x00ff: "y\u0308", 0x0100: "A\u0304", 0x0101: "a\u0304", 0x0102: "A\u0306",
+	0x0103: "a\u0306", 0x0104: "A\u0328", 0x0105: "a\u0328", 0x0106: "C\u0301",
+	0x0107: "c\u0301", 0x0108: "C\u0302", 0x0109: "c\u0302", 0x010a: "C\u0307",
+	0x010b: "c\u0307", 0x010c: "C\u030c", 0x010d: "c\u030c", 0x010e: "D\u030c",
+	0x010f: "d\u030c", 0x0112: "E\u0304", 0x0113: "e\u0304", 0x0114: "E\u0306",
+	0x0115: "e\u0306", 0x0116: "E\u0307", 0x0117: "e\u0307", 0x0118: "E\u0328",
+	0x0119: "e\u0328", 0x011a: "E\u030c", 0x011b: "e\u030c", 0x011c: "G\u0302",
+	0x011d: "g\u0302", 0x011e: "G\u0306", 0x011f: "g\u0306", 0x0120: "G\u0307",
+	0x0121: "g\u0307", 0x0122: "G\u0327", 0x0123: "g\u0327", 0x0124: "H\u0302",
+	0x0125: "h\u0302", 0x0128: "I\u0303", 0x0129: "i\u0303", 0x012a: "I\u0304",
+	0x012b: "i\u0304", 0x012c: "I\u0306", 0x012d: "i\u0306", 0x012e: "I\u0328",
+	0x012f: "i\u0328", 0x0130: "I\u0307", 0x0134: "J\u0302", 0x0135: "j\u0302",
+	0x0136: "K\u0327", 0x0137: "k\u0327", 0x0139: "L\u0301", 0x013a: "l\u0301",
+	0x013b: "L\u0327", 0x013c: "l\u0327", 0x013d: "L\u030c", 0x013e: "l\u030c",
+	0x0143: "N\u0301", 0x0144: "n\u0301", 0x0145: "N\u0327", 0x0146: "n\u0327",
+	0x0147: "N\u030c", 0x0148: "n\u030c", 0x014c: "O\u0304", 0x014d: "o\u0304",
+	0x014e: "O\u0306", 0x014f: "o\u0306", 0x0150: "O\u030b", 0x0151: "o\u030b",
+	0x0154: "R\u0301", 0x0155: "r\u0301", 0x0156: "R\u0327", 0x0157: "r\u0327",
+	0x0158: "R\u030c", 0x0159: "r\u030c", 0x015a: "S\u0301", 0x015b: "s\u0301",
+	0x015c: "S\u0302", 0x015d: "s\u0302", 0x015e: "S\u0327", 0x015f: "s\u0327",
+	0x0160: "S\u030c", 0x0161: "s\u030c", 0x0162: "T\u0327", 0x0163: "t\u0327",
+	0x0164: "T\u030c", 0x0165: "t\u030c", 0x0168: "U\u0303", 0x0169: "u\u0303",
+	0x016a: "U\u0304", 0x016b: "u\u0304", 0x016c: "U\u0306", 0x016d: "u\u0306",
+	0x016e: "U\u030a", 0x016f: "u\u030a", 0x0170: "U\u030b", 0x0171: "u\u030b",
+	0x0172: "U\u0328", 0x0173: "u\u0328", 0x0174: "W\u0302", 0x0175: "w\u0302",
+	0x0176: "Y\u0302", 0x0177: "y\u0302", 0x0178: "Y\u0308", 0x0179: "Z\u0301",
+	0x017a: "z\u0301", 0x017b: "Z\u0307", 0x017c: "z\u0307", 0x017d: "Z\u030c",
+	0x017e: "z\u030c", 0x01a0: "O\u031b", 0x01a1: "o\u031b", 0x01af: "U\u031b",
+	0x01b0: "u\u031b", 0x01cd: "A\u030c", 0x01ce: "a\u030c", 0x01cf: "I\u030c",
+	0x01d0: "i\u030c", 0x01d1: "O\u030c", 0x01d2: "o\u030c", 0x01d3: "U\u030c",
+	0x01d4: "u\u030c", 0x01d5: "U\u0308\u0304", 0x01d6: "u\u0308\u0304", 0x01d7: "U\u0308\u0301",
+	0x01d8: "u\u0308\u0301", 0x01d9: "U\u0308\u030c", 0x01da: "u\u0308\u030c", 0x01db: "U\u0308\u0300",
+	0x01dc: "u\u0308\u0300", 0x01de: "A\u0308\u0304", 0x01df: "a\u0308\u0304", 0x01e0: "A\u0307\u0304",
+	0x01e1: "a\u0307\u0304", 0x01e2: "\u00c6\u0304", 0x01e3: "\u00e6\u0304", 0x01e6: "G\u030c",
+	0x01e7: "g\u030c", 0x01e8: "K\u030c", 0x01e9: "k\u030c", 0x01ea: "O\u0328",
+	0x01eb: "o\u0328", 0x01ec: "O\u0328\u0304", 0x01ed: "o\u0328\u0304", 0x01ee: "\u01b7\u030c",
+	0x01ef: "\u0292\u030c", 0x01f0: "j\u030c", 0x01f4: "G\u0301", 0x01f5: "g\u0301",
+	0x01f8: "N\u0300", 0x01f9: "n\u0300", 0x01fa: "A\u030a\u0301", 0x01fb: "a\u030a\u0301",
+	0x01fc: "\u00c6\u0301", 0x01fd: "\u00e6\u0301", 0x01fe: "\u00d8\u0301", 0x01ff: "\u00f8\u0301",
+	0x0200: "A\u030f", 0x0201: "a\u030f", 0x0202: "A\u0311", 0x0203: "a\u0311",
+	0x0204: "E\u030f", 0x0205: "e\u030f", 0x0206: "E\u0311", 0x0207: "e\u0311",
+	0x0208: "I\u030f", 0x0209: "i\u030f", 0x020a: "I\u0311", 0x020b: "i\u0311",
+	0x020c: "O\u030f", 0x020d: "o\u030f", 0x020e: "O\u0311", 0x020f: "o\u0311",
+	0x0210: "R\u030f", 0x0211: "r\u030f", 0x0212: "R\u0311", 0x0213: "r\u0311",
+	0x0214: "U\u030f", 0x0215: "u\u030f", 0x0216: "U\u0311", 0x0217: "u\u0311",
+	0x0218: "S\u0326", 0x0219: "s\u0326", 0x021a: "T\u0326", 0x021b: "t\u0326",
+	0x021e: "H\u030c", 0x021f: "h\u030c", 0x0226: "A\u0307", 0x0227: "a\u0307",
+	0x0228: "E\u0327", 0x0229: "e\u0327", 0x022a: "O\u0308\u0304", 0x022b: "o\u0308\u0304",
+	0x022c: "O\u0303\u0304", 0x022d: "o\u0303\u0304", 0x022e: "O\u0307", 0x022f: "o\u0307",
+	0x0230: "O\u0307\u0304", 0x0231: "o\u0307\u0304", 0x0232: "Y\u0304", 0x0233: "y\u0304",
+	0x0374: "\u02b9", 0x037e: "\u003b", 0x0385: "\u00a8\u0301", 0x0386: "\u0391\u0301",
+	0x0387: "\u00b7", 0x0388: "\u0395\u0301", 0x0389: "\u0397\u0301", 0x038a: "\u0399\u0301",
+	0x038c: "\u039f\u0301", 0x038e: "\u03a5\u0301", 0x038f: "\u03a9\u0301", 0x0390: "\u03b9\u0308\u0301",
+	0x03aa: "\u0399\u0308", 0x03ab: "\u03a5\u0308", 0x03ac: "\u03b1\u0301", 0x03ad: "\u03b5\u0301",
+	0x03ae: "\u03b7\u0301", 0x03af: "\u03b9\u0301", 0x03b0: "\u03c5\u0308\u0301", 0x03ca: "\u03b9\u0308",
+	0x03cb: "\u03c5\u0308", 0x03cc: "\u03bf\u0301", 0x03cd: "\u03c5\u0301", 0x03ce: "\u03c9\u0301",
+	0x03d3: "\u03d2\u0301", 0x03d4: "\u03d2\u0308", 0x0400: "\u0415\u0300", 0x0401: "\u0415\u0308",
+	0x0403: "\u0413\u0301", 0x0407: "\u0406\u0308", 0x040c: "\u041a\u0301", 0x040d: "\u0418\u0300",
+	0x040e: "\u0423\u0306", 0x0419: "\u0418\u0306", 0x0439: "\u0438\u0306", 0x0450: "\u0435\u0300",
+	0x0451: "\u0435\u0308", 0x0453: "\u0433\u0301", 0x0457: "\u0456\u0308", 0x045c: "\u043a\u0301",
+	0x045d: "\u0438\u0300", 0x045e: "\u0443\u0306", 0x0476: "\u0474\u030f", 0x0477: "\u0475\u030f",
+	0x04c1: "\u0416\u0306", 0x04c2: "\u0436\u0306", 0x04d0: "\u0410\u0306", 0x04d1: "\u0430\u0306",
+	0x04d2: "\u0410\u0308", 0x04d3: "\u0430\u0308", 0x04d6: "\u0415\u0306", 0x04d7: "\u0435\u0306",
+	0x04da: "\u04d8\u0308", 0x04db: "\u04d9\u0308", 0x04dc: "\u0416\u0308", 0x04dd: "\u0436\u0308",
+	0x04de: "\u0417\u0308", 0x04df: "\u0437\u0308", 0x04e2: "\u0418\u0304", 0x04e3: "\u0438\u0304",
+	0x04e4: "\u0418\u0308", 0x04e5: "\u0438\u0308", 0x04e6: "\u041e\u0308", 0x04e7: "\u043e\u0308",
+	0x04ea: "\u04e8\u0308", 0x04eb: "\u04e9\u0308", 0x04ec: "\u042d\u0308", 0x04ed: "\u044d\u0308",
+	0x04ee: "\u0423\u0304", 0x04ef: "\u0443\u0304", 0x04f0: "\u0423\u0308", 0x04f1: "\u0443\u0308",
+	0x04f2: "\u0423\u030b", 0x04f3: "\u0443\u030b", 0x04f4: "\u0427\u0308", 0x04f5: "\u0447\u0308",
+	0x04f8: "\u042b\u0308", 0x04f9: "\u044b\u0308", 0x1e00: "A\u0325", 0x1e01: "a\u0325",
+	0x1e02: "B\u0307", 0x1e03: "b\u0307", 0x1e04: "B\u0323", 0x1e05: "b\u0323",
+	0x1e06: "B\u0331", 0x1e07: "b\u0331", 0x1e08: "C\u0327\u0301", 0x1e09: "c\u0327\u0301",
+	0x1e0a: "D\u0307", 0x1e0b: "d\u0307", 0x1e0c: "D\u0323", 0x1e0d: "d\u0323",
+	0x1e0e: "D\u0331", 0x1e0f: "d\u0331", 0x1e10: "D\u0327", 0x1e11: "d\u0327",
+	0x1e12: "D\u032d", 0x1e13: "d\u032d", 0x1e14: "E\u0304\u0300", 0x1e15: "e\u0304\u0300",
+	0x1e16: "E\u0304\u0301", 0x1e17: "e\u0304\u0301", 0x1e18: "E\u032d", 0x1e19: "e\u032d",
+	0x1e1a: "E\u0330", 0x1e1b: "e\u0330", 0x1e1c: "E\u0327\u0306", 0x1e1d: "e\u0327\u0306",
+	0x1e1e: "F\u0307", 0x1e1f: "f\u0307", 0x1e20: "G\u0304", 0x1e21: "g\u0304",
+	0x1e22: "H\u0307", 0x1e23: "h\u0307", 0x1e24: "H\u0323", 0x1e25: "h\u0323",
+	0x1e26: "H\u0308", 0x1e27: "h\u0308", 0x1e28: "H\u0327", 0x1e29: "h\u0327",
+	0x1e2a: "H\u032e", 0x1e2b: "h\u032e", 0x1e2c: "I\u0330", 0x1e2d: "i\u0330",
+	0x1e2e: "I\u0308\u0301", 0x1e2f: "i\u0308\u0301", 0x1e30: "K\u0301", 0x1e31: "k\u0301",
+	0x1e32: "K\u0323", 0x1e33: "k\u0323", 0x1e34: "K\u0331", 0x1e35: "k\u0331",
+	0x1e36: "L\u0323", 0x1e37: "l\u0323", 0x1e38: "L\u0323\u0304", 0x1e39: "l\u0323\u0304",
+	0x1e3a: "L\u0331", 0x1e3b: "l\u0331", 0x1e3c: "L\u032d", 0x1e3d: "l\u032d",
+	0x1e3e: "M\u0301", 0x1e3f: "m\u0301", 0x1e40: "M\u0307", 0x1e41: "m\u0307",
+	0x1e42: "M\u0323", 0x1e43: "m\u0323", 0x1e44: "N\u0307", 0x1e45: "n\u0307",
+	0x1e46: "N\u0323", 0x1e47: "n\u0323", 0x1e48: "N\u0331", 0x1e49: "n\u0331",
+	0x1e4a: "N\u032d", 0x1e4b: "n\u032d", 0x1e4c: "O\u0303\u0301", 0x1e4d: "o\u0303\u0301",
+	0x1e4e: "O\u0303\u0308", 0x1e4f: "o\u0303\u0308", 0x1e50: "O\u0304\u0300", 0x1e51: "o\u0304\u0300",
+	0x1e52: "O\u0304\u0301", 0x1e53: "o\u0304\u0301", 0x1e54: "P\u0301", 0x1e55: "p\u0301",
+	0x1e56: "P\u0307", 0x1e57: "p\u0307", 0x1e58: "R\u0307", 0x1e59: "r\u0307",
+	0x1e5a: "R\u0323", 0x1e5b: "r\u0323", 0x1e5c: "R\u0323\u0304", 0x1e5d: "r\u0323\u0304",
+	0x1e5e: "R\u0331", 0x1e5f: "r\u0331", 0x1e60: "S\u0307", 0x1e61: "s\u0307",
+	0x1e62: "S\u0323", 0x1e63: "s\u0323", 0x1e64: "S\u0301\u0307", 0x1e65: "s\u0301\u0307",
+	0x1e66: "S\u030c\u0307", 0x1e67: "s\u030c\u0307", 0x1e68: "S\u0323\u0307", 0x1e69: "s\u0323\u0307",
+	0x1e6a: "T\u0307", 0x1e6b: "t\u0307", 0x1e6c: "T\u0323", 0x1e6d: "t\u0323",
+	0x1e6e: "T\u0331", 0x1e6f: "t\u0331", 0x1e70: "T\u032d", 0x1e71: "t\u032d",
+	0x1e72: "U\u0324", 0x1e73: "u\u0324", 0x1e74: "U\u0330", 0x1e75: "u\u0330",
+	0x1e76: "U\u032d", 0x1e77: "u\u032d", 0x1e78: "U\u0303\u0301", 0x1e79: "u\u0303\u0301",
+	0x1e7a: "U\u0304\u0308", 0x1e7b: "u\u0304\u0308", 0x1e7c: "V\u0303", 0x1e7d: "v\u0303",
+	0x1e7e: "V\u0323", 0x1e7f: "v\u0323", 0x1e80: "W\u0300", 0x1e81: "w\u0300",
+	0x1e82: "W\u0301", 0x1e83: "w\u0301", 0x1e84: "W\u0308", 0x1e85: "w\u0308",
+	0x1e86: "W\u0307", 0x1e87: "w\u0307", 0x1e88: "W\u0323", 0x1e89: "w\u0323",
+	0x1e8a: "X\u0307", 0x1e8b: "x\u0307", 0x1e8c: "X\u0308", 0x1e8d: "x\u0308",
+	0x1e8e: "Y\u0307", 0x1e8f: "y\u0307", 0x1e90: "Z\u0302", 0x1e91: "z\u0302",
+	0x1e92: "Z\u0323", 0x1e93: "z\u0323", 0x1e94: "Z\u0331", 0x1e95: "z\u0331",
+	0x1e96: "h\u0331", 0x1e97: "t\u0308", 0x1e98: "w\u030a", 0x1e99: "y\u030a",
+	0x1e9b: "\u017f\u0307", 0x1ea0: "A\u0323", 0x1ea1: "a\u0323", 0x1ea2: "A\u0309",
+	0x1ea3: "a\u0309", 0x1ea4: "A\u0302\u0301", 0x1ea5: "a\u0302\u0301", 0x1ea6: "A\u0302\u0300",
+	0x1ea7: "a\u0302\u0300", 0x1ea8: "A\u0302\u0309", 0x1ea9: "a\u0302\u0309", 0x1eaa: "A\u0302\u0303",
+	0x1eab: "a\u0302\u0303", 0x1eac: "A\u0323\u0302", 0x1ead: "a\u0323\u0302", 0x1eae: "A\u0306\u0301",
+	0x1eaf: "a\u0306\u0301", 0x1eb0: "A\u0306\u0300", 0x1eb1: "a\u0306\u0300", 0x1eb2: "A\u0306\u0309",
+	0x1eb3: "a\u0306\u0309", 0x1eb4: "A\u0306\u0303", 0x1eb5: "a\u0306\u0303", 0x1eb6: "A\u0323\u0306",
+	0x1eb7: "a\u0323\u0306", 0x1eb8: "E\u0323", 0x1eb9: "e\u0323", 0x1eba: "E\u0309",
+	0x1ebb: "e\u0309", 0x1ebc: "E\u0303", 0x1ebd: "e\u0303", 0x1ebe: "E\u0302\u0301",
+	0x1ebf: "e\u0302\u0301", 0x1ec0: "E\u0302\u0300", 0x1ec1: "e\u0302\u0300", 0x1ec2: "E\u0302\u0309",
+	0x1ec3: "e\u0302\u0309", 0x1ec4: "E\u0302\u0303", 0x1ec5: "e\u0302\u0303", 0x1ec6: "E\u0323\u0302",
+	0x1ec7: "e\u0323\u0302", 0x1ec8: "I\u0309", 0x1ec9: "i\u0309", 0x1eca: "I\u0323",
+	0x1ecb: "i\u0323", 0x1ecc: "O\u0323", 0x1ecd: "o\u0323", 0x1ece: "O\u0309",
+	0x1ecf: "o\u0309", 0x1ed0: "O\u0302\u0301", 0x1ed1: "o\u0302\u0301", 0x1ed2: "O\u0302\u0300",
+	0x1ed3: "o\u0302\u0300", 0x1ed4: "O\u0302\u0309", 0x1ed5: "o\u0302\u0309", 0x1ed6: "O\u0302\u0303",
+	0x1ed7: "o\u0302\u0303", 0x1ed8: "O\u0323\u0302", 0x1ed9: "o\u0323\u0302", 0x1eda: "O\u031b\u0301",
+	0x1edb: "o\u031b\u0301", 0x1edc: "O\u031b\u0300", 0x1edd: "o\u031b\u0300", 0x1ede: "O\u031b\u0309",
+	0x1edf: "o\u031b\u0309", 0x1ee0: "O\u031b\u0303", 0x1ee1: "o\u031b\u0303", 0x1ee2: "O\u031b\u0323",
+	0x1ee3: "o\u031b\u0323", 0x1ee4: "U\u0323", 0x1ee5: "u\u0323", 0x1ee6: "U\u0309",
+	0x1ee7: "u\u0309", 0x1ee8: "U\u031b\u0301", 0x1ee9: "u\u031b\u0301", 0x1eea: "U\u031b\u0300",
+	0x1eeb: "u\u031b\u0300", 0x1eec: "U\u031b\u0309", 0x1eed: "u\u031b\u0309", 0x1eee: "U\u031b\u0303",
+	0x1eef: "u\u031b\u0303", 0x1ef0: "U\u031b\u0323", 0x1ef1: "u\u031b\u0323", 0x1ef2: "Y\u0300",
+	0x1ef3: "y\u0300", 0x1ef4: "Y\u0323", 0x1ef5: "y\u0323", 0x1ef6: "Y\u0309",
+	0x1ef7: "y\u0309", 0x1ef8: "Y\u0303", 0x1ef9: "y\u0303",
+}
+
+// combiningClass returns the canonical combining class of ch as defined by
+// Unicode 14.0.0 for the combining marks used by decompositions. Returns zero
+// for starters and for marks outside of those blocks.
+func combiningClass(ch rune) uint8 {
+	switch {
+	case ch < 0x0300:
+		return 0
+	case ch <= 0x0314:
+		return 230
+	case ch == 0x0315, ch == 0x031a, ch == 0x0358:
+		return 232
+	case ch <= 0x0319:
+		return 220
+	case ch == 0x031b:
+		return 216
+	case ch == 0x0321, ch == 0x0322, ch == 0x0327, ch == 0x0328:
+		return 202
+	case ch <= 0x0333:
+		return 220
+	case ch <= 0x0338:
+		return 1
+	case ch <= 0x033c:
+		return 220
+	case ch <= 0x0344:
+		return 230
+	case ch == 0x0345:
+		return 240
+	case ch == 0x0346:
+		return 230
+	case ch <= 0x0349:
+		return 220
+	case ch <= 0x034c:
+		return 230
+	case ch <= 0x034e:
+		return 220
+	case ch == 0x034f:
+		return 0
+	case ch <= 0x0352:
+		return 230
+	case ch <= 0x0356:
+		return 220
+	case ch == 0x0357, ch == 0x035b:
+		return 230
+	case ch <= 0x035a:
+		return 220
+	case ch == 0x035c, ch == 0x035f, ch == 0x0362:
+		return 233
+	case ch <= 0x0361:
+		return 234
+	case ch <= 0x036f:
+		return 230
+	case ch >= 0x0483 && ch <= 0x0487:
+		return 230
+	}
+	return 0
+}
@@ -0,0 +1,126 @@
+package immutable
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestCollationComparer(t *testing.T) {
+	for _, tt := range []struct {
+		c    Collation
+		a, b string
+		exp  int
+	}{
+		{0, "B", "a", -1},
+		{CollationIgnoreCase, "B", "a", 1},
+		{CollationIgnoreCase, "FOO", "foo", 0},
+		{CollationIgnoreCase, "ÉCOLE", "école", 0},
+		{0, "café", "cafe\u0301", 1},
+		{CollationNormalize, "café", "cafe\u0301", 0},
+		{CollationNormalize, "café", "cafe", 1},
+		{CollationNormalize | CollationIgnoreCase, "CAFÉ", "cafe\u0301", 0},
+		{CollationNormalize, "\u1ec7", "\u00ea\u0323", 0},
+		{CollationNormalize, "\u1ec7", "e\u0302\u0323", 0},
+		{CollationNormalize, "a\u0301\u0323b", "a\u0323\u0301b", 0},
+		{CollationNormalize, "a\u0301\u0301", "a\u0301", 1},
+		{0, "a\u0301\u0323", "a\u0323\u0301", -1},
+		{CollationIgnoreAccents, "café", "cafe", 0},
+		{CollationIgnoreAccents, "Ångström", "angstrom", -1},
+		{CollationIgnoreAccents | CollationIgnoreCase, "Ångström", "angstrom", 0},
+		{CollationIgnoreAccents, "Tiếng Việt", "Tieng Viet", 0},
+		{0, "file10", "file2", -1},
+		{CollationNatural, "file10", "file2", 1},
+		{CollationNatural, "file2", "file02", 0},
+		{CollationNatural, "file2a", "file2b", -1},
+		{CollationNatural, "file", "file0", -1},
+		{CollationNatural, "a100b", "a99c", 1},
+		{CollationNatural, "v1.10", "v1.9", 1},
+		{CollationNatural, "x0", "x000", 0},
+		{CollationNatural | CollationIgnoreCase, "File10", "file9", 1},
+	} {
+		c := NewCollationComparer(tt.c)
+		if got := c.Compare(tt.a, tt.b); got != tt.exp {
+			t.Fatalf("Compare(%q, %q) with %d=%d, expected %d", tt.a, tt.b, tt.c, got, tt.exp)
+		} else if got := c.Compare(tt.b, tt.a); got != -tt.exp {
+			t.Fatalf("Compare(%q, %q) with %d=%d, expected %d", tt.b, tt.a, tt.c, got, -tt.exp)
+		}
+
+		// Hashes must match for equal strings.
+		h := NewCollationHasherWithSeed(tt.c, 0)
+		if tt.exp == 0 && h.Hash(tt.a) != h.Hash(tt.b) {
+			t.Fatalf("Hash(%q) != Hash(%q) with %d", tt.a, tt.b, tt.c)
+		} else if h.Equal(tt.a, tt.b) != (tt.exp == 0) {
+			t.Fatalf("Equal(%q, %q) with %d=%v", tt.a, tt.b, tt.c, !(tt.exp == 0))
+		}
+	}
+}
+
+// Ensure the natural collation is a consistent ordering for sort.
+func TestCollationComparer_Natural(t *testing.T) {
+	RunRandom(t, "Sort", func(t *testing.T, rand *rand.Rand) {
+		a := make([]string, 100)
+		for i := range a {
+			a[i] = fmt.Sprintf("%s%0*d%s", string(rune('a'+rand.Intn(3))), rand.Intn(4), rand.Intn(200), string(rune('a'+rand.Intn(3))))
+		}
+
+		c := NewCollationComparer(CollationNatural)
+		sort.Slice(a, func(i, j int) bool { return c.Compare(a[i], a[j]) < 0 })
+		for i := 1; i < len(a); i++ {
+			for j := 0; j < i; j++ {
+				if c.Compare(a[j], a[i]) > 0 {
+					t.Fatalf("out of order: %q > %q", a[j], a[i])
+				}
+			}
+		}
+	})
+}
+
+func TestCollationHasher_Map(t *testing.T) {
+	m := NewMap(NewCollationHasher(CollationIgnoreCase | CollationIgnoreAccents))
+	m = m.Set("Café", 1)
+	m = m.Set("CAFE", 2)
+	if m.Len() != 1 {
+		t.Fatalf("unexpected len: %d", m.Len())
+	} else if v, ok := m.Get("cafe\u0301"); !ok || v != 2 {
+		t.Fatalf("unexpected value: <%v,%v>", v, ok)
+	}
+}
+
+func BenchmarkCollationComparer_Compare(b *testing.B) {
+	c := NewCollationComparer(CollationIgnoreCase | CollationNatural)
+	x, y := "Report-2021-10.pdf", "report-2021-9.pdf"
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.Compare(x, y)
+	}
+}
+
+func BenchmarkCollationHasher_Hash(b *testing.B) {
+	h := NewCollationHasher(CollationIgnoreCase | CollationIgnoreAccents)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		h.Hash("Crème Brûlée")
+	}
+}
+
+func ExampleNewCollationComparer() {
+	m := NewSortedMap(NewCollationComparer(CollationNatural | CollationIgnoreCase))
+	m = m.Set("file10.txt", nil)
+	m = m.Set("File2.txt", nil)
+	m = m.Set("file1.txt", nil)
+
+	for itr := m.Iterator(); !itr.Done(); {
+		k, _ := itr.Next()
+		fmt.Println(k)
+	}
+	// Output:
+	// file1.txt
+	// File2.txt
+	// file10.txt
+}
@@ -0,0 +1,273 @@
+package immutable
+
+import (
+	"math/bits"
+)
+
+// ChangeType represents the kind of change made to a key between two maps.
+type ChangeType int
+
+const (
+	// ChangeAdded indicates a key exists only in the newer map.
+	ChangeAdded ChangeType = iota + 1
+
+	// ChangeRemoved indicates a key exists only in the older map.
+	ChangeRemoved
+
+	// ChangeUpdated indicates a key exists in both maps with different values.
+	ChangeUpdated
+)
+
+// String returns the name of the change type.
+func (t ChangeType) String() string {
+	switch t {
+	case ChangeAdded:
+		return "added"
+	case ChangeRemoved:
+		return "removed"
+	case ChangeUpdated:
+		return "updated"
+	default:
+		return "unknown"
+	}
+}
+
+// Change represents a difference for a single key between two maps.
+type Change struct {
+	Type     ChangeType
+	Key      interface{}
+	OldValue interface{} // nil if added
+	NewValue interface{} // nil if removed
+}
+
+// identicalValues returns true if a and b are the same value. Values that
+// cannot be compared with == are never considered identical.
+func identicalValues(a, b interface{}) (ok bool) {
+	defer func() {
+		if recover() != nil {
+			ok = false
+		}
+	}()
+	return a == b
+}
+
+// diffMaps calls fn for each key that differs between a and b. Values are
+// compared with eq, or by identity if eq is nil. Subtrees shared by both maps
+// are skipped. Returns false if fn returns false.
+func diffMaps(a, b *Map, eq func(a, b interface{}) bool, fn func(Change) bool) bool {
+	if eq == nil {
+		eq = identicalValues
+	}
+
+	// Trie layouts are only comparable if both maps hash keys identically.
+	if identicalValues(a.hasher, b.hasher) || a.root == nil || b.root == nil {
+		h := a.hasher
+		if h == nil {
+			h = b.hasher
+		}
+		return diffMapNodes(a.root, b.root, 0, h, eq, fn)
+	}
+
+	// Otherwise fall back to looking up every key in the other map.
+	for itr := a.Iterator(); !itr.Done(); {
+		k, v := itr.Next()
+		if other, ok := b.Get(k); !ok {
+			if !fn(Change{Type: ChangeRemoved, Key: k, OldValue: v}) {
+				return false
+			}
+		} else if !eq(v, other) {
+			if !fn(Change{Type: ChangeUpdated, Key: k, OldValue: v, NewValue: other}) {
+				return false
+			}
+		}
+	}
+	for itr := b.Iterator(); !itr.Done(); {
+		k, v := itr.Next()
+		if _, ok := a.Get(k); !ok {
+			if !fn(Change{Type: ChangeAdded, Key: k, NewValue: v}) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// diffMapNodes calls fn for each key that differs between nodes a & b at the
+// given shift. Branches are compared slot by slot so identical child nodes
+// are skipped without being traversed.
+func diffMapNodes(a, b mapNode, shift uint, h Hasher, eq func(a, b interface{}) bool, fn func(Change) bool) bool {
+	if a == b {
+		return true
+	}
+
+	if isMapBranchNode(a) && isMapBranchNode(b) {
+		for i := 0; i < mapNodeSize; i++ {
+			if !diffMapNodes(mapBranchChild(a, i), mapBranchChild(b, i), shift+mapNodeBits, h, eq, fn) {
+				return false
+			}
+		}
+		return true
+	}
+
+	// Compare entries directly if either side is a leaf or array node.
+	for _, entry := range mapNodeEntries(a, nil) {
+		var value interface{}
+		var ok bool
+		if b != nil {
+			value, ok = b.get(entry.key, shift, hashKey(h, entry.key), h)
+		}
+
+		if !ok {
+			if !fn(Change{Type: ChangeRemoved, Key: entry.key, OldValue: entry.value}) {
+				return false
+			}
+		} else if !eq(entry.value, value) {
+			if !fn(Change{Type: ChangeUpdated, Key: entry.key, OldValue: entry.value, NewValue: value}) {
+				return false
+			}
+		}
+	}
+	for _, entry := range mapNodeEntries(b, nil) {
+		if a != nil {
+			if _, ok := a.get(entry.key, shift, hashKey(h, entry.key), h); ok {
+				continue
+			}
+		}
+		if !fn(Change{Type: ChangeAdded, Key: entry.key, NewValue: entry.value}) {
+			return false
+		}
+	}
+	return true
+}
+
+// isMapBranchNode returns true if n is a bitmap indexed or hash array node.
+func isMapBranchNode(n mapNode) bool {
+	switch n.(type) {
+	case *mapBitmapIndexedNode, *mapHashArrayNode:
+		return true
+	default:
+		return false
+	}
+}
+
+// mapBranchChild returns the child of branch node n at slot i, if any.
+func mapBranchChild(n mapNode, i int) mapNode {
+	switch n := n.(type) {
+	case *mapBitmapIndexedNode:
+		bit := uint32(1) << uint(i)
+		if n.bitmap&bit == 0 {
+			return nil
+		}
+		return n.nodes[bits.OnesCount32(n.bitmap&(bit-1))]
+	case *mapHashArrayNode:
+		return n.nodes[i]
+	default:
+		return nil
+	}
+}
+
+// mapNodeEntries appends all key/value pairs under n to a and returns it.
+func mapNodeEntries(n mapNode, a []mapEntry) []mapEntry {
+	switch n := n.(type) {
+	case *mapArrayNode:
+		return append(a, n.entries...)
+	case *mapBitmapIndexedNode:
+		for _, child := range n.nodes {
+			a = mapNodeEntries(child, a)
+		}
+	case *mapHashArrayNode:
+		for _, child := range n.nodes {
+			if child != nil {
+				a = mapNodeEntries(child, a)
+			}
+		}
+	case *mapValueNode:
+		return append(a, mapEntry{key: n.key, value: n.value})
+	case *mapHashCollisionNode:
+		return append(a, n.entries...)
+	}
+	return a
+}
+
+// diffSortedMaps calls fn for each key that differs between a and b in key
+// order. Values are compared with eq, or by identity if eq is nil. Subtrees
+// shared by both maps are skipped. Returns false if fn returns false.
+func diffSortedMaps(a, b *SortedMap, eq func(a, b interface{}) bool, fn func(Change) bool) bool {
+	if eq == nil {
+		eq = identicalValues
+	}
+	if a.root == b.root {
+		return true
+	}
+
+	c := a.comparer
+	if c == nil {
+		c = b.comparer
+	}
+
+	// Merge both iterators in key order and skip subtrees found at the
+	// current position of both iterators.
+	itrA, itrB := a.Iterator(), b.Iterator()
+	for {
+		skipSharedSortedMapSubtrees(itrA, itrB)
+		if itrA.Done() && itrB.Done() {
+			return true
+		}
+
+		var cmp int
+		if itrA.Done() {
+			cmp = 1
+		} else if itrB.Done() {
+			cmp = -1
+		} else {
+			keyA, _ := itrA.peek()
+			keyB, _ := itrB.peek()
+			cmp = c.Compare(keyA, keyB)
+		}
+
+		var change Change
+		switch {
+		case cmp < 0:
+			key, value := itrA.Next()
+			change = Change{Type: ChangeRemoved, Key: key, OldValue: value}
+		case cmp > 0:
+			key, value := itrB.Next()
+			change = Change{Type: ChangeAdded, Key: key, NewValue: value}
+		default:
+			key, valueA := itrA.Next()
+			_, valueB := itrB.Next()
+			if eq(valueA, valueB) {
+				continue
+			}
+			change = Change{Type: ChangeUpdated, Key: key, OldValue: valueA, NewValue: valueB}
+		}
+
+		if !fn(change) {
+			return false
+		}
+	}
+}
+
+// skipSharedSortedMapSubtrees advances both iterators past the largest
+// subtree that both iterators are positioned at the start of.
+func skipSharedSortedMapSubtrees(a, b *SortedMapIterator) {
+	for !a.Done() && !b.Done() {
+		// Walk up from the leaves while both iterators are at the start of
+		// the node at each level and record the highest shared node.
+		level := -1
+		for i := 0; i <= a.depth && i <= b.depth; i++ {
+			elemA, elemB := &a.stack[a.depth-i], &b.stack[b.depth-i]
+			if elemA.index != 0 || elemB.index != 0 {
+				break
+			} else if elemA.node == elemB.node {
+				level = i
+			}
+		}
+		if level == -1 {
+			return
+		}
+
+		a.skip(a.depth - level)
+		b.skip(b.depth - level)
+	}
+}
@@ -0,0 +1,586 @@
+package immutable
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/hex"
+	"math/big"
+	"sort"
+	"sync/atomic"
+	"unsafe"
+)
+
+// Digest represents a SHA-256 based digest of the contents of a collection.
+type Digest [sha256.Size]byte
+
+// String returns the hex representation of the digest.
+func (d Digest) String() string {
+	return hex.EncodeToString(d[:])
+}
+
+// digester is implemented by collections that can compute a digest.
+type digester interface {
+	Digest() (Digest, error)
+}
+
+// Digest returns a digest of the map's key/value pairs. Maps containing equal
+// key/value pairs and using the same hasher have equal digests regardless of
+// the order in which keys were inserted or deleted, so digests can be
+// compared to check replicas for equality. Maps with a nil hasher only share a
+// seed within a process so replicas in different processes should use a
+// hasher with a common seed, such as one from NewStringHasher.
+//
+// The digest is the root of a Merkle tree that follows the map's hash trie.
+// Each key/value pair is encoded with DefaultCodec and hashed with SHA-256.
+// Values that are themselves a *List, *Map, or *SortedMap are represented by
+// their digest. Each branch hashes the digests of its children in order of
+// their hash segment, and keys with equal hashes are hashed together. Maps
+// with different contents can be compared top down to find the subtrees that
+// differ. Digests are cached on each node so computing the digest of a new
+// version of a map only visits nodes that have changed. An empty map has a
+// zero digest.
+//
+// Returns an error if a key or value is not supported by DefaultCodec.
+func (m *Map) Digest() (Digest, error) {
+	if m.root == nil {
+		return Digest{}, nil
+	}
+	d, err := mapNodeDigest(m.root, 0, m.hasher)
+	return d.sum, err
+}
+
+// Digest returns a digest of the map's key/value pairs. Sorted maps containing
+// equal key/value pairs have equal digests regardless of their tree shape.
+//
+// Each key/value pair is encoded with DefaultCodec and hashed to an element of
+// the multiplicative group modulo a 3072-bit prime. Values that are themselves
+// a *List, *Map, or *SortedMap are represented by their digest. The digest of
+// the map is the SHA-256 of the product of every pair's element. This is the
+// MuHash multiset hash, so finding two different maps with equal digests is
+// as hard as computing discrete logarithms in that group. Unlike a Merkle
+// tree, the digest of any key range can be combined from the products cached
+// on each node, which Sync uses to compare ranges of two replicas. An empty
+// map has a zero digest.
+//
+// Returns an error if a key or value is not supported by DefaultCodec.
+func (m *SortedMap) Digest() (Digest, error) {
+	if m.root == nil {
+		return Digest{}, nil
+	}
+	d, err := sortedMapNodeDigest(m.root)
+	return d.digest(), err
+}
+
+// Digest returns a digest of the list's elements. The digest is the root of a
+// Merkle tree built over the elements in index order, with 32 elements per
+// leaf, so equal lists have equal digests regardless of whether they were
+// built by appending, prepending, or slicing.
+//
+// Digests of internal nodes are cached when a node's elements line up with the
+// Merkle tree, which is always the case for lists built by appending. Other
+// nodes are rehashed each time the digest is computed.
+//
+// Returns an error if an element is not supported by DefaultCodec.
+func (l *List) Digest() (Digest, error) {
+	w := listDigestWriter{origin: l.origin, size: l.size}
+	if l.size > 0 {
+		if err := w.writeNode(l.root, 0); err != nil {
+			return Digest{}, err
+		}
+	}
+	root := w.root()
+
+	buf := appendUvarint([]byte{blockTypeList}, uint64(l.size))
+	buf = append(buf, root[:]...)
+	return sha256.Sum256(buf), nil
+}
+
+// nodeDigest represents the computed digest of a node.
+type nodeDigest struct {
+	product *big.Int // product of sorted map pair elements modulo digestModulus
+	count   int      // number of key/value pairs under the node
+	sum     Digest   // Merkle hash of a map or list node
+	single  bool     // true if every key under a map node has the same hash
+}
+
+// digestModulus is the prime 2^3072 - 1103717 that defines the group used to
+// combine map entries. Products must not be modified once computed as they are
+// shared between cached digests.
+var digestModulus = func() *big.Int {
+	p := new(big.Int).Lsh(big.NewInt(1), 3072)
+	return p.Sub(p, big.NewInt(1103717))
+}()
+
+// digestElementSize is the size of a group element in bytes.
+const digestElementSize = 3072 / 8
+
+// add multiplies the product of d by the product of other.
+func (d *nodeDigest) add(other nodeDigest) {
+	switch {
+	case other.product == nil:
+	case d.product == nil:
+		d.product = other.product
+	default:
+		product := new(big.Int).Mul(d.product, other.product)
+		d.product = product.Mod(product, digestModulus)
+	}
+	d.count += other.count
+}
+
+// digest returns the SHA-256 of the fixed-size encoding of the product.
+// Returns a zero digest if there are no key/value pairs.
+func (d *nodeDigest) digest() Digest {
+	if d.product == nil {
+		return Digest{}
+	}
+	var buf [digestElementSize]byte
+	b := d.product.Bytes()
+	copy(buf[len(buf)-len(b):], b)
+	return sha256.Sum256(buf[:])
+}
+
+// digestCache holds the digest of a node once it has been computed. Nodes
+// may be shared between goroutines so the digest is accessed atomically.
+type digestCache struct {
+	p unsafe.Pointer // *nodeDigest
+}
+
+// load returns the cached digest. Returns nil if not yet computed.
+func (c *digestCache) load() *nodeDigest {
+	return (*nodeDigest)(atomic.LoadPointer(&c.p))
+}
+
+// store caches the digest.
+func (c *digestCache) store(d *nodeDigest) {
+	atomic.StorePointer(&c.p, unsafe.Pointer(d))
+}
+
+// mapNodeDigest returns the digest of n at the given shift, computing and
+// caching it if needed.
+//
+// The digest of a map node only depends on the key/value pairs under it so
+// the different node types produce the same digests for the same keys. A
+// single pair is a leaf and pairs with equal key hashes form a collision
+// leaf, even if the physical node is a branch. All other nodes are branches.
+func mapNodeDigest(n mapNode, shift uint, h Hasher) (nodeDigest, error) {
+	var cache *digestCache
+	switch n := n.(type) {
+	case *mapArrayNode:
+		cache = &n.digest
+	case *mapBitmapIndexedNode:
+		cache = &n.digest
+	case *mapHashArrayNode:
+		cache = &n.digest
+	case *mapValueNode:
+		cache = &n.digest
+	case *mapHashCollisionNode:
+		cache = &n.digest
+	}
+	if d := cache.load(); d != nil {
+		return *d, nil
+	}
+
+	var d nodeDigest
+	var err error
+	switch n := n.(type) {
+	case *mapArrayNode:
+		d, err = mapEntriesDigest(n.entries, n.keyHashes(h), shift)
+
+	case *mapBitmapIndexedNode:
+		var b mapBranchDigest
+		for seg, i := uint64(0), 0; seg < mapNodeSize; seg++ {
+			if n.bitmap&(uint32(1)<<seg) == 0 {
+				continue
+			}
+			other, err := mapNodeDigest(n.nodes[i], shift+mapNodeBits, h)
+			if err != nil {
+				return d, err
+			}
+			b.add(seg, other)
+			i++
+		}
+		d = b.digest()
+
+	case *mapHashArrayNode:
+		var b mapBranchDigest
+		for seg, child := range n.nodes {
+			if child == nil {
+				continue
+			}
+			other, err := mapNodeDigest(child, shift+mapNodeBits, h)
+			if err != nil {
+				return d, err
+			}
+			b.add(uint64(seg), other)
+		}
+		d = b.digest()
+
+	case *mapValueNode:
+		d, err = mapLeafDigest(n.key, n.value)
+
+	case *mapHashCollisionNode:
+		d, err = mapCollisionDigest(n.entries)
+	}
+	if err != nil {
+		return d, err
+	}
+
+	cache.store(&d)
+	return d, nil
+}
+
+// mapEntriesDigest returns the digest of the branch at the given shift that
+// holds entries, whose key hashes are in hashes. Used for array nodes which
+// store their entries without branches.
+func mapEntriesDigest(entries []mapEntry, hashes []uint64, shift uint) (nodeDigest, error) {
+	switch {
+	case len(entries) == 0:
+		return nodeDigest{}, nil
+	case len(entries) == 1:
+		return mapLeafDigest(entries[0].key, entries[0].value)
+	}
+
+	single := true
+	for _, hash := range hashes[1:] {
+		single = single && hash == hashes[0]
+	}
+	if single {
+		return mapCollisionDigest(entries)
+	}
+
+	var b mapBranchDigest
+	for seg := uint64(0); seg < mapNodeSize; seg++ {
+		var segEntries []mapEntry
+		var segHashes []uint64
+		for i, hash := range hashes {
+			if (hash>>shift)&mapNodeMask == seg {
+				segEntries, segHashes = append(segEntries, entries[i]), append(segHashes, hash)
+			}
+		}
+		if len(segEntries) == 0 {
+			continue
+		}
+
+		other, err := mapEntriesDigest(segEntries, segHashes, shift+mapNodeBits)
+		if err != nil {
+			return nodeDigest{}, err
+		}
+		b.add(seg, other)
+	}
+	return b.digest(), nil
+}
+
+// mapLeafDigest returns the digest of a single key/value pair.
+func mapLeafDigest(key, value interface{}) (nodeDigest, error) {
+	buf, err := appendDigestValue([]byte{blockTypeMapValue}, key)
+	if err != nil {
+		return nodeDigest{}, err
+	} else if buf, err = appendDigestValue(buf, value); err != nil {
+		return nodeDigest{}, err
+	}
+	return nodeDigest{sum: sha256.Sum256(buf), count: 1, single: true}, nil
+}
+
+// mapCollisionDigest returns the digest of entries whose keys have equal
+// hashes. Keys with equal hashes are only ordered if the hasher implements
+// Comparer so the leaf digests are sorted before they are combined.
+func mapCollisionDigest(entries []mapEntry) (nodeDigest, error) {
+	sums := make([]Digest, len(entries))
+	for i, entry := range entries {
+		d, err := mapLeafDigest(entry.key, entry.value)
+		if err != nil {
+			return nodeDigest{}, err
+		}
+		sums[i] = d.sum
+	}
+	sort.Slice(sums, func(i, j int) bool { return bytes.Compare(sums[i][:], sums[j][:]) < 0 })
+
+	buf := []byte{blockTypeMapHashCollision}
+	for _, sum := range sums {
+		buf = append(buf, sum[:]...)
+	}
+	return nodeDigest{sum: sha256.Sum256(buf), count: len(entries), single: true}, nil
+}
+
+// mapBranchDigest accumulates the child digests of a branch in a map's
+// Merkle tree. Children must be added in order of their hash segment.
+type mapBranchDigest struct {
+	buf   []byte
+	n     int        // number of non-empty children
+	count int        // number of key/value pairs under the branch
+	first nodeDigest // digest of the first child
+}
+
+// add appends the digest of the child at the given hash segment.
+func (b *mapBranchDigest) add(seg uint64, d nodeDigest) {
+	if d.count == 0 {
+		return
+	} else if b.n == 0 {
+		b.buf, b.first = []byte{blockTypeMapBitmapIndexed}, d
+	}
+	b.buf = append(append(b.buf, byte(seg)), d.sum[:]...)
+	b.n, b.count = b.n+1, b.count+d.count
+}
+
+// digest returns the digest of the branch. A branch with a single child whose
+// keys all have the same hash collapses into that child.
+func (b *mapBranchDigest) digest() nodeDigest {
+	switch {
+	case b.n == 0:
+		return nodeDigest{}
+	case b.n == 1 && b.first.single:
+		return b.first
+	}
+	return nodeDigest{sum: sha256.Sum256(b.buf), count: b.count}
+}
+
+// sortedMapNodeDigest returns the digest of n, computing and caching it if needed.
+func sortedMapNodeDigest(n sortedMapNode) (nodeDigest, error) {
+	switch n := n.(type) {
+	case *sortedMapBranchNode:
+		if d := n.digest.load(); d != nil {
+			return *d, nil
+		}
+
+		var d nodeDigest
+		for _, elem := range n.elems {
+			other, err := sortedMapNodeDigest(elem.node)
+			if err != nil {
+				return d, err
+			}
+			d.add(other)
+		}
+		n.digest.store(&d)
+		return d, nil
+
+	default:
+		leaf := n.(*sortedMapLeafNode)
+		if d := leaf.digest.load(); d != nil {
+			return *d, nil
+		}
+
+		var d nodeDigest
+		if err := d.addEntries(leaf.entries); err != nil {
+			return d, err
+		}
+		leaf.digest.store(&d)
+		return d, nil
+	}
+}
+
+// addEntries multiplies the element of each key/value pair into d.
+func (d *nodeDigest) addEntries(entries []mapEntry) error {
+	for _, entry := range entries {
+		elem, err := entryElement(entry.key, entry.value)
+		if err != nil {
+			return err
+		}
+		d.add(nodeDigest{product: elem, count: 1})
+	}
+	return nil
+}
+
+// listDigestWriter builds the Merkle tree of a list's elements in logical
+// index order. Each level holds the pending children of the rightmost node at
+// that height: element encodings at level zero and child digests above.
+type listDigestWriter struct {
+	origin int // physical index of the first element
+	size   int // number of elements
+	levels []listDigestLevel
+}
+
+// listDigestLevel holds the pending children of a node in the Merkle tree.
+type listDigestLevel struct {
+	buf []byte
+	n   int
+}
+
+// push appends data as the next child at the given level. Full nodes are
+// hashed and pushed to the level above.
+func (w *listDigestWriter) push(level int, data []byte) {
+	for len(w.levels) <= level {
+		w.levels = append(w.levels, listDigestLevel{})
+	}
+
+	lvl := &w.levels[level]
+	if lvl.n == 0 {
+		lvl.buf = listDigestHeader(lvl.buf[:0], level)
+	}
+	lvl.buf = append(lvl.buf, data...)
+	if lvl.n++; lvl.n == listNodeSize {
+		sum := sha256.Sum256(lvl.buf)
+		lvl.n = 0
+		w.push(level+1, sum[:])
+	}
+}
+
+// root hashes the remaining partial nodes and returns the root of the tree.
+func (w *listDigestWriter) root() Digest {
+	for level := 0; level < len(w.levels); level++ {
+		lvl := &w.levels[level]
+		if lvl.n == 0 {
+			continue
+		}
+
+		// A single digest at the top of the tree is the root.
+		if level == len(w.levels)-1 && level > 0 && lvl.n == 1 {
+			var d Digest
+			copy(d[:], lvl.buf[len(lvl.buf)-len(d):])
+			return d
+		}
+
+		sum := sha256.Sum256(lvl.buf)
+		lvl.n = 0
+		w.push(level+1, sum[:])
+	}
+	return Digest{}
+}
+
+// writeNode pushes the elements of n that are in the list. The physical
+// index of the first slot in n is base.
+func (w *listDigestWriter) writeNode(n listNode, base int) error {
+	depth := n.depth()
+	span := 1 << ((depth + 1) * listNodeBits)
+	if base+span <= w.origin || base >= w.origin+w.size {
+		return nil
+	}
+
+	// Reuse the node's digest if it is a complete node of the Merkle tree.
+	if base >= w.origin && base+span <= w.origin+w.size && (base-w.origin)%span == 0 {
+		sum, err := listNodeDigest(n)
+		if err != nil {
+			return err
+		}
+		w.push(int(depth)+1, sum[:])
+		return nil
+	}
+
+	switch n := n.(type) {
+	case *listBranchNode:
+		childSpan := span >> listNodeBits
+		for i, child := range n.children {
+			if child == nil {
+				continue
+			} else if err := w.writeNode(child, base+i*childSpan); err != nil {
+				return err
+			}
+		}
+
+	case *listLeafNode:
+		for i, v := range n.children {
+			if index := base + i; index < w.origin || index >= w.origin+w.size {
+				continue
+			}
+			buf, err := appendDigestValue(nil, v)
+			if err != nil {
+				return err
+			}
+			w.push(0, buf)
+		}
+	}
+	return nil
+}
+
+// listDigestHeader appends the header of a Merkle tree node at level. Leaves
+// are at level zero.
+func listDigestHeader(dst []byte, level int) []byte {
+	if level == 0 {
+		return append(dst, blockTypeListLeaf)
+	}
+	return appendUvarint(append(dst, blockTypeListBranch), uint64(level))
+}
+
+// listNodeDigest returns the digest of a complete node, computing and caching
+// it if needed. The digest matches the Merkle tree node computed by
+// listDigestWriter for the same elements.
+func listNodeDigest(n listNode) (Digest, error) {
+	var cache *digestCache
+	var buf []byte
+	switch n := n.(type) {
+	case *listBranchNode:
+		cache = &n.digest
+		if d := cache.load(); d != nil {
+			return d.sum, nil
+		}
+
+		buf = listDigestHeader(nil, int(n.d))
+		for _, child := range n.children {
+			sum, err := listNodeDigest(child)
+			if err != nil {
+				return Digest{}, err
+			}
+			buf = append(buf, sum[:]...)
+		}
+
+	case *listLeafNode:
+		cache = &n.digest
+		if d := cache.load(); d != nil {
+			return d.sum, nil
+		}
+
+		buf = listDigestHeader(nil, 0)
+		for _, v := range n.children {
+			var err error
+			if buf, err = appendDigestValue(buf, v); err != nil {
+				return Digest{}, err
+			}
+		}
+	}
+
+	d := &nodeDigest{sum: sha256.Sum256(buf)}
+	cache.store(d)
+	return d.sum, nil
+}
+
+// entryDigest returns the SHA-256 of the encoding of a single key/value pair.
+func entryDigest(key, value interface{}) (Digest, error) {
+	buf, err := appendDigestValue(nil, key)
+	if err != nil {
+		return Digest{}, err
+	} else if buf, err = appendDigestValue(buf, value); err != nil {
+		return Digest{}, err
+	}
+	return sha256.Sum256(buf), nil
+}
+
+// entryElement returns the group element of a single key/value pair. The
+// pair's digest keys an AES-CTR stream which is expanded to the size of the
+// modulus.
+func entryElement(key, value interface{}) (*big.Int, error) {
+	seed, err := entryDigest(key, value)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(seed[:])
+	if err != nil {
+		return nil, err
+	}
+	var iv [aes.BlockSize]byte
+	var stream [digestElementSize]byte
+	cipher.NewCTR(block, iv[:]).XORKeyStream(stream[:], stream[:])
+
+	// Zero has no inverse in the group. It occurs with negligible probability.
+	elem := new(big.Int).SetBytes(stream[:])
+	if elem.Mod(elem, digestModulus).Sign() == 0 {
+		elem.SetInt64(1)
+	}
+	return elem, nil
+}
+
+// digestTagNested prefixes the digest of a nested collection.
+const digestTagNested = 0xFF
+
+// appendDigestValue appends the encoding of v used for computing digests.
+func appendDigestValue(dst []byte, v interface{}) ([]byte, error) {
+	if v, ok := v.(digester); ok {
+		sum, err := v.Digest()
+		if err != nil {
+			return dst, err
+		}
+		return append(append(dst, digestTagNested), sum[:]...), nil
+	}
+	return DefaultCodec.AppendValue(dst, v)
+}
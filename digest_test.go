@@ -0,0 +1,260 @@
+package immutable
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func TestMap_Digest(t *testing.T) {
+	t.Run("Empty", func(t *testing.T) {
+		if d, err := NewMap(nil).Digest(); err != nil {
+			t.Fatal(err)
+		} else if d != (Digest{}) {
+			t.Fatalf("unexpected digest: %s", d)
+		}
+	})
+
+	t.Run("Changed", func(t *testing.T) {
+		m0 := NewMap(nil).Set("foo", 1).Set("bar", 2)
+		m1 := m0.Set("foo", 3)
+		d0 := mustMapDigest(t, m0)
+		if d1 := mustMapDigest(t, m1); d0 == d1 {
+			t.Fatal("expected different digest")
+		} else if d2 := mustMapDigest(t, m1.Set("foo", 1)); d0 != d2 {
+			t.Fatal("expected equal digest")
+		}
+	})
+
+	t.Run("Nested", func(t *testing.T) {
+		m0 := NewMap(nil).Set("foo", NewSortedMap(nil).Set(1, "a"))
+		m1 := NewMap(nil).Set("foo", NewSortedMap(nil).Set(1, "a"))
+		m2 := NewMap(nil).Set("foo", NewSortedMap(nil).Set(1, "b"))
+		if mustMapDigest(t, m0) != mustMapDigest(t, m1) {
+			t.Fatal("expected equal digest")
+		} else if mustMapDigest(t, m0) == mustMapDigest(t, m2) {
+			t.Fatal("expected different digest")
+		}
+	})
+
+	// Ensure the digest does not depend on the type of the nodes holding keys.
+	t.Run("Layout", func(t *testing.T) {
+		a, b := NewMap(nil), NewMap(nil)
+		for i := 0; i < 20; i++ {
+			b = b.Set(i, i)
+		}
+		for i := 0; i < maxArrayMapSize; i++ {
+			a, b = a.Set(i, i), b.Delete(i+maxArrayMapSize)
+		}
+		for i := 2 * maxArrayMapSize; i < 20; i++ {
+			b = b.Delete(i)
+		}
+
+		if _, ok := a.root.(*mapArrayNode); !ok {
+			t.Fatalf("unexpected root: %T", a.root)
+		} else if _, ok := b.root.(*mapArrayNode); ok {
+			t.Fatalf("unexpected root: %T", b.root)
+		} else if da, db := mustMapDigest(t, a), mustMapDigest(t, b); da != db {
+			t.Fatalf("digest mismatch: %s != %s", da, db)
+		}
+	})
+
+	// Ensure maps that differ by one key only differ in one subtree.
+	t.Run("Subtrees", func(t *testing.T) {
+		m0 := NewMap(nil)
+		for i := 0; i < 1000; i++ {
+			m0 = m0.Set(i, i)
+		}
+		m1 := m0.Set(500, -1)
+
+		root0, ok0 := m0.root.(*mapHashArrayNode)
+		root1, ok1 := m1.root.(*mapHashArrayNode)
+		if !ok0 || !ok1 {
+			t.Fatalf("unexpected roots: %T, %T", m0.root, m1.root)
+		}
+		var n int
+		for i := range root0.nodes {
+			d0, err := mapNodeDigest(root0.nodes[i], mapNodeBits, m0.hasher)
+			if err != nil {
+				t.Fatal(err)
+			}
+			d1, err := mapNodeDigest(root1.nodes[i], mapNodeBits, m1.hasher)
+			if err != nil {
+				t.Fatal(err)
+			} else if d0.sum != d1.sum {
+				n++
+			}
+		}
+		if n != 1 {
+			t.Fatalf("unexpected changed subtrees: %d", n)
+		}
+	})
+
+	t.Run("ErrUnsupportedType", func(t *testing.T) {
+		m := NewMap(nil).Set("foo", struct{}{})
+		if _, err := m.Digest(); err == nil || err.Error() != `immutable.DefaultCodec: unsupported type struct {}` {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	// Ensure maps with the same contents have the same digest regardless of
+	// the order of insertion and deletion.
+	RunRandom(t, "Random", func(t *testing.T, rand *rand.Rand) {
+		h := &mockHasher{
+			hash:  func(value interface{}) uint32 { return hashUint64(uint64(value.(int))) % 0x3FF },
+			equal: func(a, b interface{}) bool { return a.(int) == b.(int) },
+		}
+
+		a, b := NewMap(h), NewMap(h)
+		keys := rand.Perm(2000)
+		for _, k := range keys {
+			a = a.Set(k, k*2)
+		}
+		for i := len(keys) - 1; i >= 0; i-- {
+			b = b.Set(keys[i], -1)
+		}
+
+		// Compute an intermediate digest to ensure the cache is not reused.
+		mustMapDigest(t, b)
+		for _, k := range keys {
+			b = b.Set(k, k*2)
+		}
+		for i := 0; i < 100; i++ {
+			k := rand.Intn(3000)
+			a, b = a.Delete(k), b.Delete(k)
+		}
+
+		if da, db := mustMapDigest(t, a), mustMapDigest(t, b); da != db {
+			t.Fatalf("digest mismatch: %s != %s", da, db)
+		}
+	})
+}
+
+func TestSortedMap_Digest(t *testing.T) {
+	a, b := NewSortedMap(nil), NewSortedMap(nil)
+	for i := 0; i < 1000; i++ {
+		a = a.Set(i, fmt.Sprint(i))
+	}
+	for i := 1999; i >= 0; i-- {
+		b = b.Set(i, fmt.Sprint(i))
+	}
+	mustSortedMapDigest(t, b)
+	for i := 1000; i < 2000; i++ {
+		b = b.Delete(i)
+	}
+
+	if da, db := mustSortedMapDigest(t, a), mustSortedMapDigest(t, b); da != db {
+		t.Fatalf("digest mismatch: %s != %s", da, db)
+	} else if dc := mustSortedMapDigest(t, b.Set(500, "foo")); da == dc {
+		t.Fatal("expected different digest")
+	}
+}
+
+func TestList_Digest(t *testing.T) {
+	a, b := NewList(), NewList()
+	for i := 0; i < 2000; i++ {
+		a, b = a.Append(i), b.Append(i)
+	}
+
+	da := mustListDigest(t, a)
+	if db := mustListDigest(t, b); da != db {
+		t.Fatalf("digest mismatch: %s != %s", da, db)
+	}
+
+	// Ensure an updated list does not reuse the cached digest.
+	if dc := mustListDigest(t, a.Set(1000, "foo")); da == dc {
+		t.Fatal("expected different digest")
+	} else if dc := mustListDigest(t, a.Slice(0, 1999)); da == dc {
+		t.Fatal("expected different digest")
+	} else if dc := mustListDigest(t, a.Set(1000, "foo").Set(1000, 1000)); da != dc {
+		t.Fatal("expected equal digest")
+	}
+
+	t.Run("Layout", func(t *testing.T) {
+		for _, n := range []int{0, 1, 31, 32, 33, 1023, 1024, 1025, 2000} {
+			appended, prepended := NewList(), NewList()
+			for i := 0; i < n; i++ {
+				appended = appended.Append(i)
+				prepended = prepended.Prepend(n - i - 1)
+			}
+			want := mustListDigest(t, appended)
+			if got := mustListDigest(t, prepended); got != want {
+				t.Fatalf("n=%d: prepended digest mismatch: %s != %s", n, got, want)
+			}
+
+			// Slicing a longer list changes its origin but not its elements.
+			sliced := appended.Prepend(-1).Append(n).Slice(1, n+1)
+			if got := mustListDigest(t, sliced); got != want {
+				t.Fatalf("n=%d: sliced digest mismatch: %s != %s", n, got, want)
+			}
+		}
+	})
+}
+
+func mustMapDigest(tb testing.TB, m *Map) Digest {
+	tb.Helper()
+	d, err := m.Digest()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return d
+}
+
+func mustSortedMapDigest(tb testing.TB, m *SortedMap) Digest {
+	tb.Helper()
+	d, err := m.Digest()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return d
+}
+
+func mustListDigest(tb testing.TB, l *List) Digest {
+	tb.Helper()
+	d, err := l.Digest()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return d
+}
+
+func BenchmarkMap_Digest(b *testing.B) {
+	m := NewMap(nil)
+	for i := 0; i < 100000; i++ {
+		m = m.Set(i, i)
+	}
+	mustMapDigest(b, m)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m = m.Set(i%100000, i)
+		mustMapDigest(b, m)
+	}
+}
+
+func BenchmarkSortedMap_Digest(b *testing.B) {
+	m := NewSortedMap(nil)
+	for i := 0; i < 100000; i++ {
+		m = m.Set(i, i)
+	}
+	mustSortedMapDigest(b, m)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m = m.Set(i%100000, i)
+		mustSortedMapDigest(b, m)
+	}
+}
+
+func ExampleMap_Digest() {
+	a := NewMap(nil).Set("foo", 1).Set("bar", 2)
+	b := NewMap(nil).Set("bar", 2).Set("foo", 1)
+
+	da, _ := a.Digest()
+	db, _ := b.Digest()
+	fmt.Println(da == db)
+	// Output:
+	// true
+}
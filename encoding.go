@@ -0,0 +1,850 @@
+package immutable
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"math/bits"
+	"sync"
+)
+
+// ErrBlockNotFound is returned by a BlockStore when a block does not exist.
+var ErrBlockNotFound = errors.New("immutable: block not found")
+
+// BlockID is the SHA-256 hash of an encoded block.
+type BlockID [sha256.Size]byte
+
+// String returns the hex representation of the identifier.
+func (id BlockID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// BlockStore represents content-addressed storage for encoded nodes.
+type BlockStore interface {
+	// Returns the data for a block. Returns ErrBlockNotFound if the block
+	// does not exist.
+	Get(id BlockID) ([]byte, error)
+
+	// Stores the data for a block.
+	Put(id BlockID, data []byte) error
+
+	// Returns true if the block exists.
+	Has(id BlockID) (bool, error)
+}
+
+// MemBlockStore is an in-memory implementation of BlockStore.
+type MemBlockStore struct {
+	mu     sync.RWMutex
+	blocks map[BlockID][]byte
+}
+
+// NewMemBlockStore returns a new, empty instance of MemBlockStore.
+func NewMemBlockStore() *MemBlockStore {
+	return &MemBlockStore{blocks: make(map[BlockID][]byte)}
+}
+
+// Len returns the number of blocks in the store.
+func (s *MemBlockStore) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.blocks)
+}
+
+// Get returns the data for a block.
+func (s *MemBlockStore) Get(id BlockID) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	data, ok := s.blocks[id]
+	if !ok {
+		return nil, ErrBlockNotFound
+	}
+	return data, nil
+}
+
+// Put stores the data for a block.
+func (s *MemBlockStore) Put(id BlockID, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.blocks[id] = data
+	return nil
+}
+
+// Has returns true if the block exists.
+func (s *MemBlockStore) Has(id BlockID) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.blocks[id]
+	return ok, nil
+}
+
+// Codec encodes and decodes the keys and values stored within nodes.
+type Codec interface {
+	// Appends the encoded form of v to dst and returns the extended buffer.
+	AppendValue(dst []byte, v interface{}) ([]byte, error)
+
+	// Decodes a value from the beginning of src. Returns the value and the
+	// number of bytes read.
+	ReadValue(src []byte) (v interface{}, n int, err error)
+}
+
+// DefaultCodec is the Codec used when none is specified. It supports nil,
+// bool, int, int64, uint64, float64, string, and []byte values.
+var DefaultCodec Codec = defaultCodec{}
+
+// Value type tags used by the default codec.
+const (
+	codecNil = iota
+	codecFalse
+	codecTrue
+	codecInt
+	codecInt64
+	codecUint64
+	codecFloat64
+	codecString
+	codecBytes
+)
+
+// defaultCodec implements Codec for common primitive types.
+type defaultCodec struct{}
+
+// AppendValue appends the encoded form of v to dst.
+func (defaultCodec) AppendValue(dst []byte, v interface{}) ([]byte, error) {
+	switch v := v.(type) {
+	case nil:
+		return append(dst, codecNil), nil
+	case bool:
+		if v {
+			return append(dst, codecTrue), nil
+		}
+		return append(dst, codecFalse), nil
+	case int:
+		return appendVarint(append(dst, codecInt), int64(v)), nil
+	case int64:
+		return appendVarint(append(dst, codecInt64), v), nil
+	case uint64:
+		return appendUvarint(append(dst, codecUint64), v), nil
+	case float64:
+		var buf [8]byte
+		binary.BigEndian.PutUint64(buf[:], math.Float64bits(v))
+		return append(append(dst, codecFloat64), buf[:]...), nil
+	case string:
+		dst = appendUvarint(append(dst, codecString), uint64(len(v)))
+		return append(dst, v...), nil
+	case []byte:
+		dst = appendUvarint(append(dst, codecBytes), uint64(len(v)))
+		return append(dst, v...), nil
+	default:
+		return dst, fmt.Errorf("immutable.DefaultCodec: unsupported type %T", v)
+	}
+}
+
+// ReadValue decodes a value from the beginning of src.
+func (defaultCodec) ReadValue(src []byte) (v interface{}, n int, err error) {
+	if len(src) == 0 {
+		return nil, 0, errors.New("immutable.DefaultCodec: unexpected end of data")
+	}
+
+	switch src[0] {
+	case codecNil:
+		return nil, 1, nil
+	case codecFalse:
+		return false, 1, nil
+	case codecTrue:
+		return true, 1, nil
+	case codecInt, codecInt64:
+		x, sz := binary.Varint(src[1:])
+		if sz <= 0 {
+			return nil, 0, errors.New("immutable.DefaultCodec: invalid varint")
+		} else if src[0] == codecInt {
+			return int(x), 1 + sz, nil
+		}
+		return x, 1 + sz, nil
+	case codecUint64:
+		x, sz := binary.Uvarint(src[1:])
+		if sz <= 0 {
+			return nil, 0, errors.New("immutable.DefaultCodec: invalid uvarint")
+		}
+		return x, 1 + sz, nil
+	case codecFloat64:
+		if len(src) < 9 {
+			return nil, 0, errors.New("immutable.DefaultCodec: unexpected end of data")
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(src[1:9])), 9, nil
+	case codecString, codecBytes:
+		x, sz := binary.Uvarint(src[1:])
+		if sz <= 0 || uint64(len(src)-1-sz) < x {
+			return nil, 0, errors.New("immutable.DefaultCodec: unexpected end of data")
+		}
+		data := src[1+sz : 1+sz+int(x)]
+		if src[0] == codecString {
+			return string(data), 1 + sz + int(x), nil
+		}
+		return append([]byte{}, data...), 1 + sz + int(x), nil
+	default:
+		return nil, 0, fmt.Errorf("immutable.DefaultCodec: unknown type tag %d", src[0])
+	}
+}
+
+// Block types. Each encoded block begins with one of these values.
+const (
+	blockTypeList = iota + 1
+	blockTypeMap
+	blockTypeSortedMap
+	blockTypeListBranch
+	blockTypeListLeaf
+	blockTypeMapArray
+	blockTypeMapBitmapIndexed
+	blockTypeMapHashArray
+	blockTypeMapValue
+	blockTypeMapHashCollision
+	blockTypeSortedMapBranch
+	blockTypeSortedMapLeaf
+)
+
+// Encoder writes collections to a BlockStore. Each node is written as a
+// separate block addressed by the hash of its contents so nodes shared
+// between versions of a collection are only stored once.
+//
+// The encoder remembers the identifier of every node it has encoded so
+// encoding a new version of a collection only encodes the nodes that have
+// changed since a previous version. Because this retains every encoded node
+// in memory, an encoder should be discarded once it is no longer needed.
+type Encoder struct {
+	store BlockStore
+	codec Codec
+	ids   map[interface{}]BlockID // identifiers of encoded nodes
+}
+
+// NewEncoder returns a new encoder that writes to store. If codec is nil then
+// DefaultCodec is used to encode keys and values.
+func NewEncoder(store BlockStore, codec Codec) *Encoder {
+	if codec == nil {
+		codec = DefaultCodec
+	}
+	return &Encoder{
+		store: store,
+		codec: codec,
+		ids:   make(map[interface{}]BlockID),
+	}
+}
+
+// EncodeList writes l to the store and returns the identifier of its root block.
+func (e *Encoder) EncodeList(l *List) (BlockID, error) {
+	rootID, err := e.encodeListNode(l.root)
+	if err != nil {
+		return BlockID{}, err
+	}
+
+	buf := []byte{blockTypeList}
+	buf = appendUvarint(buf, uint64(l.origin))
+	buf = appendUvarint(buf, uint64(l.size))
+	buf = append(buf, rootID[:]...)
+	return e.write(buf)
+}
+
+// EncodeMap writes m to the store and returns the identifier of its root block.
+//
+// The hasher seed is not written. The tree shape still depends on the hashes
+// of the keys so encoded maps should not be shared with untrusted parties
+// that could use it to find colliding keys.
+func (e *Encoder) EncodeMap(m *Map) (BlockID, error) {
+	buf := []byte{blockTypeMap}
+	buf = appendUvarint(buf, uint64(m.size))
+	buf = appendString(buf, typeName(m.hasher))
+	buf = appendUvarint(buf, hasherSeedCheck(m.hasher))
+	if m.root != nil {
+		rootID, err := e.encodeMapNode(m.root)
+		if err != nil {
+			return BlockID{}, err
+		}
+		buf = append(buf, rootID[:]...)
+	}
+	return e.write(buf)
+}
+
+// EncodeSortedMap writes m to the store and returns the identifier of its root block.
+func (e *Encoder) EncodeSortedMap(m *SortedMap) (BlockID, error) {
+	buf := []byte{blockTypeSortedMap}
+	buf = appendUvarint(buf, uint64(m.size))
+	buf = appendString(buf, typeName(m.comparer))
+	if m.root != nil {
+		rootID, err := e.encodeSortedMapNode(m.root)
+		if err != nil {
+			return BlockID{}, err
+		}
+		buf = append(buf, rootID[:]...)
+	}
+	return e.write(buf)
+}
+
+// encodeListNode recursively writes n and its children to the store.
+func (e *Encoder) encodeListNode(n listNode) (BlockID, error) {
+	if id, ok := e.ids[n]; ok {
+		return id, nil
+	}
+
+	var buf []byte
+	var err error
+	switch n := n.(type) {
+	case *listBranchNode:
+		buf = appendUvarint([]byte{blockTypeListBranch}, uint64(n.d))
+		for _, child := range n.children {
+			if buf, err = e.appendChild(buf, child); err != nil {
+				return BlockID{}, err
+			}
+		}
+	case *listLeafNode:
+		buf = []byte{blockTypeListLeaf}
+		for _, v := range n.children {
+			if buf, err = e.codec.AppendValue(buf, v); err != nil {
+				return BlockID{}, err
+			}
+		}
+	}
+	return e.writeNode(n, buf)
+}
+
+// encodeMapNode recursively writes n and its children to the store.
+func (e *Encoder) encodeMapNode(n mapNode) (BlockID, error) {
+	if id, ok := e.ids[n]; ok {
+		return id, nil
+	}
+
+	var buf []byte
+	var err error
+	switch n := n.(type) {
+	case *mapArrayNode:
+		buf = appendUvarint([]byte{blockTypeMapArray}, uint64(len(n.entries)))
+		if buf, err = e.appendEntries(buf, n.entries); err != nil {
+			return BlockID{}, err
+		}
+	case *mapBitmapIndexedNode:
+		buf = appendUvarint([]byte{blockTypeMapBitmapIndexed}, uint64(n.bitmap))
+		for _, child := range n.nodes {
+			if buf, err = e.appendChild(buf, child); err != nil {
+				return BlockID{}, err
+			}
+		}
+	case *mapHashArrayNode:
+		buf = []byte{blockTypeMapHashArray}
+		for _, child := range n.nodes {
+			if buf, err = e.appendChild(buf, child); err != nil {
+				return BlockID{}, err
+			}
+		}
+	case *mapValueNode:
+		buf = appendUvarint([]byte{blockTypeMapValue}, n.keyHash)
+		if buf, err = e.appendEntries(buf, []mapEntry{{key: n.key, value: n.value}}); err != nil {
+			return BlockID{}, err
+		}
+	case *mapHashCollisionNode:
+		buf = appendUvarint([]byte{blockTypeMapHashCollision}, n.keyHash)
+		buf = appendUvarint(buf, uint64(len(n.entries)))
+		if buf, err = e.appendEntries(buf, n.entries); err != nil {
+			return BlockID{}, err
+		}
+	}
+	return e.writeNode(n, buf)
+}
+
+// encodeSortedMapNode recursively writes n and its children to the store.
+func (e *Encoder) encodeSortedMapNode(n sortedMapNode) (BlockID, error) {
+	if id, ok := e.ids[n]; ok {
+		return id, nil
+	}
+
+	var buf []byte
+	var err error
+	switch n := n.(type) {
+	case *sortedMapBranchNode:
+		buf = appendUvarint([]byte{blockTypeSortedMapBranch}, uint64(len(n.elems)))
+		for _, elem := range n.elems {
+			if buf, err = e.codec.AppendValue(buf, elem.key); err != nil {
+				return BlockID{}, err
+			}
+			id, err := e.encodeSortedMapNode(elem.node)
+			if err != nil {
+				return BlockID{}, err
+			}
+			buf = append(buf, id[:]...)
+		}
+	case *sortedMapLeafNode:
+		buf = appendUvarint([]byte{blockTypeSortedMapLeaf}, uint64(len(n.entries)))
+		if buf, err = e.appendEntries(buf, n.entries); err != nil {
+			return BlockID{}, err
+		}
+	}
+	return e.writeNode(n, buf)
+}
+
+// appendChild encodes child and appends a presence flag and its identifier.
+// Child must be nil, a list node, or a map node.
+func (e *Encoder) appendChild(buf []byte, child interface{}) ([]byte, error) {
+	var id BlockID
+	var err error
+	switch child := child.(type) {
+	case nil:
+		return append(buf, 0), nil
+	case listNode:
+		id, err = e.encodeListNode(child)
+	case mapNode:
+		id, err = e.encodeMapNode(child)
+	}
+	if err != nil {
+		return buf, err
+	}
+	return append(append(buf, 1), id[:]...), nil
+}
+
+// appendEntries appends the key & value of each entry to buf.
+func (e *Encoder) appendEntries(buf []byte, entries []mapEntry) (_ []byte, err error) {
+	for _, entry := range entries {
+		if buf, err = e.codec.AppendValue(buf, entry.key); err != nil {
+			return buf, err
+		} else if buf, err = e.codec.AppendValue(buf, entry.value); err != nil {
+			return buf, err
+		}
+	}
+	return buf, nil
+}
+
+// writeNode writes the encoded node to the store and caches its identifier.
+func (e *Encoder) writeNode(n interface{}, buf []byte) (BlockID, error) {
+	id, err := e.write(buf)
+	if err != nil {
+		return id, err
+	}
+	e.ids[n] = id
+	return id, nil
+}
+
+// write writes buf to the store if a block with the same content does not
+// already exist. Returns the identifier of the block.
+func (e *Encoder) write(buf []byte) (BlockID, error) {
+	id := BlockID(sha256.Sum256(buf))
+	if ok, err := e.store.Has(id); err != nil {
+		return id, err
+	} else if ok {
+		return id, nil
+	}
+	return id, e.store.Put(id, buf)
+}
+
+// Decoder reads collections written by an Encoder from a BlockStore.
+//
+// The decoder remembers every node it has decoded so decoding several versions
+// of a collection returns collections that share nodes in memory in the same
+// way as the versions that were encoded.
+type Decoder struct {
+	store BlockStore
+	codec Codec
+	nodes map[BlockID]interface{} // decoded nodes
+}
+
+// NewDecoder returns a new decoder that reads from store. If codec is nil then
+// DefaultCodec is used to decode keys and values.
+func NewDecoder(store BlockStore, codec Codec) *Decoder {
+	if codec == nil {
+		codec = DefaultCodec
+	}
+	return &Decoder{
+		store: store,
+		codec: codec,
+		nodes: make(map[BlockID]interface{}),
+	}
+}
+
+// DecodeList reads the list with the given root block identifier.
+func (d *Decoder) DecodeList(id BlockID) (*List, error) {
+	r, err := d.read(id, blockTypeList)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &List{origin: int(r.uvarint()), size: int(r.uvarint())}
+	rootID := r.id()
+	if err := r.close(); err != nil {
+		return nil, err
+	} else if l.root, err = d.decodeListNode(rootID); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// DecodeMap reads the map with the given root block identifier. If hasher is
+// nil then the built-in hasher for the first key is used with the default
+// seed. If the map was encoded with a different seed then its keys are
+// rehashed, which requires inserting every key into a new map. Returns an
+// error if hasher is a different type than the encoded hasher.
+func (d *Decoder) DecodeMap(id BlockID, hasher Hasher) (*Map, error) {
+	r, err := d.read(id, blockTypeMap)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Map{size: int(r.uvarint()), hasher: hasher}
+	name, check := r.string(), r.uvarint()
+	if r.remaining() == 0 {
+		return m, r.close()
+	}
+	rootID := r.id()
+	if err := r.close(); err != nil {
+		return nil, err
+	} else if m.root, err = d.decodeMapNode(rootID); err != nil {
+		return nil, err
+	}
+
+	// Restore the built-in hasher for the first key if none is provided.
+	if m.hasher == nil {
+		key, _ := m.Iterator().Next()
+		m.hasher = defaultHasher(key)
+	}
+	if typeName(m.hasher) != name {
+		return nil, fmt.Errorf("immutable.Decoder.DecodeMap: hasher mismatch: encoded with %s", name)
+	} else if hasherSeedCheck(m.hasher) != check {
+		return rehashMap(m), nil
+	}
+	return m, nil
+}
+
+// rehashMap returns a copy of m with every key inserted using m's hasher. Used
+// when m's nodes were built with a different seed.
+func rehashMap(m *Map) *Map {
+	entries := make([]MapEntry, 0, m.Len())
+	for itr := m.Iterator(); !itr.Done(); {
+		k, v := itr.Next()
+		entries = append(entries, MapEntry{Key: k, Value: v})
+	}
+	return NewMap(m.hasher).SetMany(entries)
+}
+
+// DecodeSortedMap reads the sorted map with the given root block identifier.
+// If comparer is nil then the built-in comparer used when the map was encoded
+// is restored. Returns an error if comparer is a different type than the
+// encoded comparer.
+func (d *Decoder) DecodeSortedMap(id BlockID, comparer Comparer) (*SortedMap, error) {
+	r, err := d.read(id, blockTypeSortedMap)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &SortedMap{size: int(r.uvarint()), comparer: comparer}
+	name := r.string()
+	if r.remaining() == 0 {
+		return m, r.close()
+	}
+	rootID := r.id()
+	if err := r.close(); err != nil {
+		return nil, err
+	} else if m.root, err = d.decodeSortedMapNode(rootID); err != nil {
+		return nil, err
+	}
+
+	// Restore the built-in comparer for the first key if none is provided.
+	if m.comparer == nil {
+		m.comparer = defaultComparer(m.root.minKey())
+	}
+	if typeName(m.comparer) != name {
+		return nil, fmt.Errorf("immutable.Decoder.DecodeSortedMap: comparer mismatch: encoded with %s", name)
+	}
+	return m, nil
+}
+
+// decodeListNode recursively reads the list node with the given identifier.
+func (d *Decoder) decodeListNode(id BlockID) (listNode, error) {
+	if n, ok := d.nodes[id]; ok {
+		return n.(listNode), nil
+	}
+
+	r, err := d.read(id, blockTypeListBranch, blockTypeListLeaf)
+	if err != nil {
+		return nil, err
+	}
+
+	var n listNode
+	switch r.typ {
+	case blockTypeListBranch:
+		branch := &listBranchNode{d: uint(r.uvarint())}
+		for i := range branch.children {
+			if childID, ok := r.child(); ok {
+				if branch.children[i], err = d.decodeListNode(childID); err != nil {
+					return nil, err
+				}
+			}
+		}
+		n = branch
+	case blockTypeListLeaf:
+		leaf := &listLeafNode{}
+		for i := range leaf.children {
+			leaf.children[i] = r.value()
+		}
+		n = leaf
+	}
+
+	if err := r.close(); err != nil {
+		return nil, err
+	}
+	d.nodes[id] = n
+	return n, nil
+}
+
+// decodeMapNode recursively reads the map node with the given identifier.
+func (d *Decoder) decodeMapNode(id BlockID) (mapNode, error) {
+	if n, ok := d.nodes[id]; ok {
+		return n.(mapNode), nil
+	}
+
+	r, err := d.read(id, blockTypeMapArray, blockTypeMapBitmapIndexed, blockTypeMapHashArray, blockTypeMapValue, blockTypeMapHashCollision)
+	if err != nil {
+		return nil, err
+	}
+
+	var n mapNode
+	switch r.typ {
+	case blockTypeMapArray:
+		n = &mapArrayNode{entries: r.entries()}
+	case blockTypeMapBitmapIndexed:
+		bitmap := uint32(r.uvarint())
+		node := &mapBitmapIndexedNode{bitmap: bitmap, nodes: make([]mapNode, bits.OnesCount32(bitmap))}
+		for i := range node.nodes {
+			childID, ok := r.child()
+			if !ok {
+				return nil, fmt.Errorf("immutable.Decoder: missing child in block %s", id)
+			} else if node.nodes[i], err = d.decodeMapNode(childID); err != nil {
+				return nil, err
+			}
+		}
+		n = node
+	case blockTypeMapHashArray:
+		node := &mapHashArrayNode{}
+		for i := range node.nodes {
+			if childID, ok := r.child(); ok {
+				if node.nodes[i], err = d.decodeMapNode(childID); err != nil {
+					return nil, err
+				}
+				node.count++
+			}
+		}
+		n = node
+	case blockTypeMapValue:
+		keyHash := r.uvarint()
+		key, value := r.value(), r.value()
+		n = &mapValueNode{keyHash: keyHash, key: key, value: value}
+	case blockTypeMapHashCollision:
+		keyHash := r.uvarint()
+		n = &mapHashCollisionNode{keyHash: keyHash, entries: r.entries()}
+	}
+
+	if err := r.close(); err != nil {
+		return nil, err
+	}
+	d.nodes[id] = n
+	return n, nil
+}
+
+// decodeSortedMapNode recursively reads the sorted map node with the given identifier.
+func (d *Decoder) decodeSortedMapNode(id BlockID) (sortedMapNode, error) {
+	if n, ok := d.nodes[id]; ok {
+		return n.(sortedMapNode), nil
+	}
+
+	r, err := d.read(id, blockTypeSortedMapBranch, blockTypeSortedMapLeaf)
+	if err != nil {
+		return nil, err
+	}
+
+	var n sortedMapNode
+	switch r.typ {
+	case blockTypeSortedMapBranch:
+		// Each element requires at least one byte for its key & its child's id.
+		node := &sortedMapBranchNode{elems: make([]sortedMapBranchElem, r.count(1+len(BlockID{})))}
+		for i := range node.elems {
+			node.elems[i].key = r.value()
+			childID := r.id()
+			if r.err != nil {
+				break
+			} else if node.elems[i].node, err = d.decodeSortedMapNode(childID); err != nil {
+				return nil, err
+			}
+		}
+		n = node
+	case blockTypeSortedMapLeaf:
+		n = &sortedMapLeafNode{entries: r.entries()}
+	}
+
+	if err := r.close(); err != nil {
+		return nil, err
+	}
+	d.nodes[id] = n
+	return n, nil
+}
+
+// read fetches the block with the given identifier, verifies its contents, and
+// returns a reader positioned after the block type. Returns an error if the
+// block type is not one of types.
+func (d *Decoder) read(id BlockID, types ...byte) (*blockReader, error) {
+	data, err := d.store.Get(id)
+	if err != nil {
+		return nil, err
+	} else if BlockID(sha256.Sum256(data)) != id {
+		return nil, fmt.Errorf("immutable.Decoder: checksum mismatch for block %s", id)
+	} else if len(data) == 0 {
+		return nil, fmt.Errorf("immutable.Decoder: empty block %s", id)
+	}
+
+	for _, typ := range types {
+		if data[0] == typ {
+			return &blockReader{block: id, typ: typ, data: data[1:], codec: d.codec}, nil
+		}
+	}
+	return nil, fmt.Errorf("immutable.Decoder: unexpected block type %d in block %s", data[0], id)
+}
+
+// blockReader reads fields from an encoded block. The first error encountered
+// is retained and subsequent reads return zero values.
+type blockReader struct {
+	block BlockID
+	typ   byte
+	data  []byte
+	codec Codec
+	err   error
+}
+
+// remaining returns the number of unread bytes.
+func (r *blockReader) remaining() int {
+	return len(r.data)
+}
+
+// close returns the first read error. Returns an error if unread bytes remain.
+func (r *blockReader) close() error {
+	if r.err == nil && len(r.data) != 0 {
+		r.err = fmt.Errorf("immutable.Decoder: unexpected trailing data in block %s", r.block)
+	}
+	return r.err
+}
+
+// fail records err if no error has been recorded yet.
+func (r *blockReader) fail(err error) {
+	if r.err == nil {
+		r.err = err
+		r.data = nil
+	}
+}
+
+// uvarint reads a variable-length unsigned integer.
+func (r *blockReader) uvarint() uint64 {
+	x, n := binary.Uvarint(r.data)
+	if n <= 0 {
+		r.fail(fmt.Errorf("immutable.Decoder: invalid uvarint in block %s", r.block))
+		return 0
+	}
+	r.data = r.data[n:]
+	return x
+}
+
+// string reads a length-prefixed string.
+func (r *blockReader) string() string {
+	n := r.uvarint()
+	if uint64(len(r.data)) < n {
+		r.fail(fmt.Errorf("immutable.Decoder: unexpected end of block %s", r.block))
+		return ""
+	}
+	s := string(r.data[:n])
+	r.data = r.data[n:]
+	return s
+}
+
+// id reads a block identifier.
+func (r *blockReader) id() (id BlockID) {
+	if len(r.data) < len(id) {
+		r.fail(fmt.Errorf("immutable.Decoder: unexpected end of block %s", r.block))
+		return id
+	}
+	copy(id[:], r.data)
+	r.data = r.data[len(id):]
+	return id
+}
+
+// child reads an optional child identifier. Returns false if no child exists.
+func (r *blockReader) child() (BlockID, bool) {
+	if len(r.data) == 0 {
+		r.fail(fmt.Errorf("immutable.Decoder: unexpected end of block %s", r.block))
+		return BlockID{}, false
+	}
+	flag := r.data[0]
+	r.data = r.data[1:]
+	if flag == 0 {
+		return BlockID{}, false
+	}
+	id := r.id()
+	return id, r.err == nil
+}
+
+// value reads a single key or value using the codec.
+func (r *blockReader) value() interface{} {
+	if r.err != nil {
+		return nil
+	}
+	v, n, err := r.codec.ReadValue(r.data)
+	if err != nil {
+		r.fail(err)
+		return nil
+	}
+	r.data = r.data[n:]
+	return v
+}
+
+// count reads an element count. Returns zero and fails if the remaining data
+// is too short to hold that many elements of at least size bytes each, which
+// prevents a corrupt count from causing a large allocation.
+func (r *blockReader) count(size int) int {
+	n := r.uvarint()
+	if n > uint64(len(r.data)/size) {
+		r.fail(fmt.Errorf("immutable.Decoder: unexpected end of block %s", r.block))
+		return 0
+	}
+	return int(n)
+}
+
+// entries reads a count followed by that many key/value pairs.
+func (r *blockReader) entries() []mapEntry {
+	// Each entry requires at least one byte for its key & value.
+	n := r.count(2)
+	if r.err != nil {
+		return nil
+	}
+	entries := make([]mapEntry, n)
+	for i := range entries {
+		entries[i].key = r.value()
+		entries[i].value = r.value()
+	}
+	return entries
+}
+
+// typeName returns the type name of v, used to identify hashers & comparers.
+func typeName(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// appendUvarint appends the variable-length encoding of v to dst.
+func appendUvarint(dst []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(dst, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+// appendVarint appends the variable-length encoding of v to dst.
+func appendVarint(dst []byte, v int64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(dst, buf[:binary.PutVarint(buf[:], v)]...)
+}
+
+// appendString appends a length-prefixed string to dst.
+func appendString(dst []byte, s string) []byte {
+	return append(appendUvarint(dst, uint64(len(s))), s...)
+}
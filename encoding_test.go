@@ -0,0 +1,485 @@
+package immutable
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"math"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDefaultCodec(t *testing.T) {
+	for _, v := range []interface{}{
+		nil, true, false, 0, -1, 1 << 30, int64(1 << 40), int64(-100), uint64(1 << 63), 1.5, "", "foo", []byte("bar"),
+	} {
+		buf, err := DefaultCodec.AppendValue([]byte("x"), v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		other, n, err := DefaultCodec.ReadValue(buf[1:])
+		if err != nil {
+			t.Fatal(err)
+		} else if n != len(buf)-1 {
+			t.Fatalf("unexpected n for %#v: %d", v, n)
+		} else if !reflect.DeepEqual(other, v) {
+			t.Fatalf("unexpected value: %#v, expected %#v", other, v)
+		}
+	}
+
+	t.Run("ErrUnsupportedType", func(t *testing.T) {
+		if _, err := DefaultCodec.AppendValue(nil, struct{}{}); err == nil || err.Error() != `immutable.DefaultCodec: unsupported type struct {}` {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("ErrUnexpectedEOF", func(t *testing.T) {
+		buf, _ := DefaultCodec.AppendValue(nil, "foo")
+		if _, _, err := DefaultCodec.ReadValue(buf[:len(buf)-1]); err == nil {
+			t.Fatal("expected error")
+		}
+	})
+}
+
+func TestEncoder_List(t *testing.T) {
+	store := NewMemBlockStore()
+	enc, dec := NewEncoder(store, nil), NewDecoder(store, nil)
+
+	t.Run("Empty", func(t *testing.T) {
+		id, err := enc.EncodeList(NewList())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if l, err := dec.DecodeList(id); err != nil {
+			t.Fatal(err)
+		} else if l.Len() != 0 {
+			t.Fatalf("unexpected len: %d", l.Len())
+		}
+	})
+
+	t.Run("Sliced", func(t *testing.T) {
+		l := NewList()
+		for i := 0; i < 2000; i++ {
+			l = l.Append(i)
+		}
+		l = l.Slice(100, 1500).Prepend("foo")
+
+		id, err := enc.EncodeList(l)
+		if err != nil {
+			t.Fatal(err)
+		}
+		other, err := dec.DecodeList(id)
+		if err != nil {
+			t.Fatal(err)
+		} else if !reflect.DeepEqual(listValues(other), listValues(l)) {
+			t.Fatal("list mismatch")
+		}
+
+		// Ensure the decoded list can be updated.
+		other = other.Append("bar").Set(1, "baz")
+		if v := other.Get(other.Len() - 1); v != "bar" {
+			t.Fatalf("unexpected value: %v", v)
+		} else if v := other.Get(1); v != "baz" {
+			t.Fatalf("unexpected value: %v", v)
+		}
+	})
+}
+
+func TestEncoder_Map(t *testing.T) {
+	t.Run("Empty", func(t *testing.T) {
+		store := NewMemBlockStore()
+		id, err := NewEncoder(store, nil).EncodeMap(NewMap(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m, err := NewDecoder(store, nil).DecodeMap(id, nil); err != nil {
+			t.Fatal(err)
+		} else if m.Len() != 0 {
+			t.Fatalf("unexpected len: %d", m.Len())
+		} else if m = m.Set("foo", "bar"); m.Len() != 1 {
+			t.Fatalf("unexpected len: %d", m.Len())
+		}
+	})
+
+	t.Run("Collisions", func(t *testing.T) {
+		h := &mockHasher{
+			hash:  func(value interface{}) uint32 { return uint32(value.(int)) % 40 },
+			equal: func(a, b interface{}) bool { return a.(int) == b.(int) },
+		}
+		m := NewMap(h)
+		for i := 0; i < 200; i++ {
+			m = m.Set(i, i*10)
+		}
+
+		store := NewMemBlockStore()
+		id, err := NewEncoder(store, nil).EncodeMap(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		other, err := NewDecoder(store, nil).DecodeMap(id, h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 200; i++ {
+			if v, ok := other.Get(i); !ok || v != i*10 {
+				t.Fatalf("unexpected value for %d: <%v,%v>", i, v, ok)
+			}
+		}
+	})
+
+	t.Run("ErrHasherMismatch", func(t *testing.T) {
+		store := NewMemBlockStore()
+		id, err := NewEncoder(store, nil).EncodeMap(NewMap(nil).Set("foo", 1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		h := &mockHasher{}
+		if _, err := NewDecoder(store, nil).DecodeMap(id, h); err == nil || err.Error() != `immutable.Decoder.DecodeMap: hasher mismatch: encoded with *immutable.stringHasher` {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	// Ensure the built-in hasher is restored with the default seed.
+	t.Run("Seed", func(t *testing.T) {
+		m := NewMap(nil)
+		for i := 0; i < 1000; i++ {
+			m = m.Set(fmt.Sprint(i), i)
+		}
+
+		store := NewMemBlockStore()
+		id, err := NewEncoder(store, nil).EncodeMap(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		other, err := NewDecoder(store, nil).DecodeMap(id, nil)
+		if err != nil {
+			t.Fatal(err)
+		} else if got, exp := hasherSeed(other.hasher), hasherSeed(m.hasher); got != exp {
+			t.Fatalf("unexpected seed: %d, expected %d", got, exp)
+		}
+		for i := 0; i < 1000; i++ {
+			if v, ok := other.Get(fmt.Sprint(i)); !ok || v != i {
+				t.Fatalf("unexpected value for %d: <%v,%v>", i, v, ok)
+			}
+		}
+	})
+
+	// Ensure keys are rehashed when decoding with a different seed.
+	t.Run("Rehash", func(t *testing.T) {
+		m := NewMap(NewStringHasher(1))
+		for i := 0; i < 1000; i++ {
+			m = m.Set(fmt.Sprint(i), i)
+		}
+
+		store := NewMemBlockStore()
+		id, err := NewEncoder(store, nil).EncodeMap(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		other, err := NewDecoder(store, nil).DecodeMap(id, NewStringHasher(2))
+		if err != nil {
+			t.Fatal(err)
+		} else if got, exp := hasherSeed(other.hasher), uint64(2); got != exp {
+			t.Fatalf("unexpected seed: %d, expected %d", got, exp)
+		} else if other.Len() != m.Len() {
+			t.Fatalf("unexpected len: %d", other.Len())
+		}
+		for i := 0; i < 1000; i++ {
+			if v, ok := other.Get(fmt.Sprint(i)); !ok || v != i {
+				t.Fatalf("unexpected value for %d: <%v,%v>", i, v, ok)
+			}
+		}
+	})
+
+	// Ensure the hasher seed is not written to the map block.
+	t.Run("SeedNotEncoded", func(t *testing.T) {
+		const seed = 0x0123456789abcdef
+		store := NewMemBlockStore()
+		id, err := NewEncoder(store, nil).EncodeMap(NewMap(NewStringHasher(seed)).Set("foo", 1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := store.Get(id)
+		if bytes.Contains(data, appendUvarint(nil, seed)) {
+			t.Fatal("expected seed to not be encoded")
+		}
+	})
+
+	t.Run("ErrChecksumMismatch", func(t *testing.T) {
+		store := NewMemBlockStore()
+		id, err := NewEncoder(store, nil).EncodeMap(NewMap(nil).Set("foo", 1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := store.Get(id)
+		store.Put(id, append([]byte{}, data[:len(data)-1]...))
+		if _, err := NewDecoder(store, nil).DecodeMap(id, nil); err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("ErrBlockNotFound", func(t *testing.T) {
+		if _, err := NewDecoder(NewMemBlockStore(), nil).DecodeMap(BlockID{}, nil); err != ErrBlockNotFound {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("ErrUnexpectedBlockType", func(t *testing.T) {
+		store := NewMemBlockStore()
+		id, err := NewEncoder(store, nil).EncodeList(NewList())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := NewDecoder(store, nil).DecodeMap(id, nil); err == nil || !strings.Contains(err.Error(), "unexpected block type") {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	RunRandom(t, "Random", func(t *testing.T, rand *rand.Rand) {
+		store := NewMemBlockStore()
+		enc, dec := NewEncoder(store, nil), NewDecoder(store, nil)
+
+		m := NewMap(nil)
+		for i := 0; i < 5; i++ {
+			for j := 0; j < 1000; j++ {
+				if k := rand.Intn(5000); rand.Intn(4) == 0 {
+					m = m.Delete(k)
+				} else {
+					m = m.Set(k, fmt.Sprint(j))
+				}
+			}
+
+			id, err := enc.EncodeMap(m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			other, err := dec.DecodeMap(id, nil)
+			if err != nil {
+				t.Fatal(err)
+			} else if other.Len() != m.Len() {
+				t.Fatalf("unexpected len: %d, expected %d", other.Len(), m.Len())
+			}
+			for itr := m.Iterator(); !itr.Done(); {
+				k, v := itr.Next()
+				if got, ok := other.Get(k); !ok || got != v {
+					t.Fatalf("unexpected value for %v: <%v,%v>", k, got, ok)
+				}
+			}
+		}
+	})
+}
+
+func TestEncoder_SortedMap(t *testing.T) {
+	t.Run("ErrComparerRequired", func(t *testing.T) {
+		m := NewSortedMap(&mockComparer{compare: func(a, b interface{}) int { return a.(int) - b.(int) }}).Set(1, 1)
+
+		store := NewMemBlockStore()
+		id, err := NewEncoder(store, nil).EncodeSortedMap(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := NewDecoder(store, nil).DecodeSortedMap(id, &mockComparer{}); err != nil {
+			t.Fatal(err)
+		} else if _, err := NewDecoder(store, nil).DecodeSortedMap(id, nil); err == nil || err.Error() != `immutable.Decoder.DecodeSortedMap: comparer mismatch: encoded with *immutable.mockComparer` {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	// Ensure encoding a new version only writes changed nodes and decoding
+	// both versions shares unchanged nodes in memory.
+	t.Run("Shared", func(t *testing.T) {
+		m0 := NewSortedMap(nil)
+		for i := 0; i < 10000; i++ {
+			m0 = m0.Set(i, i)
+		}
+		m1 := m0.Set(5000, "foo")
+
+		store := NewMemBlockStore()
+		enc, dec := NewEncoder(store, nil), NewDecoder(store, nil)
+		id0, err := enc.EncodeSortedMap(m0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := store.Len()
+
+		id1, err := enc.EncodeSortedMap(m1)
+		if err != nil {
+			t.Fatal(err)
+		} else if got := store.Len() - n; got != 5 {
+			t.Fatalf("unexpected number of new blocks: %d", got)
+		}
+
+		// Encoding the same nodes again from a new encoder writes no blocks.
+		if _, err := NewEncoder(store, nil).EncodeSortedMap(m1); err != nil {
+			t.Fatal(err)
+		} else if got := store.Len() - n; got != 5 {
+			t.Fatalf("unexpected number of new blocks: %d", got)
+		}
+
+		other0, err := dec.DecodeSortedMap(id0, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		other1, err := dec.DecodeSortedMap(id1, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if v, _ := other0.Get(5000); v != 5000 {
+			t.Fatalf("unexpected value: %v", v)
+		} else if v, _ := other1.Get(5000); v != "foo" {
+			t.Fatalf("unexpected value: %v", v)
+		}
+
+		var shared int
+		root0, root1 := other0.root.(*sortedMapBranchNode), other1.root.(*sortedMapBranchNode)
+		for i := range root0.elems {
+			if root0.elems[i].node == root1.elems[i].node {
+				shared++
+			}
+		}
+		if shared != len(root0.elems)-1 {
+			t.Fatalf("unexpected shared nodes: %d of %d", shared, len(root0.elems))
+		}
+
+		// Ensure the structure is identical to the encoded version.
+		if changes := diffSortedMapsChanges(m1, other1); len(changes) != 0 {
+			t.Fatalf("unexpected changes: %v", changes)
+		}
+	})
+}
+
+// Ensure corrupt blocks with valid checksums return errors instead of
+// panicking or allocating based on untrusted counts.
+func TestDecoder_Corrupt(t *testing.T) {
+	// put stores data under its checksum and returns its identifier.
+	put := func(store *MemBlockStore, data []byte) BlockID {
+		id := BlockID(sha256.Sum256(data))
+		store.Put(id, data)
+		return id
+	}
+
+	t.Run("ErrCount", func(t *testing.T) {
+		for _, typ := range []byte{blockTypeSortedMapBranch, blockTypeSortedMapLeaf, blockTypeMapArray, blockTypeMapHashCollision} {
+			for _, count := range []uint64{1, 2, 100, 1 << 31, 1 << 40, 1<<63 + 1, math.MaxUint64} {
+				for _, trailer := range [][]byte{nil, {codecNil}, make([]byte, 33)} {
+					data := []byte{typ}
+					if typ == blockTypeMapHashCollision {
+						data = appendUvarint(data, 1) // key hash
+					}
+					data = append(appendUvarint(data, count), trailer...)
+
+					store := NewMemBlockStore()
+					id := put(store, data)
+					dec := NewDecoder(store, nil)
+
+					var err error
+					if typ == blockTypeSortedMapBranch || typ == blockTypeSortedMapLeaf {
+						_, err = dec.decodeSortedMapNode(id)
+					} else {
+						_, err = dec.decodeMapNode(id)
+					}
+					if err == nil {
+						t.Fatalf("expected error: type=%d count=%d trailer=%d", typ, count, len(trailer))
+					}
+				}
+			}
+		}
+	})
+
+	RunRandom(t, "Random", func(t *testing.T, rand *rand.Rand) {
+		m := NewSortedMap(nil)
+		for i := 0; i < 2000; i++ {
+			m = m.Set(rand.Intn(10000), fmt.Sprint(i))
+		}
+		src := NewMemBlockStore()
+		if _, err := NewEncoder(src, nil).EncodeSortedMap(m); err != nil {
+			t.Fatal(err)
+		}
+
+		// Truncate or flip bytes in each block and store it under its new checksum.
+		for id := range src.blocks {
+			data, _ := src.Get(id)
+			for i := 0; i < 10; i++ {
+				other := append([]byte{}, data...)
+				if rand.Intn(2) == 0 {
+					other = other[:rand.Intn(len(other))]
+				} else {
+					other[rand.Intn(len(other))] = byte(rand.Intn(256))
+				}
+
+				store := NewMemBlockStore()
+				for id, data := range src.blocks {
+					store.Put(id, data)
+				}
+				NewDecoder(store, nil).decodeSortedMapNode(put(store, other)) // must not panic
+			}
+		}
+	})
+}
+
+// diffSortedMapsChanges returns all changes between a and b.
+func diffSortedMapsChanges(a, b *SortedMap) []Change {
+	var changes []Change
+	diffSortedMaps(a, b, nil, func(c Change) bool {
+		changes = append(changes, c)
+		return true
+	})
+	return changes
+}
+
+// listValues returns all values of l in order.
+func listValues(l *List) []interface{} {
+	a := make([]interface{}, 0, l.Len())
+	for itr := l.Iterator(); !itr.Done(); {
+		_, v := itr.Next()
+		a = append(a, v)
+	}
+	return a
+}
+
+func BenchmarkEncoder_EncodeSortedMap(b *testing.B) {
+	m := NewSortedMap(nil)
+	for i := 0; i < 100000; i++ {
+		m = m.Set(i, i)
+	}
+	store := NewMemBlockStore()
+	enc := NewEncoder(store, nil)
+	if _, err := enc.EncodeSortedMap(m); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m = m.Set(i%100000, i)
+		if _, err := enc.EncodeSortedMap(m); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func ExampleEncoder() {
+	store := NewMemBlockStore()
+	enc := NewEncoder(store, nil)
+
+	m := NewSortedMap(nil)
+	for i := 0; i < 1000; i++ {
+		m = m.Set(i, i)
+	}
+	enc.EncodeSortedMap(m)
+	n := store.Len()
+
+	// Only blocks for changed nodes are written for the new version.
+	id, _ := enc.EncodeSortedMap(m.Set(500, "foo"))
+	fmt.Println("new blocks:", store.Len()-n)
+
+	other, _ := NewDecoder(store, nil).DecodeSortedMap(id, nil)
+	v, _ := other.Get(500)
+	fmt.Println(v)
+	// Output:
+	// new blocks: 4
+	// foo
+}
@@ -0,0 +1,172 @@
+package immutable
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"math/bits"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// hasherSeedKey is a per-process SipHash key used to generate seeds for
+// built-in hashers. It is initialized from a cryptographically secure source
+// so that seeds cannot be predicted by users that control map keys. Seeds are
+// SipHash outputs of a counter so one seed does not reveal any other seed.
+var hasherSeedKey = newHasherSeedKey()
+
+// hasherSeedCounter is incremented for each generated seed.
+var hasherSeedCounter uint64
+
+// defaultHasherSeed is the seed of the built-in hashers used by maps created
+// with a nil hasher. It is chosen once per process so that maps with the same
+// keys iterate in the same order.
+var defaultHasherSeed = newHasherSeed()
+
+// newHasherSeedKey returns a random key for generating hasher seeds.
+func newHasherSeedKey() sipKey {
+	var buf [16]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		binary.LittleEndian.PutUint64(buf[:], uint64(time.Now().UnixNano()))
+	}
+	return sipKey{
+		k0: binary.LittleEndian.Uint64(buf[:8]),
+		k1: binary.LittleEndian.Uint64(buf[8:]),
+	}
+}
+
+// newHasherSeed returns a new random seed for a built-in hasher.
+func newHasherSeed() uint64 {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], atomic.AddUint64(&hasherSeedCounter, 1))
+	return hasherSeedKey.hashBytes64(buf[:])
+}
+
+// seededHasher is implemented by built-in hashers that use a seed.
+type seededHasher interface {
+	Hasher
+	seed() uint64
+}
+
+// hasherSeed returns the seed of h. Returns zero if h is not seeded.
+func hasherSeed(h Hasher) uint64 {
+	if h, ok := h.(seededHasher); ok {
+		return h.seed()
+	}
+	return 0
+}
+
+// hasherSeedCheck returns a value that identifies the seed of h without
+// revealing it. It is recorded when encoding a map so the decoder can tell
+// whether keys must be rehashed. Returns zero if h is not seeded.
+func hasherSeedCheck(h Hasher) uint64 {
+	if h, ok := h.(seededHasher); ok {
+		return newSipKey(h.seed()).hashString64("immutable.hasherSeedCheck")
+	}
+	return 0
+}
+
+// sipKey is the 128-bit key used by SipHash.
+type sipKey struct {
+	k0, k1 uint64
+}
+
+// newSipKey expands a 64-bit seed into a SipHash key.
+func newSipKey(seed uint64) sipKey {
+	k0 := splitmix64(seed)
+	return sipKey{k0: k0, k1: splitmix64(k0)}
+}
+
+// hashString returns a 32-bit hash of s.
+func (k sipKey) hashString(s string) uint32 {
+	return fold64(sipHash24(k.k0, k.k1, s))
+}
+
+// hashBytes returns a 32-bit hash of b.
+func (k sipKey) hashBytes(b []byte) uint32 {
+	return k.hashString(bytesToString(b))
+}
+
+// hashString64 returns a 64-bit hash of s.
+func (k sipKey) hashString64(s string) uint64 {
+	return sipHash24(k.k0, k.k1, s)
+}
+
+// hashBytes64 returns a 64-bit hash of b.
+func (k sipKey) hashBytes64(b []byte) uint64 {
+	return sipHash24(k.k0, k.k1, bytesToString(b))
+}
+
+// bytesToString returns b as a string without copying. The string must not be
+// retained after b is modified.
+func bytesToString(b []byte) string {
+	return *(*string)(unsafe.Pointer(&b))
+}
+
+// fold64 folds a 64-bit hash into a 32-bit hash.
+func fold64(h uint64) uint32 {
+	return uint32(h) ^ uint32(h>>32)
+}
+
+// splitmix64 returns a well-mixed 64-bit value for x.
+func splitmix64(x uint64) uint64 {
+	x += 0x9e3779b97f4a7c15
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
+
+// sipHash24 returns the SipHash-2-4 hash of s using the key k0 & k1.
+func sipHash24(k0, k1 uint64, s string) uint64 {
+	v0 := k0 ^ 0x736f6d6570736575
+	v1 := k1 ^ 0x646f72616e646f6d
+	v2 := k0 ^ 0x6c7967656e657261
+	v3 := k1 ^ 0x7465646279746573
+
+	// Compress each full 8-byte word.
+	n := len(s)
+	for ; len(s) >= 8; s = s[8:] {
+		m := uint64(s[0]) | uint64(s[1])<<8 | uint64(s[2])<<16 | uint64(s[3])<<24 |
+			uint64(s[4])<<32 | uint64(s[5])<<40 | uint64(s[6])<<48 | uint64(s[7])<<56
+		v3 ^= m
+		v0, v1, v2, v3 = sipRound(v0, v1, v2, v3)
+		v0, v1, v2, v3 = sipRound(v0, v1, v2, v3)
+		v0 ^= m
+	}
+
+	// Compress the remaining bytes along with the message length.
+	m := uint64(n) << 56
+	for i := len(s) - 1; i >= 0; i-- {
+		m |= uint64(s[i]) << (8 * uint(i))
+	}
+	v3 ^= m
+	v0, v1, v2, v3 = sipRound(v0, v1, v2, v3)
+	v0, v1, v2, v3 = sipRound(v0, v1, v2, v3)
+	v0 ^= m
+
+	// Finalize.
+	v2 ^= 0xff
+	for i := 0; i < 4; i++ {
+		v0, v1, v2, v3 = sipRound(v0, v1, v2, v3)
+	}
+	return v0 ^ v1 ^ v2 ^ v3
+}
+
+// sipRound performs a single SipRound.
+func sipRound(v0, v1, v2, v3 uint64) (uint64, uint64, uint64, uint64) {
+	v0 += v1
+	v1 = bits.RotateLeft64(v1, 13)
+	v1 ^= v0
+	v0 = bits.RotateLeft64(v0, 32)
+	v2 += v3
+	v3 = bits.RotateLeft64(v3, 16)
+	v3 ^= v2
+	v0 += v3
+	v3 = bits.RotateLeft64(v3, 21)
+	v3 ^= v0
+	v2 += v1
+	v1 = bits.RotateLeft64(v1, 17)
+	v1 ^= v2
+	v2 = bits.RotateLeft64(v2, 32)
+	return v0, v1, v2, v3
+}
@@ -0,0 +1,98 @@
+package immutable
+
+import (
+	"fmt"
+	"testing"
+)
+
+// Ensure the SipHash implementation matches the reference test vectors.
+func TestSipHash24(t *testing.T) {
+	const k0, k1 = 0x0706050403020100, 0x0f0e0d0c0b0a0908
+	msg := make([]byte, 16)
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+
+	for _, tt := range []struct {
+		n   int
+		exp uint64
+	}{
+		{0, 0x726fdb47dd0e0e31},
+		{1, 0x74f839c593dc67fd},
+		{7, 0xab0200f58b01d137},
+		{8, 0x93f5f5799a932462},
+		{15, 0xa129ca6149be45e5},
+	} {
+		if got := sipHash24(k0, k1, string(msg[:tt.n])); got != tt.exp {
+			t.Fatalf("sipHash24(%d)=%x, expected %x", tt.n, got, tt.exp)
+		}
+	}
+}
+
+func TestNewStringHasher(t *testing.T) {
+	h0, h1 := NewStringHasher(0), NewStringHasher(1)
+	if h0.Hash("foo") != NewStringHasher(0).Hash("foo") {
+		t.Fatal("expected equal hash for equal seed")
+	} else if h0.Hash("foo") == h1.Hash("foo") {
+		t.Fatal("expected different hash for different seed")
+	} else if h0.Hash("foo") != NewByteSliceHasher(0).Hash([]byte("foo")) {
+		t.Fatal("expected string & byte slice hashes to match")
+	}
+
+	// Keys that collided with the previous polynomial hash no longer collide.
+	if h0.Hash("Aa") == h0.Hash("BB") {
+		t.Fatal("unexpected collision")
+	}
+}
+
+// Ensure maps created with a nil hasher are seeded independently.
+func TestMap_HasherSeed(t *testing.T) {
+	a, b := NewMap(nil).Set("foo", 1), NewMap(nil).Set("foo", 1)
+	if hasherSeed(a.hasher) != hasherSeed(b.hasher) {
+		t.Fatal("expected default seeds to be equal")
+	} else if other := a.Set("bar", 2); other.hasher != a.hasher {
+		t.Fatal("expected hasher to be retained")
+	} else if c := NewMap(NewStringHasher(1)).Set("foo", 1); !a.Equal(c, nil) {
+		t.Fatal("expected maps with different seeds to be equal")
+	}
+
+	// Maps with a nil hasher iterate in the same order within a process.
+	a, b = NewMap(nil), NewMap(nil)
+	for i := 0; i < 100; i++ {
+		a, b = a.Set(fmt.Sprint(i), i), b.Set(fmt.Sprint(99-i), 99-i)
+	}
+	for itrA, itrB := a.Iterator(), b.Iterator(); !itrA.Done(); {
+		ka, _ := itrA.Next()
+		kb, _ := itrB.Next()
+		if ka != kb {
+			t.Fatalf("unexpected key: %v, expected %v", kb, ka)
+		}
+	}
+}
+
+func BenchmarkStringHasher_Hash(b *testing.B) {
+	h := NewStringHasher(0)
+	keys := make([]string, 1000)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key-%d", i)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		h.Hash(keys[i%len(keys)])
+	}
+}
+
+func ExampleNewStringHasher() {
+	// Maps that share a hasher with a fixed seed iterate in the same order.
+	h := NewStringHasher(0)
+	a := NewMap(h).Set("foo", 1).Set("bar", 2)
+	b := NewMap(h).Set("bar", 2).Set("foo", 1)
+
+	ka, _ := a.Iterator().Next()
+	kb, _ := b.Iterator().Next()
+	fmt.Println(ka == kb)
+	// Output:
+	// true
+}
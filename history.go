@@ -0,0 +1,202 @@
+package immutable
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// History represents an immutable, ordered set of versions of a value such
+// as a *Map or *SortedMap. Because each version of a persistent collection
+// shares unchanged nodes with the versions before it, retaining a history of
+// versions costs only the nodes changed between them.
+//
+// A History tracks a current version which moves with Undo & Redo. Committing
+// a new value after an undo discards the versions that could be redone.
+type History struct {
+	entries *List // HistoryEntry values, ordered by version
+	index   int   // index of current entry, -1 if empty
+	next    int   // version assigned to the next commit
+	limit   int   // maximum number of retained entries, if positive
+}
+
+// HistoryEntry represents a single committed version within a History.
+type HistoryEntry struct {
+	Version int
+	Time    time.Time
+	Label   string
+	Value   interface{}
+}
+
+// NewHistory returns a new, empty history. If limit is positive then the
+// oldest versions are pruned on commit so that at most limit are retained.
+func NewHistory(limit int) *History {
+	return &History{
+		entries: NewList(),
+		index:   -1,
+		next:    1,
+		limit:   limit,
+	}
+}
+
+// Len returns the number of versions retained by the history.
+func (h *History) Len() int {
+	return h.entries.Len()
+}
+
+// Current returns the entry for the current version.
+// Returns false if the history is empty.
+func (h *History) Current() (entry HistoryEntry, ok bool) {
+	if h.index < 0 {
+		return entry, false
+	}
+	return h.entries.Get(h.index).(HistoryEntry), true
+}
+
+// Commit returns a new history with value added as the current version.
+// Any versions after the current version are discarded.
+func (h *History) Commit(value interface{}, label string) *History {
+	return h.CommitAt(value, label, time.Now())
+}
+
+// CommitAt returns a new history with value added as the current version
+// using t as the commit time. Any versions after the current version are
+// discarded.
+func (h *History) CommitAt(value interface{}, label string, t time.Time) *History {
+	other := *h
+	other.entries = h.entries.Slice(0, h.index+1).Append(HistoryEntry{
+		Version: h.next,
+		Time:    t,
+		Label:   label,
+		Value:   value,
+	})
+	other.index = other.entries.Len() - 1
+	other.next++
+
+	if other.limit > 0 && other.entries.Len() > other.limit {
+		return other.Prune(other.limit)
+	}
+	return &other
+}
+
+// At returns the entry for the given version.
+// Returns false if the version does not exist or has been pruned.
+func (h *History) At(version int) (entry HistoryEntry, ok bool) {
+	if i := h.search(version); i >= 0 {
+		return h.entries.Get(i).(HistoryEntry), true
+	}
+	return entry, false
+}
+
+// search returns the index of the entry for version. Returns -1 if not found.
+func (h *History) search(version int) int {
+	n := h.entries.Len()
+	i := sort.Search(n, func(i int) bool {
+		return h.entries.Get(i).(HistoryEntry).Version >= version
+	})
+	if i < n && h.entries.Get(i).(HistoryEntry).Version == version {
+		return i
+	}
+	return -1
+}
+
+// CanUndo returns true if there is a version before the current version.
+func (h *History) CanUndo() bool {
+	return h.index > 0
+}
+
+// CanRedo returns true if there is a version after the current version.
+func (h *History) CanRedo() bool {
+	return h.index < h.entries.Len()-1
+}
+
+// Undo returns a new history with the previous version set as current.
+// Returns the original history if there is no previous version.
+func (h *History) Undo() *History {
+	if !h.CanUndo() {
+		return h
+	}
+	other := *h
+	other.index--
+	return &other
+}
+
+// Redo returns a new history with the next version set as current.
+// Returns the original history if there is no next version.
+func (h *History) Redo() *History {
+	if !h.CanRedo() {
+		return h
+	}
+	other := *h
+	other.index++
+	return &other
+}
+
+// Prune returns a new history with the oldest versions removed so that at
+// most n versions are retained. The current version is never removed so more
+// than n versions are retained if the current version is older.
+func (h *History) Prune(n int) *History {
+	start := h.entries.Len() - n
+	if start > h.index {
+		start = h.index
+	}
+	return h.prune(start)
+}
+
+// PruneBefore returns a new history with versions committed before t removed.
+// The current version and versions after it are never removed.
+func (h *History) PruneBefore(t time.Time) *History {
+	var start int
+	for start < h.index && h.entries.Get(start).(HistoryEntry).Time.Before(t) {
+		start++
+	}
+	return h.prune(start)
+}
+
+// prune returns a new history with entries before index start removed.
+func (h *History) prune(start int) *History {
+	if start <= 0 {
+		return h
+	}
+	other := *h
+	other.entries = h.entries.Slice(start, h.entries.Len())
+	other.index -= start
+	return &other
+}
+
+// Diff returns the changes between the values of versions v1 and v2. Both
+// values must be a *Map or both must be a *SortedMap. Nodes shared by both
+// versions are skipped so the cost is proportional to the size of the change.
+//
+// Values are considered unchanged if they are equal using ==. Changes are
+// returned in key order for sorted maps and in an unspecified order for maps.
+func (h *History) Diff(v1, v2 int) ([]Change, error) {
+	e1, ok := h.At(v1)
+	if !ok {
+		return nil, fmt.Errorf("immutable.History.Diff: version %d not found", v1)
+	}
+	e2, ok := h.At(v2)
+	if !ok {
+		return nil, fmt.Errorf("immutable.History.Diff: version %d not found", v2)
+	}
+
+	var changes []Change
+	fn := func(c Change) bool {
+		changes = append(changes, c)
+		return true
+	}
+
+	switch a := e1.Value.(type) {
+	case *Map:
+		if b, ok := e2.Value.(*Map); ok {
+			diffMaps(a, b, nil, fn)
+			return changes, nil
+		}
+	case *SortedMap:
+		if b, ok := e2.Value.(*SortedMap); ok {
+			diffSortedMaps(a, b, nil, fn)
+			return changes, nil
+		}
+	}
+	return nil, fmt.Errorf("immutable.History.Diff: cannot diff %T and %T", e1.Value, e2.Value)
+}
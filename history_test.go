@@ -0,0 +1,296 @@
+package immutable
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestHistory(t *testing.T) {
+	t.Run("Empty", func(t *testing.T) {
+		h := NewHistory(0)
+		if n := h.Len(); n != 0 {
+			t.Fatalf("unexpected len: %d", n)
+		} else if _, ok := h.Current(); ok {
+			t.Fatal("expected no current entry")
+		} else if h.CanUndo() || h.CanRedo() {
+			t.Fatal("expected no undo or redo")
+		} else if h.Undo() != h || h.Redo() != h {
+			t.Fatal("expected same history")
+		}
+	})
+
+	t.Run("Commit", func(t *testing.T) {
+		h0 := NewHistory(0)
+		h1 := h0.Commit("foo", "first")
+		h2 := h1.Commit("bar", "second")
+
+		if n := h0.Len(); n != 0 {
+			t.Fatalf("unexpected original len: %d", n)
+		} else if n := h2.Len(); n != 2 {
+			t.Fatalf("unexpected len: %d", n)
+		}
+
+		if e, ok := h2.Current(); !ok || e.Version != 2 || e.Label != "second" || e.Value != "bar" {
+			t.Fatalf("unexpected current entry: %+v", e)
+		} else if e, ok := h2.At(1); !ok || e.Label != "first" || e.Value != "foo" {
+			t.Fatalf("unexpected entry: %+v", e)
+		} else if _, ok := h2.At(3); ok {
+			t.Fatal("expected no entry")
+		}
+	})
+
+	t.Run("UndoRedo", func(t *testing.T) {
+		h := NewHistory(0).Commit(1, "").Commit(2, "").Commit(3, "")
+
+		h = h.Undo().Undo()
+		if e, _ := h.Current(); e.Value != 1 {
+			t.Fatalf("unexpected value: %v", e.Value)
+		} else if h.CanUndo() || !h.CanRedo() {
+			t.Fatal("unexpected undo/redo state")
+		}
+
+		h = h.Redo()
+		if e, _ := h.Current(); e.Value != 2 {
+			t.Fatalf("unexpected value: %v", e.Value)
+		}
+
+		// Committing after an undo discards the redo versions.
+		h = h.Commit(4, "")
+		if e, _ := h.Current(); e.Version != 4 || e.Value != 4 {
+			t.Fatalf("unexpected entry: %+v", e)
+		} else if h.CanRedo() {
+			t.Fatal("expected no redo")
+		} else if _, ok := h.At(3); ok {
+			t.Fatal("expected discarded version")
+		} else if n := h.Len(); n != 3 {
+			t.Fatalf("unexpected len: %d", n)
+		}
+	})
+
+	t.Run("Limit", func(t *testing.T) {
+		h := NewHistory(3)
+		for i := 1; i <= 10; i++ {
+			h = h.Commit(i, "")
+		}
+		if n := h.Len(); n != 3 {
+			t.Fatalf("unexpected len: %d", n)
+		} else if _, ok := h.At(7); ok {
+			t.Fatal("expected pruned version")
+		} else if e, ok := h.At(8); !ok || e.Value != 8 {
+			t.Fatalf("unexpected entry: %+v", e)
+		}
+	})
+
+	t.Run("Prune", func(t *testing.T) {
+		h := NewHistory(0)
+		for i := 1; i <= 5; i++ {
+			h = h.Commit(i, "")
+		}
+
+		if other := h.Prune(2); other.Len() != 2 {
+			t.Fatalf("unexpected len: %d", other.Len())
+		} else if e, _ := other.Current(); e.Version != 5 {
+			t.Fatalf("unexpected current version: %d", e.Version)
+		}
+
+		// The current version is retained even if it is older.
+		h = h.Undo().Undo().Undo()
+		if other := h.Prune(1); other.Len() != 4 {
+			t.Fatalf("unexpected len: %d", other.Len())
+		} else if e, _ := other.Current(); e.Version != 2 {
+			t.Fatalf("unexpected current version: %d", e.Version)
+		} else if other.CanUndo() {
+			t.Fatal("expected no undo")
+		}
+	})
+
+	t.Run("PruneBefore", func(t *testing.T) {
+		now := time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+		h := NewHistory(0)
+		for i := 0; i < 5; i++ {
+			h = h.CommitAt(i, "", now.Add(time.Duration(i)*time.Hour))
+		}
+
+		if other := h.PruneBefore(now.Add(2 * time.Hour)); other.Len() != 3 {
+			t.Fatalf("unexpected len: %d", other.Len())
+		} else if e, _ := other.At(3); e.Value != 2 {
+			t.Fatalf("unexpected value: %v", e.Value)
+		}
+
+		if other := h.PruneBefore(now.Add(24 * time.Hour)); other.Len() != 1 {
+			t.Fatalf("unexpected len: %d", other.Len())
+		} else if e, _ := other.Current(); e.Value != 4 {
+			t.Fatalf("unexpected value: %v", e.Value)
+		}
+	})
+}
+
+func TestHistory_Diff(t *testing.T) {
+	t.Run("Map", func(t *testing.T) {
+		m := NewMap(nil)
+		for i := 0; i < 1000; i++ {
+			m = m.Set(i, i)
+		}
+		h := NewHistory(0).Commit(m, "")
+		h = h.Commit(m.Set(1000, 1000).Set(5, -5).Delete(10), "")
+
+		changes, err := h.Diff(1, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Slice(changes, func(i, j int) bool { return changes[i].Key.(int) < changes[j].Key.(int) })
+		if exp := []Change{
+			{Type: ChangeUpdated, Key: 5, OldValue: 5, NewValue: -5},
+			{Type: ChangeRemoved, Key: 10, OldValue: 10},
+			{Type: ChangeAdded, Key: 1000, NewValue: 1000},
+		}; !reflect.DeepEqual(changes, exp) {
+			t.Fatalf("unexpected changes: %+v", changes)
+		}
+	})
+
+	t.Run("SortedMap", func(t *testing.T) {
+		m := NewSortedMap(nil)
+		for i := 0; i < 1000; i++ {
+			m = m.Set(i, i)
+		}
+		h := NewHistory(0).Commit(m, "")
+		h = h.Commit(m.Set(1000, 1000).Set(5, -5).Delete(10), "")
+
+		changes, err := h.Diff(2, 1)
+		if err != nil {
+			t.Fatal(err)
+		} else if exp := []Change{
+			{Type: ChangeUpdated, Key: 5, OldValue: -5, NewValue: 5},
+			{Type: ChangeAdded, Key: 10, NewValue: 10},
+			{Type: ChangeRemoved, Key: 1000, OldValue: 1000},
+		}; !reflect.DeepEqual(changes, exp) {
+			t.Fatalf("unexpected changes: %+v", changes)
+		}
+	})
+
+	t.Run("Same", func(t *testing.T) {
+		h := NewHistory(0).Commit(NewSortedMap(nil).Set(1, 1), "")
+		if changes, err := h.Diff(1, 1); err != nil {
+			t.Fatal(err)
+		} else if len(changes) != 0 {
+			t.Fatalf("unexpected changes: %+v", changes)
+		}
+	})
+
+	t.Run("ErrVersionNotFound", func(t *testing.T) {
+		h := NewHistory(0).Commit(NewMap(nil), "")
+		if _, err := h.Diff(1, 2); err == nil || err.Error() != `immutable.History.Diff: version 2 not found` {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("ErrTypeMismatch", func(t *testing.T) {
+		h := NewHistory(0).Commit(NewMap(nil), "").Commit(NewSortedMap(nil), "")
+		if _, err := h.Diff(1, 2); err == nil || err.Error() != `immutable.History.Diff: cannot diff *immutable.Map and *immutable.SortedMap` {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	RunRandom(t, "Random", func(t *testing.T, rand *rand.Rand) {
+		a, sa, stdA := NewMap(nil), NewSortedMap(nil), make(map[int]int)
+		for i := 0; i < 1000; i++ {
+			k, v := rand.Intn(500), rand.Intn(10)
+			a, sa, stdA[k] = a.Set(k, v), sa.Set(k, v), v
+		}
+
+		b, sb, stdB := a, sa, make(map[int]int)
+		for k, v := range stdA {
+			stdB[k] = v
+		}
+		for i := 0; i < 100; i++ {
+			k, v := rand.Intn(600), rand.Intn(10)
+			if rand.Intn(3) == 0 {
+				b, sb = b.Delete(k), sb.Delete(k)
+				delete(stdB, k)
+			} else {
+				b, sb, stdB[k] = b.Set(k, v), sb.Set(k, v), v
+			}
+		}
+
+		exp := make(map[interface{}]Change)
+		for k, v := range stdA {
+			if other, ok := stdB[k]; !ok {
+				exp[k] = Change{Type: ChangeRemoved, Key: k, OldValue: v}
+			} else if other != v {
+				exp[k] = Change{Type: ChangeUpdated, Key: k, OldValue: v, NewValue: other}
+			}
+		}
+		for k, v := range stdB {
+			if _, ok := stdA[k]; !ok {
+				exp[k] = Change{Type: ChangeAdded, Key: k, NewValue: v}
+			}
+		}
+
+		got := make(map[interface{}]Change)
+		diffMaps(a, b, nil, func(c Change) bool { got[c.Key] = c; return true })
+		if !reflect.DeepEqual(got, exp) {
+			t.Fatalf("map changes mismatch:\ngot=%+v\nexp=%+v", got, exp)
+		}
+
+		prev := -1
+		got = make(map[interface{}]Change)
+		diffSortedMaps(sa, sb, nil, func(c Change) bool {
+			if c.Key.(int) <= prev {
+				t.Fatalf("out of order key: %v", c.Key)
+			}
+			prev, got[c.Key] = c.Key.(int), c
+			return true
+		})
+		if !reflect.DeepEqual(got, exp) {
+			t.Fatalf("sorted map changes mismatch:\ngot=%+v\nexp=%+v", got, exp)
+		}
+	})
+}
+
+func BenchmarkHistory_Diff(b *testing.B) {
+	m := NewSortedMap(nil)
+	for i := 0; i < 100000; i++ {
+		m = m.Set(i, i)
+	}
+	h := NewHistory(0).Commit(m, "").Commit(m.Set(50000, 0), "")
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := h.Diff(1, 2); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func ExampleHistory_Undo() {
+	h := NewHistory(10)
+	h = h.Commit(NewSortedMap(nil).Set("foo", 1), "add foo")
+	h = h.Commit(NewSortedMap(nil).Set("foo", 2), "update foo")
+
+	h = h.Undo()
+	e, _ := h.Current()
+	v, _ := e.Value.(*SortedMap).Get("foo")
+	fmt.Println(e.Label, v)
+	// Output:
+	// add foo 1
+}
+
+func ExampleHistory_Diff() {
+	m := NewSortedMap(nil).Set("foo", 1).Set("bar", 2)
+	h := NewHistory(10)
+	h = h.Commit(m, "")
+	h = h.Commit(m.Set("baz", 3).Delete("bar"), "")
+
+	changes, _ := h.Diff(1, 2)
+	for _, c := range changes {
+		fmt.Println(c.Type, c.Key)
+	}
+	// Output:
+	// removed bar
+	// added baz
+}
@@ -43,10 +43,13 @@ package immutable
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"math/bits"
 	"sort"
 	"strings"
+	"time"
 )
 
 // List is a dense, ordered, indexed collections. They are analogous to slices
@@ -54,9 +57,10 @@ import (
 // values to the beginning of the list, or updating existing indexes in the
 // list.
 type List struct {
-	root   listNode // root node
-	origin int      // offset to zero index element
-	size   int      // total number of elements in use
+	root    listNode     // root node
+	origin  int          // offset to zero index element
+	size    int          // total number of elements in use
+	equaler ValueEqualer // optional value equality check for Set
 }
 
 // NewList returns a new empty instance of List.
@@ -66,6 +70,15 @@ func NewList() *List {
 	}
 }
 
+// WithValueEqualer returns a copy of the list that uses eq to compare values.
+// Set returns the original list when the new value is equal to the existing
+// value at the index. A nil equaler restores the default behavior.
+func (l *List) WithValueEqualer(eq ValueEqualer) *List {
+	other := *l
+	other.equaler = eq
+	return &other
+}
+
 // Len returns the number of elements in the list.
 func (l *List) Len() int {
 	return l.size
@@ -91,6 +104,8 @@ func (l *List) Get(index int) interface{} {
 func (l *List) Set(index int, value interface{}) *List {
 	if index < 0 || index >= l.size {
 		panic(fmt.Sprintf("immutable.List.Set: index %d out of bounds", index))
+	} else if l.equaler != nil && l.equaler.Equal(l.root.get(l.origin+index), value) {
+		return l
 	}
 	other := *l
 	other.root = other.root.set(l.origin+index, value)
@@ -178,6 +193,45 @@ func (l *List) Slice(start, end int) *List {
 	return &other
 }
 
+// Each calls fn for each index and value in the list in order until fn returns
+// false. The tree is walked recursively so no iterator needs to be allocated.
+func (l *List) Each(fn func(index int, value interface{}) bool) {
+	if l.size > 0 {
+		eachListNode(l.root, 0, l.origin, l.origin+l.size, func(i int, v interface{}) bool {
+			return fn(i-l.origin, v)
+		})
+	}
+}
+
+// eachListNode calls fn for each element of n at an index within [lo, hi)
+// until fn returns false. The base is the index of the first slot in n.
+// Returns false if fn returned false.
+func eachListNode(n listNode, base, lo, hi int, fn func(index int, value interface{}) bool) bool {
+	switch n := n.(type) {
+	case *listBranchNode:
+		span := 1 << (n.d * listNodeBits)
+		for i, child := range n.children {
+			if start := base + i*span; child == nil || start+span <= lo {
+				continue
+			} else if start >= hi {
+				return true
+			} else if !eachListNode(child, start, lo, hi, fn) {
+				return false
+			}
+		}
+
+	case *listLeafNode:
+		for i := range n.children {
+			if index := base + i; index >= hi {
+				return true
+			} else if index >= lo && !fn(index, n.children[i]) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
 // Iterator returns a new iterator for this list positioned at the first index.
 func (l *List) Iterator() *ListIterator {
 	itr := &ListIterator{list: l}
@@ -217,6 +271,7 @@ func newListNode(depth uint) listNode {
 type listBranchNode struct {
 	d        uint // depth
 	children [listNodeSize]listNode
+	digest   digestCache
 }
 
 // depth returns the depth of this branch node from the leaf.
@@ -239,9 +294,9 @@ func (n *listBranchNode) set(index int, v interface{}) listNode {
 	}
 
 	// Return a copy of this branch with the new child.
-	other := *n
+	other := &listBranchNode{d: n.d, children: n.children}
 	other.children[idx] = child.set(index, v)
-	return &other
+	return other
 }
 
 // containsBefore returns true if non-nil values exists between [0,index).
@@ -317,6 +372,7 @@ func (n *listBranchNode) deleteAfter(index int) listNode {
 // listLeafNode represents a leaf node in a List.
 type listLeafNode struct {
 	children [listNodeSize]interface{}
+	digest   digestCache
 }
 
 // depth always returns 0 for leaf nodes.
@@ -330,9 +386,9 @@ func (n *listLeafNode) get(index int) interface{} {
 // set returns a copy of the node with the value at the index updated to v.
 func (n *listLeafNode) set(index int, v interface{}) listNode {
 	idx := index & listNodeMask
-	other := *n
+	other := &listLeafNode{children: n.children}
 	other.children[idx] = v
-	return &other
+	return other
 }
 
 // containsBefore returns true if non-nil values exists between [0,index).
@@ -455,6 +511,44 @@ func (itr *ListIterator) Next() (index int, value interface{}) {
 	return index, value
 }
 
+// NextChunk returns the values from the current index to the end of the
+// current leaf node and moves the iterator forward past them. Up to 32 values
+// are returned at a time. Returns nil if there are no more elements to return.
+//
+// The returned slice refers to the list's internal storage and must not be
+// modified. It remains valid after the iterator moves.
+func (itr *ListIterator) NextChunk() []interface{} {
+	// Exit immediately if there are no elements remaining.
+	if itr.Done() {
+		return nil
+	}
+
+	// Limit the chunk to the end of the leaf or the end of the list.
+	elem := &itr.stack[itr.depth]
+	lo := elem.index
+	hi := lo + itr.list.Len() - itr.index
+	if hi > listNodeSize {
+		hi = listNodeSize
+	}
+	values := elem.node.(*listLeafNode).children[lo:hi:hi]
+
+	// Move past the chunk. If index is at the end then return immediately.
+	itr.index += hi - lo
+	if itr.Done() {
+		return values
+	}
+
+	// Move up stack until we find a node that has remaining position ahead.
+	elem.index = hi - 1
+	for ; itr.depth > 0 && itr.stack[itr.depth].index >= listNodeSize-1; itr.depth-- {
+	}
+
+	// Seek to correct position from current depth.
+	itr.seek(itr.index)
+
+	return values
+}
+
 // Prev returns the current index and value and moves the iterator backward.
 // Returns an index of -1 if the there are no more elements to return.
 func (itr *ListIterator) Prev() (index int, value interface{}) {
@@ -526,20 +620,34 @@ const (
 //
 // It is implemented as an Hash Array Mapped Trie.
 type Map struct {
-	size   int     // total number of key/value pairs
-	root   mapNode // root node of trie
-	hasher Hasher  // hasher implementation
+	size    int          // total number of key/value pairs
+	root    mapNode      // root node of trie
+	hasher  Hasher       // hasher implementation
+	equaler ValueEqualer // optional value equality check for Set
 }
 
 // NewMap returns a new instance of Map. If hasher is nil, a default hasher
 // implementation will automatically be chosen based on the first key added.
-// Default hasher implementations only exist for int, string, and byte slice types.
+// Default hasher implementations exist for the types supported by NewHasher.
+// String, byte slice, and byte array hashers use a random seed that is chosen
+// once per process.
 func NewMap(hasher Hasher) *Map {
 	return &Map{
 		hasher: hasher,
 	}
 }
 
+// WithValueEqualer returns a copy of the map that uses eq to compare values.
+// Set returns the original map when the new value is equal to the existing
+// value for the key. A nil equaler restores the default behavior.
+//
+// The equaler is not encoded and must be set again on decoded maps.
+func (m *Map) WithValueEqualer(eq ValueEqualer) *Map {
+	other := *m
+	other.equaler = eq
+	return &other
+}
+
 // Len returns the number of elements in the map.
 func (m *Map) Len() int {
 	return m.size
@@ -552,26 +660,19 @@ func (m *Map) Get(key interface{}) (value interface{}, ok bool) {
 	if m.root == nil {
 		return nil, false
 	}
-	keyHash := m.hasher.Hash(key)
+	keyHash := hashKey(m.hasher, key)
 	return m.root.get(key, 0, keyHash, m.hasher)
 }
 
 // Set returns a map with the key set to the new value. A nil value is allowed.
 //
 // This function will return a new map even if the updated value is the same as
-// the existing value because Map does not track value equality.
+// the existing value unless the map has a ValueEqualer. See WithValueEqualer.
 func (m *Map) Set(key, value interface{}) *Map {
 	// Set a hasher on the first value if one does not already exist.
 	hasher := m.hasher
 	if hasher == nil {
-		switch key.(type) {
-		case int:
-			hasher = &intHasher{}
-		case string:
-			hasher = &stringHasher{}
-		case []byte:
-			hasher = &byteSliceHasher{}
-		default:
+		if hasher = defaultHasher(key); hasher == nil {
 			panic(fmt.Sprintf("immutable.Map.Set: must set hasher for %T type", key))
 		}
 	}
@@ -579,19 +680,27 @@ func (m *Map) Set(key, value interface{}) *Map {
 	// If the map is empty, initialize with a simple array node.
 	if m.root == nil {
 		return &Map{
-			size:   1,
-			root:   &mapArrayNode{entries: []mapEntry{{key: key, value: value}}},
-			hasher: hasher,
+			size:    1,
+			root:    &mapArrayNode{entries: []mapEntry{{key: key, value: value}}},
+			hasher:  hasher,
+			equaler: m.equaler,
 		}
 	}
 
+	// Compare against the existing value during insertion if values can be
+	// checked for equality.
+	if m.equaler != nil {
+		return m.update(key, hasher, func(interface{}, bool) (interface{}, bool) { return value, true })
+	}
+
 	// Otherwise copy the map and delegate insertion to the root.
 	// Resized will return true if the key does not currently exist.
 	var resized bool
 	other := &Map{
-		size:   m.size,
-		root:   m.root.set(key, value, 0, hasher.Hash(key), hasher, &resized),
-		hasher: hasher,
+		size:    m.size,
+		root:    m.root.set(key, value, 0, hashKey(hasher, key), hasher, &resized),
+		hasher:  hasher,
+		equaler: m.equaler,
 	}
 	if resized {
 		other.size++
@@ -608,33 +717,163 @@ func (m *Map) Delete(key interface{}) *Map {
 	}
 
 	// If the delete did not change the node then return the original map.
-	newRoot := m.root.delete(key, 0, m.hasher.Hash(key), m.hasher)
+	newRoot := m.root.delete(key, 0, hashKey(m.hasher, key), m.hasher)
 	if newRoot == m.root {
 		return m
 	}
 
 	// Return copy of map with new root and decreased size.
 	return &Map{
-		size:   m.size - 1,
-		root:   newRoot,
-		hasher: m.hasher,
+		size:    m.size - 1,
+		root:    newRoot,
+		hasher:  m.hasher,
+		equaler: m.equaler,
 	}
 }
 
+// Update returns a map with the value for key replaced by the result of fn.
+// The fn function receives the current value and a flag indicating whether the
+// key exists. If fn returns false for keep then the key is removed. The key is
+// hashed and the trie is descended only once.
+//
+// The original map is returned if fn returns a value equal to the existing
+// value or removes a key that does not exist. Values are compared with the
+// map's ValueEqualer, if set, or by identity otherwise.
+func (m *Map) Update(key interface{}, fn func(old interface{}, exists bool) (value interface{}, keep bool)) *Map {
+	// Set a hasher on the first value if one does not already exist.
+	hasher := m.hasher
+	if hasher == nil {
+		if hasher = defaultHasher(key); hasher == nil {
+			panic(fmt.Sprintf("immutable.Map.Update: must set hasher for %T type", key))
+		}
+	}
+
+	// If the map is empty, initialize with a simple array node if the key is kept.
+	if m.root == nil {
+		value, keep := fn(nil, false)
+		if !keep {
+			return m
+		}
+		return &Map{
+			size:    1,
+			root:    &mapArrayNode{entries: []mapEntry{{key: key, value: value}}},
+			hasher:  hasher,
+			equaler: m.equaler,
+		}
+	}
+	return m.update(key, hasher, fn)
+}
+
+// update applies fn to the value for key in a non-empty map. Returns the
+// original map if the update did not change the root.
+func (m *Map) update(key interface{}, hasher Hasher, fn mapUpdateFunc) *Map {
+	var delta int
+	newRoot := m.root.update(key, 0, hashKey(hasher, key), hasher, m.equaler, fn, &delta)
+	if newRoot == m.root {
+		return m
+	}
+	return &Map{
+		size:    m.size + delta,
+		root:    newRoot,
+		hasher:  hasher,
+		equaler: m.equaler,
+	}
+}
+
+// Equal returns true if m and other contain the same keys with equal values.
+// Values are compared with valueEq, or with == if valueEq is nil. The order in
+// which keys were inserted or deleted does not affect the result. Subtrees
+// shared by both maps are not compared.
+func (m *Map) Equal(other *Map, valueEq func(a, b interface{}) bool) bool {
+	if m.Len() != other.Len() {
+		return false
+	}
+	return diffMaps(m, other, valueEq, func(Change) bool { return false })
+}
+
 // Iterator returns a new iterator for the map.
+//
+// Iteration order depends only on the keys in the map and the hasher's seed,
+// not on the order in which they were inserted. Maps created with a nil hasher
+// share a random seed chosen once per process so their iteration order is the
+// same within a process but differs between processes. Keys with equal hashes are ordered by the hasher if it also
+// implements Comparer. The built-in hashers implement Comparer.
 func (m *Map) Iterator() *MapIterator {
 	itr := &MapIterator{m: m}
 	itr.First()
 	return itr
 }
 
+// IteratorAt returns a new iterator positioned at a position previously
+// returned by MapIterator.Position(). A nil position returns an iterator at
+// the first key/value pair.
+//
+// Positions encode a path through the map's trie so they are only meaningful
+// for the map that produced them. Returns an error if pos does not describe a
+// key/value pair in this map.
+func (m *Map) IteratorAt(pos []byte) (*MapIterator, error) {
+	itr := &MapIterator{m: m}
+	if pos == nil {
+		itr.First()
+		return itr, nil
+	} else if m.root == nil {
+		return nil, errors.New("immutable.Map.IteratorAt: invalid position")
+	}
+
+	itr.stack[0] = mapIteratorElem{node: m.root}
+	for itr.depth = 0; ; itr.depth++ {
+		v, n := binary.Uvarint(pos)
+		if n <= 0 {
+			return nil, errors.New("immutable.Map.IteratorAt: invalid position")
+		}
+		pos = pos[n:]
+
+		// Validate the index against the node and descend into branches.
+		elem := &itr.stack[itr.depth]
+		elem.index = int(v)
+		var child mapNode
+		switch node := elem.node.(type) {
+		case *mapBitmapIndexedNode:
+			if v < uint64(len(node.nodes)) {
+				child = node.nodes[v]
+			}
+		case *mapHashArrayNode:
+			if v < uint64(len(node.nodes)) {
+				child = node.nodes[v]
+			}
+		case *mapArrayNode:
+			if v < uint64(len(node.entries)) && len(pos) == 0 {
+				return itr, nil
+			}
+		case *mapHashCollisionNode:
+			if v < uint64(len(node.entries)) && len(pos) == 0 {
+				return itr, nil
+			}
+		case *mapValueNode:
+			if v == 0 && len(pos) == 0 {
+				return itr, nil
+			}
+		}
+
+		if child == nil || itr.depth+1 >= len(itr.stack) {
+			return nil, errors.New("immutable.Map.IteratorAt: invalid position")
+		}
+		itr.stack[itr.depth+1] = mapIteratorElem{node: child}
+	}
+}
+
 // mapNode represents any node in the map tree.
 type mapNode interface {
-	get(key interface{}, shift uint, keyHash uint32, h Hasher) (value interface{}, ok bool)
-	set(key, value interface{}, shift uint, keyHash uint32, h Hasher, resized *bool) mapNode
-	delete(key interface{}, shift uint, keyHash uint32, h Hasher) mapNode
+	get(key interface{}, shift uint, keyHash uint64, h Hasher) (value interface{}, ok bool)
+	set(key, value interface{}, shift uint, keyHash uint64, h Hasher, resized *bool) mapNode
+	delete(key interface{}, shift uint, keyHash uint64, h Hasher) mapNode
+	update(key interface{}, shift uint, keyHash uint64, h Hasher, eq ValueEqualer, fn mapUpdateFunc, delta *int) mapNode
+	updateMany(ops []mapBatchOp, shift uint, h Hasher, eq ValueEqualer, delta *int) mapNode
 }
 
+// mapUpdateFunc is the function passed to Map.Update.
+type mapUpdateFunc func(old interface{}, exists bool) (value interface{}, keep bool)
+
 var _ mapNode = (*mapArrayNode)(nil)
 var _ mapNode = (*mapBitmapIndexedNode)(nil)
 var _ mapNode = (*mapHashArrayNode)(nil)
@@ -644,7 +883,7 @@ var _ mapNode = (*mapHashCollisionNode)(nil)
 // mapLeafNode represents a node that stores a single key hash at the leaf of the map tree.
 type mapLeafNode interface {
 	mapNode
-	keyHashValue() uint32
+	keyHashValue() uint64
 }
 
 var _ mapLeafNode = (*mapValueNode)(nil)
@@ -655,6 +894,21 @@ var _ mapLeafNode = (*mapHashCollisionNode)(nil)
 // indexed node once a given threshold size is crossed.
 type mapArrayNode struct {
 	entries []mapEntry
+	hashes  []uint64 // key hash of each entry, nil if not yet computed
+	digest  digestCache
+}
+
+// keyHashes returns the key hash of each entry, computing them if the node
+// was created without them.
+func (n *mapArrayNode) keyHashes(h Hasher) []uint64 {
+	if len(n.hashes) == len(n.entries) {
+		return n.hashes
+	}
+	hashes := make([]uint64, len(n.entries))
+	for i := range n.entries {
+		hashes[i] = hashKey(h, n.entries[i].key)
+	}
+	return hashes
 }
 
 // indexOf returns the entry index of the given key. Returns -1 if key not found.
@@ -668,7 +922,7 @@ func (n *mapArrayNode) indexOf(key interface{}, h Hasher) int {
 }
 
 // get returns the value for the given key.
-func (n *mapArrayNode) get(key interface{}, shift uint, keyHash uint32, h Hasher) (value interface{}, ok bool) {
+func (n *mapArrayNode) get(key interface{}, shift uint, keyHash uint64, h Hasher) (value interface{}, ok bool) {
 	i := n.indexOf(key, h)
 	if i == -1 {
 		return nil, false
@@ -678,7 +932,7 @@ func (n *mapArrayNode) get(key interface{}, shift uint, keyHash uint32, h Hasher
 
 // set inserts or updates the value for a given key. If the key is inserted and
 // the new size crosses the max size threshold, a bitmap indexed node is returned.
-func (n *mapArrayNode) set(key, value interface{}, shift uint, keyHash uint32, h Hasher, resized *bool) mapNode {
+func (n *mapArrayNode) set(key, value interface{}, shift uint, keyHash uint64, h Hasher, resized *bool) mapNode {
 	idx := n.indexOf(key, h)
 
 	// Mark as resized if the key doesn't exist.
@@ -688,32 +942,49 @@ func (n *mapArrayNode) set(key, value interface{}, shift uint, keyHash uint32, h
 
 	// If we are adding and it crosses the max size threshold, expand the node.
 	// We do this by continually setting the entries to a value node and expanding.
+	hashes := n.keyHashes(h)
 	if idx == -1 && len(n.entries) >= maxArrayMapSize {
-		var node mapNode = newMapValueNode(h.Hash(key), key, value)
-		for _, entry := range n.entries {
-			node = node.set(entry.key, entry.value, 0, h.Hash(entry.key), h, resized)
+		var node mapNode = newMapValueNode(keyHash, key, value)
+		for i, entry := range n.entries {
+			node = node.set(entry.key, entry.value, 0, hashes[i], h, resized)
 		}
 		return node
 	}
 
 	// Update existing entry if a match is found.
-	// Otherwise append to the end of the element list if it doesn't exist.
+	// Otherwise insert in the order that the keys would be iterated in a branch
+	// node so that iteration order does not depend on insertion order.
 	var other mapArrayNode
 	if idx != -1 {
 		other.entries = make([]mapEntry, len(n.entries))
 		copy(other.entries, n.entries)
 		other.entries[idx] = mapEntry{key, value}
+		other.hashes = hashes
 	} else {
+		idx = len(n.entries)
+		for i := range n.entries {
+			if mapKeyLess(key, keyHash, n.entries[i].key, hashes[i], h) {
+				idx = i
+				break
+			}
+		}
+
 		other.entries = make([]mapEntry, len(n.entries)+1)
-		copy(other.entries, n.entries)
-		other.entries[len(other.entries)-1] = mapEntry{key, value}
+		copy(other.entries[:idx], n.entries[:idx])
+		copy(other.entries[idx+1:], n.entries[idx:])
+		other.entries[idx] = mapEntry{key, value}
+
+		other.hashes = make([]uint64, len(hashes)+1)
+		copy(other.hashes[:idx], hashes[:idx])
+		copy(other.hashes[idx+1:], hashes[idx:])
+		other.hashes[idx] = keyHash
 	}
 	return &other
 }
 
 // delete removes the given key from the node. Returns the same node if key does
 // not exist. Returns a nil node when removing the last entry.
-func (n *mapArrayNode) delete(key interface{}, shift uint, keyHash uint32, h Hasher) mapNode {
+func (n *mapArrayNode) delete(key interface{}, shift uint, keyHash uint64, h Hasher) mapNode {
 	idx := n.indexOf(key, h)
 
 	// Return original node if key does not exist.
@@ -730,19 +1001,33 @@ func (n *mapArrayNode) delete(key interface{}, shift uint, keyHash uint32, h Has
 	other := &mapArrayNode{entries: make([]mapEntry, len(n.entries)-1)}
 	copy(other.entries[:idx], n.entries[:idx])
 	copy(other.entries[idx:], n.entries[idx+1:])
+	if len(n.hashes) == len(n.entries) {
+		other.hashes = make([]uint64, len(n.hashes)-1)
+		copy(other.hashes[:idx], n.hashes[:idx])
+		copy(other.hashes[idx:], n.hashes[idx+1:])
+	}
 	return other
 }
 
+// update applies fn to the value for the given key.
+func (n *mapArrayNode) update(key interface{}, shift uint, keyHash uint64, h Hasher, eq ValueEqualer, fn mapUpdateFunc, delta *int) mapNode {
+	if idx := n.indexOf(key, h); idx != -1 {
+		return updateLeafNode(n, key, n.entries[idx].value, true, shift, keyHash, h, eq, fn, delta)
+	}
+	return updateLeafNode(n, key, nil, false, shift, keyHash, h, eq, fn, delta)
+}
+
 // mapBitmapIndexedNode represents a map branch node with a variable number of
 // node slots and indexed using a bitmap. Indexes for the node slots are
 // calculated by counting the number of set bits before the target bit using popcount.
 type mapBitmapIndexedNode struct {
 	bitmap uint32
 	nodes  []mapNode
+	digest digestCache
 }
 
 // get returns the value for the given key.
-func (n *mapBitmapIndexedNode) get(key interface{}, shift uint, keyHash uint32, h Hasher) (value interface{}, ok bool) {
+func (n *mapBitmapIndexedNode) get(key interface{}, shift uint, keyHash uint64, h Hasher) (value interface{}, ok bool) {
 	bit := uint32(1) << ((keyHash >> shift) & mapNodeMask)
 	if (n.bitmap & bit) == 0 {
 		return nil, false
@@ -753,7 +1038,7 @@ func (n *mapBitmapIndexedNode) get(key interface{}, shift uint, keyHash uint32,
 
 // set inserts or updates the value for the given key. If a new key is inserted
 // and the size crosses the max size threshold then a hash array node is returned.
-func (n *mapBitmapIndexedNode) set(key, value interface{}, shift uint, keyHash uint32, h Hasher, resized *bool) mapNode {
+func (n *mapBitmapIndexedNode) set(key, value interface{}, shift uint, keyHash uint64, h Hasher, resized *bool) mapNode {
 	// Extract the index for the bit segment of the key hash.
 	keyHashFrag := (keyHash >> shift) & mapNodeMask
 
@@ -812,7 +1097,7 @@ func (n *mapBitmapIndexedNode) set(key, value interface{}, shift uint, keyHash u
 // delete removes the key from the tree. If the key does not exist then the
 // original node is returned. If removing the last child node then a nil is
 // returned. Note that shrinking the node will not convert it to an array node.
-func (n *mapBitmapIndexedNode) delete(key interface{}, shift uint, keyHash uint32, h Hasher) mapNode {
+func (n *mapBitmapIndexedNode) delete(key interface{}, shift uint, keyHash uint64, h Hasher) mapNode {
 	bit := uint32(1) << ((keyHash >> shift) & mapNodeMask)
 
 	// Return original node if key does not exist.
@@ -832,8 +1117,41 @@ func (n *mapBitmapIndexedNode) delete(key interface{}, shift uint, keyHash uint3
 		return n
 	}
 
+	return n.replaceChild(idx, bit, newChild)
+}
+
+// update applies fn to the value for the given key. If the key's slot is empty
+// then fn is called directly and a value node is inserted if the key is kept.
+func (n *mapBitmapIndexedNode) update(key interface{}, shift uint, keyHash uint64, h Hasher, eq ValueEqualer, fn mapUpdateFunc, delta *int) mapNode {
+	bit := uint32(1) << ((keyHash >> shift) & mapNodeMask)
+
+	// Insert into an empty slot using set so the node can expand if needed.
+	if (n.bitmap & bit) == 0 {
+		value, keep := fn(nil, false)
+		if !keep {
+			return n
+		}
+		*delta = 1
+		var resized bool
+		return n.set(key, value, shift, keyHash, h, &resized)
+	}
+
+	// Delegate update to child node. Return original node if child is unchanged.
+	idx := bits.OnesCount32(n.bitmap & (bit - 1))
+	child := n.nodes[idx]
+	newChild := child.update(key, shift+mapNodeBits, keyHash, h, eq, fn, delta)
+	if newChild == child {
+		return n
+	}
+	return n.replaceChild(idx, bit, newChild)
+}
+
+// replaceChild returns a copy of the node with the child at idx replaced. If
+// child is nil then the child & its bit are removed. Returns nil if the last
+// child is removed.
+func (n *mapBitmapIndexedNode) replaceChild(idx int, bit uint32, child mapNode) mapNode {
 	// Remove if returned child has been deleted.
-	if newChild == nil {
+	if child == nil {
 		// If we won't have any children then return nil.
 		if len(n.nodes) == 1 {
 			return nil
@@ -849,19 +1167,20 @@ func (n *mapBitmapIndexedNode) delete(key interface{}, shift uint, keyHash uint3
 	// Return copy with child updated.
 	other := &mapBitmapIndexedNode{bitmap: n.bitmap, nodes: make([]mapNode, len(n.nodes))}
 	copy(other.nodes, n.nodes)
-	other.nodes[idx] = newChild
+	other.nodes[idx] = child
 	return other
 }
 
 // mapHashArrayNode is a map branch node that stores nodes in a fixed length
 // array. Child nodes are indexed by their index bit segment for the current depth.
 type mapHashArrayNode struct {
-	count uint                 // number of set nodes
-	nodes [mapNodeSize]mapNode // child node slots, may contain empties
+	count  uint                 // number of set nodes
+	nodes  [mapNodeSize]mapNode // child node slots, may contain empties
+	digest digestCache
 }
 
 // get returns the value for the given key.
-func (n *mapHashArrayNode) get(key interface{}, shift uint, keyHash uint32, h Hasher) (value interface{}, ok bool) {
+func (n *mapHashArrayNode) get(key interface{}, shift uint, keyHash uint64, h Hasher) (value interface{}, ok bool) {
 	node := n.nodes[(keyHash>>shift)&mapNodeMask]
 	if node == nil {
 		return nil, false
@@ -870,7 +1189,7 @@ func (n *mapHashArrayNode) get(key interface{}, shift uint, keyHash uint32, h Ha
 }
 
 // set returns a node with the value set for the given key.
-func (n *mapHashArrayNode) set(key, value interface{}, shift uint, keyHash uint32, h Hasher, resized *bool) mapNode {
+func (n *mapHashArrayNode) set(key, value interface{}, shift uint, keyHash uint64, h Hasher, resized *bool) mapNode {
 	idx := (keyHash >> shift) & mapNodeMask
 	node := n.nodes[idx]
 
@@ -885,18 +1204,18 @@ func (n *mapHashArrayNode) set(key, value interface{}, shift uint, keyHash uint3
 	}
 
 	// Return a copy of node with updated child node (and updated size, if new).
-	other := *n
+	other := &mapHashArrayNode{count: n.count, nodes: n.nodes}
 	if node == nil {
 		other.count++
 	}
 	other.nodes[idx] = newNode
-	return &other
+	return other
 }
 
 // delete returns a node with the given key removed. Returns the same node if
 // the key does not exist. If node shrinks to within bitmap-indexed size then
 // converts to a bitmap-indexed node.
-func (n *mapHashArrayNode) delete(key interface{}, shift uint, keyHash uint32, h Hasher) mapNode {
+func (n *mapHashArrayNode) delete(key interface{}, shift uint, keyHash uint64, h Hasher) mapNode {
 	idx := (keyHash >> shift) & mapNodeMask
 	node := n.nodes[idx]
 
@@ -911,38 +1230,72 @@ func (n *mapHashArrayNode) delete(key interface{}, shift uint, keyHash uint32, h
 		return n
 	}
 
+	return n.replaceChild(idx, newNode)
+}
+
+// update applies fn to the value for the given key. If the key's slot is empty
+// then fn is called directly and a value node is inserted if the key is kept.
+func (n *mapHashArrayNode) update(key interface{}, shift uint, keyHash uint64, h Hasher, eq ValueEqualer, fn mapUpdateFunc, delta *int) mapNode {
+	idx := (keyHash >> shift) & mapNodeMask
+	node := n.nodes[idx]
+
+	// Insert a value node into an empty slot if the key is kept.
+	if node == nil {
+		value, keep := fn(nil, false)
+		if !keep {
+			return n
+		}
+		*delta = 1
+		other := &mapHashArrayNode{count: n.count + 1, nodes: n.nodes}
+		other.nodes[idx] = newMapValueNode(keyHash, key, value)
+		return other
+	}
+
+	// Delegate update to child node. Return original node if child is unchanged.
+	newNode := node.update(key, shift+mapNodeBits, keyHash, h, eq, fn, delta)
+	if newNode == node {
+		return n
+	}
+	return n.replaceChild(idx, newNode)
+}
+
+// replaceChild returns a copy of the node with the child at idx replaced. If
+// child is nil and the node drops below a threshold then it is converted back
+// to a bitmap indexed node.
+func (n *mapHashArrayNode) replaceChild(idx uint64, child mapNode) mapNode {
 	// If we remove a node and drop below a threshold, convert back to bitmap indexed node.
-	if newNode == nil && n.count <= maxBitmapIndexedSize {
+	if child == nil && n.count <= maxBitmapIndexedSize {
 		other := &mapBitmapIndexedNode{nodes: make([]mapNode, 0, n.count-1)}
-		for i, child := range n.nodes {
-			if child != nil && uint32(i) != idx {
+		for i, node := range n.nodes {
+			if node != nil && uint64(i) != idx {
 				other.bitmap |= 1 << uint(i)
-				other.nodes = append(other.nodes, child)
+				other.nodes = append(other.nodes, node)
 			}
 		}
 		return other
 	}
 
 	// Return copy of node with child updated.
-	other := *n
-	other.nodes[idx] = newNode
-	if newNode == nil {
+	other := &mapHashArrayNode{count: n.count, nodes: n.nodes}
+	other.nodes[idx] = child
+	if child == nil {
 		other.count--
 	}
-	return &other
+	return other
 }
 
 // mapValueNode represents a leaf node with a single key/value pair.
 // A value node can be converted to a hash collision leaf node if a different
 // key with the same keyHash is inserted.
 type mapValueNode struct {
-	keyHash uint32
+	keyHash uint64
 	key     interface{}
 	value   interface{}
+	digest  digestCache
 }
 
 // newMapValueNode returns a new instance of mapValueNode.
-func newMapValueNode(keyHash uint32, key, value interface{}) *mapValueNode {
+func newMapValueNode(keyHash uint64, key, value interface{}) *mapValueNode {
 	return &mapValueNode{
 		keyHash: keyHash,
 		key:     key,
@@ -951,12 +1304,12 @@ func newMapValueNode(keyHash uint32, key, value interface{}) *mapValueNode {
 }
 
 // keyHashValue returns the key hash for this node.
-func (n *mapValueNode) keyHashValue() uint32 {
+func (n *mapValueNode) keyHashValue() uint64 {
 	return n.keyHash
 }
 
 // get returns the value for the given key.
-func (n *mapValueNode) get(key interface{}, shift uint, keyHash uint32, h Hasher) (value interface{}, ok bool) {
+func (n *mapValueNode) get(key interface{}, shift uint, keyHash uint64, h Hasher) (value interface{}, ok bool) {
 	if !h.Equal(n.key, key) {
 		return nil, false
 	}
@@ -967,7 +1320,7 @@ func (n *mapValueNode) get(key interface{}, shift uint, keyHash uint32, h Hasher
 // the node's key then a new value node is returned. If key is not equal to the
 // node's key but has the same hash then a hash collision node is returned.
 // Otherwise the nodes are merged into a branch node.
-func (n *mapValueNode) set(key, value interface{}, shift uint, keyHash uint32, h Hasher, resized *bool) mapNode {
+func (n *mapValueNode) set(key, value interface{}, shift uint, keyHash uint64, h Hasher, resized *bool) mapNode {
 	// If the keys match then return a new value node overwriting the value.
 	if h.Equal(n.key, key) {
 		return newMapValueNode(n.keyHash, key, value)
@@ -981,14 +1334,15 @@ func (n *mapValueNode) set(key, value interface{}, shift uint, keyHash uint32, h
 	}
 
 	// Merge into collision node if hash matches.
-	return &mapHashCollisionNode{keyHash: keyHash, entries: []mapEntry{
-		{key: n.key, value: n.value},
-		{key: key, value: value},
-	}}
+	entries := []mapEntry{{key: n.key, value: n.value}, {key: key, value: value}}
+	if compareMapKeys(key, n.key, h) < 0 {
+		entries[0], entries[1] = entries[1], entries[0]
+	}
+	return &mapHashCollisionNode{keyHash: keyHash, entries: entries}
 }
 
 // delete returns nil if the key matches the node's key. Otherwise returns the original node.
-func (n *mapValueNode) delete(key interface{}, shift uint, keyHash uint32, h Hasher) mapNode {
+func (n *mapValueNode) delete(key interface{}, shift uint, keyHash uint64, h Hasher) mapNode {
 	// Return original node if the keys do not match.
 	if !h.Equal(n.key, key) {
 		return n
@@ -998,15 +1352,24 @@ func (n *mapValueNode) delete(key interface{}, shift uint, keyHash uint32, h Has
 	return nil
 }
 
+// update applies fn to the value for the given key.
+func (n *mapValueNode) update(key interface{}, shift uint, keyHash uint64, h Hasher, eq ValueEqualer, fn mapUpdateFunc, delta *int) mapNode {
+	if h.Equal(n.key, key) {
+		return updateLeafNode(n, key, n.value, true, shift, keyHash, h, eq, fn, delta)
+	}
+	return updateLeafNode(n, key, nil, false, shift, keyHash, h, eq, fn, delta)
+}
+
 // mapHashCollisionNode represents a leaf node that contains two or more key/value
 // pairs with the same key hash. Single pairs for a hash are stored as value nodes.
 type mapHashCollisionNode struct {
-	keyHash uint32 // key hash for all entries
+	keyHash uint64 // key hash for all entries
 	entries []mapEntry
+	digest  digestCache
 }
 
 // keyHashValue returns the key hash for all entries on the node.
-func (n *mapHashCollisionNode) keyHashValue() uint32 {
+func (n *mapHashCollisionNode) keyHashValue() uint64 {
 	return n.keyHash
 }
 
@@ -1022,7 +1385,7 @@ func (n *mapHashCollisionNode) indexOf(key interface{}, h Hasher) int {
 }
 
 // get returns the value for the given key.
-func (n *mapHashCollisionNode) get(key interface{}, shift uint, keyHash uint32, h Hasher) (value interface{}, ok bool) {
+func (n *mapHashCollisionNode) get(key interface{}, shift uint, keyHash uint64, h Hasher) (value interface{}, ok bool) {
 	for i := range n.entries {
 		if h.Equal(n.entries[i].key, key) {
 			return n.entries[i].value, true
@@ -1032,21 +1395,30 @@ func (n *mapHashCollisionNode) get(key interface{}, shift uint, keyHash uint32,
 }
 
 // set returns a copy of the node with key set to the given value.
-func (n *mapHashCollisionNode) set(key, value interface{}, shift uint, keyHash uint32, h Hasher, resized *bool) mapNode {
+func (n *mapHashCollisionNode) set(key, value interface{}, shift uint, keyHash uint64, h Hasher, resized *bool) mapNode {
 	// Merge node with key/value pair if this is not a hash collision.
 	if n.keyHash != keyHash {
 		*resized = true
 		return mergeIntoNode(n, shift, keyHash, key, value)
 	}
 
-	// Append to end of node if key doesn't exist & mark resized.
+	// Insert in key order if key doesn't exist & mark resized.
 	// Otherwise copy nodes and overwrite at matching key index.
 	other := &mapHashCollisionNode{keyHash: n.keyHash}
 	if idx := n.indexOf(key, h); idx == -1 {
 		*resized = true
+		idx = len(n.entries)
+		for i := range n.entries {
+			if compareMapKeys(key, n.entries[i].key, h) < 0 {
+				idx = i
+				break
+			}
+		}
+
 		other.entries = make([]mapEntry, len(n.entries)+1)
-		copy(other.entries, n.entries)
-		other.entries[len(other.entries)-1] = mapEntry{key, value}
+		copy(other.entries[:idx], n.entries[:idx])
+		copy(other.entries[idx+1:], n.entries[idx:])
+		other.entries[idx] = mapEntry{key, value}
 	} else {
 		other.entries = make([]mapEntry, len(n.entries))
 		copy(other.entries, n.entries)
@@ -1058,7 +1430,7 @@ func (n *mapHashCollisionNode) set(key, value interface{}, shift uint, keyHash u
 // delete returns a node with the given key deleted. Returns the same node if
 // the key does not exist. If removing the key would shrink the node to a single
 // entry then a value node is returned.
-func (n *mapHashCollisionNode) delete(key interface{}, shift uint, keyHash uint32, h Hasher) mapNode {
+func (n *mapHashCollisionNode) delete(key interface{}, shift uint, keyHash uint64, h Hasher) mapNode {
 	idx := n.indexOf(key, h)
 
 	// Return original node if key is not found.
@@ -1082,9 +1454,42 @@ func (n *mapHashCollisionNode) delete(key interface{}, shift uint, keyHash uint3
 	return other
 }
 
+// update applies fn to the value for the given key.
+func (n *mapHashCollisionNode) update(key interface{}, shift uint, keyHash uint64, h Hasher, eq ValueEqualer, fn mapUpdateFunc, delta *int) mapNode {
+	if n.keyHash == keyHash {
+		if idx := n.indexOf(key, h); idx != -1 {
+			return updateLeafNode(n, key, n.entries[idx].value, true, shift, keyHash, h, eq, fn, delta)
+		}
+	}
+	return updateLeafNode(n, key, nil, false, shift, keyHash, h, eq, fn, delta)
+}
+
+// updateLeafNode calls fn with the current value of key in the leaf node n and
+// applies the result using the node's set or delete. Returns n if the key is
+// unchanged. Sets delta to the change in the number of keys.
+func updateLeafNode(n mapNode, key, old interface{}, exists bool, shift uint, keyHash uint64, h Hasher, eq ValueEqualer, fn mapUpdateFunc, delta *int) mapNode {
+	value, keep := fn(old, exists)
+	if !keep {
+		if !exists {
+			return n
+		}
+		*delta = -1
+		return n.delete(key, shift, keyHash, h)
+	} else if exists && valuesEqual(eq, old, value) {
+		return n
+	}
+
+	var resized bool
+	other := n.set(key, value, shift, keyHash, h, &resized)
+	if resized {
+		*delta = 1
+	}
+	return other
+}
+
 // mergeIntoNode merges a key/value pair into an existing node.
 // Caller must verify that node's keyHash is not equal to keyHash.
-func mergeIntoNode(node mapLeafNode, shift uint, keyHash uint32, key, value interface{}) mapNode {
+func mergeIntoNode(node mapLeafNode, shift uint, keyHash uint64, key, value interface{}) mapNode {
 	idx1 := (node.keyHashValue() >> shift) & mapNodeMask
 	idx2 := (keyHash >> shift) & mapNodeMask
 
@@ -1102,6 +1507,28 @@ func mergeIntoNode(node mapLeafNode, shift uint, keyHash uint32, key, value inte
 	return other
 }
 
+// mapKeyLess returns true if key a with hash ha is iterated before key b with
+// hash hb. Keys are ordered by each hash segment starting from the root of the
+// trie. Keys with equal hashes are ordered by compareMapKeys.
+func mapKeyLess(a interface{}, ha uint64, b interface{}, hb uint64, h Hasher) bool {
+	for shift := uint(0); shift < 64; shift += mapNodeBits {
+		if fa, fb := (ha>>shift)&mapNodeMask, (hb>>shift)&mapNodeMask; fa != fb {
+			return fa < fb
+		}
+	}
+	return compareMapKeys(a, b, h) < 0
+}
+
+// compareMapKeys compares two keys with equal hashes using the hasher if it
+// also implements Comparer. Otherwise keys are considered equal so that they
+// retain their insertion order.
+func compareMapKeys(a, b interface{}, h Hasher) int {
+	if c, ok := h.(Comparer); ok {
+		return c.Compare(a, b)
+	}
+	return 0
+}
+
 // mapEntry represents a single key/value pair.
 type mapEntry struct {
 	key   interface{}
@@ -1136,6 +1563,36 @@ func (itr *MapIterator) First() {
 	itr.first()
 }
 
+// Last moves the iterator to the last key/value pair.
+func (itr *MapIterator) Last() {
+	// Exit immediately if the map is empty.
+	if itr.m.root == nil {
+		itr.depth = -1
+		return
+	}
+
+	// Initialize the stack to the right most element.
+	itr.stack[0] = mapIteratorElem{node: itr.m.root}
+	itr.depth = 0
+	itr.last()
+}
+
+// Position returns an encoded path to the current key/value pair which can be
+// passed to Map.IteratorAt() to resume iteration from the same pair. Returns
+// nil if the iterator is done.
+func (itr *MapIterator) Position() []byte {
+	if itr.Done() {
+		return nil
+	}
+
+	pos := make([]byte, 0, itr.depth+1)
+	for i := 0; i <= itr.depth; i++ {
+		var buf [binary.MaxVarintLen64]byte
+		pos = append(pos, buf[:binary.PutUvarint(buf[:], uint64(itr.stack[i].index))]...)
+	}
+	return pos
+}
+
 // Next returns the next key/value pair. Returns a nil key when no elements remain.
 func (itr *MapIterator) Next() (key, value interface{}) {
 	// Return nil key if iteration is done.
@@ -1143,23 +1600,42 @@ func (itr *MapIterator) Next() (key, value interface{}) {
 		return nil, nil
 	}
 
-	// Retrieve current index & value. Current node is always a leaf.
+	// Retrieve current key/value pair. Then move up stack until we find a
+	// node that has remaining position ahead and move that element forward.
+	key, value = itr.peek()
+	itr.next()
+	return key, value
+}
+
+// Prev returns the current key/value pair and moves the iterator backward.
+// Returns a nil key when no elements remain.
+func (itr *MapIterator) Prev() (key, value interface{}) {
+	// Return nil key if iteration is done.
+	if itr.Done() {
+		return nil, nil
+	}
+
+	// Retrieve current key/value pair. Then move up stack until we find a
+	// node that has remaining position behind and move that element backward.
+	key, value = itr.peek()
+	itr.prev()
+	return key, value
+}
+
+// peek returns the current key/value pair. Current node is always a leaf.
+func (itr *MapIterator) peek() (key, value interface{}) {
 	elem := &itr.stack[itr.depth]
 	switch node := elem.node.(type) {
 	case *mapArrayNode:
 		entry := &node.entries[elem.index]
-		key, value = entry.key, entry.value
+		return entry.key, entry.value
 	case *mapValueNode:
-		key, value = node.key, node.value
+		return node.key, node.value
 	case *mapHashCollisionNode:
 		entry := &node.entries[elem.index]
-		key, value = entry.key, entry.value
+		return entry.key, entry.value
 	}
-
-	// Move up stack until we find a node that has remaining position ahead
-	// and move that element forward by one.
-	itr.next()
-	return key, value
+	return nil, nil
 }
 
 // next moves to the next available key.
@@ -1233,6 +1709,85 @@ func (itr *MapIterator) first() {
 	}
 }
 
+// prev moves to the previous available key.
+func (itr *MapIterator) prev() {
+	for ; itr.depth >= 0; itr.depth-- {
+		elem := &itr.stack[itr.depth]
+
+		switch node := elem.node.(type) {
+		case *mapArrayNode:
+			if elem.index > 0 {
+				elem.index--
+				return
+			}
+
+		case *mapBitmapIndexedNode:
+			if elem.index > 0 {
+				elem.index--
+				itr.stack[itr.depth+1].node = node.nodes[elem.index]
+				itr.depth++
+				itr.last()
+				return
+			}
+
+		case *mapHashArrayNode:
+			for i := elem.index - 1; i >= 0; i-- {
+				if node.nodes[i] != nil {
+					elem.index = i
+					itr.stack[itr.depth+1].node = node.nodes[elem.index]
+					itr.depth++
+					itr.last()
+					return
+				}
+			}
+
+		case *mapValueNode:
+			continue // always the first value, traverse up
+
+		case *mapHashCollisionNode:
+			if elem.index > 0 {
+				elem.index--
+				return
+			}
+		}
+	}
+}
+
+// last positions the stack right most index.
+// Elements and indexes at and below the current depth are assumed to be correct.
+func (itr *MapIterator) last() {
+	for ; ; itr.depth++ {
+		elem := &itr.stack[itr.depth]
+
+		switch node := elem.node.(type) {
+		case *mapBitmapIndexedNode:
+			elem.index = len(node.nodes) - 1
+			itr.stack[itr.depth+1].node = node.nodes[elem.index]
+
+		case *mapHashArrayNode:
+			for i := len(node.nodes) - 1; i >= 0; i-- {
+				if node.nodes[i] != nil { // find last node
+					elem.index = i
+					itr.stack[itr.depth+1].node = node.nodes[i]
+					break
+				}
+			}
+
+		case *mapArrayNode:
+			elem.index = len(node.entries) - 1
+			return
+
+		case *mapHashCollisionNode:
+			elem.index = len(node.entries) - 1
+			return
+
+		default: // *mapValueNode
+			elem.index = 0
+			return
+		}
+	}
+}
+
 // mapIteratorElem represents a node/index pair in the MapIterator stack.
 type mapIteratorElem struct {
 	node  mapNode
@@ -1252,17 +1807,29 @@ type SortedMap struct {
 	size     int           // total number of key/value pairs
 	root     sortedMapNode // root of b+tree
 	comparer Comparer
+	equaler  ValueEqualer // optional value equality check for Set
 }
 
 // NewSortedMap returns a new instance of SortedMap. If comparer is nil then
 // a default comparer is set after the first key is inserted. Default comparers
-// exist for int, string, and byte slice keys.
+// exist for the types supported by NewComparer.
 func NewSortedMap(comparer Comparer) *SortedMap {
 	return &SortedMap{
 		comparer: comparer,
 	}
 }
 
+// WithValueEqualer returns a copy of the map that uses eq to compare values.
+// Set returns the original map when the new value is equal to the existing
+// value for the key. A nil equaler restores the default behavior.
+//
+// The equaler is not encoded and must be set again on decoded maps.
+func (m *SortedMap) WithValueEqualer(eq ValueEqualer) *SortedMap {
+	other := *m
+	other.equaler = eq
+	return &other
+}
+
 // Len returns the number of elements in the sorted map.
 func (m *SortedMap) Len() int {
 	return m.size
@@ -1277,19 +1844,14 @@ func (m *SortedMap) Get(key interface{}) (interface{}, bool) {
 	return m.root.get(key, m.comparer)
 }
 
-// Set returns a copy of the map with the key set to the given value.
+// Set returns a copy of the map with the key set to the given value. If the map
+// has a ValueEqualer and the value is equal to the existing value then the
+// original map is returned. See WithValueEqualer.
 func (m *SortedMap) Set(key, value interface{}) *SortedMap {
 	// Set a comparer on the first value if one does not already exist.
 	comparer := m.comparer
 	if comparer == nil {
-		switch key.(type) {
-		case int:
-			comparer = &intComparer{}
-		case string:
-			comparer = &stringComparer{}
-		case []byte:
-			comparer = &byteSliceComparer{}
-		default:
+		if comparer = defaultComparer(key); comparer == nil {
 			panic(fmt.Sprintf("immutable.SortedMap.Set: must set comparer for %T type", key))
 		}
 	}
@@ -1300,9 +1862,16 @@ func (m *SortedMap) Set(key, value interface{}) *SortedMap {
 			size:     1,
 			root:     &sortedMapLeafNode{entries: []mapEntry{{key: key, value: value}}},
 			comparer: comparer,
+			equaler:  m.equaler,
 		}
 	}
 
+	// Compare against the existing value during insertion if values can be
+	// checked for equality.
+	if m.equaler != nil {
+		return m.update(key, comparer, func(interface{}, bool) (interface{}, bool) { return value, true })
+	}
+
 	// Otherwise delegate to root node.
 	// If a split occurs then grow the tree from the root.
 	var resized bool
@@ -1316,6 +1885,7 @@ func (m *SortedMap) Set(key, value interface{}) *SortedMap {
 		size:     m.size,
 		root:     newRoot,
 		comparer: comparer,
+		equaler:  m.equaler,
 	}
 	if resized {
 		other.size++
@@ -1342,6 +1912,59 @@ func (m *SortedMap) Delete(key interface{}) *SortedMap {
 		size:     m.size - 1,
 		root:     newRoot,
 		comparer: m.comparer,
+		equaler:  m.equaler,
+	}
+}
+
+// Update returns a copy of the map with the value for key replaced by the result
+// of fn. The fn function receives the current value and a flag indicating
+// whether the key exists. If fn returns false for keep then the key is removed.
+// The tree is descended only once.
+//
+// The original map is returned if fn returns a value equal to the existing
+// value or removes a key that does not exist. Values are compared with the
+// map's ValueEqualer, if set, or by identity otherwise.
+func (m *SortedMap) Update(key interface{}, fn func(old interface{}, exists bool) (value interface{}, keep bool)) *SortedMap {
+	// Set a comparer on the first value if one does not already exist.
+	comparer := m.comparer
+	if comparer == nil {
+		if comparer = defaultComparer(key); comparer == nil {
+			panic(fmt.Sprintf("immutable.SortedMap.Update: must set comparer for %T type", key))
+		}
+	}
+
+	// If no values are set then initialize with a leaf node if the key is kept.
+	if m.root == nil {
+		value, keep := fn(nil, false)
+		if !keep {
+			return m
+		}
+		return &SortedMap{
+			size:     1,
+			root:     &sortedMapLeafNode{entries: []mapEntry{{key: key, value: value}}},
+			comparer: comparer,
+			equaler:  m.equaler,
+		}
+	}
+	return m.update(key, comparer, fn)
+}
+
+// update applies fn to the value for key in a non-empty map. Returns the
+// original map if the root is unchanged. If a split occurs then the tree grows
+// from the root.
+func (m *SortedMap) update(key interface{}, comparer Comparer, fn mapUpdateFunc) *SortedMap {
+	var delta int
+	newRoot, splitNode := m.root.update(key, comparer, m.equaler, fn, &delta)
+	if newRoot == m.root {
+		return m
+	} else if splitNode != nil {
+		newRoot = newSortedMapBranchNode(newRoot, splitNode)
+	}
+	return &SortedMap{
+		size:     m.size + delta,
+		root:     newRoot,
+		comparer: comparer,
+		equaler:  m.equaler,
 	}
 }
 
@@ -1359,6 +1982,7 @@ type sortedMapNode interface {
 	get(key interface{}, c Comparer) (value interface{}, ok bool)
 	set(key, value interface{}, c Comparer, resized *bool) (sortedMapNode, sortedMapNode)
 	delete(key interface{}, c Comparer) sortedMapNode
+	update(key interface{}, c Comparer, eq ValueEqualer, fn mapUpdateFunc, delta *int) (sortedMapNode, sortedMapNode)
 }
 
 var _ sortedMapNode = (*sortedMapBranchNode)(nil)
@@ -1366,7 +1990,8 @@ var _ sortedMapNode = (*sortedMapLeafNode)(nil)
 
 // sortedMapBranchNode represents a branch in the sorted map.
 type sortedMapBranchNode struct {
-	elems []sortedMapBranchElem
+	elems  []sortedMapBranchElem
+	digest digestCache
 }
 
 // newSortedMapBranchNode returns a new branch node with the given child nodes.
@@ -1480,6 +2105,51 @@ func (n *sortedMapBranchNode) delete(key interface{}, c Comparer) sortedMapNode
 	return other
 }
 
+// update applies fn to the value for the given key. Returns the original node
+// if the key is unchanged. Returns nil if all child nodes are removed and
+// returns a split node if the child splits and this node has no more room.
+func (n *sortedMapBranchNode) update(key interface{}, c Comparer, eq ValueEqualer, fn mapUpdateFunc, delta *int) (sortedMapNode, sortedMapNode) {
+	idx := n.indexOf(key, c)
+
+	// Return original node if child has not changed.
+	child := n.elems[idx].node
+	newNode, splitNode := child.update(key, c, eq, fn, delta)
+	if newNode == child {
+		return n, nil
+	}
+
+	// Remove child if it is now nil.
+	if newNode == nil {
+		if len(n.elems) == 1 {
+			return nil, nil
+		}
+		other := &sortedMapBranchNode{elems: make([]sortedMapBranchElem, len(n.elems)-1)}
+		copy(other.elems[:idx], n.elems[:idx])
+		copy(other.elems[idx:], n.elems[idx+1:])
+		return other, nil
+	}
+
+	// Otherwise replace the child and insert the split node, if any.
+	var other sortedMapBranchNode
+	if splitNode == nil {
+		other.elems = make([]sortedMapBranchElem, len(n.elems))
+		copy(other.elems, n.elems)
+	} else {
+		other.elems = make([]sortedMapBranchElem, len(n.elems)+1)
+		copy(other.elems[:idx], n.elems[:idx])
+		copy(other.elems[idx+1:], n.elems[idx:])
+		other.elems[idx+1] = sortedMapBranchElem{key: splitNode.minKey(), node: splitNode}
+	}
+	other.elems[idx] = sortedMapBranchElem{key: newNode.minKey(), node: newNode}
+
+	// If the child splits and we have no more room then we split too.
+	if len(other.elems) > sortedMapNodeSize {
+		splitIdx := len(other.elems) / 2
+		return &sortedMapBranchNode{elems: other.elems[:splitIdx]}, &sortedMapBranchNode{elems: other.elems[splitIdx:]}
+	}
+	return &other, nil
+}
+
 type sortedMapBranchElem struct {
 	key  interface{}
 	node sortedMapNode
@@ -1488,6 +2158,7 @@ type sortedMapBranchElem struct {
 // sortedMapLeafNode represents a leaf node in the sorted map.
 type sortedMapLeafNode struct {
 	entries []mapEntry
+	digest  digestCache
 }
 
 // minKey returns the first key stored in this node.
@@ -1569,6 +2240,35 @@ func (n *sortedMapLeafNode) delete(key interface{}, c Comparer) sortedMapNode {
 	return other
 }
 
+// update applies fn to the value for the given key using the node's set or
+// delete. Returns the original node if the key is unchanged.
+func (n *sortedMapLeafNode) update(key interface{}, c Comparer, eq ValueEqualer, fn mapUpdateFunc, delta *int) (sortedMapNode, sortedMapNode) {
+	var old interface{}
+	idx := n.indexOf(key, c)
+	exists := idx < len(n.entries) && c.Compare(n.entries[idx].key, key) == 0
+	if exists {
+		old = n.entries[idx].value
+	}
+
+	value, keep := fn(old, exists)
+	if !keep {
+		if !exists {
+			return n, nil
+		}
+		*delta = -1
+		return n.delete(key, c), nil
+	} else if exists && valuesEqual(eq, old, value) {
+		return n, nil
+	}
+
+	var resized bool
+	newNode, splitNode := n.set(key, value, c, &resized)
+	if resized {
+		*delta = 1
+	}
+	return newNode, splitNode
+}
+
 // SortedMapIterator represents an iterator over a sorted map.
 // Iteration can occur in natural or reverse order based on use of Next() or Prev().
 type SortedMapIterator struct {
@@ -1576,6 +2276,10 @@ type SortedMapIterator struct {
 
 	stack [32]sortedMapIteratorElem // search stack
 	depth int                       // stack depth
+
+	cursor    interface{} // last key returned by Next() or Prev()
+	hasCursor bool        // true if cursor is set
+	reverse   bool        // true if cursor was returned by Prev()
 }
 
 // Done returns true if no more key/value pairs remain in the iterator.
@@ -1585,6 +2289,7 @@ func (itr *SortedMapIterator) Done() bool {
 
 // First moves the iterator to the first key/value pair.
 func (itr *SortedMapIterator) First() {
+	itr.resetCursor()
 	if itr.m.root == nil {
 		itr.depth = -1
 		return
@@ -1596,6 +2301,7 @@ func (itr *SortedMapIterator) First() {
 
 // Last moves the iterator to the last key/value pair.
 func (itr *SortedMapIterator) Last() {
+	itr.resetCursor()
 	if itr.m.root == nil {
 		itr.depth = -1
 		return
@@ -1609,6 +2315,7 @@ func (itr *SortedMapIterator) Last() {
 // If the key does not exist then the next key is used. If no more keys exist
 // then the iteartor is marked as done.
 func (itr *SortedMapIterator) Seek(key interface{}) {
+	itr.resetCursor()
 	if itr.m.root == nil {
 		itr.depth = -1
 		return
@@ -1631,6 +2338,7 @@ func (itr *SortedMapIterator) Next() (key, value interface{}) {
 	leafNode := leafElem.node.(*sortedMapLeafNode)
 	leafEntry := &leafNode.entries[leafElem.index]
 	key, value = leafEntry.key, leafEntry.value
+	itr.cursor, itr.hasCursor, itr.reverse = key, true, false
 
 	// Move to the next available key/value pair.
 	itr.next()
@@ -1639,6 +2347,20 @@ func (itr *SortedMapIterator) Next() (key, value interface{}) {
 	return key, value
 }
 
+// peek returns the current key/value pair without moving the iterator.
+func (itr *SortedMapIterator) peek() (key, value interface{}) {
+	elem := &itr.stack[itr.depth]
+	entry := &elem.node.(*sortedMapLeafNode).entries[elem.index]
+	return entry.key, entry.value
+}
+
+// skip moves the iterator past all remaining keys in the node at depth.
+func (itr *SortedMapIterator) skip(depth int) {
+	itr.depth = depth
+	itr.last()
+	itr.next()
+}
+
 // next moves to the next key. If no keys are after then depth is set to -1.
 func (itr *SortedMapIterator) next() {
 	for ; itr.depth >= 0; itr.depth-- {
@@ -1675,6 +2397,7 @@ func (itr *SortedMapIterator) Prev() (key, value interface{}) {
 	leafNode := leafElem.node.(*sortedMapLeafNode)
 	leafEntry := &leafNode.entries[leafElem.index]
 	key, value = leafEntry.key, leafEntry.value
+	itr.cursor, itr.hasCursor, itr.reverse = key, true, true
 
 	itr.prev()
 	return key, value
@@ -1758,6 +2481,83 @@ func (itr *SortedMapIterator) seek(key interface{}) {
 	}
 }
 
+// Cursor returns a serializable token that records the key last returned by
+// Next() or Prev() and the direction of iteration. The token can be passed to
+// SortedMap.IteratorFromCursor() on the same map or on a later version of it
+// to continue iterating after that key. Returns nil if no key has been returned
+// since the iterator was last positioned.
+//
+// Keys are encoded with DefaultCodec. Returns an error if the key type is not
+// supported by DefaultCodec.
+func (itr *SortedMapIterator) Cursor() ([]byte, error) {
+	if !itr.hasCursor {
+		return nil, nil
+	}
+
+	tok := []byte{sortedMapCursorForward}
+	if itr.reverse {
+		tok[0] = sortedMapCursorReverse
+	}
+	return DefaultCodec.AppendValue(tok, itr.cursor)
+}
+
+// resetCursor clears the last returned key.
+func (itr *SortedMapIterator) resetCursor() {
+	itr.cursor, itr.hasCursor, itr.reverse = nil, false, false
+}
+
+// Cursor direction flags.
+const (
+	sortedMapCursorForward = iota
+	sortedMapCursorReverse
+)
+
+// IteratorFromCursor returns a new iterator that continues from a token
+// returned by SortedMapIterator.Cursor(). The map does not need to be the
+// version the token was created from. The iterator is re-seeked using the
+// map's comparer so deleted keys are skipped and inserted keys are included.
+//
+// For a forward cursor the iterator is positioned on the first key after the
+// cursor's key and should be read with Next(). For a reverse cursor it is
+// positioned on the last key before the cursor's key and should be read with
+// Prev(). A nil token returns an iterator at the first key/value pair.
+func (m *SortedMap) IteratorFromCursor(tok []byte) (*SortedMapIterator, error) {
+	itr := &SortedMapIterator{m: m}
+	if tok == nil {
+		itr.First()
+		return itr, nil
+	} else if len(tok) < 2 || tok[0] > sortedMapCursorReverse {
+		return nil, errors.New("immutable.SortedMap.IteratorFromCursor: invalid cursor")
+	}
+
+	key, n, err := DefaultCodec.ReadValue(tok[1:])
+	if err != nil {
+		return nil, err
+	} else if n != len(tok)-1 {
+		return nil, errors.New("immutable.SortedMap.IteratorFromCursor: invalid cursor")
+	}
+	reverse := tok[0] == sortedMapCursorReverse
+
+	// Position the iterator on the first key at or after the cursor's key and
+	// then move past the cursor's key in the iteration direction.
+	itr.Seek(key)
+	if reverse {
+		if itr.Done() {
+			itr.Last()
+		} else {
+			itr.prev()
+		}
+	} else if !itr.Done() {
+		if k, _ := itr.peek(); itr.m.comparer.Compare(k, key) == 0 {
+			itr.next()
+		}
+	}
+
+	// Retain the cursor so it is unchanged if no keys are read.
+	itr.cursor, itr.hasCursor, itr.reverse = key, true, reverse
+	return itr, nil
+}
+
 // sortedMapIteratorElem represents node/index pair in the SortedMapIterator stack.
 type sortedMapIteratorElem struct {
 	node  sortedMapNode
@@ -1773,6 +2573,61 @@ type Hasher interface {
 	Equal(a, b interface{}) bool
 }
 
+// Hasher64 is a Hasher that can also compute 64-bit hashes. Map uses 64-bit
+// hashes when its hasher implements Hasher64, which allows the trie to grow
+// deeper before keys are stored in collision nodes. Hash64 must be consistent
+// with Equal in the same way as Hash. All built-in hashers implement Hasher64.
+type Hasher64 interface {
+	Hasher
+
+	// Computes a 64-bit hash for key.
+	Hash64(key interface{}) uint64
+}
+
+// hashKey returns the hash used by Map for key. Returns the 64-bit hash if h
+// implements Hasher64. Otherwise returns the 32-bit hash.
+func hashKey(h Hasher, key interface{}) uint64 {
+	if h, ok := h.(Hasher64); ok {
+		return h.Hash64(key)
+	}
+	return uint64(h.Hash(key))
+}
+
+// defaultHasher returns the built-in hasher for the type of key. Seeded
+// hashers use the process-wide default seed. Returns nil if no built-in
+// hasher exists for the type.
+func defaultHasher(key interface{}) Hasher {
+	return defaultHasherWithSeed(key, defaultHasherSeed)
+}
+
+// defaultHasherWithSeed returns the built-in hasher for the type of key using
+// the given seed. Returns nil if no built-in hasher exists for the type.
+func defaultHasherWithSeed(key interface{}, seed uint64) Hasher {
+	switch key.(type) {
+	case int:
+		return &intHasher{}
+	case int8, int16, int32, int64:
+		return &signedHasher{}
+	case uint, uint8, uint16, uint32, uint64, uintptr:
+		return &unsignedHasher{}
+	case float32, float64:
+		return &floatHasher{}
+	case bool:
+		return &boolHasher{}
+	case string:
+		return NewStringHasher(seed)
+	case []byte:
+		return NewByteSliceHasher(seed)
+	case time.Time:
+		return &timeHasher{}
+	default:
+		if isByteArray(key) {
+			return NewByteArrayHasher(seed)
+		}
+		return nil
+	}
+}
+
 // intHasher implements Hasher for int keys.
 type intHasher struct{}
 
@@ -1781,22 +2636,46 @@ func (h *intHasher) Hash(key interface{}) uint32 {
 	return hashUint64(uint64(key.(int)))
 }
 
+// Hash64 returns a 64-bit hash for key.
+func (h *intHasher) Hash64(key interface{}) uint64 {
+	return uint64(key.(int))
+}
+
 // Equal returns true if a is equal to b. Otherwise returns false.
 // Panics if a and b are not ints.
 func (h *intHasher) Equal(a, b interface{}) bool {
 	return a.(int) == b.(int)
 }
 
-// stringHasher implements Hasher for string keys.
-type stringHasher struct{}
+// Compare returns -1 if a is less than b, returns 1 if a is greater than b, and
+// returns 0 if a is equal to b. Used to order keys with equal hashes.
+func (h *intHasher) Compare(a, b interface{}) int {
+	return (&intComparer{}).Compare(a, b)
+}
+
+// stringHasher implements Hasher for string keys using seeded SipHash.
+type stringHasher struct {
+	s   uint64
+	key sipKey
+}
+
+// NewStringHasher returns the built-in hasher for string keys using the given
+// seed. Maps created with a nil hasher use a random per-process seed so that
+// colliding keys cannot be constructed ahead of time. Pass a seed from a
+// secure random source to give a map its own seed. A fixed seed should only be used
+// when a reproducible iteration order is required, such as in tests.
+func NewStringHasher(seed uint64) Hasher {
+	return &stringHasher{s: seed, key: newSipKey(seed)}
+}
 
 // Hash returns a hash for value.
 func (h *stringHasher) Hash(value interface{}) uint32 {
-	var hash uint32
-	for i, value := 0, value.(string); i < len(value); i++ {
-		hash = 31*hash + uint32(value[i])
-	}
-	return hash
+	return h.key.hashString(value.(string))
+}
+
+// Hash64 returns a 64-bit hash for value.
+func (h *stringHasher) Hash64(value interface{}) uint64 {
+	return h.key.hashString64(value.(string))
 }
 
 // Equal returns true if a is equal to b. Otherwise returns false.
@@ -1805,16 +2684,35 @@ func (h *stringHasher) Equal(a, b interface{}) bool {
 	return a.(string) == b.(string)
 }
 
-// byteSliceHasher implements Hasher for string keys.
-type byteSliceHasher struct{}
+// Compare returns -1 if a is less than b, returns 1 if a is greater than b, and
+// returns 0 if a is equal to b. Used to order keys with equal hashes.
+func (h *stringHasher) Compare(a, b interface{}) int {
+	return (&stringComparer{}).Compare(a, b)
+}
+
+// seed returns the seed used to create the hasher.
+func (h *stringHasher) seed() uint64 { return h.s }
+
+// byteSliceHasher implements Hasher for byte slice keys using seeded SipHash.
+type byteSliceHasher struct {
+	s   uint64
+	key sipKey
+}
+
+// NewByteSliceHasher returns the built-in hasher for byte slice keys using
+// the given seed. See NewStringHasher for details about seeding.
+func NewByteSliceHasher(seed uint64) Hasher {
+	return &byteSliceHasher{s: seed, key: newSipKey(seed)}
+}
 
 // Hash returns a hash for value.
 func (h *byteSliceHasher) Hash(value interface{}) uint32 {
-	var hash uint32
-	for i, value := 0, value.([]byte); i < len(value); i++ {
-		hash = 31*hash + uint32(value[i])
-	}
-	return hash
+	return h.key.hashBytes(value.([]byte))
+}
+
+// Hash64 returns a 64-bit hash for value.
+func (h *byteSliceHasher) Hash64(value interface{}) uint64 {
+	return h.key.hashBytes64(value.([]byte))
 }
 
 // Equal returns true if a is equal to b. Otherwise returns false.
@@ -1823,6 +2721,15 @@ func (h *byteSliceHasher) Equal(a, b interface{}) bool {
 	return bytes.Equal(a.([]byte), b.([]byte))
 }
 
+// Compare returns -1 if a is less than b, returns 1 if a is greater than b, and
+// returns 0 if a is equal to b. Used to order keys with equal hashes.
+func (h *byteSliceHasher) Compare(a, b interface{}) int {
+	return (&byteSliceComparer{}).Compare(a, b)
+}
+
+// seed returns the seed used to create the hasher.
+func (h *byteSliceHasher) seed() uint64 { return h.s }
+
 // hashUint64 returns a 32-bit hash for a 64-bit value.
 func hashUint64(value uint64) uint32 {
 	hash := value
@@ -1840,6 +2747,60 @@ type Comparer interface {
 	Compare(a, b interface{}) int
 }
 
+// ValueEqualer checks values for equality. Collections with a ValueEqualer
+// return themselves from Set when the new value is equal to the existing value
+// so that no-op writes preserve pointer equality.
+type ValueEqualer interface {
+	// Returns true if a and b are equal.
+	Equal(a, b interface{}) bool
+}
+
+// ValueEqualerFunc is an adapter to allow the use of an ordinary function as a
+// ValueEqualer.
+type ValueEqualerFunc func(a, b interface{}) bool
+
+// Equal returns f(a, b).
+func (f ValueEqualerFunc) Equal(a, b interface{}) bool {
+	return f(a, b)
+}
+
+// valuesEqual returns true if a and b are equal using eq. Values are compared
+// by identity if eq is nil.
+func valuesEqual(eq ValueEqualer, a, b interface{}) bool {
+	if eq == nil {
+		return identicalValues(a, b)
+	}
+	return eq.Equal(a, b)
+}
+
+// defaultComparer returns the built-in comparer for the type of key.
+// Returns nil if no built-in comparer exists for the type.
+func defaultComparer(key interface{}) Comparer {
+	switch key.(type) {
+	case int:
+		return &intComparer{}
+	case int8, int16, int32, int64:
+		return &signedComparer{}
+	case uint, uint8, uint16, uint32, uint64, uintptr:
+		return &unsignedComparer{}
+	case float32, float64:
+		return &floatComparer{}
+	case bool:
+		return &boolComparer{}
+	case string:
+		return &stringComparer{}
+	case []byte:
+		return &byteSliceComparer{}
+	case time.Time:
+		return &timeComparer{}
+	default:
+		if isByteArray(key) {
+			return &byteArrayComparer{}
+		}
+		return nil
+	}
+}
+
 // intComparer compares two integers. Implements Comparer.
 type intComparer struct{}
 
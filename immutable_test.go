@@ -1,9 +1,11 @@
 package immutable
 
 import (
+	"bytes"
 	"flag"
 	"fmt"
 	"math/rand"
+	"reflect"
 	"sort"
 	"testing"
 
@@ -76,6 +78,22 @@ func TestList(t *testing.T) {
 		}
 	})
 
+	t.Run("SetWithValueEqualer", func(t *testing.T) {
+		list := NewList().WithValueEqualer(ValueEqualerFunc(func(a, b interface{}) bool { return a == b }))
+		list = list.Append("foo")
+		list = list.Append("bar")
+
+		if other := list.Set(0, "foo"); other != list {
+			t.Fatal("expected same list")
+		} else if other = list.Set(0, "baz"); other == list {
+			t.Fatal("expected new list")
+		} else if v := other.Get(0); v != "baz" {
+			t.Fatalf("unexpected value: %v", v)
+		} else if other = other.Append("bat").Slice(1, 3); other.Set(1, "bat") != other {
+			t.Fatal("expected equaler to be retained")
+		}
+	})
+
 	t.Run("GetBelowRange", func(t *testing.T) {
 		var r string
 		func() {
@@ -180,6 +198,63 @@ func TestList(t *testing.T) {
 		}
 	})
 
+	t.Run("IteratorNextChunk", func(t *testing.T) {
+		l := NewList()
+		for i := 0; i < 100; i++ {
+			l = l.Append(i)
+		}
+		l = l.Slice(10, 90)
+
+		itr := l.Iterator()
+		itr.Seek(20)
+		var got []interface{}
+		for values := itr.NextChunk(); values != nil; values = itr.NextChunk() {
+			got = append(got, values...)
+		}
+		if len(got) != 60 || got[0] != 30 || got[59] != 89 {
+			t.Fatalf("unexpected values: %v", got)
+		} else if values := l.Iterator().NextChunk(); len(values) != 22 || values[0] != 10 {
+			t.Fatalf("unexpected first chunk: %v", values)
+		} else if values := NewList().Iterator().NextChunk(); values != nil {
+			t.Fatalf("unexpected chunk for empty list: %v", values)
+		}
+	})
+
+	t.Run("IteratorNextChunkThenNext", func(t *testing.T) {
+		l := NewList()
+		for i := 0; i < 100; i++ {
+			l = l.Append(i)
+		}
+
+		itr := l.Iterator()
+		itr.NextChunk()
+		if i, v := itr.Next(); i != 32 || v != 32 {
+			t.Fatalf("unexpected Next()=<%v,%v>", i, v)
+		} else if i, v := itr.Prev(); i != 33 || v != 33 {
+			t.Fatalf("unexpected Prev()=<%v,%v>", i, v)
+		}
+	})
+
+	t.Run("EachStop", func(t *testing.T) {
+		l := NewList()
+		for i := 0; i < 1000; i++ {
+			l = l.Append(i)
+		}
+
+		var n int
+		l.Each(func(index int, value interface{}) bool {
+			n++
+			return index < 500
+		})
+		if n != 501 {
+			t.Fatalf("unexpected calls: %d", n)
+		}
+		NewList().Each(func(index int, value interface{}) bool {
+			t.Fatal("unexpected call for empty list")
+			return false
+		})
+	})
+
 	RunRandom(t, "Random", func(t *testing.T, rand *rand.Rand) {
 		l := NewTList()
 		for i := 0; i < 100000; i++ {
@@ -284,6 +359,10 @@ func (l *TList) Validate() error {
 		return err
 	} else if err := l.validateBackwardIterator(); err != nil {
 		return err
+	} else if err := l.validateChunkIterator(); err != nil {
+		return err
+	} else if err := l.validateEach(); err != nil {
+		return err
 	}
 	return nil
 }
@@ -356,6 +435,45 @@ func BenchmarkList_Set(b *testing.B) {
 	}
 }
 
+func (l *TList) validateChunkIterator() error {
+	var i int
+	itr := l.im.Iterator()
+	for values := itr.NextChunk(); values != nil; values = itr.NextChunk() {
+		if len(values) == 0 || len(values) > listNodeSize {
+			return fmt.Errorf("ListIterator.NextChunk() len=%d", len(values))
+		}
+		for _, v := range values {
+			if i >= len(l.std) || l.std[i] != v {
+				return fmt.Errorf("ListIterator.NextChunk()[%d]=%v, unexpected", i, v)
+			}
+			i++
+		}
+	}
+	if i != len(l.std) {
+		return fmt.Errorf("ListIterator.NextChunk() returned %d values, expected %d", i, len(l.std))
+	}
+	return nil
+}
+
+func (l *TList) validateEach() error {
+	var i int
+	var err error
+	l.im.Each(func(j int, v interface{}) bool {
+		if i != j || i >= len(l.std) || l.std[i] != v {
+			err = fmt.Errorf("List.Each()=<%v,%v>, unexpected at %d", j, v, i)
+			return false
+		}
+		i++
+		return true
+	})
+	if err != nil {
+		return err
+	} else if i != len(l.std) {
+		return fmt.Errorf("List.Each() visited %d elements, expected %d", i, len(l.std))
+	}
+	return nil
+}
+
 func BenchmarkList_Iterator(b *testing.B) {
 	const n = 10000
 	l := NewList()
@@ -384,6 +502,22 @@ func BenchmarkList_Iterator(b *testing.B) {
 			itr.Prev()
 		}
 	})
+
+	b.Run("Chunk", func(b *testing.B) {
+		itr := l.Iterator()
+		for i := 0; i < b.N; i += listNodeSize {
+			if itr.Done() {
+				itr.First()
+			}
+			itr.NextChunk()
+		}
+	})
+
+	b.Run("Each", func(b *testing.B) {
+		for i := 0; i < b.N; i += n {
+			l.Each(func(index int, value interface{}) bool { return true })
+		}
+	})
 }
 
 func ExampleList_Append() {
@@ -460,6 +594,21 @@ func ExampleList_Iterator() {
 	// 2 baz
 }
 
+func ExampleList_Each() {
+	l := NewList()
+	l = l.Append("foo")
+	l = l.Append("bar")
+	l = l.Append("baz")
+
+	l.Each(func(i int, v interface{}) bool {
+		fmt.Println(i, v)
+		return v != "bar"
+	})
+	// Output:
+	// 0 foo
+	// 1 bar
+}
+
 func ExampleList_Iterator_reverse() {
 	l := NewList()
 	l = l.Append("foo")
@@ -485,7 +634,7 @@ func TestInternal_mapNode_Overwrite(t *testing.T) {
 	var node mapNode = &mapArrayNode{}
 	for i := 0; i < n; i++ {
 		var resized bool
-		node = node.set(i, i, 0, h.Hash(i), &h, &resized)
+		node = node.set(i, i, 0, uint64(h.Hash(i)), &h, &resized)
 		if !resized {
 			t.Fatal("expected resize")
 		}
@@ -493,21 +642,21 @@ func TestInternal_mapNode_Overwrite(t *testing.T) {
 		// Overwrite every node.
 		for j := 0; j <= i; j++ {
 			var resized bool
-			node = node.set(j, i*j, 0, h.Hash(j), &h, &resized)
+			node = node.set(j, i*j, 0, uint64(h.Hash(j)), &h, &resized)
 			if resized {
 				t.Fatalf("expected no resize: i=%d, j=%d", i, j)
 			}
 		}
 
 		// Verify not found at each branch type.
-		if _, ok := node.get(1000000, 0, h.Hash(1000000), &h); ok {
+		if _, ok := node.get(1000000, 0, uint64(h.Hash(1000000)), &h); ok {
 			t.Fatal("expected no value")
 		}
 	}
 
 	// Verify all key/value pairs in map.
 	for i := 0; i < n; i++ {
-		if v, ok := node.get(i, 0, h.Hash(i), &h); !ok || v != i*(n-1) {
+		if v, ok := node.get(i, 0, uint64(h.Hash(i)), &h); !ok || v != i*(n-1) {
 			t.Fatalf("get(%d)=<%v,%v>", i, v, ok)
 		}
 	}
@@ -520,13 +669,13 @@ func TestInternal_mapArrayNode(t *testing.T) {
 		n := &mapArrayNode{}
 		for i := 0; i < 8; i++ {
 			var resized bool
-			n = n.set(i*10, i, 0, h.Hash(i*10), &h, &resized).(*mapArrayNode)
+			n = n.set(i*10, i, 0, uint64(h.Hash(i*10)), &h, &resized).(*mapArrayNode)
 			if !resized {
 				t.Fatal("expected resize")
 			}
 
 			for j := 0; j < i; j++ {
-				if v, ok := n.get(j*10, 0, h.Hash(j*10), &h); !ok || v != j {
+				if v, ok := n.get(j*10, 0, uint64(h.Hash(j*10)), &h); !ok || v != j {
 					t.Fatalf("get(%d)=<%v,%v>", j, v, ok)
 				}
 			}
@@ -539,13 +688,13 @@ func TestInternal_mapArrayNode(t *testing.T) {
 		n := &mapArrayNode{}
 		for i := 7; i >= 0; i-- {
 			var resized bool
-			n = n.set(i*10, i, 0, h.Hash(i*10), &h, &resized).(*mapArrayNode)
+			n = n.set(i*10, i, 0, uint64(h.Hash(i*10)), &h, &resized).(*mapArrayNode)
 			if !resized {
 				t.Fatal("expected resize")
 			}
 
 			for j := i; j <= 7; j++ {
-				if v, ok := n.get(j*10, 0, h.Hash(j*10), &h); !ok || v != j {
+				if v, ok := n.get(j*10, 0, uint64(h.Hash(j*10)), &h); !ok || v != j {
 					t.Fatalf("get(%d)=<%v,%v>", j, v, ok)
 				}
 			}
@@ -558,30 +707,48 @@ func TestInternal_mapArrayNode(t *testing.T) {
 		var n mapNode = &mapArrayNode{}
 		for i := 0; i < 100; i++ {
 			var resized bool
-			n = n.set(i, i, 0, h.Hash(i), &h, &resized)
+			n = n.set(i, i, 0, uint64(h.Hash(i)), &h, &resized)
 			if !resized {
 				t.Fatal("expected resize")
 			}
 
 			for j := 0; j < i; j++ {
-				if v, ok := n.get(j, 0, h.Hash(j), &h); !ok || v != j {
+				if v, ok := n.get(j, 0, uint64(h.Hash(j)), &h); !ok || v != j {
 					t.Fatalf("get(%d)=<%v,%v>", j, v, ok)
 				}
 			}
 		}
 	})
 
+	// Ensure existing keys are not rehashed on every insert.
+	t.Run("HashOnce", func(t *testing.T) {
+		var calls int
+		h := &mockHasher{
+			hash:  func(value interface{}) uint32 { calls++; return uint32(value.(int)) },
+			equal: func(a, b interface{}) bool { return a == b },
+		}
+		m := NewMap(h)
+		for i := 0; i < maxArrayMapSize; i++ {
+			m = m.Set(i, i)
+		}
+		if _, ok := m.root.(*mapArrayNode); !ok {
+			t.Fatalf("unexpected root type: %T", m.root)
+		} else if calls != maxArrayMapSize {
+			t.Fatalf("unexpected hash calls: %d", calls)
+		}
+	})
+
 	// Ensure deleting elements returns the correct new node.
 	RunRandom(t, "Delete", func(t *testing.T, rand *rand.Rand) {
 		var h intHasher
 		var n mapNode = &mapArrayNode{}
 		for i := 0; i < 8; i++ {
 			var resized bool
-			n = n.set(i*10, i, 0, h.Hash(i*10), &h, &resized)
+			n = n.set(i*10, i, 0, uint64(h.Hash(i*10)), &h, &resized)
 		}
 
 		for _, i := range rand.Perm(8) {
-			n = n.delete(i*10, 0, h.Hash(i*10), &h)
+			n = n.delete(i*10, 0, uint64(h.Hash(i*10)), &h)
 		}
 		if n != nil {
 			t.Fatal("expected nil rand")
@@ -592,8 +759,8 @@ func TestInternal_mapArrayNode(t *testing.T) {
 func TestInternal_mapValueNode(t *testing.T) {
 	t.Run("Simple", func(t *testing.T) {
 		var h intHasher
-		n := newMapValueNode(h.Hash(2), 2, 3)
-		if v, ok := n.get(2, 0, h.Hash(2), &h); !ok {
+		n := newMapValueNode(uint64(h.Hash(2)), 2, 3)
+		if v, ok := n.get(2, 0, uint64(h.Hash(2)), &h); !ok {
 			t.Fatal("expected ok")
 		} else if v != 3 {
 			t.Fatalf("unexpected value: %v", v)
@@ -603,11 +770,11 @@ func TestInternal_mapValueNode(t *testing.T) {
 	t.Run("KeyEqual", func(t *testing.T) {
 		var h intHasher
 		var resized bool
-		n := newMapValueNode(h.Hash(2), 2, 3)
-		other := n.set(2, 4, 0, h.Hash(2), &h, &resized).(*mapValueNode)
+		n := newMapValueNode(uint64(h.Hash(2)), 2, 3)
+		other := n.set(2, 4, 0, uint64(h.Hash(2)), &h, &resized).(*mapValueNode)
 		if other == n {
 			t.Fatal("expected new node")
-		} else if got, exp := other.keyHash, h.Hash(2); got != exp {
+		} else if got, exp := other.keyHash, uint64(h.Hash(2)); got != exp {
 			t.Fatalf("keyHash=%v, expected %v", got, exp)
 		} else if got, exp := other.key, 2; got != exp {
 			t.Fatalf("key=%v, expected %v", got, exp)
@@ -624,9 +791,9 @@ func TestInternal_mapValueNode(t *testing.T) {
 			equal: func(a, b interface{}) bool { return a.(int) == b.(int) },
 		}
 		var resized bool
-		n := newMapValueNode(h.Hash(2), 2, 3)
-		other := n.set(4, 5, 0, h.Hash(4), h, &resized).(*mapHashCollisionNode)
-		if got, exp := other.keyHash, h.Hash(2); got != exp {
+		n := newMapValueNode(uint64(h.Hash(2)), 2, 3)
+		other := n.set(4, 5, 0, uint64(h.Hash(4)), h, &resized).(*mapHashCollisionNode)
+		if got, exp := other.keyHash, uint64(h.Hash(2)); got != exp {
 			t.Fatalf("keyHash=%v, expected %v", got, exp)
 		} else if got, exp := len(other.entries), 2; got != exp {
 			t.Fatalf("entries=%v, expected %v", got, exp)
@@ -650,8 +817,8 @@ func TestInternal_mapValueNode(t *testing.T) {
 		t.Run("NoConflict", func(t *testing.T) {
 			var h intHasher
 			var resized bool
-			n := newMapValueNode(h.Hash(2), 2, 3)
-			other := n.set(4, 5, 0, h.Hash(4), &h, &resized).(*mapBitmapIndexedNode)
+			n := newMapValueNode(uint64(h.Hash(2)), 2, 3)
+			other := n.set(4, 5, 0, uint64(h.Hash(4)), &h, &resized).(*mapBitmapIndexedNode)
 			if got, exp := other.bitmap, uint32(0x14); got != exp {
 				t.Fatalf("bitmap=0x%02x, expected 0x%02x", got, exp)
 			} else if got, exp := len(other.nodes), 2; got != exp {
@@ -675,9 +842,9 @@ func TestInternal_mapValueNode(t *testing.T) {
 			}
 
 			// Ensure both values can be read.
-			if v, ok := other.get(2, 0, h.Hash(2), &h); !ok || v.(int) != 3 {
+			if v, ok := other.get(2, 0, uint64(h.Hash(2)), &h); !ok || v.(int) != 3 {
 				t.Fatalf("Get(2)=<%v,%v>", v, ok)
-			} else if v, ok := other.get(4, 0, h.Hash(4), &h); !ok || v.(int) != 5 {
+			} else if v, ok := other.get(4, 0, uint64(h.Hash(4)), &h); !ok || v.(int) != 5 {
 				t.Fatalf("Get(4)=<%v,%v>", v, ok)
 			}
 		})
@@ -686,8 +853,8 @@ func TestInternal_mapValueNode(t *testing.T) {
 		t.Run("NoConflictReverse", func(t *testing.T) {
 			var h intHasher
 			var resized bool
-			n := newMapValueNode(h.Hash(4), 4, 5)
-			other := n.set(2, 3, 0, h.Hash(2), &h, &resized).(*mapBitmapIndexedNode)
+			n := newMapValueNode(uint64(h.Hash(4)), 4, 5)
+			other := n.set(2, 3, 0, uint64(h.Hash(2)), &h, &resized).(*mapBitmapIndexedNode)
 			if got, exp := other.bitmap, uint32(0x14); got != exp {
 				t.Fatalf("bitmap=0x%02x, expected 0x%02x", got, exp)
 			} else if got, exp := len(other.nodes), 2; got != exp {
@@ -711,9 +878,9 @@ func TestInternal_mapValueNode(t *testing.T) {
 			}
 
 			// Ensure both values can be read.
-			if v, ok := other.get(2, 0, h.Hash(2), &h); !ok || v.(int) != 3 {
+			if v, ok := other.get(2, 0, uint64(h.Hash(2)), &h); !ok || v.(int) != 3 {
 				t.Fatalf("Get(2)=<%v,%v>", v, ok)
-			} else if v, ok := other.get(4, 0, h.Hash(4), &h); !ok || v.(int) != 5 {
+			} else if v, ok := other.get(4, 0, uint64(h.Hash(4)), &h); !ok || v.(int) != 5 {
 				t.Fatalf("Get(4)=<%v,%v>", v, ok)
 			}
 		})
@@ -725,8 +892,8 @@ func TestInternal_mapValueNode(t *testing.T) {
 				equal: func(a, b interface{}) bool { return a.(int) == b.(int) },
 			}
 			var resized bool
-			n := newMapValueNode(h.Hash(2), 2, 3)
-			other := n.set(4, 5, 0, h.Hash(4), h, &resized).(*mapBitmapIndexedNode)
+			n := newMapValueNode(uint64(h.Hash(2)), 2, 3)
+			other := n.set(4, 5, 0, uint64(h.Hash(4)), h, &resized).(*mapBitmapIndexedNode)
 			if got, exp := other.bitmap, uint32(0x01); got != exp { // mask is zero, expect first slot.
 				t.Fatalf("bitmap=0x%02x, expected 0x%02x", got, exp)
 			} else if got, exp := len(other.nodes), 1; got != exp {
@@ -755,11 +922,11 @@ func TestInternal_mapValueNode(t *testing.T) {
 			}
 
 			// Ensure both values can be read.
-			if v, ok := other.get(2, 0, h.Hash(2), h); !ok || v.(int) != 3 {
+			if v, ok := other.get(2, 0, uint64(h.Hash(2)), h); !ok || v.(int) != 3 {
 				t.Fatalf("Get(2)=<%v,%v>", v, ok)
-			} else if v, ok := other.get(4, 0, h.Hash(4), h); !ok || v.(int) != 5 {
+			} else if v, ok := other.get(4, 0, uint64(h.Hash(4)), h); !ok || v.(int) != 5 {
 				t.Fatalf("Get(4)=<%v,%v>", v, ok)
-			} else if v, ok := other.get(10, 0, h.Hash(10), h); ok {
+			} else if v, ok := other.get(10, 0, uint64(h.Hash(10)), h); ok {
 				t.Fatalf("Get(10)=<%v,%v>, expected no value", v, ok)
 			}
 		})
@@ -887,9 +1054,9 @@ func TestMap_Set(t *testing.T) {
 		func() {
 			defer func() { r = recover().(string) }()
 			m := NewMap(nil)
-			m = m.Set(uint64(100), "bar")
+			m = m.Set(struct{}{}, "bar")
 		}()
-		if r != `immutable.Map.Set: must set hasher for uint64 type` {
+		if r != `immutable.Map.Set: must set hasher for struct {} type` {
 			t.Fatalf("unexpected panic: %q", r)
 		}
 	})
@@ -1011,6 +1178,148 @@ func TestMap_Delete(t *testing.T) {
 	})
 }
 
+func TestMap_Update(t *testing.T) {
+	incr := func(old interface{}, exists bool) (interface{}, bool) {
+		if !exists {
+			return 1, true
+		}
+		return old.(int) + 1, true
+	}
+
+	t.Run("Empty", func(t *testing.T) {
+		m := NewMap(nil)
+		if other := m.Update("foo", func(interface{}, bool) (interface{}, bool) { return nil, false }); m != other {
+			t.Fatal("expected same map")
+		} else if other = m.Update("foo", incr); other.Len() != 1 {
+			t.Fatalf("unexpected len: %d", other.Len())
+		} else if v, ok := other.Get("foo"); !ok || v != 1 {
+			t.Fatalf("unexpected value: <%v,%v>", v, ok)
+		}
+	})
+
+	t.Run("Simple", func(t *testing.T) {
+		m := NewMap(nil)
+		m = m.Update("foo", incr)
+		m = m.Update("foo", incr)
+		m = m.Update("bar", incr)
+		if m.Len() != 2 {
+			t.Fatalf("unexpected len: %d", m.Len())
+		} else if v, ok := m.Get("foo"); !ok || v != 2 {
+			t.Fatalf("unexpected value: <%v,%v>", v, ok)
+		}
+
+		m = m.Update("foo", func(old interface{}, exists bool) (interface{}, bool) {
+			if !exists || old != 2 {
+				t.Fatalf("unexpected old value: <%v,%v>", old, exists)
+			}
+			return nil, false
+		})
+		if m.Len() != 1 {
+			t.Fatalf("unexpected len: %d", m.Len())
+		} else if _, ok := m.Get("foo"); ok {
+			t.Fatal("expected no value")
+		}
+	})
+
+	t.Run("Identical", func(t *testing.T) {
+		m := NewMap(nil)
+		for i := 0; i < 1000; i++ {
+			m = m.Set(i, i)
+		}
+		same := func(old interface{}, exists bool) (interface{}, bool) { return old, exists }
+		for i := 0; i < 2000; i++ {
+			if other := m.Update(i, same); m != other {
+				t.Fatalf("expected same map for key %d", i)
+			}
+		}
+	})
+
+	t.Run("LimitedHash", func(t *testing.T) {
+		h := mockHasher{
+			hash:  func(value interface{}) uint32 { return hashUint64(uint64(value.(int))) % 0xFF },
+			equal: func(a, b interface{}) bool { return a.(int) == b.(int) },
+		}
+		m := NewMap(&h)
+		for i := 0; i < 10000; i++ {
+			m = m.Update(i%5000, incr)
+		}
+		for i := 0; i < 5000; i++ {
+			if v, ok := m.Get(i); !ok || v != 2 {
+				t.Fatalf("Get(%d)=<%v,%v>", i, v, ok)
+			}
+		}
+		for i := 0; i < 5000; i++ {
+			m = m.Update(i, func(interface{}, bool) (interface{}, bool) { return nil, false })
+		}
+		if m.Len() != 0 {
+			t.Fatalf("unexpected len: %d", m.Len())
+		}
+	})
+
+	RunRandom(t, "Random", func(t *testing.T, rand *rand.Rand) {
+		m := NewTestMap()
+		for i := 0; i < 10000; i++ {
+			switch rand.Intn(8) {
+			case 0: // overwrite
+				m.Update(m.ExistingKey(rand), rand.Intn(10000), true)
+			case 1: // delete existing key
+				m.Update(m.ExistingKey(rand), 0, false)
+			case 2: // delete non-existent key.
+				m.Update(m.NewKey(rand), 0, false)
+			default: // set new key
+				m.Update(m.NewKey(rand), rand.Intn(10000), true)
+			}
+		}
+		if m.im.Len() != len(m.std) {
+			t.Fatalf("unexpected len: %d, expected %d", m.im.Len(), len(m.std))
+		} else if err := m.Validate(); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestMap_WithValueEqualer(t *testing.T) {
+	eq := ValueEqualerFunc(func(a, b interface{}) bool { return a.(int) == b.(int) })
+
+	t.Run("Set", func(t *testing.T) {
+		m := NewMap(nil).WithValueEqualer(eq)
+		for i := 0; i < 1000; i++ {
+			m = m.Set(i, i)
+		}
+		for i := 0; i < 1000; i++ {
+			if other := m.Set(i, i); other != m {
+				t.Fatalf("expected same map for key %d", i)
+			}
+		}
+		if other := m.Set(0, 1); other == m {
+			t.Fatal("expected new map")
+		} else if v, ok := other.Get(0); !ok || v != 1 {
+			t.Fatalf("unexpected value: <%v,%v>", v, ok)
+		} else if other = other.Set(1000, 1000); other.Len() != 1001 {
+			t.Fatalf("unexpected len: %d", other.Len())
+		} else if other = other.Delete(0); other.Set(1, 1) != other {
+			t.Fatal("expected equaler to be retained")
+		}
+	})
+
+	t.Run("Default", func(t *testing.T) {
+		m := NewMap(nil).Set("foo", 1)
+		if other := m.Set("foo", 1); other == m {
+			t.Fatal("expected new map without equaler")
+		}
+	})
+
+	t.Run("Diff", func(t *testing.T) {
+		m := NewMap(nil).WithValueEqualer(eq).Set(1, 100).Set(2, 200)
+		other := m.Set(1, 100)
+		var n int
+		diffMaps(m, other, nil, func(Change) bool { n++; return true })
+		if other != m || n != 0 {
+			t.Fatalf("unexpected changes: %d", n)
+		}
+	})
+}
+
 // Ensure map works even with hash conflicts.
 func TestMap_LimitedHash(t *testing.T) {
 	h := mockHasher{
@@ -1046,6 +1355,10 @@ func TestMap_LimitedHash(t *testing.T) {
 		}
 	}
 
+	if err := validateMapIteratorOrder(m); err != nil {
+		t.Fatal(err)
+	}
+
 	// Verify not found works.
 	if _, ok := m.Get(10000000); ok {
 		t.Fatal("expected no value")
@@ -1065,6 +1378,148 @@ func TestMap_LimitedHash(t *testing.T) {
 	}
 }
 
+// Ensure keys that only collide in their 32-bit hash are not stored in
+// collision nodes when the hasher implements Hasher64.
+func TestMap_Hasher64(t *testing.T) {
+	h := &mockHasher64{
+		mockHasher: mockHasher{
+			hash:  func(value interface{}) uint32 { return 0 },
+			equal: func(a, b interface{}) bool { return a.(int) == b.(int) },
+		},
+		hash64: func(value interface{}) uint64 { return uint64(value.(int)%10000) << 32 },
+	}
+
+	m := NewMap(h)
+	for i := 0; i < 20000; i++ {
+		m = m.Set(i, i)
+	}
+	for i := 0; i < 20000; i++ {
+		if v, ok := m.Get(i); !ok || v != i {
+			t.Fatalf("Get(%d)=<%v,%v>", i, v, ok)
+		}
+	}
+
+	// Only keys with equal 64-bit hashes share a collision node.
+	if n := countMapCollisionNodes(m.root); n != 10000 {
+		t.Fatalf("unexpected collision node count: %d", n)
+	}
+
+	for i := 10000; i < 20000; i++ {
+		m = m.Delete(i)
+	}
+	if m.Len() != 10000 {
+		t.Fatalf("unexpected len: %d", m.Len())
+	} else if n := countMapCollisionNodes(m.root); n != 0 {
+		t.Fatalf("unexpected collision node count: %d", n)
+	}
+}
+
+// countMapCollisionNodes returns the number of collision nodes under n.
+func countMapCollisionNodes(n mapNode) int {
+	if _, ok := n.(*mapHashCollisionNode); ok {
+		return 1
+	} else if !isMapBranchNode(n) {
+		return 0
+	}
+
+	var count int
+	for i := 0; i < mapNodeSize; i++ {
+		if child := mapBranchChild(n, i); child != nil {
+			count += countMapCollisionNodes(child)
+		}
+	}
+	return count
+}
+
+func TestMap_Equal(t *testing.T) {
+	a := NewMap(nil).Set("foo", 1).Set("bar", 2)
+	if b := NewMap(nil).Set("bar", 2).Set("foo", 1); !a.Equal(b, nil) {
+		t.Fatal("expected equal")
+	} else if a.Equal(b.Set("foo", 3), nil) {
+		t.Fatal("expected not equal: value")
+	} else if a.Equal(b.Delete("foo").Set("baz", 1), nil) {
+		t.Fatal("expected not equal: key")
+	} else if a.Equal(b.Set("baz", 3), nil) {
+		t.Fatal("expected not equal: len")
+	} else if !NewMap(nil).Equal(NewMap(nil), nil) {
+		t.Fatal("expected empty maps equal")
+	}
+
+	t.Run("ValueEqual", func(t *testing.T) {
+		a := NewMap(nil).Set("foo", []byte("bar"))
+		b := NewMap(nil).Set("foo", []byte("bar"))
+		if a.Equal(b, nil) {
+			t.Fatal("expected uncomparable values not equal")
+		} else if !a.Equal(b, func(a, b interface{}) bool { return bytes.Equal(a.([]byte), b.([]byte)) }) {
+			t.Fatal("expected equal")
+		}
+	})
+}
+
+// Ensure maps with the same keys iterate in the same order regardless of the
+// order of insertion and deletion.
+func TestMap_IteratorOrder(t *testing.T) {
+	t.Run("ArrayNode", func(t *testing.T) {
+		h := NewStringHasher(0)
+		a := NewMap(h).Set("foo", 1).Set("bar", 2).Set("baz", 3)
+		b := NewMap(h).Set("baz", 3).Set("foo", 1).Set("bar", 2)
+		if ka, kb := mapKeys(a), mapKeys(b); !reflect.DeepEqual(ka, kb) {
+			t.Fatalf("order mismatch: %v != %v", ka, kb)
+		}
+	})
+
+	t.Run("Collision", func(t *testing.T) {
+		h := &comparableMockHasher{
+			mockHasher: mockHasher{
+				hash:  func(value interface{}) uint32 { return 1 },
+				equal: func(a, b interface{}) bool { return a.(int) == b.(int) },
+			},
+			mockComparer: mockComparer{
+				compare: func(a, b interface{}) int { return a.(int) - b.(int) },
+			},
+		}
+
+		m := NewMap(h)
+		for _, k := range []int{5, 3, 9, 1, 7, 2, 8, 4, 6, 0} {
+			m = m.Set(k, k)
+		}
+		if got, exp := mapKeys(m), []interface{}{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}; !reflect.DeepEqual(got, exp) {
+			t.Fatalf("unexpected order: %v", got)
+		}
+	})
+
+	RunRandom(t, "Random", func(t *testing.T, rand *rand.Rand) {
+		a, b := NewMap(nil), NewMap(nil)
+		keys := rand.Perm(rand.Intn(1000))
+		for _, k := range keys {
+			a = a.Set(k, k)
+		}
+		for i := len(keys) - 1; i >= 0; i-- {
+			b = b.Set(keys[i], keys[i])
+		}
+		for i := 0; i < 100; i++ {
+			k := rand.Intn(1000)
+			a, b = a.Delete(k), b.Delete(k)
+		}
+
+		if ka, kb := mapKeys(a), mapKeys(b); !reflect.DeepEqual(ka, kb) {
+			t.Fatalf("order mismatch: %v != %v", ka, kb)
+		} else if !a.Equal(b, nil) {
+			t.Fatal("expected equal")
+		}
+	})
+}
+
+// mapKeys returns the keys of m in iteration order.
+func mapKeys(m *Map) []interface{} {
+	var a []interface{}
+	for itr := m.Iterator(); !itr.Done(); {
+		k, _ := itr.Next()
+		a = append(a, k)
+	}
+	return a
+}
+
 // TestMap represents a combined immutable and stdlib map.
 type TestMap struct {
 	im, prev *Map
@@ -1119,6 +1574,33 @@ func (m *TestMap) Delete(k int) {
 	}
 }
 
+// Update updates k using Map.Update and verifies the old value passed to fn.
+func (m *TestMap) Update(k, v int, keep bool) {
+	m.prev = m.im
+	m.im = m.im.Update(k, func(old interface{}, exists bool) (interface{}, bool) {
+		if prev, ok := m.std[k]; exists != ok || (exists && old != prev) {
+			panic(fmt.Sprintf("unexpected old value for key %d: <%v,%v>", k, old, exists))
+		}
+		return v, keep
+	})
+
+	if !keep {
+		delete(m.std, k)
+		for i := range m.keys {
+			if m.keys[i] == k {
+				m.keys = append(m.keys[:i], m.keys[i+1:]...)
+				break
+			}
+		}
+		return
+	}
+
+	if _, exists := m.std[k]; !exists {
+		m.keys = append(m.keys, k)
+	}
+	m.std[k] = v
+}
+
 func (m *TestMap) Validate() error {
 	for _, k := range m.keys {
 		if v, ok := m.im.Get(k); !ok {
@@ -1143,6 +1625,37 @@ func (m *TestMap) validateIterator() error {
 	if k, v := itr.Next(); k != nil || v != nil {
 		return fmt.Errorf("map iterator returned key/value after done: <%v/%v>", k, v)
 	}
+	return validateMapIteratorOrder(m.im)
+}
+
+// validateMapIteratorOrder returns an error if reverse iteration does not
+// match forward iteration or if any position does not resume at its key.
+func validateMapIteratorOrder(m *Map) error {
+	var keys []interface{}
+	for itr := m.Iterator(); !itr.Done(); {
+		pos := itr.Position()
+		k, _ := itr.Next()
+		keys = append(keys, k)
+
+		if other, err := m.IteratorAt(pos); err != nil {
+			return fmt.Errorf("Map.IteratorAt(%v): %s", pos, err)
+		} else if key, _ := other.Next(); key != k {
+			return fmt.Errorf("Map.IteratorAt(%v).Next()=%v, expected %v", pos, key, k)
+		}
+	}
+
+	itr := m.Iterator()
+	itr.Last()
+	for i := len(keys) - 1; i >= 0; i-- {
+		if k, _ := itr.Prev(); k != keys[i] {
+			return fmt.Errorf("MapIterator.Prev()=%v, expected %v", k, keys[i])
+		}
+	}
+	if !itr.Done() || itr.Position() != nil {
+		return fmt.Errorf("MapIterator expected done after Prev()")
+	} else if k, v := itr.Prev(); k != nil || v != nil {
+		return fmt.Errorf("map iterator returned key/value after done: <%v/%v>", k, v)
+	}
 	return nil
 }
 
@@ -1169,6 +1682,37 @@ func BenchmarkMap_Delete(b *testing.B) {
 	}
 }
 
+func BenchmarkMap_Update(b *testing.B) {
+	const n = 10000
+
+	m := NewMap(nil)
+	for i := 0; i < n; i++ {
+		m = m.Set(i, i)
+	}
+	incr := func(old interface{}, exists bool) (interface{}, bool) { return old.(int) + 1, true }
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		m.Update(i%n, incr) // Do not update map, always operate on original
+	}
+}
+
+func BenchmarkMap_Equal(b *testing.B) {
+	m0, m1 := NewMap(nil), NewMap(nil)
+	for i := 0; i < 10000; i++ {
+		m0, m1 = m0.Set(i, i), m1.Set(9999-i, 9999-i)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if !m0.Equal(m1, nil) {
+			b.Fatal("expected equal")
+		}
+	}
+}
+
 func BenchmarkMap_Iterator(b *testing.B) {
 	const n = 10000
 	m := NewMap(nil)
@@ -1187,6 +1731,86 @@ func BenchmarkMap_Iterator(b *testing.B) {
 			itr.Next()
 		}
 	})
+
+	b.Run("Reverse", func(b *testing.B) {
+		itr := m.Iterator()
+		for i := 0; i < b.N; i++ {
+			if i%n == 0 {
+				itr.Last()
+			}
+			itr.Prev()
+		}
+	})
+}
+
+func TestMap_IteratorAt(t *testing.T) {
+	t.Run("Empty", func(t *testing.T) {
+		m := NewMap(nil)
+		if itr, err := m.IteratorAt(nil); err != nil {
+			t.Fatal(err)
+		} else if !itr.Done() {
+			t.Fatal("expected done")
+		} else if _, err := m.IteratorAt([]byte{0}); err == nil || err.Error() != `immutable.Map.IteratorAt: invalid position` {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("Paginate", func(t *testing.T) {
+		m := NewMap(nil)
+		for i := 0; i < 1000; i++ {
+			m = m.Set(i, i)
+		}
+
+		// Read pages of 30 keys, resuming from the previous position each time.
+		seen := make(map[interface{}]bool)
+		var pos []byte
+		for {
+			itr, err := m.IteratorAt(pos)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 30 && !itr.Done(); i++ {
+				k, _ := itr.Next()
+				if seen[k] {
+					t.Fatalf("duplicate key: %v", k)
+				}
+				seen[k] = true
+			}
+			if pos = itr.Position(); pos == nil {
+				break
+			}
+		}
+		if len(seen) != m.Len() {
+			t.Fatalf("unexpected key count: %d", len(seen))
+		}
+	})
+
+	t.Run("Small", func(t *testing.T) {
+		m := NewMap(nil).Set("foo", 1).Set("bar", 2)
+		if err := validateMapIteratorOrder(m); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("ErrInvalidPosition", func(t *testing.T) {
+		m := NewMap(nil)
+		for i := 0; i < 1000; i++ {
+			m = m.Set(i, i)
+		}
+		pos := m.Iterator().Position()
+
+		for _, pos := range [][]byte{
+			{},
+			{0xFF},
+			pos[:len(pos)-1],
+			append(append([]byte{}, pos...), 0),
+			append([]byte{32}, pos[1:]...),
+		} {
+			if _, err := m.IteratorAt(pos); err == nil {
+				t.Fatalf("expected error for position %v", pos)
+			}
+		}
+	})
 }
 
 func ExampleMap_Set() {
@@ -1224,8 +1848,58 @@ func ExampleMap_Delete() {
 	// baz <nil> false
 }
 
-func ExampleMap_Iterator() {
+func ExampleMap_WithValueEqualer() {
+	m := NewMap(nil).WithValueEqualer(ValueEqualerFunc(func(a, b interface{}) bool {
+		return a == b
+	}))
+	m = m.Set("foo", "bar")
+
+	fmt.Println(m.Set("foo", "bar") == m)
+	fmt.Println(m.Set("foo", "baz") == m)
+	// Output:
+	// true
+	// false
+}
+
+func ExampleMap_Update() {
+	incr := func(old interface{}, exists bool) (interface{}, bool) {
+		if !exists {
+			return 1, true
+		}
+		return old.(int) + 1, true
+	}
+
 	m := NewMap(nil)
+	m = m.Update("foo", incr)
+	m = m.Update("foo", incr)
+	m = m.Update("bar", incr)
+	m = m.Update("bar", func(old interface{}, exists bool) (interface{}, bool) {
+		return nil, false // delete
+	})
+
+	v, ok := m.Get("foo")
+	fmt.Println("foo", v, ok)
+
+	v, ok = m.Get("bar")
+	fmt.Println("bar", v, ok)
+	// Output:
+	// foo 2 true
+	// bar <nil> false
+}
+
+func ExampleMap_Equal() {
+	a := NewMap(nil).Set("foo", 1).Set("bar", 2)
+	b := NewMap(nil).Set("bar", 2).Set("foo", 1)
+	fmt.Println(a.Equal(b, nil))
+	fmt.Println(a.Equal(b.Set("bar", 3), nil))
+	// Output:
+	// true
+	// false
+}
+
+func ExampleMap_Iterator() {
+	// Use a fixed seed so that the iteration order is reproducible.
+	m := NewMap(NewStringHasher(0))
 	m = m.Set("apple", 100)
 	m = m.Set("grape", 200)
 	m = m.Set("kiwi", 300)
@@ -1243,14 +1917,40 @@ func ExampleMap_Iterator() {
 	}
 	// Output:
 	// mango 400
-	// pear 700
+	// strawberry 900
 	// pineapple 800
+	// pear 700
 	// grape 200
-	// orange 500
-	// strawberry 900
 	// kiwi 300
 	// peach 600
 	// apple 100
+	// orange 500
+}
+
+func ExampleMap_IteratorAt() {
+	m := NewMap(nil)
+	m = m.Set("foo", 100)
+	m = m.Set("bar", 200)
+	m = m.Set("baz", 300)
+
+	// Read the first key and save the position of the next one.
+	itr := m.Iterator()
+	itr.Next()
+	pos := itr.Position()
+
+	// Resume from the saved position to read the remaining keys.
+	itr, err := m.IteratorAt(pos)
+	if err != nil {
+		panic(err)
+	}
+	var n int
+	for !itr.Done() {
+		itr.Next()
+		n++
+	}
+	fmt.Println(n)
+	// Output:
+	// 2
 }
 
 func TestInternalSortedMapLeafNode(t *testing.T) {
@@ -1551,9 +2251,9 @@ func TestSortedMap_Set(t *testing.T) {
 		func() {
 			defer func() { r = recover().(string) }()
 			m := NewSortedMap(nil)
-			m = m.Set(uint64(100), "bar")
+			m = m.Set(struct{}{}, "bar")
 		}()
-		if r != `immutable.SortedMap.Set: must set comparer for uint64 type` {
+		if r != `immutable.SortedMap.Set: must set comparer for struct {} type` {
 			t.Fatalf("unexpected panic: %q", r)
 		}
 	})
@@ -1685,6 +2385,112 @@ func TestSortedMap_Delete(t *testing.T) {
 	})
 }
 
+func TestSortedMap_Update(t *testing.T) {
+	incr := func(old interface{}, exists bool) (interface{}, bool) {
+		if !exists {
+			return 1, true
+		}
+		return old.(int) + 1, true
+	}
+
+	t.Run("Empty", func(t *testing.T) {
+		m := NewSortedMap(nil)
+		if other := m.Update("foo", func(interface{}, bool) (interface{}, bool) { return nil, false }); m != other {
+			t.Fatal("expected same map")
+		} else if other = m.Update("foo", incr); other.Len() != 1 {
+			t.Fatalf("unexpected len: %d", other.Len())
+		} else if v, ok := other.Get("foo"); !ok || v != 1 {
+			t.Fatalf("unexpected value: <%v,%v>", v, ok)
+		}
+	})
+
+	t.Run("Simple", func(t *testing.T) {
+		m := NewSortedMap(nil)
+		m = m.Update("foo", incr)
+		m = m.Update("foo", incr)
+		m = m.Update("bar", incr)
+		if m.Len() != 2 {
+			t.Fatalf("unexpected len: %d", m.Len())
+		} else if v, ok := m.Get("foo"); !ok || v != 2 {
+			t.Fatalf("unexpected value: <%v,%v>", v, ok)
+		}
+
+		m = m.Update("foo", func(interface{}, bool) (interface{}, bool) { return nil, false })
+		if m.Len() != 1 {
+			t.Fatalf("unexpected len: %d", m.Len())
+		} else if _, ok := m.Get("foo"); ok {
+			t.Fatal("expected no value")
+		}
+	})
+
+	t.Run("Identical", func(t *testing.T) {
+		m := NewSortedMap(nil)
+		for i := 0; i < 1000; i++ {
+			m = m.Set(i, i)
+		}
+		same := func(old interface{}, exists bool) (interface{}, bool) { return old, exists }
+		for i := 0; i < 2000; i++ {
+			if other := m.Update(i, same); m != other {
+				t.Fatalf("expected same map for key %d", i)
+			}
+		}
+	})
+
+	RunRandom(t, "Random", func(t *testing.T, rand *rand.Rand) {
+		m := NewTestSortedMap()
+		for i := 0; i < 10000; i++ {
+			switch rand.Intn(8) {
+			case 0: // overwrite
+				m.Update(m.ExistingKey(rand), rand.Intn(10000), true)
+			case 1: // delete existing key
+				m.Update(m.ExistingKey(rand), 0, false)
+			case 2: // delete non-existent key.
+				m.Update(m.NewKey(rand), 0, false)
+			default: // set new key
+				m.Update(m.NewKey(rand), rand.Intn(10000), true)
+			}
+		}
+		if m.im.Len() != len(m.std) {
+			t.Fatalf("unexpected len: %d, expected %d", m.im.Len(), len(m.std))
+		} else if err := m.Validate(); err != nil {
+			t.Fatal(err)
+		}
+
+		// Delete all and verify they are gone.
+		keys := make([]int, len(m.keys))
+		copy(keys, m.keys)
+		for _, key := range keys {
+			m.Update(key, 0, false)
+		}
+		if m.im.Len() != 0 {
+			t.Fatalf("unexpected len: %d", m.im.Len())
+		}
+	})
+}
+
+func TestSortedMap_WithValueEqualer(t *testing.T) {
+	eq := ValueEqualerFunc(func(a, b interface{}) bool { return a.(int) == b.(int) })
+
+	m := NewSortedMap(nil).WithValueEqualer(eq)
+	for i := 0; i < 1000; i++ {
+		m = m.Set(i, i)
+	}
+	for i := 0; i < 1000; i++ {
+		if other := m.Set(i, i); other != m {
+			t.Fatalf("expected same map for key %d", i)
+		}
+	}
+	if other := m.Set(0, 1); other == m {
+		t.Fatal("expected new map")
+	} else if v, ok := other.Get(0); !ok || v != 1 {
+		t.Fatalf("unexpected value: <%v,%v>", v, ok)
+	} else if other = other.Set(1000, 1000); other.Len() != 1001 {
+		t.Fatalf("unexpected len: %d", other.Len())
+	} else if other = other.Delete(0); other.Set(1, 1) != other {
+		t.Fatal("expected equaler to be retained")
+	}
+}
+
 func TestSortedMap_Iterator(t *testing.T) {
 	t.Run("Empty", func(t *testing.T) {
 		t.Run("First", func(t *testing.T) {
@@ -1773,6 +2579,168 @@ func TestSortedMap_Iterator(t *testing.T) {
 	})
 }
 
+func TestSortedMap_IteratorFromCursor(t *testing.T) {
+	// readPage returns up to n keys from itr and the cursor after them.
+	readPage := func(t *testing.T, itr *SortedMapIterator, n int, reverse bool) ([]interface{}, []byte) {
+		var keys []interface{}
+		for i := 0; i < n && !itr.Done(); i++ {
+			var k interface{}
+			if reverse {
+				k, _ = itr.Prev()
+			} else {
+				k, _ = itr.Next()
+			}
+			keys = append(keys, k)
+		}
+		tok, err := itr.Cursor()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return keys, tok
+	}
+
+	t.Run("Forward", func(t *testing.T) {
+		m := NewSortedMap(nil)
+		for i := 0; i < 100; i += 10 {
+			m = m.Set(i, i)
+		}
+
+		keys, tok := readPage(t, m.Iterator(), 3, false)
+		if got, exp := keys, []interface{}{0, 10, 20}; !reflect.DeepEqual(got, exp) {
+			t.Fatalf("unexpected keys: %v", got)
+		}
+
+		// Delete the next key, insert keys on either side of the cursor and
+		// delete the cursor's key itself.
+		m = m.Delete(30).Delete(20).Set(15, 15).Set(25, 25)
+
+		itr, err := m.IteratorFromCursor(tok)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if keys, _ = readPage(t, itr, 3, false); !reflect.DeepEqual(keys, []interface{}{25, 40, 50}) {
+			t.Fatalf("unexpected keys: %v", keys)
+		}
+	})
+
+	t.Run("Reverse", func(t *testing.T) {
+		m := NewSortedMap(nil)
+		for i := 0; i < 100; i += 10 {
+			m = m.Set(i, i)
+		}
+
+		itr := m.Iterator()
+		itr.Last()
+		keys, tok := readPage(t, itr, 3, true)
+		if got, exp := keys, []interface{}{90, 80, 70}; !reflect.DeepEqual(got, exp) {
+			t.Fatalf("unexpected keys: %v", got)
+		}
+
+		m = m.Delete(60).Set(75, 75).Set(65, 65)
+		if itr, err := m.IteratorFromCursor(tok); err != nil {
+			t.Fatal(err)
+		} else if keys, _ = readPage(t, itr, 3, true); !reflect.DeepEqual(keys, []interface{}{65, 50, 40}) {
+			t.Fatalf("unexpected keys: %v", keys)
+		}
+
+		// Keys inserted behind a reverse cursor are not included.
+		m = m.Set(95, 95)
+		if itr, err := m.IteratorFromCursor(tok); err != nil {
+			t.Fatal(err)
+		} else if k, _ := itr.Prev(); k != 65 {
+			t.Fatalf("unexpected key: %v", k)
+		}
+	})
+
+	t.Run("Paginate", func(t *testing.T) {
+		m := NewSortedMap(nil)
+		for i := 0; i < 1000; i++ {
+			m = m.Set(i, i)
+		}
+
+		// Read pages of 30 keys while deleting every read key from the map.
+		var tok []byte
+		var n int
+		for {
+			itr, err := m.IteratorFromCursor(tok)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var keys []interface{}
+			if keys, tok = readPage(t, itr, 30, false); len(keys) == 0 {
+				break
+			}
+			for _, k := range keys {
+				if k != n {
+					t.Fatalf("unexpected key: %v, expected %d", k, n)
+				}
+				m, n = m.Delete(k), n+1
+			}
+		}
+		if n != 1000 || m.Len() != 0 {
+			t.Fatalf("unexpected state: n=%d len=%d", n, m.Len())
+		}
+	})
+
+	t.Run("End", func(t *testing.T) {
+		m := NewSortedMap(nil).Set("foo", 1)
+		_, tok := readPage(t, m.Iterator(), 10, false)
+		if itr, err := m.IteratorFromCursor(tok); err != nil {
+			t.Fatal(err)
+		} else if !itr.Done() {
+			t.Fatal("expected done")
+		} else if other, err := itr.Cursor(); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(other, tok) {
+			t.Fatalf("unexpected cursor: %v", other)
+		}
+	})
+
+	t.Run("NoCursor", func(t *testing.T) {
+		m := NewSortedMap(nil).Set("foo", 1)
+		if tok, err := m.Iterator().Cursor(); err != nil {
+			t.Fatal(err)
+		} else if tok != nil {
+			t.Fatalf("unexpected cursor: %v", tok)
+		} else if itr, err := m.IteratorFromCursor(nil); err != nil {
+			t.Fatal(err)
+		} else if k, _ := itr.Next(); k != "foo" {
+			t.Fatalf("unexpected key: %v", k)
+		}
+	})
+
+	t.Run("Empty", func(t *testing.T) {
+		_, tok := readPage(t, NewSortedMap(nil).Set("foo", 1).Iterator(), 1, false)
+		if itr, err := NewSortedMap(nil).IteratorFromCursor(tok); err != nil {
+			t.Fatal(err)
+		} else if !itr.Done() {
+			t.Fatal("expected done")
+		}
+	})
+
+	t.Run("ErrUnsupportedKey", func(t *testing.T) {
+		m := NewSortedMap(&mockComparer{compare: func(a, b interface{}) int { return 0 }}).Set(struct{}{}, 1)
+		itr := m.Iterator()
+		itr.Next()
+		if _, err := itr.Cursor(); err == nil || err.Error() != `immutable.DefaultCodec: unsupported type struct {}` {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("ErrInvalidCursor", func(t *testing.T) {
+		m := NewSortedMap(nil).Set("foo", 1)
+		for _, tok := range [][]byte{{}, {0}, {2, codecNil}, {0, codecNil, 0}} {
+			if _, err := m.IteratorFromCursor(tok); err == nil || err.Error() != `immutable.SortedMap.IteratorFromCursor: invalid cursor` {
+				t.Fatalf("unexpected error for %v: %v", tok, err)
+			}
+		}
+		if _, err := m.IteratorFromCursor([]byte{0, 0xFF}); err == nil {
+			t.Fatal("expected error")
+		}
+	})
+}
+
 // TestSortedMap represents a combined immutable and stdlib sorted map.
 type TestSortedMap struct {
 	im, prev *SortedMap
@@ -1827,6 +2795,34 @@ func (m *TestSortedMap) Delete(k int) {
 	}
 }
 
+// Update updates k using SortedMap.Update and verifies the old value passed to fn.
+func (m *TestSortedMap) Update(k, v int, keep bool) {
+	m.prev = m.im
+	m.im = m.im.Update(k, func(old interface{}, exists bool) (interface{}, bool) {
+		if prev, ok := m.std[k]; exists != ok || (exists && old != prev) {
+			panic(fmt.Sprintf("unexpected old value for key %d: <%v,%v>", k, old, exists))
+		}
+		return v, keep
+	})
+
+	if !keep {
+		delete(m.std, k)
+		for i := range m.keys {
+			if m.keys[i] == k {
+				m.keys = append(m.keys[:i], m.keys[i+1:]...)
+				break
+			}
+		}
+		return
+	}
+
+	if _, exists := m.std[k]; !exists {
+		m.keys = append(m.keys, k)
+		sort.Ints(m.keys)
+	}
+	m.std[k] = v
+}
+
 func (m *TestSortedMap) Validate() error {
 	for _, k := range m.keys {
 		if v, ok := m.im.Get(k); !ok {
@@ -1908,6 +2904,22 @@ func BenchmarkSortedMap_Delete(b *testing.B) {
 	}
 }
 
+func BenchmarkSortedMap_Update(b *testing.B) {
+	const n = 10000
+
+	m := NewSortedMap(nil)
+	for i := 0; i < n; i++ {
+		m = m.Set(i, i)
+	}
+	incr := func(old interface{}, exists bool) (interface{}, bool) { return old.(int) + 1, true }
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		m.Update(i%n, incr) // Do not update map, always operate on original
+	}
+}
+
 func BenchmarkSortedMap_Iterator(b *testing.B) {
 	const n = 10000
 	m := NewSortedMap(nil)
@@ -1973,6 +2985,19 @@ func ExampleSortedMap_Delete() {
 	// baz <nil> false
 }
 
+func ExampleSortedMap_Update() {
+	m := NewSortedMap(nil)
+	m = m.Set("foo", "bar")
+	m = m.Update("foo", func(old interface{}, exists bool) (interface{}, bool) {
+		return old.(string) + "baz", true
+	})
+
+	v, ok := m.Get("foo")
+	fmt.Println("foo", v, ok)
+	// Output:
+	// foo barbaz true
+}
+
 func ExampleSortedMap_Iterator() {
 	m := NewSortedMap(nil)
 	m = m.Set("strawberry", 900)
@@ -2002,6 +3027,35 @@ func ExampleSortedMap_Iterator() {
 	// strawberry 900
 }
 
+func ExampleSortedMap_IteratorFromCursor() {
+	m := NewSortedMap(nil)
+	m = m.Set("apple", 100)
+	m = m.Set("grape", 200)
+	m = m.Set("kiwi", 300)
+
+	// Read the first page and save a cursor after it.
+	itr := m.Iterator()
+	fmt.Println(itr.Next())
+	tok, err := itr.Cursor()
+	if err != nil {
+		panic(err)
+	}
+
+	// Resume on a newer version of the map.
+	m = m.Delete("grape").Set("banana", 150)
+	itr, err = m.IteratorFromCursor(tok)
+	if err != nil {
+		panic(err)
+	}
+	for !itr.Done() {
+		fmt.Println(itr.Next())
+	}
+	// Output:
+	// apple 100
+	// banana 150
+	// kiwi 300
+}
+
 // RunRandom executes fn multiple times with a different rand.
 func RunRandom(t *testing.T, name string, fn func(t *testing.T, rand *rand.Rand)) {
 	if testing.Short() {
@@ -2009,6 +3063,7 @@ func RunRandom(t *testing.T, name string, fn func(t *testing.T, rand *rand.Rand)
 	}
 	t.Run(name, func(t *testing.T) {
 		for i := 0; i < *randomN; i++ {
+			i := i
 			t.Run(fmt.Sprintf("%08d", i), func(t *testing.T) {
 				t.Parallel()
 				fn(t, rand.New(rand.NewSource(int64(i))))
@@ -2046,6 +3101,23 @@ func (h *mockHasher) Equal(a, b interface{}) bool {
 	return h.equal(a, b)
 }
 
+// mockHasher64 represents a mock implementation of immutable.Hasher64.
+type mockHasher64 struct {
+	mockHasher
+	hash64 func(value interface{}) uint64
+}
+
+// Hash64 executes the mocked hash64 function.
+func (h *mockHasher64) Hash64(value interface{}) uint64 {
+	return h.hash64(value)
+}
+
+// comparableMockHasher represents a mock hasher that also implements Comparer.
+type comparableMockHasher struct {
+	mockHasher
+	mockComparer
+}
+
 // mockComparer represents a mock implementation of immutable.Comparer.
 type mockComparer struct {
 	compare func(a, b interface{}) int
@@ -0,0 +1,316 @@
+package immutable
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// JSONDecodeFunc decodes a single JSON element into a key or value.
+type JSONDecodeFunc func(data []byte) (interface{}, error)
+
+// DefaultJSONDecode decodes data into a generic Go value. It is similar to
+// json.Unmarshal into an interface{} except that integers within the range of
+// an int are decoded as int instead of float64.
+func DefaultJSONDecode(data []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return convertJSONNumbers(v), nil
+}
+
+// convertJSONNumbers recursively replaces json.Number values with an int, if
+// the number is an integer that fits in an int, or with a float64 otherwise.
+func convertJSONNumbers(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil && int64(int(i)) == i {
+			return int(i)
+		}
+		f, _ := v.Float64()
+		return f
+	case []interface{}:
+		for i := range v {
+			v[i] = convertJSONNumbers(v[i])
+		}
+	case map[string]interface{}:
+		for k := range v {
+			v[k] = convertJSONNumbers(v[k])
+		}
+	}
+	return v
+}
+
+// MarshalJSON encodes the list as a JSON array.
+func (l *List) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('[')
+	for itr := l.Iterator(); !itr.Done(); {
+		i, v := itr.Next()
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		if err := writeJSON(&buf, v); err != nil {
+			return nil, err
+		}
+	}
+	buf.WriteByte(']')
+	return buf.Bytes(), nil
+}
+
+// UnmarshalJSON decodes a JSON array into the list using DefaultJSONDecode
+// for each element. The list is replaced so this should only be used on a
+// newly allocated list.
+func (l *List) UnmarshalJSON(data []byte) error {
+	other, err := UnmarshalListJSON(data, nil)
+	if err != nil {
+		return err
+	}
+	*l = *other
+	return nil
+}
+
+// UnmarshalListJSON decodes a JSON array into a new list. Each element is
+// decoded with fn. If fn is nil then DefaultJSONDecode is used.
+func UnmarshalListJSON(data []byte, fn JSONDecodeFunc) (*List, error) {
+	if fn == nil {
+		fn = DefaultJSONDecode
+	}
+
+	var elems []json.RawMessage
+	if err := json.Unmarshal(data, &elems); err != nil {
+		return nil, err
+	}
+
+	l := NewList()
+	for _, elem := range elems {
+		v, err := fn(elem)
+		if err != nil {
+			return nil, err
+		}
+		l = l.Append(v)
+	}
+	return l, nil
+}
+
+// MarshalJSON encodes the map as a JSON object if every key is a string.
+// Object keys are written in sorted order. Otherwise the map is encoded as
+// an array of [key, value] pairs in iteration order.
+func (m *Map) MarshalJSON() ([]byte, error) {
+	var entries []mapEntry
+	stringKeys := true
+	for itr := m.Iterator(); !itr.Done(); {
+		k, v := itr.Next()
+		if _, ok := k.(string); !ok {
+			stringKeys = false
+		}
+		entries = append(entries, mapEntry{key: k, value: v})
+	}
+
+	if stringKeys {
+		sort.Slice(entries, func(i, j int) bool { return entries[i].key.(string) < entries[j].key.(string) })
+	}
+	return marshalJSONEntries(entries, stringKeys)
+}
+
+// UnmarshalJSON decodes a JSON object or an array of [key, value] pairs into
+// the map using DefaultJSONDecode for each key and value. The map's hasher is
+// retained if one is set. Otherwise a default hasher is chosen for the first
+// key, which is the built-in string hasher for JSON objects.
+//
+// The map is replaced so this should only be used on a newly allocated map.
+func (m *Map) UnmarshalJSON(data []byte) error {
+	other, err := UnmarshalMapJSON(data, m.hasher, nil, nil)
+	if err != nil {
+		return err
+	}
+	*m = *other
+	return nil
+}
+
+// UnmarshalMapJSON decodes a JSON object or an array of [key, value] pairs
+// into a new map that uses hasher. Keys are decoded with keyFn and values are
+// decoded with valueFn. Object keys are passed to keyFn as JSON strings. If
+// either function is nil then DefaultJSONDecode is used.
+func UnmarshalMapJSON(data []byte, hasher Hasher, keyFn, valueFn JSONDecodeFunc) (*Map, error) {
+	m := NewMap(hasher)
+	err := unmarshalJSONEntries(data, keyFn, valueFn, func(key, value interface{}) {
+		m = m.Set(key, value)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// MarshalJSON encodes the map as a JSON object if every key is a string.
+// Otherwise the map is encoded as an array of [key, value] pairs. Keys are
+// written in sorted order in both cases.
+func (m *SortedMap) MarshalJSON() ([]byte, error) {
+	var entries []mapEntry
+	stringKeys := true
+	for itr := m.Iterator(); !itr.Done(); {
+		k, v := itr.Next()
+		if _, ok := k.(string); !ok {
+			stringKeys = false
+		}
+		entries = append(entries, mapEntry{key: k, value: v})
+	}
+	return marshalJSONEntries(entries, stringKeys)
+}
+
+// UnmarshalJSON decodes a JSON object or an array of [key, value] pairs into
+// the map using DefaultJSONDecode for each key and value. The map's comparer
+// is retained if one is set. Otherwise a default comparer is chosen for the
+// first key, which is the built-in string comparer for JSON objects.
+//
+// The map is replaced so this should only be used on a newly allocated map.
+func (m *SortedMap) UnmarshalJSON(data []byte) error {
+	other, err := UnmarshalSortedMapJSON(data, m.comparer, nil, nil)
+	if err != nil {
+		return err
+	}
+	*m = *other
+	return nil
+}
+
+// UnmarshalSortedMapJSON decodes a JSON object or an array of [key, value]
+// pairs into a new sorted map that uses comparer. Keys are decoded with keyFn
+// and values are decoded with valueFn. Object keys are passed to keyFn as
+// JSON strings. If either function is nil then DefaultJSONDecode is used.
+func UnmarshalSortedMapJSON(data []byte, comparer Comparer, keyFn, valueFn JSONDecodeFunc) (*SortedMap, error) {
+	m := NewSortedMap(comparer)
+	err := unmarshalJSONEntries(data, keyFn, valueFn, func(key, value interface{}) {
+		m = m.Set(key, value)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// marshalJSONEntries encodes entries as a JSON object if object is true.
+// Otherwise entries are encoded as an array of [key, value] pairs.
+func marshalJSONEntries(entries []mapEntry, object bool) ([]byte, error) {
+	var buf bytes.Buffer
+	if object {
+		buf.WriteByte('{')
+	} else {
+		buf.WriteByte('[')
+	}
+
+	for i, entry := range entries {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		if !object {
+			buf.WriteByte('[')
+		}
+
+		if err := writeJSON(&buf, entry.key); err != nil {
+			return nil, err
+		}
+		if object {
+			buf.WriteByte(':')
+		} else {
+			buf.WriteByte(',')
+		}
+		if err := writeJSON(&buf, entry.value); err != nil {
+			return nil, err
+		}
+
+		if !object {
+			buf.WriteByte(']')
+		}
+	}
+
+	if object {
+		buf.WriteByte('}')
+	} else {
+		buf.WriteByte(']')
+	}
+	return buf.Bytes(), nil
+}
+
+// unmarshalJSONEntries decodes a JSON object or an array of [key, value]
+// pairs and calls fn for each decoded key and value.
+func unmarshalJSONEntries(data []byte, keyFn, valueFn JSONDecodeFunc, fn func(key, value interface{})) error {
+	if keyFn == nil {
+		keyFn = DefaultJSONDecode
+	}
+	if valueFn == nil {
+		valueFn = DefaultJSONDecode
+	}
+
+	switch data := bytes.TrimSpace(data); {
+	case bytes.Equal(data, []byte("null")):
+		return nil
+
+	case len(data) > 0 && data[0] == '{':
+		var obj map[string]json.RawMessage
+		if err := json.Unmarshal(data, &obj); err != nil {
+			return err
+		}
+
+		// Sort object keys so decoding is deterministic.
+		keys := make([]string, 0, len(obj))
+		for k := range obj {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			buf, err := json.Marshal(k)
+			if err != nil {
+				return err
+			}
+			key, err := keyFn(buf)
+			if err != nil {
+				return err
+			}
+			value, err := valueFn(obj[k])
+			if err != nil {
+				return err
+			}
+			fn(key, value)
+		}
+		return nil
+
+	default:
+		var pairs [][]json.RawMessage
+		if err := json.Unmarshal(data, &pairs); err != nil {
+			return err
+		}
+
+		for _, pair := range pairs {
+			if len(pair) != 2 {
+				return fmt.Errorf("immutable: expected [key, value] pair, got %d elements", len(pair))
+			}
+			key, err := keyFn(pair[0])
+			if err != nil {
+				return err
+			}
+			value, err := valueFn(pair[1])
+			if err != nil {
+				return err
+			}
+			fn(key, value)
+		}
+		return nil
+	}
+}
+
+// writeJSON writes the JSON encoding of v to buf.
+func writeJSON(buf *bytes.Buffer, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	buf.Write(data)
+	return nil
+}
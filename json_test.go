@@ -0,0 +1,240 @@
+package immutable
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestDefaultJSONDecode(t *testing.T) {
+	v, err := DefaultJSONDecode([]byte(`[1, 1.5, "foo", {"bar": 2}, null, true, 100000000000000000000]`))
+	if err != nil {
+		t.Fatal(err)
+	} else if exp := []interface{}{1, 1.5, "foo", map[string]interface{}{"bar": 2}, nil, true, 1e20}; !reflect.DeepEqual(v, exp) {
+		t.Fatalf("unexpected value: %#v", v)
+	}
+}
+
+func TestList_MarshalJSON(t *testing.T) {
+	l := NewList().Append(1).Append("foo").Append(NewList().Append(true))
+	if buf, err := json.Marshal(l); err != nil {
+		t.Fatal(err)
+	} else if got, exp := string(buf), `[1,"foo",[true]]`; got != exp {
+		t.Fatalf("got %s, expected %s", got, exp)
+	}
+
+	if buf, err := json.Marshal(NewList()); err != nil {
+		t.Fatal(err)
+	} else if got, exp := string(buf), `[]`; got != exp {
+		t.Fatalf("got %s, expected %s", got, exp)
+	}
+}
+
+func TestList_UnmarshalJSON(t *testing.T) {
+	var v struct {
+		L *List `json:"l"`
+	}
+	if err := json.Unmarshal([]byte(`{"l":[1,"foo",2.5]}`), &v); err != nil {
+		t.Fatal(err)
+	} else if got, exp := listValues(v.L), []interface{}{1, "foo", 2.5}; !reflect.DeepEqual(got, exp) {
+		t.Fatalf("unexpected values: %#v", got)
+	}
+
+	// Ensure the decoded list can be updated.
+	if l := v.L.Append("bar"); l.Len() != 4 || l.Get(3) != "bar" {
+		t.Fatal("unexpected append")
+	}
+
+	t.Run("ErrNotArray", func(t *testing.T) {
+		var l List
+		if err := json.Unmarshal([]byte(`{}`), &l); err == nil {
+			t.Fatal("expected error")
+		}
+	})
+}
+
+func TestUnmarshalListJSON(t *testing.T) {
+	l, err := UnmarshalListJSON([]byte(`["1","2"]`), func(data []byte) (interface{}, error) {
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return nil, err
+		}
+		return strconv.Atoi(s)
+	})
+	if err != nil {
+		t.Fatal(err)
+	} else if got, exp := listValues(l), []interface{}{1, 2}; !reflect.DeepEqual(got, exp) {
+		t.Fatalf("unexpected values: %#v", got)
+	}
+}
+
+func TestMap_MarshalJSON(t *testing.T) {
+	t.Run("Object", func(t *testing.T) {
+		m := NewMap(nil).Set("foo", 1).Set("bar", "baz").Set("a\"b", nil)
+		if buf, err := json.Marshal(m); err != nil {
+			t.Fatal(err)
+		} else if got, exp := string(buf), `{"a\"b":null,"bar":"baz","foo":1}`; got != exp {
+			t.Fatalf("got %s, expected %s", got, exp)
+		}
+	})
+
+	t.Run("Pairs", func(t *testing.T) {
+		m := NewMap(nil).Set(1, "foo")
+		if buf, err := json.Marshal(m); err != nil {
+			t.Fatal(err)
+		} else if got, exp := string(buf), `[[1,"foo"]]`; got != exp {
+			t.Fatalf("got %s, expected %s", got, exp)
+		}
+	})
+
+	t.Run("Empty", func(t *testing.T) {
+		if buf, err := json.Marshal(NewMap(nil)); err != nil {
+			t.Fatal(err)
+		} else if got, exp := string(buf), `{}`; got != exp {
+			t.Fatalf("got %s, expected %s", got, exp)
+		}
+	})
+}
+
+func TestMap_UnmarshalJSON(t *testing.T) {
+	t.Run("Object", func(t *testing.T) {
+		var m *Map
+		if err := json.Unmarshal([]byte(`{"foo":1,"bar":{"baz":2.5}}`), &m); err != nil {
+			t.Fatal(err)
+		} else if _, ok := m.hasher.(*stringHasher); !ok {
+			t.Fatalf("unexpected hasher: %T", m.hasher)
+		} else if v, _ := m.Get("foo"); v != 1 {
+			t.Fatalf("unexpected value: %#v", v)
+		} else if v, _ := m.Get("bar"); !reflect.DeepEqual(v, map[string]interface{}{"baz": 2.5}) {
+			t.Fatalf("unexpected value: %#v", v)
+		}
+	})
+
+	t.Run("Pairs", func(t *testing.T) {
+		var m *Map
+		if err := json.Unmarshal([]byte(`[[1,"foo"],[2,"bar"]]`), &m); err != nil {
+			t.Fatal(err)
+		} else if m.Len() != 2 {
+			t.Fatalf("unexpected len: %d", m.Len())
+		} else if v, _ := m.Get(2); v != "bar" {
+			t.Fatalf("unexpected value: %#v", v)
+		}
+	})
+
+	t.Run("RoundTrip", func(t *testing.T) {
+		m := NewMap(nil)
+		for i := 0; i < 1000; i++ {
+			m = m.Set(fmt.Sprint(i), i)
+		}
+		buf, err := json.Marshal(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		other := &Map{}
+		if err := json.Unmarshal(buf, other); err != nil {
+			t.Fatal(err)
+		} else if other.Len() != m.Len() {
+			t.Fatalf("unexpected len: %d", other.Len())
+		}
+		for i := 0; i < 1000; i++ {
+			if v, _ := other.Get(fmt.Sprint(i)); v != i {
+				t.Fatalf("unexpected value: %#v", v)
+			}
+		}
+	})
+
+	t.Run("ErrInvalidPair", func(t *testing.T) {
+		var m Map
+		if err := json.Unmarshal([]byte(`[[1,2,3]]`), &m); err == nil || err.Error() != `immutable: expected [key, value] pair, got 3 elements` {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestUnmarshalMapJSON(t *testing.T) {
+	keyFn := func(data []byte) (interface{}, error) {
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return nil, err
+		}
+		return strconv.Atoi(s)
+	}
+	m, err := UnmarshalMapJSON([]byte(`{"1":"foo","2":"bar"}`), nil, keyFn, nil)
+	if err != nil {
+		t.Fatal(err)
+	} else if v, _ := m.Get(2); v != "bar" {
+		t.Fatalf("unexpected value: %#v", v)
+	}
+}
+
+func TestSortedMap_MarshalJSON(t *testing.T) {
+	t.Run("Object", func(t *testing.T) {
+		m := NewSortedMap(nil).Set("foo", 1).Set("bar", 2)
+		if buf, err := json.Marshal(m); err != nil {
+			t.Fatal(err)
+		} else if got, exp := string(buf), `{"bar":2,"foo":1}`; got != exp {
+			t.Fatalf("got %s, expected %s", got, exp)
+		}
+	})
+
+	t.Run("Pairs", func(t *testing.T) {
+		m := NewSortedMap(nil).Set(3, "foo").Set(1, "bar")
+		if buf, err := json.Marshal(m); err != nil {
+			t.Fatal(err)
+		} else if got, exp := string(buf), `[[1,"bar"],[3,"foo"]]`; got != exp {
+			t.Fatalf("got %s, expected %s", got, exp)
+		}
+	})
+}
+
+func TestSortedMap_UnmarshalJSON(t *testing.T) {
+	var v struct {
+		M *SortedMap `json:"m"`
+	}
+	if err := json.Unmarshal([]byte(`{"m":{"foo":1,"bar":2}}`), &v); err != nil {
+		t.Fatal(err)
+	} else if _, ok := v.M.comparer.(*stringComparer); !ok {
+		t.Fatalf("unexpected comparer: %T", v.M.comparer)
+	} else if buf, err := json.Marshal(v.M); err != nil {
+		t.Fatal(err)
+	} else if got, exp := string(buf), `{"bar":2,"foo":1}`; got != exp {
+		t.Fatalf("got %s, expected %s", got, exp)
+	}
+
+	t.Run("Null", func(t *testing.T) {
+		m, err := UnmarshalSortedMapJSON([]byte(`null`), nil, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		} else if m.Len() != 0 {
+			t.Fatalf("unexpected len: %d", m.Len())
+		}
+	})
+}
+
+func BenchmarkMap_MarshalJSON(b *testing.B) {
+	m := NewMap(nil)
+	for i := 0; i < 1000; i++ {
+		m = m.Set(fmt.Sprint(i), i)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := json.Marshal(m); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func ExampleSortedMap_MarshalJSON() {
+	m := NewSortedMap(nil)
+	m = m.Set("foo", 1)
+	m = m.Set("bar", 2)
+
+	buf, _ := json.Marshal(m)
+	fmt.Println(string(buf))
+	// Output:
+	// {"bar":2,"foo":1}
+}
@@ -0,0 +1,311 @@
+package immutable
+
+import (
+	"context"
+	"runtime"
+	"sync"
+)
+
+// ParallelRange calls fn for each key/value pair in the map using up to workers
+// goroutines. If workers is less than one then GOMAXPROCS is used. fn is called
+// concurrently and in no particular order. Returns the first error returned by
+// fn or the context's error if ctx is canceled.
+func (m *Map) ParallelRange(ctx context.Context, workers int, fn func(key, value interface{}) error) error {
+	if m.root == nil {
+		return ctx.Err()
+	}
+	_, _, err := parallelMapNode(ctx, m.root, workers, func(ctx context.Context, n mapNode) (mapNode, int, error) {
+		return n, 0, rangeMapNode(ctx, n, fn)
+	})
+	return err
+}
+
+// ParallelMapValues returns a new map with the same keys where each value is
+// replaced by the result of fn, which is called using up to workers
+// goroutines. Returns nil and the first error returned by fn or the context's
+// error if ctx is canceled.
+func (m *Map) ParallelMapValues(ctx context.Context, workers int, fn func(key, value interface{}) (interface{}, error)) (*Map, error) {
+	if m.root == nil {
+		return m, ctx.Err()
+	}
+	root, _, err := parallelMapNode(ctx, m.root, workers, func(ctx context.Context, n mapNode) (mapNode, int, error) {
+		n, err := mapValuesMapNode(ctx, n, fn)
+		return n, 0, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Map{size: m.size, root: root, hasher: m.hasher, equaler: m.equaler}, nil
+}
+
+// ParallelFilter returns a new map containing only the key/value pairs for
+// which fn returns true, calling fn using up to workers goroutines. Returns the
+// original map if no keys are removed. Returns nil and the first error returned
+// by fn or the context's error if ctx is canceled.
+func (m *Map) ParallelFilter(ctx context.Context, workers int, fn func(key, value interface{}) (bool, error)) (*Map, error) {
+	if m.root == nil {
+		return m, ctx.Err()
+	}
+	root, removed, err := parallelMapNode(ctx, m.root, workers, func(ctx context.Context, n mapNode) (mapNode, int, error) {
+		return filterMapNode(ctx, n, fn)
+	})
+	if err != nil {
+		return nil, err
+	} else if root == m.root {
+		return m, nil
+	}
+	return &Map{size: m.size - removed, root: root, hasher: m.hasher, equaler: m.equaler}, nil
+}
+
+// parallelMapNode calls fn for each child of the root node n using up to
+// workers goroutines. If workers is less than one then GOMAXPROCS is used.
+// Each call returns the replacement for its child and a count that is summed
+// across all children. If n is not a branch node then fn is called once with
+// n itself.
+//
+// Children are handed out to workers as they become free so they are
+// processed concurrently and in no particular order. Results are stored by
+// slot, so the new root has the same shape as n and is built directly from
+// the replaced children without a merge. Unchanged children are shared with
+// n. Workers stop early once fn returns an error or ctx is canceled and the
+// first error is returned.
+func parallelMapNode(ctx context.Context, n mapNode, workers int, fn func(ctx context.Context, n mapNode) (mapNode, int, error)) (mapNode, int, error) {
+	if !isMapBranchNode(n) {
+		if err := ctx.Err(); err != nil {
+			return nil, 0, err
+		}
+		return fn(ctx, n)
+	}
+
+	// Collect the slots of the root's children.
+	var children [mapNodeSize]mapNode
+	slots := make(chan int, mapNodeSize)
+	for i := range children {
+		if children[i] = mapBranchChild(n, i); children[i] != nil {
+			slots <- i
+		}
+	}
+	close(slots)
+
+	if workers < 1 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if workers > len(slots) {
+		workers = len(slots)
+	}
+
+	// Process children until all are done or a worker fails. Each worker only
+	// writes to the slots it receives so results need no locking.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		once     sync.Once
+		firstErr error
+		results  [mapNodeSize]mapNode
+		counts   [mapNodeSize]int
+	)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range slots {
+				if ctx.Err() != nil {
+					return
+				}
+
+				var err error
+				if results[i], counts[i], err = fn(ctx, children[i]); err != nil {
+					once.Do(func() { firstErr = err })
+					cancel()
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, 0, firstErr
+	} else if err := ctx.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	// Return the original root if no children changed.
+	var count int
+	var changed bool
+	for i := range results {
+		count += counts[i]
+		changed = changed || results[i] != children[i]
+	}
+	if !changed {
+		return n, count, nil
+	}
+	return newMapBranchNode(&results), count, nil
+}
+
+// isDone returns true if ctx has been canceled.
+func isDone(ctx context.Context) bool {
+	select {
+	case <-ctx.Done():
+		return true
+	default:
+		return false
+	}
+}
+
+// rangeMapNode calls fn for each key/value pair under n.
+func rangeMapNode(ctx context.Context, n mapNode, fn func(key, value interface{}) error) error {
+	switch n := n.(type) {
+	case *mapBitmapIndexedNode:
+		for _, child := range n.nodes {
+			if err := rangeMapNode(ctx, child, fn); err != nil {
+				return err
+			}
+		}
+		return nil
+	case *mapHashArrayNode:
+		for _, child := range n.nodes {
+			if child == nil {
+				continue
+			} else if err := rangeMapNode(ctx, child, fn); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// Check for cancellation once per leaf node.
+	if isDone(ctx) {
+		return ctx.Err()
+	} else if n, ok := n.(*mapValueNode); ok {
+		return fn(n.key, n.value)
+	}
+	for _, e := range mapNodeEntries(n, nil) {
+		if err := fn(e.key, e.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mapValuesMapNode returns a copy of n with each value replaced by fn.
+func mapValuesMapNode(ctx context.Context, n mapNode, fn func(key, value interface{}) (interface{}, error)) (_ mapNode, err error) {
+	switch n := n.(type) {
+	case *mapBitmapIndexedNode:
+		other := &mapBitmapIndexedNode{bitmap: n.bitmap, nodes: make([]mapNode, len(n.nodes))}
+		for i, child := range n.nodes {
+			if other.nodes[i], err = mapValuesMapNode(ctx, child, fn); err != nil {
+				return nil, err
+			}
+		}
+		return other, nil
+
+	case *mapHashArrayNode:
+		other := &mapHashArrayNode{count: n.count}
+		for i, child := range n.nodes {
+			if child == nil {
+				continue
+			} else if other.nodes[i], err = mapValuesMapNode(ctx, child, fn); err != nil {
+				return nil, err
+			}
+		}
+		return other, nil
+	}
+
+	// Check for cancellation once per leaf node.
+	if isDone(ctx) {
+		return nil, ctx.Err()
+	}
+
+	if n, ok := n.(*mapValueNode); ok {
+		value, err := fn(n.key, n.value)
+		if err != nil {
+			return nil, err
+		}
+		return newMapValueNode(n.keyHash, n.key, value), nil
+	}
+
+	entries, err := mapValuesEntries(mapNodeEntries(n, nil), fn)
+	if err != nil {
+		return nil, err
+	} else if n, ok := n.(*mapHashCollisionNode); ok {
+		return &mapHashCollisionNode{keyHash: n.keyHash, entries: entries}, nil
+	}
+	return &mapArrayNode{entries: entries}, nil
+}
+
+// mapValuesEntries returns a copy of entries with each value replaced by fn.
+func mapValuesEntries(entries []mapEntry, fn func(key, value interface{}) (interface{}, error)) ([]mapEntry, error) {
+	other := make([]mapEntry, len(entries))
+	for i, e := range entries {
+		value, err := fn(e.key, e.value)
+		if err != nil {
+			return nil, err
+		}
+		other[i] = mapEntry{key: e.key, value: value}
+	}
+	return other, nil
+}
+
+// filterMapNode returns n with the key/value pairs removed for which fn
+// returns false, along with the number of removed pairs. Returns n if no pairs
+// are removed and nil if all pairs are removed.
+func filterMapNode(ctx context.Context, n mapNode, fn func(key, value interface{}) (bool, error)) (mapNode, int, error) {
+	if isMapBranchNode(n) {
+		var children [mapNodeSize]mapNode
+		var removed int
+		var changed bool
+		for i := range children {
+			child := mapBranchChild(n, i)
+			if child == nil {
+				continue
+			}
+
+			newChild, count, err := filterMapNode(ctx, child, fn)
+			if err != nil {
+				return nil, 0, err
+			}
+			children[i], removed = newChild, removed+count
+			changed = changed || newChild != child
+		}
+		if !changed {
+			return n, 0, nil
+		}
+		return newMapBranchNode(&children), removed, nil
+	}
+
+	// Check for cancellation once per leaf node.
+	if isDone(ctx) {
+		return nil, 0, ctx.Err()
+	}
+
+	// Keep matching entries. Return the original node if all are kept.
+	entries := mapNodeEntries(n, nil)
+	kept := make([]mapEntry, 0, len(entries))
+	for _, e := range entries {
+		if ok, err := fn(e.key, e.value); err != nil {
+			return nil, 0, err
+		} else if ok {
+			kept = append(kept, e)
+		}
+	}
+	removed := len(entries) - len(kept)
+	switch {
+	case removed == 0:
+		return n, 0, nil
+	case len(kept) == 0:
+		return nil, removed, nil
+	}
+
+	// A value node keeps or removes its only pair so only array and collision
+	// nodes can be partially filtered.
+	if n, ok := n.(*mapHashCollisionNode); ok {
+		if len(kept) == 1 {
+			return newMapValueNode(n.keyHash, kept[0].key, kept[0].value), removed, nil
+		}
+		return &mapHashCollisionNode{keyHash: n.keyHash, entries: kept}, removed, nil
+	}
+	return &mapArrayNode{entries: kept}, removed, nil
+}
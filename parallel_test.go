@@ -0,0 +1,212 @@
+package immutable
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestMap_ParallelRange(t *testing.T) {
+	for _, n := range []int{0, 1, 5, 1000, 100000} {
+		t.Run(fmt.Sprint(n), func(t *testing.T) {
+			m := NewMap(nil)
+			for i := 0; i < n; i++ {
+				m = m.Set(i, i*2)
+			}
+
+			var mu sync.Mutex
+			seen := make(map[int]int)
+			if err := m.ParallelRange(context.Background(), 4, func(key, value interface{}) error {
+				mu.Lock()
+				defer mu.Unlock()
+				seen[key.(int)] = value.(int)
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			} else if len(seen) != n {
+				t.Fatalf("unexpected count: %d", len(seen))
+			}
+			for k, v := range seen {
+				if v != k*2 {
+					t.Fatalf("unexpected value for %d: %d", k, v)
+				}
+			}
+		})
+	}
+
+	t.Run("Error", func(t *testing.T) {
+		m := NewMap(nil)
+		for i := 0; i < 100000; i++ {
+			m = m.Set(i, i)
+		}
+
+		errMarker := errors.New("marker")
+		var calls int64
+		if err := m.ParallelRange(context.Background(), 0, func(key, value interface{}) error {
+			atomic.AddInt64(&calls, 1)
+			return errMarker
+		}); err != errMarker {
+			t.Fatalf("unexpected error: %v", err)
+		} else if calls > mapNodeSize {
+			t.Fatalf("expected workers to stop early, got %d calls", calls)
+		}
+	})
+
+	t.Run("Canceled", func(t *testing.T) {
+		m := NewMap(nil)
+		for i := 0; i < 100000; i++ {
+			m = m.Set(i, i)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		var calls int64
+		if err := m.ParallelRange(ctx, 4, func(key, value interface{}) error {
+			if atomic.AddInt64(&calls, 1) == 100 {
+				cancel()
+			}
+			return nil
+		}); err != context.Canceled {
+			t.Fatalf("unexpected error: %v", err)
+		} else if calls == 100000 {
+			t.Fatal("expected workers to stop early")
+		}
+	})
+}
+
+func TestMap_ParallelMapValues(t *testing.T) {
+	for _, n := range []int{0, 1, 5, 1000, 100000} {
+		t.Run(fmt.Sprint(n), func(t *testing.T) {
+			m := NewMap(nil)
+			for i := 0; i < n; i++ {
+				m = m.Set(i, i)
+			}
+
+			other, err := m.ParallelMapValues(context.Background(), 4, func(key, value interface{}) (interface{}, error) {
+				return value.(int) * 2, nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			} else if other.Len() != n {
+				t.Fatalf("unexpected len: %d", other.Len())
+			}
+			for i := 0; i < n; i++ {
+				if v, ok := other.Get(i); !ok || v != i*2 {
+					t.Fatalf("Get(%d)=<%v,%v>", i, v, ok)
+				} else if v, _ := m.Get(i); v != i {
+					t.Fatalf("original map changed: Get(%d)=%v", i, v)
+				}
+			}
+
+			// The result must still support writes.
+			if other = other.Set(n, n).Delete(0); other.Len() != n {
+				t.Fatalf("unexpected len after writes: %d", other.Len())
+			}
+		})
+	}
+
+	t.Run("Error", func(t *testing.T) {
+		m := NewMap(nil).Set(1, 1).Set(2, 2)
+		errMarker := errors.New("marker")
+		if other, err := m.ParallelMapValues(context.Background(), 1, func(key, value interface{}) (interface{}, error) {
+			return nil, errMarker
+		}); err != errMarker || other != nil {
+			t.Fatalf("unexpected result: <%v,%v>", other, err)
+		}
+	})
+}
+
+func TestMap_ParallelFilter(t *testing.T) {
+	h := mockHasher{
+		hash:  func(value interface{}) uint32 { return hashUint64(uint64(value.(int))) % 0xFF },
+		equal: func(a, b interface{}) bool { return a.(int) == b.(int) },
+	}
+
+	for _, tt := range []struct {
+		name   string
+		hasher Hasher
+		n      int
+	}{
+		{"Empty", nil, 0},
+		{"Array", nil, 5},
+		{"Small", nil, 1000},
+		{"Large", nil, 100000},
+		{"LimitedHash", &h, 10000},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewMap(tt.hasher)
+			for i := 0; i < tt.n; i++ {
+				m = m.Set(i, i)
+			}
+
+			other, err := m.ParallelFilter(context.Background(), 4, func(key, value interface{}) (bool, error) {
+				return key.(int)%3 == 0, nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			} else if exp := (tt.n + 2) / 3; other.Len() != exp {
+				t.Fatalf("unexpected len: %d, expected %d", other.Len(), exp)
+			}
+			for i := 0; i < tt.n; i++ {
+				if v, ok := other.Get(i); ok != (i%3 == 0) || (ok && v != i) {
+					t.Fatalf("Get(%d)=<%v,%v>", i, v, ok)
+				}
+			}
+			if n := len(mapKeys(other)); n != other.Len() {
+				t.Fatalf("unexpected iterator count: %d", n)
+			}
+
+			// Filtering nothing returns the original map.
+			if same, err := m.ParallelFilter(context.Background(), 4, func(key, value interface{}) (bool, error) {
+				return true, nil
+			}); err != nil || same != m {
+				t.Fatalf("expected same map: %v", err)
+			}
+
+			// Filtering everything returns an empty map.
+			if empty, err := m.ParallelFilter(context.Background(), 4, func(key, value interface{}) (bool, error) {
+				return false, nil
+			}); err != nil || empty.Len() != 0 {
+				t.Fatalf("expected empty map: <%v,%v>", empty.Len(), err)
+			} else if empty = empty.Set(1, 1); empty.Len() != 1 {
+				t.Fatalf("unexpected len: %d", empty.Len())
+			}
+		})
+	}
+}
+
+func BenchmarkMap_ParallelMapValues(b *testing.B) {
+	m := NewMap(nil)
+	for i := 0; i < 100000; i++ {
+		m = m.Set(i, i)
+	}
+	fn := func(key, value interface{}) (interface{}, error) { return value.(int) + 1, nil }
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := m.ParallelMapValues(context.Background(), 0, fn); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func ExampleMap_ParallelFilter() {
+	m := NewMap(nil)
+	for i := 0; i < 1000; i++ {
+		m = m.Set(i, i)
+	}
+
+	m, err := m.ParallelFilter(context.Background(), 4, func(key, value interface{}) (bool, error) {
+		return value.(int)%10 == 0, nil
+	})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Println(m.Len())
+	// Output:
+	// 100
+}
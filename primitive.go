@@ -0,0 +1,440 @@
+package immutable
+
+import (
+	"bytes"
+	"math"
+	"reflect"
+	"time"
+)
+
+// NewHasher returns the built-in hasher for the type of key. Seeded hashers
+// use the same random seed as maps created with a nil hasher. Returns nil if
+// no built-in hasher exists for the type.
+//
+// Built-in hashers exist for all integer types, float32, float64, bool,
+// string, []byte, time.Time, and byte arrays such as [16]byte. Built-in
+// hashers also implement Comparer.
+func NewHasher(key interface{}) Hasher {
+	return defaultHasher(key)
+}
+
+// NewComparer returns the built-in comparer for the type of key. Returns nil
+// if no built-in comparer exists for the type. Built-in comparers exist for the
+// same types as built-in hashers.
+func NewComparer(key interface{}) Comparer {
+	return defaultComparer(key)
+}
+
+// NewByteArrayHasher returns the built-in hasher for byte array keys, such as
+// [16]byte, using the given seed. See NewStringHasher for details about seeding.
+func NewByteArrayHasher(seed uint64) Hasher {
+	return &byteArrayHasher{s: seed, key: newSipKey(seed)}
+}
+
+// signedHasher implements Hasher for int8, int16, int32 & int64 keys.
+type signedHasher struct {
+	signedComparer
+}
+
+// Hash returns a hash for key.
+func (h *signedHasher) Hash(key interface{}) uint32 {
+	return hashUint64(uint64(toInt64(key)))
+}
+
+// Hash64 returns a 64-bit hash for key.
+func (h *signedHasher) Hash64(key interface{}) uint64 {
+	return uint64(toInt64(key))
+}
+
+// Equal returns true if a is equal to b. Otherwise returns false.
+// Panics if a and b are not signed integers.
+func (h *signedHasher) Equal(a, b interface{}) bool {
+	return toInt64(a) == toInt64(b)
+}
+
+// signedComparer compares int8, int16, int32 & int64 values. Implements Comparer.
+type signedComparer struct{}
+
+// Compare returns -1 if a is less than b, returns 1 if a is greater than b, and
+// returns 0 if a is equal to b. Panics if a or b is not a signed integer.
+func (c *signedComparer) Compare(a, b interface{}) int {
+	if i, j := toInt64(a), toInt64(b); i < j {
+		return -1
+	} else if i > j {
+		return 1
+	}
+	return 0
+}
+
+// toInt64 returns v as an int64. Panics if v is not a signed integer.
+func toInt64(v interface{}) int64 {
+	switch v := v.(type) {
+	case int8:
+		return int64(v)
+	case int16:
+		return int64(v)
+	case int32:
+		return int64(v)
+	default:
+		return v.(int64)
+	}
+}
+
+// unsignedHasher implements Hasher for uint, uint8, uint16, uint32, uint64 &
+// uintptr keys.
+type unsignedHasher struct {
+	unsignedComparer
+}
+
+// Hash returns a hash for key.
+func (h *unsignedHasher) Hash(key interface{}) uint32 {
+	return hashUint64(toUint64(key))
+}
+
+// Hash64 returns a 64-bit hash for key.
+func (h *unsignedHasher) Hash64(key interface{}) uint64 {
+	return toUint64(key)
+}
+
+// Equal returns true if a is equal to b. Otherwise returns false.
+// Panics if a and b are not unsigned integers.
+func (h *unsignedHasher) Equal(a, b interface{}) bool {
+	return toUint64(a) == toUint64(b)
+}
+
+// unsignedComparer compares uint, uint8, uint16, uint32, uint64 & uintptr
+// values. Implements Comparer.
+type unsignedComparer struct{}
+
+// Compare returns -1 if a is less than b, returns 1 if a is greater than b, and
+// returns 0 if a is equal to b. Panics if a or b is not an unsigned integer.
+func (c *unsignedComparer) Compare(a, b interface{}) int {
+	if i, j := toUint64(a), toUint64(b); i < j {
+		return -1
+	} else if i > j {
+		return 1
+	}
+	return 0
+}
+
+// toUint64 returns v as a uint64. Panics if v is not an unsigned integer.
+func toUint64(v interface{}) uint64 {
+	switch v := v.(type) {
+	case uint:
+		return uint64(v)
+	case uint8:
+		return uint64(v)
+	case uint16:
+		return uint64(v)
+	case uint32:
+		return uint64(v)
+	case uintptr:
+		return uint64(v)
+	default:
+		return v.(uint64)
+	}
+}
+
+// floatHasher implements Hasher for float32 & float64 keys.
+//
+// Negative zero is equal to positive zero and all NaN values are equal to each
+// other so that a NaN key can be retrieved after it is set.
+type floatHasher struct {
+	floatComparer
+}
+
+// Hash returns a hash for key.
+func (h *floatHasher) Hash(key interface{}) uint32 {
+	return hashUint64(floatBits(toFloat64(key)))
+}
+
+// Hash64 returns a 64-bit hash for key.
+func (h *floatHasher) Hash64(key interface{}) uint64 {
+	return floatBits(toFloat64(key))
+}
+
+// Equal returns true if a is equal to b. Otherwise returns false.
+// Panics if a and b are not floats.
+func (h *floatHasher) Equal(a, b interface{}) bool {
+	return h.Compare(a, b) == 0
+}
+
+// floatComparer compares float32 & float64 values. Implements Comparer.
+//
+// Negative zero is equal to positive zero. NaN values are equal to each other
+// and are less than all other values, including negative infinity.
+type floatComparer struct{}
+
+// Compare returns -1 if a is less than b, returns 1 if a is greater than b, and
+// returns 0 if a is equal to b. Panics if a or b is not a float.
+func (c *floatComparer) Compare(a, b interface{}) int {
+	return compareFloats(toFloat64(a), toFloat64(b))
+}
+
+// compareFloats compares x & y using the ordering described by floatComparer.
+func compareFloats(x, y float64) int {
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	case x == y:
+		return 0
+	}
+
+	// At least one value is NaN.
+	if xnan, ynan := x != x, y != y; xnan && ynan {
+		return 0
+	} else if xnan {
+		return -1
+	}
+	return 1
+}
+
+// toFloat64 returns v as a float64. Panics if v is not a float.
+func toFloat64(v interface{}) float64 {
+	if v, ok := v.(float32); ok {
+		return float64(v)
+	}
+	return v.(float64)
+}
+
+// floatBits returns the bits of f with all NaN values and negative zero
+// replaced by a canonical value so that equal floats have equal bits.
+func floatBits(f float64) uint64 {
+	if f != f {
+		return 0x7ff8000000000001 // canonical NaN
+	} else if f == 0 {
+		return 0 // negative zero
+	}
+	return math.Float64bits(f)
+}
+
+// boolHasher implements Hasher for bool keys.
+type boolHasher struct {
+	boolComparer
+}
+
+// Hash returns a hash for key.
+func (h *boolHasher) Hash(key interface{}) uint32 {
+	if key.(bool) {
+		return 1
+	}
+	return 0
+}
+
+// Hash64 returns a 64-bit hash for key.
+func (h *boolHasher) Hash64(key interface{}) uint64 {
+	return uint64(h.Hash(key))
+}
+
+// Equal returns true if a is equal to b. Otherwise returns false.
+// Panics if a and b are not bools.
+func (h *boolHasher) Equal(a, b interface{}) bool {
+	return a.(bool) == b.(bool)
+}
+
+// boolComparer compares bool values. False is less than true. Implements Comparer.
+type boolComparer struct{}
+
+// Compare returns -1 if a is less than b, returns 1 if a is greater than b, and
+// returns 0 if a is equal to b. Panics if a or b is not a bool.
+func (c *boolComparer) Compare(a, b interface{}) int {
+	if x, y := a.(bool), b.(bool); x == y {
+		return 0
+	} else if y {
+		return -1
+	}
+	return 1
+}
+
+// timeHasher implements Hasher for time.Time keys. Times are equal if they
+// represent the same instant, regardless of location or monotonic clock.
+type timeHasher struct {
+	timeComparer
+}
+
+// Hash returns a hash for key.
+func (h *timeHasher) Hash(key interface{}) uint32 {
+	return hashUint64(timeBits(key.(time.Time)))
+}
+
+// Hash64 returns a 64-bit hash for key.
+func (h *timeHasher) Hash64(key interface{}) uint64 {
+	return timeBits(key.(time.Time))
+}
+
+// Equal returns true if a is equal to b. Otherwise returns false.
+// Panics if a and b are not times.
+func (h *timeHasher) Equal(a, b interface{}) bool {
+	return a.(time.Time).Equal(b.(time.Time))
+}
+
+// timeComparer compares time.Time values. Implements Comparer.
+type timeComparer struct{}
+
+// Compare returns -1 if a is less than b, returns 1 if a is greater than b, and
+// returns 0 if a is equal to b. Panics if a or b is not a time.
+func (c *timeComparer) Compare(a, b interface{}) int {
+	return compareTimes(a.(time.Time), b.(time.Time))
+}
+
+// compareTimes returns -1 if x is before y, returns 1 if x is after y, and
+// returns 0 if they represent the same instant.
+func compareTimes(x, y time.Time) int {
+	if x.Before(y) {
+		return -1
+	} else if x.After(y) {
+		return 1
+	}
+	return 0
+}
+
+// timeBits returns a 64-bit value identifying the instant of t.
+func timeBits(t time.Time) uint64 {
+	return uint64(t.Unix())*1000000007 + uint64(t.Nanosecond())
+}
+
+// byteArrayHasher implements Hasher for byte array keys using seeded SipHash.
+type byteArrayHasher struct {
+	byteArrayComparer
+	s   uint64
+	key sipKey
+}
+
+// Hash returns a hash for key.
+func (h *byteArrayHasher) Hash(key interface{}) uint32 {
+	return fold64(h.Hash64(key))
+}
+
+// Hash64 returns a 64-bit hash for key. Arrays are hashed without allocating.
+func (h *byteArrayHasher) Hash64(key interface{}) uint64 {
+	switch key := key.(type) {
+	case [16]byte:
+		return h.key.hashBytes64(key[:])
+	case [20]byte:
+		return h.key.hashBytes64(key[:])
+	case [32]byte:
+		return h.key.hashBytes64(key[:])
+	case [64]byte:
+		return h.key.hashBytes64(key[:])
+	default:
+		return sipHash24Array(h.key.k0, h.key.k1, byteArrayValue(key))
+	}
+}
+
+// Equal returns true if a is equal to b. Otherwise returns false.
+func (h *byteArrayHasher) Equal(a, b interface{}) bool {
+	return a == b
+}
+
+// seed returns the seed used to create the hasher.
+func (h *byteArrayHasher) seed() uint64 { return h.s }
+
+// byteArrayComparer compares byte arrays. Implements Comparer.
+type byteArrayComparer struct{}
+
+// Compare returns -1 if a is less than b, returns 1 if a is greater than b, and
+// returns 0 if a is equal to b. Panics if a or b is not a byte array.
+func (c *byteArrayComparer) Compare(a, b interface{}) int {
+	switch x := a.(type) {
+	case [16]byte:
+		if y, ok := b.([16]byte); ok {
+			return bytes.Compare(x[:], y[:])
+		}
+	case [20]byte:
+		if y, ok := b.([20]byte); ok {
+			return bytes.Compare(x[:], y[:])
+		}
+	case [32]byte:
+		if y, ok := b.([32]byte); ok {
+			return bytes.Compare(x[:], y[:])
+		}
+	case [64]byte:
+		if y, ok := b.([64]byte); ok {
+			return bytes.Compare(x[:], y[:])
+		}
+	}
+	return compareByteArrays(a, b)
+}
+
+// compareByteArrays compares byte arrays of any size element by element so
+// that no copy of either array is allocated. Panics if a or b is not a byte
+// array.
+func compareByteArrays(a, b interface{}) int {
+	if !isByteArray(a) || !isByteArray(b) {
+		panic("immutable: byte array expected")
+	}
+	x, y := reflect.ValueOf(a), reflect.ValueOf(b)
+	for i := 0; i < x.Len() && i < y.Len(); i++ {
+		if u, v := x.Index(i).Uint(), y.Index(i).Uint(); u < v {
+			return -1
+		} else if u > v {
+			return 1
+		}
+	}
+	if x.Len() < y.Len() {
+		return -1
+	} else if x.Len() > y.Len() {
+		return 1
+	}
+	return 0
+}
+
+// byteType is the reflection type of a byte.
+var byteType = reflect.TypeOf(byte(0))
+
+// isByteArray returns true if v is an array of bytes, such as [16]byte.
+func isByteArray(v interface{}) bool {
+	t := reflect.TypeOf(v)
+	return t != nil && t.Kind() == reflect.Array && t.Elem() == byteType
+}
+
+// byteArrayValue returns the reflection value of a byte array.
+// Panics if v is not a byte array.
+func byteArrayValue(v interface{}) reflect.Value {
+	if !isByteArray(v) {
+		panic("immutable: byte array expected")
+	}
+	return reflect.ValueOf(v)
+}
+
+// sipHash24Array returns the SipHash-2-4 of the contents of byte array v. It
+// is equal to sipHash24 of the same bytes but reads each byte through v so
+// that no copy of the array is allocated.
+func sipHash24Array(k0, k1 uint64, v reflect.Value) uint64 {
+	v0 := k0 ^ 0x736f6d6570736575
+	v1 := k1 ^ 0x646f72616e646f6d
+	v2 := k0 ^ 0x6c7967656e657261
+	v3 := k1 ^ 0x7465646279746573
+
+	// Compress each full 8-byte word.
+	n, i := v.Len(), 0
+	for ; n-i >= 8; i += 8 {
+		var m uint64
+		for j := 0; j < 8; j++ {
+			m |= v.Index(i+j).Uint() << (8 * uint(j))
+		}
+		v3 ^= m
+		v0, v1, v2, v3 = sipRound(v0, v1, v2, v3)
+		v0, v1, v2, v3 = sipRound(v0, v1, v2, v3)
+		v0 ^= m
+	}
+
+	// Compress the remaining bytes along with the message length.
+	m := uint64(n) << 56
+	for j := 0; i+j < n; j++ {
+		m |= v.Index(i+j).Uint() << (8 * uint(j))
+	}
+	v3 ^= m
+	v0, v1, v2, v3 = sipRound(v0, v1, v2, v3)
+	v0, v1, v2, v3 = sipRound(v0, v1, v2, v3)
+	v0 ^= m
+
+	// Finalize.
+	v2 ^= 0xff
+	for i := 0; i < 4; i++ {
+		v0, v1, v2, v3 = sipRound(v0, v1, v2, v3)
+	}
+	return v0 ^ v1 ^ v2 ^ v3
+}
@@ -0,0 +1,201 @@
+package immutable
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Ensure all built-in key types can be used without an explicit hasher or
+// comparer and that keys are stored, found, and sorted correctly.
+func TestBuiltinKeyTypes(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		keys []interface{} // in sorted order
+	}{
+		{"int8", []interface{}{int8(math.MinInt8), int8(-1), int8(0), int8(math.MaxInt8)}},
+		{"int16", []interface{}{int16(math.MinInt16), int16(-1), int16(0), int16(math.MaxInt16)}},
+		{"int32", []interface{}{int32(math.MinInt32), int32(-1), int32(0), int32(math.MaxInt32)}},
+		{"rune", []interface{}{'a', 'b', 'z'}},
+		{"int64", []interface{}{int64(math.MinInt64), int64(-1), int64(0), int64(math.MaxInt64)}},
+		{"uint", []interface{}{uint(0), uint(1), uint(math.MaxUint32)}},
+		{"uint8", []interface{}{uint8(0), uint8(1), uint8(math.MaxUint8)}},
+		{"uint16", []interface{}{uint16(0), uint16(1), uint16(math.MaxUint16)}},
+		{"uint32", []interface{}{uint32(0), uint32(1), uint32(math.MaxUint32)}},
+		{"uint64", []interface{}{uint64(0), uint64(1), uint64(math.MaxUint64)}},
+		{"uintptr", []interface{}{uintptr(0), uintptr(1), uintptr(100)}},
+		{"float32", []interface{}{float32(math.NaN()), float32(math.Inf(-1)), float32(-1.5), float32(0), float32(1.5), float32(math.Inf(1))}},
+		{"float64", []interface{}{math.NaN(), math.Inf(-1), -1.5, 0.0, 1.5, math.MaxFloat64, math.Inf(1)}},
+		{"bool", []interface{}{false, true}},
+		{"time", []interface{}{time.Unix(0, 0), time.Unix(0, 1), time.Unix(1, 0), time.Unix(1<<40, 0)}},
+		{"[4]byte", []interface{}{[4]byte{0, 0, 0, 1}, [4]byte{0, 1, 0, 0}, [4]byte{1, 0, 0, 0}}},
+		{"[16]byte", []interface{}{[16]byte{}, [16]byte{15: 1}, [16]byte{1}}},
+		{"[20]byte", []interface{}{[20]byte{}, [20]byte{19: 1}, [20]byte{1}}},
+		{"[32]byte", []interface{}{[32]byte{}, [32]byte{1}, [32]byte{2}}},
+		{"[64]byte", []interface{}{[64]byte{}, [64]byte{63: 1}, [64]byte{1}}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			m, sm := NewMap(nil), NewSortedMap(nil)
+			for i := len(tt.keys) - 1; i >= 0; i-- {
+				m, sm = m.Set(tt.keys[i], i), sm.Set(tt.keys[i], i)
+			}
+			if m.Len() != len(tt.keys) || sm.Len() != len(tt.keys) {
+				t.Fatalf("unexpected len: %d, %d", m.Len(), sm.Len())
+			}
+
+			for i, k := range tt.keys {
+				if v, ok := m.Get(k); !ok || v != i {
+					t.Fatalf("Map.Get(%v)=<%v,%v>", k, v, ok)
+				} else if v, ok := sm.Get(k); !ok || v != i {
+					t.Fatalf("SortedMap.Get(%v)=<%v,%v>", k, v, ok)
+				}
+			}
+
+			i := 0
+			for itr := sm.Iterator(); !itr.Done(); i++ {
+				if _, v := itr.Next(); v != i {
+					t.Fatalf("unexpected value at %d: %v", i, v)
+				}
+			}
+		})
+	}
+}
+
+func TestFloatHasher(t *testing.T) {
+	h := NewHasher(0.0)
+	if !h.Equal(math.Copysign(0, -1), 0.0) {
+		t.Fatal("expected -0 to equal 0")
+	} else if h.Hash(math.Copysign(0, -1)) != h.Hash(0.0) {
+		t.Fatal("expected -0 & 0 to have equal hashes")
+	} else if !h.Equal(math.NaN(), -math.NaN()) {
+		t.Fatal("expected NaN values to be equal")
+	} else if h.Hash(math.NaN()) != h.Hash(math.Float64frombits(0x7ff8000000000042)) {
+		t.Fatal("expected NaN values to have equal hashes")
+	} else if h.Equal(math.NaN(), 0.0) {
+		t.Fatal("expected NaN not to equal 0")
+	}
+
+	m := NewMap(nil).Set(math.NaN(), "nan").Set(math.Copysign(0, -1), "zero")
+	if v, _ := m.Get(math.NaN()); v != "nan" {
+		t.Fatalf("unexpected NaN value: %v", v)
+	} else if v, _ := m.Get(0.0); v != "zero" {
+		t.Fatalf("unexpected zero value: %v", v)
+	} else if m = m.Set(math.NaN(), "other"); m.Len() != 2 {
+		t.Fatalf("unexpected len: %d", m.Len())
+	}
+}
+
+func TestTimeHasher(t *testing.T) {
+	utc := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	local := utc.In(time.FixedZone("EST", -5*60*60))
+
+	h := NewHasher(utc)
+	if !h.Equal(utc, local) {
+		t.Fatal("expected equal times")
+	} else if h.Hash(utc) != h.Hash(local) {
+		t.Fatal("expected equal hashes")
+	} else if v, ok := NewMap(nil).Set(utc, 1).Get(local); !ok || v != 1 {
+		t.Fatalf("unexpected value: <%v,%v>", v, ok)
+	}
+}
+
+func TestNewHasher(t *testing.T) {
+	for _, key := range []interface{}{struct{}{}, []int{}, [4]int{}, nil} {
+		if h := NewHasher(key); h != nil {
+			t.Fatalf("unexpected hasher for %T: %T", key, h)
+		} else if c := NewComparer(key); c != nil {
+			t.Fatalf("unexpected comparer for %T: %T", key, c)
+		}
+	}
+
+	// Built-in hashers also implement Comparer.
+	for _, key := range []interface{}{1, int8(1), uint(1), 1.0, true, "a", []byte("a"), time.Time{}, [16]byte{}} {
+		if _, ok := NewHasher(key).(Comparer); !ok {
+			t.Fatalf("expected hasher for %T to implement Comparer", key)
+		}
+	}
+
+	// Byte array hashers are seeded.
+	if NewByteArrayHasher(0).Hash([16]byte{1}) == NewByteArrayHasher(1).Hash([16]byte{1}) {
+		t.Fatal("expected different hash for different seed")
+	}
+
+	// Arrays of any size hash the same as their bytes.
+	h := NewByteArrayHasher(0).(*byteArrayHasher)
+	for _, key := range []interface{}{[0]byte{}, [3]byte{1, 2, 3}, [8]byte{1}, [16]byte{2}, [24]byte{23: 3}} {
+		if got, exp := h.Hash64(key), h.key.hashBytes64(byteArraySlice(key)); got != exp {
+			t.Fatalf("Hash64(%v)=%d, expected %d", key, got, exp)
+		}
+	}
+}
+
+// byteArraySlice returns a copy of the contents of a byte array.
+func byteArraySlice(v interface{}) []byte {
+	rv := reflect.ValueOf(v)
+	buf := make([]byte, rv.Len())
+	reflect.Copy(reflect.ValueOf(buf), rv)
+	return buf
+}
+
+func BenchmarkByteArrayHasher_Hash(b *testing.B) {
+	for _, tt := range []struct {
+		name string
+		key  interface{}
+	}{
+		{"16", [16]byte{1, 2, 3, 4}},
+		{"24", [24]byte{1, 2, 3, 4}},
+	} {
+		b.Run(tt.name, func(b *testing.B) {
+			h := NewByteArrayHasher(0)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				h.Hash(tt.key)
+			}
+		})
+	}
+}
+
+func BenchmarkByteArrayComparer_Compare(b *testing.B) {
+	for _, tt := range []struct {
+		name string
+		a, b interface{}
+	}{
+		{"16", [16]byte{1, 2, 3, 4}, [16]byte{1, 2, 3, 5}},
+		{"32", [32]byte{1, 2, 3, 4}, [32]byte{1, 2, 3, 5}},
+		{"24", [24]byte{1, 2, 3, 4}, [24]byte{1, 2, 3, 5}},
+	} {
+		b.Run(tt.name, func(b *testing.B) {
+			c := NewComparer(tt.a)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				c.Compare(tt.a, tt.b)
+			}
+		})
+	}
+}
+
+func ExampleNewComparer() {
+	m := NewSortedMap(nil)
+	m = m.Set(1.5, "b")
+	m = m.Set(math.Inf(-1), "a")
+	m = m.Set(math.Inf(1), "c")
+
+	for itr := m.Iterator(); !itr.Done(); {
+		k, v := itr.Next()
+		fmt.Println(k, v)
+	}
+
+	// Built-in comparers can also be used directly.
+	fmt.Println(NewComparer(uint8(0)).Compare(uint8(1), uint8(2)))
+	// Output:
+	// -Inf a
+	// 1.5 b
+	// +Inf c
+	// -1
+}
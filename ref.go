@@ -0,0 +1,259 @@
+package immutable
+
+import (
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+// Ref represents a mutable reference to an immutable value, such as a *Map,
+// *SortedMap, or *List. It allows goroutines to publish new versions of a
+// collection without a mutex. Readers always see a complete version and
+// writers are serialized by atomic compare-and-swap operations.
+//
+// The zero value of Ref is a reference to a nil value and is ready to use.
+type Ref struct {
+	// id is accessed atomically so it must be the first field to be 64-bit
+	// aligned on 32-bit platforms.
+	id uint64         // lazily assigned identifier, used to order locking
+	p  unsafe.Pointer // *refBox, current version
+
+	mu       sync.Mutex    // protects watchers
+	watchers []*refWatcher // subscribers to new versions
+}
+
+// NewRef returns a new instance of Ref that references value.
+func NewRef(value interface{}) *Ref {
+	return &Ref{p: unsafe.Pointer(&refBox{value: value})}
+}
+
+// Load returns the current value of the reference.
+func (r *Ref) Load() interface{} {
+	return r.load().value
+}
+
+// Swap sets the reference to value and returns the previous value.
+func (r *Ref) Swap(value interface{}) (old interface{}) {
+	for {
+		box := r.loadCommitted()
+		if r.publish(box, value) {
+			return box.value
+		}
+	}
+}
+
+// CompareAndSwap sets the reference to new only if it currently references
+// old. Returns true if the swap occurred. The old value must be comparable,
+// which is always true for pointers to collections.
+func (r *Ref) CompareAndSwap(old, new interface{}) bool {
+	for {
+		box := r.loadCommitted()
+		if box.value != old {
+			return false
+		} else if r.publish(box, new) {
+			return true
+		}
+	}
+}
+
+// Update sets the reference to the value returned by fn and returns that
+// value. The fn function is passed the current value and is called again with
+// the latest value if another writer updates the reference in the meantime,
+// so it should not have side effects.
+func (r *Ref) Update(fn func(old interface{}) interface{}) interface{} {
+	for {
+		box := r.loadCommitted()
+		value := fn(box.value)
+		if r.publish(box, value) {
+			return value
+		}
+	}
+}
+
+// Watch returns a channel that receives each new version of the value that is
+// published after the call and a function to stop watching. The stop function
+// closes the channel and must be called to release the watcher.
+//
+// The size sets the channel's buffer size and policy determines what occurs
+// when the buffer is full. Versions are always delivered in publish order but
+// a watcher may skip intermediate versions if several are published at once.
+func (r *Ref) Watch(size int, policy WatchPolicy) (ch <-chan interface{}, stop func()) {
+	// Dropping policies require a buffer to drop from.
+	if size < 1 && policy != WatchBlock {
+		size = 1
+	}
+
+	w := &refWatcher{
+		ch:     make(chan interface{}, size),
+		policy: policy,
+		done:   make(chan struct{}),
+	}
+
+	// Read the version under the lock so a version published concurrently is
+	// either already current or is delivered by notify() after registration.
+	r.mu.Lock()
+	w.version = r.load().version
+	r.watchers = append(r.watchers, w)
+	r.mu.Unlock()
+
+	var once sync.Once
+	return w.ch, func() {
+		once.Do(func() { r.unwatch(w) })
+	}
+}
+
+// unwatch removes w from the list of watchers and closes its channel.
+func (r *Ref) unwatch(w *refWatcher) {
+	// Release any blocked send before acquiring the lock.
+	close(w.done)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i := range r.watchers {
+		if r.watchers[i] == w {
+			r.watchers = append(r.watchers[:i], r.watchers[i+1:]...)
+			break
+		}
+	}
+	close(w.ch)
+}
+
+// load returns the current box. Returns emptyRefBox if no value has been set.
+func (r *Ref) load() *refBox {
+	if p := atomic.LoadPointer(&r.p); p != nil {
+		return (*refBox)(p)
+	}
+	return emptyRefBox
+}
+
+// loadCommitted returns the current box. If a transaction is committing to
+// the reference then it waits until the commit completes.
+func (r *Ref) loadCommitted() *refBox {
+	for {
+		box := r.load()
+		if box.owner == nil {
+			return box
+		}
+		<-box.released
+	}
+}
+
+// ident returns the unique identifier for the reference, assigning one if needed.
+func (r *Ref) ident() uint64 {
+	if id := atomic.LoadUint64(&r.id); id != 0 {
+		return id
+	}
+	atomic.CompareAndSwapUint64(&r.id, 0, atomic.AddUint64(&refSeq, 1))
+	return atomic.LoadUint64(&r.id)
+}
+
+// refSeq is the last identifier assigned to a Ref.
+var refSeq uint64
+
+// publish atomically replaces box with a new box containing value and notifies
+// watchers. Returns false if box is no longer the current box.
+func (r *Ref) publish(box *refBox, value interface{}) bool {
+	next := &refBox{value: value, version: box.version + 1}
+	if !r.cas(box, next) {
+		return false
+	}
+	r.notify(next)
+	return true
+}
+
+// cas swaps the current box from old to new. The emptyRefBox returned by
+// load() matches a reference that has never been set.
+func (r *Ref) cas(old, new *refBox) bool {
+	if old == emptyRefBox && atomic.CompareAndSwapPointer(&r.p, nil, unsafe.Pointer(new)) {
+		return true
+	}
+	return atomic.CompareAndSwapPointer(&r.p, unsafe.Pointer(old), unsafe.Pointer(new))
+}
+
+// notify sends the value of box to every watcher that has not yet received
+// an equal or newer version.
+func (r *Ref) notify(box *refBox) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, w := range r.watchers {
+		if box.version <= w.version {
+			continue
+		}
+		w.version = box.version
+		w.send(box.value)
+	}
+}
+
+// refBox holds a single version of a Ref's value.
+//
+// While a transaction commits, the reference holds a locked copy of the
+// current box which is owned by the transaction and points to the original.
+type refBox struct {
+	value   interface{}
+	version uint64 // incremented on each publish
+
+	owner    *Tx           // committing transaction, if locked
+	prev     *refBox       // original box, if locked
+	released chan struct{} // closed when the lock is released, if locked
+}
+
+// emptyRefBox represents the box of a Ref that has never been set.
+var emptyRefBox = &refBox{}
+
+// WatchPolicy determines how a Ref delivers a new version to a watcher whose
+// channel buffer is full.
+type WatchPolicy int
+
+const (
+	// WatchDropOldest discards the oldest buffered version to make room.
+	WatchDropOldest WatchPolicy = iota
+
+	// WatchDropNewest discards the new version.
+	WatchDropNewest
+
+	// WatchBlock waits until the watcher receives the new version. Writers
+	// are blocked until delivery completes so watchers must receive promptly.
+	WatchBlock
+)
+
+// refWatcher represents a subscriber to a Ref.
+type refWatcher struct {
+	ch      chan interface{}
+	policy  WatchPolicy
+	done    chan struct{} // closed when the watcher is stopped
+	version uint64        // last version sent
+}
+
+// send delivers value to the watcher's channel based on its policy.
+func (w *refWatcher) send(value interface{}) {
+	switch w.policy {
+	case WatchDropNewest:
+		select {
+		case w.ch <- value:
+		default:
+		}
+
+	case WatchBlock:
+		select {
+		case w.ch <- value:
+		case <-w.done:
+		}
+
+	default:
+		for {
+			select {
+			case w.ch <- value:
+				return
+			default:
+			}
+
+			// Buffer is full so discard the oldest version and retry.
+			select {
+			case <-w.ch:
+			default:
+			}
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package immutable
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestRef(t *testing.T) {
+	t.Run("Zero", func(t *testing.T) {
+		var r Ref
+		if v := r.Load(); v != nil {
+			t.Fatalf("unexpected value: %v", v)
+		} else if !r.CompareAndSwap(nil, "foo") {
+			t.Fatal("expected swap")
+		} else if v := r.Load(); v != "foo" {
+			t.Fatalf("unexpected value: %v", v)
+		}
+	})
+
+	t.Run("Swap", func(t *testing.T) {
+		r := NewRef("foo")
+		if old := r.Swap("bar"); old != "foo" {
+			t.Fatalf("unexpected old value: %v", old)
+		} else if v := r.Load(); v != "bar" {
+			t.Fatalf("unexpected value: %v", v)
+		}
+	})
+
+	t.Run("CompareAndSwap", func(t *testing.T) {
+		m0 := NewMap(nil).Set("a", 1)
+		m1 := m0.Set("b", 2)
+		r := NewRef(m0)
+		if r.CompareAndSwap(m1, m1) {
+			t.Fatal("expected no swap")
+		} else if v := r.Load(); v != m0 {
+			t.Fatalf("unexpected value: %v", v)
+		} else if !r.CompareAndSwap(m0, m1) {
+			t.Fatal("expected swap")
+		} else if v := r.Load(); v != m1 {
+			t.Fatalf("unexpected value: %v", v)
+		}
+	})
+
+	// Ensure concurrent updates retry on conflict and no update is lost.
+	t.Run("Update", func(t *testing.T) {
+		const n, workers = 1000, 8
+		r := NewRef(NewMap(nil))
+
+		var wg sync.WaitGroup
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for j := 0; j < n; j++ {
+					r.Update(func(old interface{}) interface{} {
+						return old.(*Map).Set(i*n+j, j)
+					})
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		if got, exp := r.Load().(*Map).Len(), n*workers; got != exp {
+			t.Fatalf("Len()=%d, expected %d", got, exp)
+		}
+	})
+}
+
+func TestRef_Watch(t *testing.T) {
+	t.Run("DropOldest", func(t *testing.T) {
+		r := NewRef(0)
+		ch, stop := r.Watch(2, WatchDropOldest)
+		for i := 1; i <= 5; i++ {
+			r.Swap(i)
+		}
+		stop()
+
+		var a []interface{}
+		for v := range ch {
+			a = append(a, v)
+		}
+		if got, exp := fmt.Sprint(a), "[4 5]"; got != exp {
+			t.Fatalf("received %s, expected %s", got, exp)
+		}
+	})
+
+	t.Run("DropNewest", func(t *testing.T) {
+		r := NewRef(0)
+		ch, stop := r.Watch(2, WatchDropNewest)
+		for i := 1; i <= 5; i++ {
+			r.Swap(i)
+		}
+		stop()
+
+		var a []interface{}
+		for v := range ch {
+			a = append(a, v)
+		}
+		if got, exp := fmt.Sprint(a), "[1 2]"; got != exp {
+			t.Fatalf("received %s, expected %s", got, exp)
+		}
+	})
+
+	t.Run("Block", func(t *testing.T) {
+		const n = 100
+		r := NewRef(0)
+		ch, stop := r.Watch(0, WatchBlock)
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := 1; i <= n; i++ {
+				r.Swap(i)
+			}
+		}()
+
+		for i := 1; i <= n; i++ {
+			if v := <-ch; v != i {
+				t.Fatalf("received %v, expected %d", v, i)
+			}
+		}
+		<-done
+		stop()
+	})
+
+	// Ensure a stopped watcher does not block writers.
+	t.Run("StopBlocked", func(t *testing.T) {
+		r := NewRef(0)
+		_, stop := r.Watch(0, WatchBlock)
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			r.Swap(1)
+		}()
+
+		stop()
+		<-done
+		r.Swap(2)
+	})
+
+	t.Run("NoChange", func(t *testing.T) {
+		r := NewRef(0)
+		ch, stop := r.Watch(1, WatchDropOldest)
+		r.CompareAndSwap(100, 1)
+		stop()
+
+		if v, ok := <-ch; ok {
+			t.Fatalf("unexpected value: %v", v)
+		}
+	})
+}
+
+func BenchmarkRef_Update(b *testing.B) {
+	r := NewRef(NewMap(nil))
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		var i int
+		for pb.Next() {
+			r.Update(func(old interface{}) interface{} {
+				return old.(*Map).Set(i%1000, i)
+			})
+			i++
+		}
+	})
+}
+
+func ExampleRef_Update() {
+	r := NewRef(NewMap(nil))
+	r.Update(func(old interface{}) interface{} {
+		return old.(*Map).Set("foo", "bar")
+	})
+
+	v, ok := r.Load().(*Map).Get("foo")
+	fmt.Println(v, ok)
+	// Output:
+	// bar true
+}
@@ -0,0 +1,338 @@
+package immutable
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+// NewReflectHasher returns a hasher for keys of any type composed of structs,
+// arrays, slices, pointers, and the primitive types supported by NewHasher.
+// It uses a random seed. See NewStringHasher for details about seeding.
+//
+// Struct keys are hashed & compared by their fields, including unexported
+// fields, in declaration order. Fields tagged with `immutable:"-"` are
+// ignored. Pointers are compared by the values they point to and a nil
+// pointer is less than any other pointer. Values must not contain cycles.
+//
+// The hasher also implements Comparer using the same ordering as
+// NewReflectComparer. Panics when used with an unsupported key type, such as
+// a map, channel, function, or interface.
+func NewReflectHasher() Hasher {
+	return NewReflectHasherWithSeed(newHasherSeed())
+}
+
+// NewReflectHasherWithSeed returns a hasher like NewReflectHasher that uses the
+// given seed. A fixed seed is required to decode a map that was encoded with
+// a reflection-based hasher.
+func NewReflectHasherWithSeed(seed uint64) Hasher {
+	return &reflectHasher{s: seed, key: newSipKey(seed)}
+}
+
+// NewReflectComparer returns a comparer for keys of any type supported by
+// NewReflectHasher. Values are compared lexicographically, field by field for
+// structs and element by element for arrays & slices. A shorter slice is less
+// than a longer slice with the same prefix.
+func NewReflectComparer() Comparer {
+	return &reflectComparer{}
+}
+
+// reflectHasher implements Hasher using a per-type plan built by reflection.
+type reflectHasher struct {
+	reflectComparer
+	s   uint64
+	key sipKey
+}
+
+// Hash returns a hash for key.
+func (h *reflectHasher) Hash(key interface{}) uint32 {
+	return fold64(h.Hash64(key))
+}
+
+// Hash64 returns a 64-bit hash for key.
+func (h *reflectHasher) Hash64(key interface{}) uint64 {
+	v := reflect.ValueOf(key)
+	p := reflectPlanOf(v.Type())
+	return p.hash(h.key.k0, h.key, p.value(v))
+}
+
+// Equal returns true if a is equal to b. Otherwise returns false.
+func (h *reflectHasher) Equal(a, b interface{}) bool {
+	return h.Compare(a, b) == 0
+}
+
+// seed returns the seed used to create the hasher.
+func (h *reflectHasher) seed() uint64 { return h.s }
+
+// reflectComparer implements Comparer using a per-type plan built by reflection.
+type reflectComparer struct{}
+
+// Compare returns -1 if a is less than b, returns 1 if a is greater than b, and
+// returns 0 if a is equal to b. Panics if a and b are different types.
+func (c *reflectComparer) Compare(a, b interface{}) int {
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	if va.Type() != vb.Type() {
+		panic(fmt.Sprintf("immutable: cannot compare %T and %T", a, b))
+	}
+	p := reflectPlanOf(va.Type())
+	return p.compare(p.value(va), p.value(vb))
+}
+
+// reflectPlan holds the functions used to hash & compare values of one type.
+// Plans for nested types are referenced by pointer so recursive types work.
+type reflectPlan struct {
+	hash    func(h uint64, key sipKey, v reflect.Value) uint64
+	compare func(a, b reflect.Value) int
+	addr    bool // values must be addressable, set on cached plans only
+}
+
+// value returns v in the form expected by the plan. Values are copied when
+// the plan reads a time from an unexported field, which requires an address.
+func (p *reflectPlan) value(v reflect.Value) reflect.Value {
+	if !p.addr {
+		return v
+	}
+	other := reflect.New(v.Type()).Elem()
+	other.Set(v)
+	return other
+}
+
+// reflectPlans caches plans by type.
+var reflectPlans sync.Map // map[reflect.Type]*reflectPlan
+
+// timeType is the reflection type of time.Time.
+var timeType = reflect.TypeOf(time.Time{})
+
+// reflectPlanOf returns the cached plan for t, building it if needed.
+func reflectPlanOf(t reflect.Type) *reflectPlan {
+	if p, ok := reflectPlans.Load(t); ok {
+		return p.(*reflectPlan)
+	}
+	p := *buildReflectPlan(t, make(map[reflect.Type]*reflectPlan))
+	p.addr = reflectNeedsAddr(t, true)
+	other, _ := reflectPlans.LoadOrStore(t, &p)
+	return other.(*reflectPlan)
+}
+
+// reflectNeedsAddr returns true if a value of type t contains a time that is
+// only reachable through unexported fields. Such times cannot be read with
+// Interface so they are read through their address instead. Elements of
+// pointers & slices are always addressable so they are not checked.
+func reflectNeedsAddr(t reflect.Type, exported bool) bool {
+	switch {
+	case t == timeType:
+		return !exported
+	case t.Kind() == reflect.Array:
+		return reflectNeedsAddr(t.Elem(), exported)
+	case t.Kind() == reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			if f := t.Field(i); f.Tag.Get("immutable") != "-" && reflectNeedsAddr(f.Type, exported && f.PkgPath == "") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// reflectTime returns the time held by v. Times in unexported fields cannot be
+// read with Interface so they are read from v's address.
+func reflectTime(v reflect.Value) time.Time {
+	if v.CanInterface() {
+		return v.Interface().(time.Time)
+	}
+	return *(*time.Time)(unsafe.Pointer(v.UnsafeAddr()))
+}
+
+// buildReflectPlan returns a plan for t. Plans that are in progress are stored
+// in building so that recursive types reference the same plan.
+func buildReflectPlan(t reflect.Type, building map[reflect.Type]*reflectPlan) *reflectPlan {
+	if p := building[t]; p != nil {
+		return p
+	}
+	p := &reflectPlan{}
+	building[t] = p
+
+	switch t.Kind() {
+	case reflect.Bool:
+		p.hash = func(h uint64, key sipKey, v reflect.Value) uint64 {
+			if v.Bool() {
+				return mixHash(h, 1)
+			}
+			return mixHash(h, 0)
+		}
+		p.compare = func(a, b reflect.Value) int {
+			if x, y := a.Bool(), b.Bool(); x == y {
+				return 0
+			} else if y {
+				return -1
+			}
+			return 1
+		}
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		p.hash = func(h uint64, key sipKey, v reflect.Value) uint64 {
+			return mixHash(h, uint64(v.Int()))
+		}
+		p.compare = func(a, b reflect.Value) int {
+			if x, y := a.Int(), b.Int(); x < y {
+				return -1
+			} else if x > y {
+				return 1
+			}
+			return 0
+		}
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		p.hash = func(h uint64, key sipKey, v reflect.Value) uint64 {
+			return mixHash(h, v.Uint())
+		}
+		p.compare = func(a, b reflect.Value) int {
+			if x, y := a.Uint(), b.Uint(); x < y {
+				return -1
+			} else if x > y {
+				return 1
+			}
+			return 0
+		}
+
+	case reflect.Float32, reflect.Float64:
+		p.hash = func(h uint64, key sipKey, v reflect.Value) uint64 {
+			return mixHash(h, floatBits(v.Float()))
+		}
+		p.compare = func(a, b reflect.Value) int {
+			return compareFloats(a.Float(), b.Float())
+		}
+
+	case reflect.String:
+		p.hash = func(h uint64, key sipKey, v reflect.Value) uint64 {
+			return mixHash(h, sipHash24(key.k0, key.k1, v.String()))
+		}
+		p.compare = func(a, b reflect.Value) int {
+			return strings.Compare(a.String(), b.String())
+		}
+
+	case reflect.Array:
+		elem := buildReflectPlan(t.Elem(), building)
+		p.hash = func(h uint64, key sipKey, v reflect.Value) uint64 {
+			for i := 0; i < v.Len(); i++ {
+				h = elem.hash(h, key, v.Index(i))
+			}
+			return h
+		}
+		p.compare = func(a, b reflect.Value) int {
+			for i := 0; i < a.Len(); i++ {
+				if cmp := elem.compare(a.Index(i), b.Index(i)); cmp != 0 {
+					return cmp
+				}
+			}
+			return 0
+		}
+
+	case reflect.Slice:
+		// Byte slices are hashed & compared as a whole.
+		if t.Elem().Kind() == reflect.Uint8 {
+			p.hash = func(h uint64, key sipKey, v reflect.Value) uint64 {
+				return mixHash(h, sipHash24(key.k0, key.k1, bytesToString(v.Bytes())))
+			}
+			p.compare = func(a, b reflect.Value) int {
+				return bytes.Compare(a.Bytes(), b.Bytes())
+			}
+			break
+		}
+
+		elem := buildReflectPlan(t.Elem(), building)
+		p.hash = func(h uint64, key sipKey, v reflect.Value) uint64 {
+			h = mixHash(h, uint64(v.Len()))
+			for i := 0; i < v.Len(); i++ {
+				h = elem.hash(h, key, v.Index(i))
+			}
+			return h
+		}
+		p.compare = func(a, b reflect.Value) int {
+			for i := 0; i < a.Len() && i < b.Len(); i++ {
+				if cmp := elem.compare(a.Index(i), b.Index(i)); cmp != 0 {
+					return cmp
+				}
+			}
+			if a.Len() < b.Len() {
+				return -1
+			} else if a.Len() > b.Len() {
+				return 1
+			}
+			return 0
+		}
+
+	case reflect.Ptr:
+		elem := buildReflectPlan(t.Elem(), building)
+		p.hash = func(h uint64, key sipKey, v reflect.Value) uint64 {
+			if v.IsNil() {
+				return mixHash(h, 0)
+			}
+			return elem.hash(mixHash(h, 1), key, v.Elem())
+		}
+		p.compare = func(a, b reflect.Value) int {
+			if a.IsNil() || b.IsNil() {
+				if a.IsNil() && b.IsNil() {
+					return 0
+				} else if a.IsNil() {
+					return -1
+				}
+				return 1
+			} else if a.Pointer() == b.Pointer() {
+				return 0
+			}
+			return elem.compare(a.Elem(), b.Elem())
+		}
+
+	case reflect.Struct:
+		// Times are compared by instant, like the built-in time hasher.
+		if t == timeType {
+			p.hash = func(h uint64, key sipKey, v reflect.Value) uint64 {
+				return mixHash(h, timeBits(reflectTime(v)))
+			}
+			p.compare = func(a, b reflect.Value) int {
+				return compareTimes(reflectTime(a), reflectTime(b))
+			}
+			break
+		}
+
+		type field struct {
+			index int
+			plan  *reflectPlan
+		}
+		var fields []field
+		for i := 0; i < t.NumField(); i++ {
+			if f := t.Field(i); f.Tag.Get("immutable") != "-" {
+				fields = append(fields, field{index: i, plan: buildReflectPlan(f.Type, building)})
+			}
+		}
+
+		p.hash = func(h uint64, key sipKey, v reflect.Value) uint64 {
+			for _, f := range fields {
+				h = f.plan.hash(h, key, v.Field(f.index))
+			}
+			return h
+		}
+		p.compare = func(a, b reflect.Value) int {
+			for _, f := range fields {
+				if cmp := f.plan.compare(a.Field(f.index), b.Field(f.index)); cmp != 0 {
+					return cmp
+				}
+			}
+			return 0
+		}
+
+	default:
+		panic(fmt.Sprintf("immutable: unsupported reflect key type %s", t))
+	}
+	return p
+}
+
+// mixHash combines the hash h with the value x.
+func mixHash(h, x uint64) uint64 {
+	return splitmix64(h ^ x)
+}
@@ -0,0 +1,184 @@
+package immutable
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+type reflectTestKey struct {
+	TenantID string
+	UserID   int64
+	Comment  string `immutable:"-"`
+	private  int
+}
+
+func TestReflectHasher(t *testing.T) {
+	h := NewReflectHasherWithSeed(0)
+	a := reflectTestKey{TenantID: "foo", UserID: 1, Comment: "a", private: 1}
+	b := reflectTestKey{TenantID: "foo", UserID: 1, Comment: "b", private: 1}
+	c := reflectTestKey{TenantID: "foo", UserID: 2}
+
+	if !h.Equal(a, b) {
+		t.Fatal("expected ignored fields to be excluded")
+	} else if h.Hash(a) != h.Hash(b) {
+		t.Fatal("expected equal hashes")
+	} else if h.Equal(a, c) {
+		t.Fatal("expected not equal")
+	} else if h.Hash(a) == NewReflectHasherWithSeed(1).Hash(a) {
+		t.Fatal("expected different hash for different seed")
+	}
+
+	t.Run("Map", func(t *testing.T) {
+		m := NewMap(NewReflectHasher())
+		for i := 0; i < 1000; i++ {
+			m = m.Set(reflectTestKey{TenantID: fmt.Sprint(i % 10), UserID: int64(i)}, i)
+		}
+		if m.Len() != 1000 {
+			t.Fatalf("unexpected len: %d", m.Len())
+		}
+		for i := 0; i < 1000; i++ {
+			if v, ok := m.Get(reflectTestKey{TenantID: fmt.Sprint(i % 10), UserID: int64(i)}); !ok || v != i {
+				t.Fatalf("unexpected value for %d: <%v,%v>", i, v, ok)
+			}
+		}
+	})
+
+	t.Run("Composite", func(t *testing.T) {
+		type key struct {
+			Name  *string
+			IDs   [2]uint16
+			Tags  []string
+			Data  []byte
+			Time  time.Time
+			Score float64
+			Next  *key
+		}
+		s0, s1 := "foo", "foo"
+		ts := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+		a := key{Name: &s0, IDs: [2]uint16{1, 2}, Tags: []string{"x"}, Data: []byte("y"), Time: ts, Next: &key{Score: 1}}
+		b := key{Name: &s1, IDs: [2]uint16{1, 2}, Tags: []string{"x"}, Data: []byte("y"), Time: ts.In(time.FixedZone("EST", -5*60*60)), Next: &key{Score: 1}}
+		if !h.Equal(a, b) {
+			t.Fatal("expected equal")
+		} else if h.Hash(a) != h.Hash(b) {
+			t.Fatal("expected equal hashes")
+		}
+
+		b.Next.Score = 2
+		if h.Equal(a, b) {
+			t.Fatal("expected not equal")
+		} else if b.Next = nil; h.Equal(a, b) {
+			t.Fatal("expected not equal to nil pointer")
+		}
+	})
+
+	t.Run("Unexported", func(t *testing.T) {
+		type key struct {
+			tenant string
+			id     int64
+			ts     time.Time
+		}
+		ts := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+		m := NewMap(NewReflectHasher())
+		for i := 0; i < 1000; i++ {
+			m = m.Set(key{tenant: fmt.Sprint(i % 10), id: int64(i), ts: ts}, i)
+		}
+		if m.Len() != 1000 {
+			t.Fatalf("unexpected len: %d", m.Len())
+		}
+		for i := 0; i < 1000; i++ {
+			if v, ok := m.Get(key{tenant: fmt.Sprint(i % 10), id: int64(i), ts: ts}); !ok || v != i {
+				t.Fatalf("unexpected value for %d: <%v,%v>", i, v, ok)
+			}
+		}
+
+		a, b := key{tenant: "foo", ts: ts}, key{tenant: "foo", ts: ts.In(time.FixedZone("EST", -5*60*60))}
+		if !h.Equal(a, b) {
+			t.Fatal("expected equal")
+		} else if h.Hash(a) != h.Hash(b) {
+			t.Fatal("expected equal hashes")
+		} else if b.ts = ts.Add(1); h.Equal(a, b) {
+			t.Fatal("expected not equal")
+		} else if c := NewReflectComparer(); c.Compare(a, b) != -1 || c.Compare(key{id: 2}, key{id: 1}) != 1 {
+			t.Fatal("unexpected comparison")
+		}
+	})
+
+	t.Run("ErrUnsupportedType", func(t *testing.T) {
+		var r interface{}
+		func() {
+			defer func() { r = recover() }()
+			h.Hash(struct{ M map[string]int }{})
+		}()
+		if r != `immutable: unsupported reflect key type map[string]int` {
+			t.Fatalf("unexpected panic: %v", r)
+		}
+	})
+}
+
+func TestReflectComparer(t *testing.T) {
+	c := NewReflectComparer()
+	for _, tt := range []struct {
+		a, b interface{}
+		exp  int
+	}{
+		{reflectTestKey{TenantID: "a", UserID: 2}, reflectTestKey{TenantID: "b", UserID: 1}, -1},
+		{reflectTestKey{TenantID: "b", UserID: 1}, reflectTestKey{TenantID: "b", UserID: 2}, -1},
+		{reflectTestKey{TenantID: "b", UserID: 2}, reflectTestKey{TenantID: "b", UserID: 1}, 1},
+		{reflectTestKey{Comment: "a"}, reflectTestKey{Comment: "b"}, 0},
+		{[]int{1, 2}, []int{1, 2, 3}, -1},
+		{[]int{1, 3}, []int{1, 2, 3}, 1},
+		{(*int)(nil), new(int), -1},
+		{[2]bool{true, false}, [2]bool{true, true}, -1},
+	} {
+		if got := c.Compare(tt.a, tt.b); got != tt.exp {
+			t.Fatalf("Compare(%v, %v)=%d, expected %d", tt.a, tt.b, got, tt.exp)
+		}
+	}
+
+	RunRandom(t, "SortedMap", func(t *testing.T, rand *rand.Rand) {
+		m := NewSortedMap(NewReflectComparer())
+		for i := 0; i < 1000; i++ {
+			m = m.Set(reflectTestKey{TenantID: fmt.Sprint(rand.Intn(10)), UserID: rand.Int63n(100)}, i)
+		}
+
+		var prev *reflectTestKey
+		for itr := m.Iterator(); !itr.Done(); {
+			k, _ := itr.Next()
+			key := k.(reflectTestKey)
+			if prev != nil && (prev.TenantID > key.TenantID || (prev.TenantID == key.TenantID && prev.UserID >= key.UserID)) {
+				t.Fatalf("out of order: %v, %v", *prev, key)
+			}
+			prev = &key
+		}
+	})
+}
+
+func BenchmarkReflectHasher_Hash(b *testing.B) {
+	h := NewReflectHasher()
+	key := reflectTestKey{TenantID: "foo", UserID: 100}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		h.Hash(key)
+	}
+}
+
+func ExampleNewReflectHasher() {
+	type key struct {
+		TenantID string
+		UserID   int64
+	}
+
+	m := NewMap(NewReflectHasher())
+	m = m.Set(key{"acme", 1}, "jane")
+	m = m.Set(key{"acme", 2}, "susy")
+
+	v, _ := m.Get(key{"acme", 2})
+	fmt.Println(v)
+	// Output:
+	// susy
+}
@@ -0,0 +1,178 @@
+package immutable
+
+// Seq represents a lazy sequence of key/value pairs. Sequences over lists use
+// the element index as the key. Values are only computed as Next() is called
+// so adapters can be chained without building intermediate collections.
+//
+// A Seq can only be consumed once.
+type Seq interface {
+	// Returns the next key/value pair. Returns false for ok once the sequence
+	// is exhausted.
+	Next() (key, value interface{}, ok bool)
+}
+
+// SeqFunc is an adapter to allow the use of an ordinary function as a Seq.
+type SeqFunc func() (key, value interface{}, ok bool)
+
+// Next returns f().
+func (f SeqFunc) Next() (key, value interface{}, ok bool) {
+	return f()
+}
+
+// Seq returns a sequence of the list's elements in order. Keys are indexes.
+func (l *List) Seq() Seq {
+	itr := l.Iterator()
+	return SeqFunc(func() (key, value interface{}, ok bool) {
+		if itr.Done() {
+			return nil, nil, false
+		}
+		index, value := itr.Next()
+		return index, value, true
+	})
+}
+
+// Seq returns a sequence of the map's key/value pairs in iteration order.
+func (m *Map) Seq() Seq {
+	itr := m.Iterator()
+	return SeqFunc(func() (key, value interface{}, ok bool) {
+		if itr.Done() {
+			return nil, nil, false
+		}
+		key, value = itr.Next()
+		return key, value, true
+	})
+}
+
+// Seq returns a sequence of the map's key/value pairs in key order.
+func (m *SortedMap) Seq() Seq {
+	itr := m.Iterator()
+	return SeqFunc(func() (key, value interface{}, ok bool) {
+		if itr.Done() {
+			return nil, nil, false
+		}
+		key, value = itr.Next()
+		return key, value, true
+	})
+}
+
+// MapSeq returns a sequence with each value of s replaced by fn. Keys are
+// unchanged.
+func MapSeq(s Seq, fn func(key, value interface{}) interface{}) Seq {
+	return SeqFunc(func() (key, value interface{}, ok bool) {
+		if key, value, ok = s.Next(); !ok {
+			return nil, nil, false
+		}
+		return key, fn(key, value), true
+	})
+}
+
+// FilterSeq returns a sequence of the pairs of s for which fn returns true.
+func FilterSeq(s Seq, fn func(key, value interface{}) bool) Seq {
+	return SeqFunc(func() (key, value interface{}, ok bool) {
+		for {
+			if key, value, ok = s.Next(); !ok || fn(key, value) {
+				return key, value, ok
+			}
+		}
+	})
+}
+
+// TakeSeq returns a sequence of the first n pairs of s. The pairs of s after
+// the first n are never read.
+func TakeSeq(s Seq, n int) Seq {
+	return SeqFunc(func() (key, value interface{}, ok bool) {
+		if n <= 0 {
+			return nil, nil, false
+		}
+		n--
+		return s.Next()
+	})
+}
+
+// DropSeq returns a sequence of the pairs of s after the first n. The skipped
+// pairs are read when the first pair is requested.
+func DropSeq(s Seq, n int) Seq {
+	return SeqFunc(func() (key, value interface{}, ok bool) {
+		for ; n > 0; n-- {
+			if _, _, ok := s.Next(); !ok {
+				return nil, nil, false
+			}
+		}
+		return s.Next()
+	})
+}
+
+// ZipSeq returns a sequence that pairs the values of a and b. The key of each
+// pair is a value from a and its value is the value from b at the same
+// position. The sequence ends when either a or b ends.
+func ZipSeq(a, b Seq) Seq {
+	return SeqFunc(func() (key, value interface{}, ok bool) {
+		if _, key, ok = a.Next(); !ok {
+			return nil, nil, false
+		} else if _, value, ok = b.Next(); !ok {
+			return nil, nil, false
+		}
+		return key, value, true
+	})
+}
+
+// ChunkSeq returns a sequence that groups the pairs of s into chunks of up to
+// size pairs. The key of each chunk is its position, starting from zero, and
+// its value is a []MapEntry. Only the last chunk may be smaller than size.
+// Panics if size is less than one.
+func ChunkSeq(s Seq, size int) Seq {
+	if size < 1 {
+		panic("immutable.ChunkSeq: size must be positive")
+	}
+
+	var index int
+	return SeqFunc(func() (key, value interface{}, ok bool) {
+		var chunk []MapEntry
+		for len(chunk) < size {
+			k, v, ok := s.Next()
+			if !ok {
+				break
+			}
+			chunk = append(chunk, MapEntry{Key: k, Value: v})
+		}
+		if len(chunk) == 0 {
+			return nil, nil, false
+		}
+
+		index++
+		return index - 1, chunk, true
+	})
+}
+
+// CollectList returns a list of the values of s in order. Keys are ignored.
+// The list is built directly from its leaf nodes.
+func CollectList(s Seq) *List {
+	var b listBuilder
+	for _, value, ok := s.Next(); ok; _, value, ok = s.Next() {
+		b.append(value)
+	}
+	return b.list()
+}
+
+// CollectMap returns a map of the pairs of s. If a key appears more than once
+// then the last value wins. The pairs are applied to the map in a single batch
+// using SetMany. If hasher is nil then a default hasher is chosen based on the
+// first key.
+func CollectMap(s Seq, hasher Hasher) *Map {
+	var entries []MapEntry
+	for key, value, ok := s.Next(); ok; key, value, ok = s.Next() {
+		entries = append(entries, MapEntry{Key: key, Value: value})
+	}
+	return NewMap(hasher).SetMany(entries)
+}
+
+// CollectSortedMap returns a sorted map of the pairs of s. If a key appears
+// more than once then the last value wins. If comparer is nil then a default
+// comparer is chosen based on the first key.
+func CollectSortedMap(s Seq, comparer Comparer) *SortedMap {
+	m := NewSortedMap(comparer)
+	for key, value, ok := s.Next(); ok; key, value, ok = s.Next() {
+		m = m.Set(key, value)
+	}
+	return m
+}
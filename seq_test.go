@@ -0,0 +1,217 @@
+package immutable
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// seqPairs returns the pairs of s as a slice.
+func seqPairs(s Seq) []MapEntry {
+	var a []MapEntry
+	for key, value, ok := s.Next(); ok; key, value, ok = s.Next() {
+		a = append(a, MapEntry{Key: key, Value: value})
+	}
+	return a
+}
+
+// countingSeq returns a sequence of the integers [0,n) that counts the number
+// of pairs read.
+func countingSeq(n int, reads *int) Seq {
+	var i int
+	return SeqFunc(func() (key, value interface{}, ok bool) {
+		if i >= n {
+			return nil, nil, false
+		}
+		i, *reads = i+1, *reads+1
+		return i - 1, i - 1, true
+	})
+}
+
+func TestSeq(t *testing.T) {
+	t.Run("List", func(t *testing.T) {
+		l := NewList().Append("foo").Append("bar")
+		if got, exp := seqPairs(l.Seq()), []MapEntry{{0, "foo"}, {1, "bar"}}; !reflect.DeepEqual(got, exp) {
+			t.Fatalf("unexpected pairs: %v", got)
+		} else if got := seqPairs(NewList().Seq()); len(got) != 0 {
+			t.Fatalf("unexpected pairs: %v", got)
+		}
+	})
+
+	t.Run("Map", func(t *testing.T) {
+		m := NewMap(nil).Set("foo", 1).Set("bar", 2)
+		got := seqPairs(m.Seq())
+		if len(got) != 2 {
+			t.Fatalf("unexpected pairs: %v", got)
+		}
+		for _, e := range got {
+			if v, ok := m.Get(e.Key); !ok || v != e.Value {
+				t.Fatalf("unexpected pair: %v", e)
+			}
+		}
+		if got := seqPairs(NewMap(nil).Seq()); len(got) != 0 {
+			t.Fatalf("unexpected pairs: %v", got)
+		}
+	})
+
+	t.Run("SortedMap", func(t *testing.T) {
+		m := NewSortedMap(nil).Set("foo", 1).Set("bar", 2)
+		if got, exp := seqPairs(m.Seq()), []MapEntry{{"bar", 2}, {"foo", 1}}; !reflect.DeepEqual(got, exp) {
+			t.Fatalf("unexpected pairs: %v", got)
+		}
+	})
+}
+
+func TestMapSeq(t *testing.T) {
+	var reads int
+	s := MapSeq(countingSeq(5, &reads), func(key, value interface{}) interface{} { return value.(int) * 10 })
+	if reads != 0 {
+		t.Fatal("expected lazy evaluation")
+	} else if got, exp := seqPairs(s), []MapEntry{{0, 0}, {1, 10}, {2, 20}, {3, 30}, {4, 40}}; !reflect.DeepEqual(got, exp) {
+		t.Fatalf("unexpected pairs: %v", got)
+	}
+}
+
+func TestFilterSeq(t *testing.T) {
+	var reads int
+	s := FilterSeq(countingSeq(10, &reads), func(key, value interface{}) bool { return value.(int)%3 == 0 })
+	if got, exp := seqPairs(s), []MapEntry{{0, 0}, {3, 3}, {6, 6}, {9, 9}}; !reflect.DeepEqual(got, exp) {
+		t.Fatalf("unexpected pairs: %v", got)
+	}
+}
+
+func TestTakeSeq(t *testing.T) {
+	var reads int
+	if got, exp := seqPairs(TakeSeq(countingSeq(100, &reads), 3)), []MapEntry{{0, 0}, {1, 1}, {2, 2}}; !reflect.DeepEqual(got, exp) {
+		t.Fatalf("unexpected pairs: %v", got)
+	} else if reads != 3 {
+		t.Fatalf("unexpected reads: %d", reads)
+	} else if got := seqPairs(TakeSeq(countingSeq(2, &reads), 5)); len(got) != 2 {
+		t.Fatalf("unexpected pairs: %v", got)
+	} else if got := seqPairs(TakeSeq(countingSeq(2, &reads), 0)); len(got) != 0 {
+		t.Fatalf("unexpected pairs: %v", got)
+	}
+}
+
+func TestDropSeq(t *testing.T) {
+	var reads int
+	if got, exp := seqPairs(DropSeq(countingSeq(5, &reads), 3)), []MapEntry{{3, 3}, {4, 4}}; !reflect.DeepEqual(got, exp) {
+		t.Fatalf("unexpected pairs: %v", got)
+	} else if got := seqPairs(DropSeq(countingSeq(2, &reads), 5)); len(got) != 0 {
+		t.Fatalf("unexpected pairs: %v", got)
+	}
+}
+
+func TestZipSeq(t *testing.T) {
+	keys := NewList().Append("foo").Append("bar").Append("baz")
+	values := NewList().Append(1).Append(2)
+	if got, exp := seqPairs(ZipSeq(keys.Seq(), values.Seq())), []MapEntry{{"foo", 1}, {"bar", 2}}; !reflect.DeepEqual(got, exp) {
+		t.Fatalf("unexpected pairs: %v", got)
+	}
+}
+
+func TestChunkSeq(t *testing.T) {
+	var reads int
+	got := seqPairs(ChunkSeq(countingSeq(5, &reads), 2))
+	exp := []MapEntry{
+		{0, []MapEntry{{0, 0}, {1, 1}}},
+		{1, []MapEntry{{2, 2}, {3, 3}}},
+		{2, []MapEntry{{4, 4}}},
+	}
+	if !reflect.DeepEqual(got, exp) {
+		t.Fatalf("unexpected pairs: %v", got)
+	}
+
+	t.Run("ErrInvalidSize", func(t *testing.T) {
+		var r string
+		func() {
+			defer func() { r = recover().(string) }()
+			ChunkSeq(countingSeq(5, &reads), 0)
+		}()
+		if r != `immutable.ChunkSeq: size must be positive` {
+			t.Fatalf("unexpected panic: %q", r)
+		}
+	})
+}
+
+func TestCollectList(t *testing.T) {
+	for _, n := range []int{0, 1, 32, 33, 1025, 40000} {
+		t.Run(fmt.Sprint(n), func(t *testing.T) {
+			var reads int
+			l := CollectList(countingSeq(n, &reads))
+			if l.Len() != n {
+				t.Fatalf("unexpected len: %d", l.Len())
+			}
+			for i := 0; i < n; i++ {
+				if v := l.Get(i); v != i {
+					t.Fatalf("Get(%d)=%v", i, v)
+				}
+			}
+			if l = l.Append(n); l.Get(n) != n {
+				t.Fatal("unexpected value after append")
+			}
+		})
+	}
+}
+
+func TestCollectMap(t *testing.T) {
+	var reads int
+	m := CollectMap(MapSeq(countingSeq(1000, &reads), func(key, value interface{}) interface{} {
+		return value.(int) * 2
+	}), nil)
+	if m.Len() != 1000 {
+		t.Fatalf("unexpected len: %d", m.Len())
+	}
+	for i := 0; i < 1000; i++ {
+		if v, ok := m.Get(i); !ok || v != i*2 {
+			t.Fatalf("Get(%d)=<%v,%v>", i, v, ok)
+		}
+	}
+	if m := CollectMap(countingSeq(0, &reads), nil); m.Len() != 0 {
+		t.Fatalf("unexpected len: %d", m.Len())
+	}
+}
+
+func TestCollectSortedMap(t *testing.T) {
+	l := NewList().Append("c").Append("a").Append("b")
+	m := CollectSortedMap(ZipSeq(l.Seq(), l.Seq()), nil)
+	if got, exp := seqPairs(m.Seq()), []MapEntry{{"a", "a"}, {"b", "b"}, {"c", "c"}}; !reflect.DeepEqual(got, exp) {
+		t.Fatalf("unexpected pairs: %v", got)
+	}
+}
+
+func BenchmarkSeq_Pipeline(b *testing.B) {
+	l := NewList()
+	for i := 0; i < 10000; i++ {
+		l = l.Append(i)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		s := FilterSeq(l.Seq(), func(key, value interface{}) bool { return value.(int)%2 == 0 })
+		s = MapSeq(s, func(key, value interface{}) interface{} { return value.(int) + 1 })
+		CollectList(TakeSeq(s, 1000))
+	}
+}
+
+func ExampleFilterSeq() {
+	l := NewList()
+	for i := 0; i < 100; i++ {
+		l = l.Append(i)
+	}
+
+	// Build a list of the first three squares of odd numbers.
+	s := FilterSeq(l.Seq(), func(key, value interface{}) bool { return value.(int)%2 == 1 })
+	s = MapSeq(s, func(key, value interface{}) interface{} { return value.(int) * value.(int) })
+	l = CollectList(TakeSeq(s, 3))
+
+	for itr := l.Iterator(); !itr.Done(); {
+		_, v := itr.Next()
+		fmt.Println(v)
+	}
+	// Output:
+	// 1
+	// 9
+	// 25
+}
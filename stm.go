@@ -0,0 +1,164 @@
+package immutable
+
+import (
+	"sort"
+)
+
+// Atomically executes fn within a transaction and commits all values set
+// through the transaction as a single atomic change across every Ref.
+//
+// If another writer changes a Ref that the transaction read before the
+// transaction commits, the commit fails and fn is executed again with a new
+// transaction. Because fn may be executed multiple times and may observe
+// values from an attempt that is later retried, it should not have side
+// effects outside of the transaction.
+//
+// If fn returns an error then none of its writes are applied and the error
+// is returned from Atomically.
+func Atomically(fn func(tx *Tx) error) error {
+	for {
+		tx := &Tx{
+			reads:  make(map[*Ref]*refBox),
+			writes: make(map[*Ref]interface{}),
+		}
+		if err := fn(tx); err != nil {
+			return err
+		} else if tx.commit() {
+			return nil
+		}
+
+		// Wait for a conflicting commit to finish before retrying.
+		if tx.conflict != nil {
+			<-tx.conflict.released
+		}
+	}
+}
+
+// Tx represents a transaction over one or more Refs. Transactions are created
+// by Atomically and must not be used after fn returns.
+type Tx struct {
+	reads  map[*Ref]*refBox     // box observed on first read
+	writes map[*Ref]interface{} // pending values
+
+	conflict *refBox // box locked by another transaction, if validation failed
+}
+
+// Get returns the value of r as seen by the transaction. This includes any
+// value previously set on r within the transaction.
+func (tx *Tx) Get(r *Ref) interface{} {
+	if value, ok := tx.writes[r]; ok {
+		return value
+	} else if box, ok := tx.reads[r]; ok {
+		return box.value
+	}
+
+	// Record the committed box so it can be validated on commit. If another
+	// transaction is mid-commit then its original box is still current.
+	box := r.load()
+	if box.owner != nil {
+		box = box.prev
+	}
+	tx.reads[r] = box
+	return box.value
+}
+
+// Set sets the value of r within the transaction. The value is not visible
+// outside of the transaction until it commits.
+func (tx *Tx) Set(r *Ref, value interface{}) {
+	tx.writes[r] = value
+}
+
+// commit locks every written Ref, verifies that no Ref read by the
+// transaction has changed, and then publishes all written values.
+// Returns false if a conflict occurred and no values were published.
+func (tx *Tx) commit() bool {
+	if len(tx.writes) == 0 {
+		return tx.validate()
+	}
+
+	// Lock refs in a consistent order so concurrent commits cannot deadlock.
+	refs := make([]*Ref, 0, len(tx.writes))
+	for r := range tx.writes {
+		refs = append(refs, r)
+	}
+	sort.Slice(refs, func(i, j int) bool { return refs[i].ident() < refs[j].ident() })
+
+	locked := make([]*refBox, 0, len(refs))
+	for _, r := range refs {
+		box := tx.lock(r)
+		if box == nil {
+			tx.unlock(refs[:len(locked)], locked)
+			return false
+		}
+		locked = append(locked, box)
+	}
+
+	// Ensure refs that were only read have not changed.
+	if !tx.validate() {
+		tx.unlock(refs, locked)
+		return false
+	}
+
+	// Publish all values and then notify watchers once every ref is updated.
+	boxes := make([]*refBox, len(refs))
+	for i, r := range refs {
+		boxes[i] = &refBox{value: tx.writes[r], version: locked[i].version + 1}
+		r.cas(locked[i], boxes[i])
+		close(locked[i].released)
+	}
+	for i, r := range refs {
+		r.notify(boxes[i])
+	}
+	return true
+}
+
+// lock replaces the current box of r with a box owned by the transaction.
+// Returns nil if r has changed since it was read by the transaction.
+func (tx *Tx) lock(r *Ref) *refBox {
+	for {
+		box := r.load()
+		if box.owner != nil {
+			<-box.released // wait for other transaction to finish
+			continue
+		} else if read, ok := tx.reads[r]; ok && read != box {
+			return nil
+		}
+
+		locked := &refBox{value: box.value, version: box.version, owner: tx, prev: box, released: make(chan struct{})}
+		if r.cas(box, locked) {
+			return locked
+		}
+	}
+}
+
+// unlock restores the original boxes for refs locked by the transaction.
+func (tx *Tx) unlock(refs []*Ref, locked []*refBox) {
+	for i, r := range refs {
+		r.cas(locked[i], locked[i].prev)
+		close(locked[i].released)
+	}
+}
+
+// validate returns true if every ref read, but not written, by the transaction
+// still holds the box that was read.
+//
+// A ref that is locked by another committing transaction fails validation even
+// if its value has not changed yet. The other transaction may itself have read
+// a ref written by this transaction so allowing both to commit would not be
+// serializable. The locked box is recorded so the retry can wait for it.
+func (tx *Tx) validate() bool {
+	for r, read := range tx.reads {
+		if _, ok := tx.writes[r]; ok {
+			continue
+		}
+
+		box := r.load()
+		if box.owner != nil {
+			tx.conflict = box
+			return false
+		} else if box != read {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,263 @@
+package immutable
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+)
+
+func TestAtomically(t *testing.T) {
+	t.Run("Simple", func(t *testing.T) {
+		users, index := NewRef(NewMap(nil)), NewRef(NewSortedMap(nil))
+		if err := Atomically(func(tx *Tx) error {
+			tx.Set(users, tx.Get(users).(*Map).Set(1, "jane"))
+			tx.Set(index, tx.Get(index).(*SortedMap).Set("jane", 1))
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		if v, ok := users.Load().(*Map).Get(1); !ok || v != "jane" {
+			t.Fatalf("unexpected user: <%v,%v>", v, ok)
+		} else if v, ok := index.Load().(*SortedMap).Get("jane"); !ok || v != 1 {
+			t.Fatalf("unexpected index: <%v,%v>", v, ok)
+		}
+	})
+
+	t.Run("ReadOwnWrite", func(t *testing.T) {
+		r := NewRef(NewList())
+		if err := Atomically(func(tx *Tx) error {
+			tx.Set(r, tx.Get(r).(*List).Append("foo"))
+			tx.Set(r, tx.Get(r).(*List).Append("bar"))
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		} else if n := r.Load().(*List).Len(); n != 2 {
+			t.Fatalf("unexpected len: %d", n)
+		}
+	})
+
+	t.Run("ZeroRef", func(t *testing.T) {
+		var r Ref
+		if err := Atomically(func(tx *Tx) error {
+			if v := tx.Get(&r); v != nil {
+				return fmt.Errorf("unexpected value: %v", v)
+			}
+			tx.Set(&r, "foo")
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		} else if v := r.Load(); v != "foo" {
+			t.Fatalf("unexpected value: %v", v)
+		}
+	})
+
+	t.Run("Error", func(t *testing.T) {
+		r := NewRef("foo")
+		errMarker := errors.New("marker")
+		if err := Atomically(func(tx *Tx) error {
+			tx.Set(r, "bar")
+			return errMarker
+		}); err != errMarker {
+			t.Fatalf("unexpected error: %v", err)
+		} else if v := r.Load(); v != "foo" {
+			t.Fatalf("unexpected value: %v", v)
+		}
+	})
+
+	// Ensure a transaction retries if a ref it read changes before commit.
+	t.Run("Conflict", func(t *testing.T) {
+		a, b := NewRef(1), NewRef(0)
+
+		var attempts int
+		if err := Atomically(func(tx *Tx) error {
+			attempts++
+			v := tx.Get(a).(int)
+			if attempts == 1 {
+				a.Swap(100) // concurrent writer
+			}
+			tx.Set(b, v)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		if attempts != 2 {
+			t.Fatalf("unexpected attempts: %d", attempts)
+		} else if v := b.Load(); v != 100 {
+			t.Fatalf("unexpected value: %v", v)
+		}
+	})
+
+	// Ensure a ref locked by another committing transaction fails validation.
+	// Otherwise two transactions that each read the ref written by the other
+	// could both commit.
+	t.Run("WriteSkewLocked", func(t *testing.T) {
+		a, b := NewRef(0), NewRef(0)
+		tx1 := &Tx{reads: make(map[*Ref]*refBox), writes: make(map[*Ref]interface{})}
+		tx2 := &Tx{reads: make(map[*Ref]*refBox), writes: make(map[*Ref]interface{})}
+		tx1.Set(b, tx1.Get(a).(int)+1)
+		tx2.Set(a, tx2.Get(b).(int)+1)
+
+		// Lock each transaction's write before either validates.
+		lockedB, lockedA := tx1.lock(b), tx2.lock(a)
+		if lockedA == nil || lockedB == nil {
+			t.Fatal("expected lock")
+		} else if tx1.validate() {
+			t.Fatal("expected tx1 validation failure")
+		} else if tx2.validate() {
+			t.Fatal("expected tx2 validation failure")
+		}
+		tx1.unlock([]*Ref{b}, []*refBox{lockedB})
+		tx2.unlock([]*Ref{a}, []*refBox{lockedA})
+
+		if a.Load() != 0 || b.Load() != 0 {
+			t.Fatalf("unexpected values: %v %v", a.Load(), b.Load())
+		}
+	})
+
+	// Ensure two concurrent transactions that each read the ref written by the
+	// other commit in a serializable order.
+	t.Run("WriteSkew", func(t *testing.T) {
+		for i := 0; i < 1000; i++ {
+			a, b := NewRef(0), NewRef(0)
+
+			// Both transactions read before either commits on the first attempt.
+			var ready sync.WaitGroup
+			ready.Add(2)
+			crossed := func(from, to *Ref) func(tx *Tx) error {
+				first := true
+				return func(tx *Tx) error {
+					v := tx.Get(from).(int)
+					if first {
+						first = false
+						ready.Done()
+						ready.Wait()
+					}
+					tx.Set(to, v+1)
+					return nil
+				}
+			}
+
+			var wg sync.WaitGroup
+			for _, fn := range []func(tx *Tx) error{crossed(a, b), crossed(b, a)} {
+				wg.Add(1)
+				go func(fn func(tx *Tx) error) {
+					defer wg.Done()
+					if err := Atomically(fn); err != nil {
+						t.Error(err)
+					}
+				}(fn)
+			}
+			wg.Wait()
+
+			// A serial order yields <2,1> or <1,2>.
+			if got := fmt.Sprint(a.Load(), b.Load()); got != "2 1" && got != "1 2" {
+				t.Fatalf("non-serializable result: %s", got)
+			}
+		}
+	})
+
+	t.Run("Watch", func(t *testing.T) {
+		r := NewRef(0)
+		ch, stop := r.Watch(1, WatchDropOldest)
+		if err := Atomically(func(tx *Tx) error {
+			tx.Set(r, 1)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		stop()
+
+		if v := <-ch; v != 1 {
+			t.Fatalf("unexpected value: %v", v)
+		}
+	})
+
+	// Ensure concurrent transfers between accounts never lose or create money.
+	t.Run("Transfer", func(t *testing.T) {
+		const accounts, workers, n = 5, 8, 500
+
+		refs := make([]*Ref, accounts)
+		for i := range refs {
+			refs[i] = NewRef(100)
+		}
+
+		var wg sync.WaitGroup
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func(seed int64) {
+				defer wg.Done()
+				rand := rand.New(rand.NewSource(seed))
+				for j := 0; j < n; j++ {
+					from, to := refs[rand.Intn(accounts)], refs[rand.Intn(accounts)]
+					if from == to {
+						continue
+					}
+
+					if err := Atomically(func(tx *Tx) error {
+						tx.Set(from, tx.Get(from).(int)-1)
+						tx.Set(to, tx.Get(to).(int)+1)
+						return nil
+					}); err != nil {
+						t.Error(err)
+						return
+					}
+
+					// Non-transactional writers must wait for commits to finish.
+					if j%10 == 0 {
+						from.Update(func(old interface{}) interface{} { return old.(int) })
+					}
+				}
+			}(int64(i))
+		}
+
+		// Read totals concurrently and ensure each snapshot is consistent.
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := 0; i < 100; i++ {
+				var total int
+				if err := Atomically(func(tx *Tx) error {
+					total = 0
+					for _, r := range refs {
+						total += tx.Get(r).(int)
+					}
+					return nil
+				}); err != nil {
+					t.Error(err)
+				} else if total != accounts*100 {
+					t.Errorf("inconsistent snapshot total: %d", total)
+				}
+			}
+		}()
+
+		wg.Wait()
+		<-done
+
+		var total int
+		for _, r := range refs {
+			total += r.Load().(int)
+		}
+		if total != accounts*100 {
+			t.Fatalf("unexpected total: %d", total)
+		}
+	})
+}
+
+func ExampleAtomically() {
+	users := NewRef(NewMap(nil))
+	index := NewRef(NewSortedMap(nil))
+
+	Atomically(func(tx *Tx) error {
+		tx.Set(users, tx.Get(users).(*Map).Set(1, "jane"))
+		tx.Set(index, tx.Get(index).(*SortedMap).Set("jane", 1))
+		return nil
+	})
+
+	fmt.Println(users.Load().(*Map).Len(), index.Load().(*SortedMap).Len())
+	// Output:
+	// 1 1
+}
@@ -0,0 +1,615 @@
+package immutable
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// SyncResolver returns the value to keep for a key that has a different value
+// in the local and remote replica. It should be deterministic and symmetric so
+// that the same value is chosen regardless of which replica is local.
+type SyncResolver func(key, local, remote interface{}) interface{}
+
+// syncThreshold is the number of keys in a range at or below which entries are
+// transferred instead of splitting the range further.
+const syncThreshold = sortedMapNodeSize
+
+// maxSyncFrameSize is the largest frame accepted from a remote replica,
+// including its type byte. Larger messages are split into continuation frames.
+const maxSyncFrameSize = 16 << 20
+
+// Sync message types.
+const (
+	syncMsgHello = iota + 1
+	syncMsgSummaries
+	syncMsgEntries
+	syncMsgPut
+	syncMsgDone
+	syncMsgError
+	syncMsgContinue
+)
+
+// Sync reconciles local with a remote replica that is concurrently calling
+// Sync on the other end of conn. It returns a new map that contains every key
+// from both replicas. Both replicas return maps with the same contents once
+// Sync completes successfully.
+//
+// Replicas exchange digests of key ranges and only recurse into ranges whose
+// digests differ, so the amount of data exchanged is proportional to the size
+// of the difference rather than the size of the maps. One replica is chosen to
+// lead the exchange and its resolver settles keys with conflicting values.
+//
+// Sync is a merge, so a key deleted from one replica is restored from the
+// other. Keys and values are transferred using DefaultCodec. Returns an error
+// if resolve is nil.
+func Sync(local *SortedMap, conn io.ReadWriter, resolve SyncResolver) (*SortedMap, error) {
+	if resolve == nil {
+		return nil, errors.New("immutable.Sync: resolver required")
+	}
+
+	s := &syncSession{
+		local:   local,
+		r:       bufio.NewReader(conn),
+		w:       conn,
+		resolve: resolve,
+	}
+	leader, err := s.handshake()
+	if err != nil {
+		return nil, err
+	}
+
+	if leader {
+		err = s.lead()
+	} else {
+		err = s.follow()
+	}
+
+	// Notify the remote replica so it does not wait for a reply.
+	if err != nil {
+		if _, ok := err.(*syncRemoteError); !ok {
+			s.abort(err)
+		}
+		return nil, err
+	}
+	return s.local, nil
+}
+
+// syncRemoteError represents an error reported by the remote replica.
+type syncRemoteError struct {
+	msg string
+}
+
+// Error returns the error message.
+func (e *syncRemoteError) Error() string {
+	return "immutable.Sync: remote error: " + e.msg
+}
+
+// syncRange represents a half-open key range [lo, hi). A nil bound is unbounded.
+type syncRange struct {
+	lo, hi interface{}
+}
+
+// syncSession represents one side of a sync exchange.
+type syncSession struct {
+	local   *SortedMap
+	r       *bufio.Reader
+	w       io.Writer
+	resolve SyncResolver
+}
+
+// handshake exchanges random nonces with the remote replica to elect a leader.
+// Returns true if the local replica leads the exchange.
+func (s *syncSession) handshake() (bool, error) {
+	for {
+		var nonce [8]byte
+		if _, err := rand.Read(nonce[:]); err != nil {
+			return false, err
+		}
+
+		// Write concurrently as the remote is also writing its nonce.
+		errc := make(chan error, 1)
+		go func() { errc <- s.write(syncMsgHello, nonce[:]) }()
+
+		typ, data, err := s.read()
+		if werr := <-errc; werr != nil {
+			return false, werr
+		} else if err != nil {
+			return false, err
+		} else if typ != syncMsgHello || len(data) != len(nonce) {
+			return false, errors.New("immutable.Sync: invalid handshake")
+		}
+
+		local, remote := binary.BigEndian.Uint64(nonce[:]), binary.BigEndian.Uint64(data)
+		if local != remote {
+			return local > remote, nil
+		}
+	}
+}
+
+// lead drives the exchange. Ranges are compared breadth first. Ranges with
+// equal digests are skipped, small ranges are merged, and large ranges are
+// split in half by key.
+func (s *syncSession) lead() error {
+	pending := []syncRange{{}}
+	for len(pending) > 0 {
+		var buf []byte
+		var err error
+		if buf, err = appendSyncRanges(nil, pending); err != nil {
+			return err
+		} else if err := s.write(syncMsgSummaries, buf); err != nil {
+			return err
+		}
+		r, err := s.expect(syncMsgSummaries)
+		if err != nil {
+			return err
+		}
+
+		var transfer, next []syncRange
+		for _, rng := range pending {
+			var remote Digest
+			copy(remote[:], r.bytes(len(remote)))
+			remoteCount := int(r.uvarint())
+			if r.err != nil {
+				return r.err
+			}
+
+			local, err := s.rangeDigest(rng)
+			if err != nil {
+				return err
+			} else if local.digest() == remote && local.count == remoteCount {
+				continue
+			} else if local.count <= syncThreshold || remoteCount <= syncThreshold {
+				transfer = append(transfer, rng)
+				continue
+			}
+
+			mid, err := s.median(rng, local.count)
+			if err != nil {
+				return err
+			}
+			next = append(next, syncRange{lo: rng.lo, hi: mid}, syncRange{lo: mid, hi: rng.hi})
+		}
+		if r.close(); r.err != nil {
+			return r.err
+		}
+
+		if len(transfer) > 0 {
+			if err := s.transfer(transfer); err != nil {
+				return err
+			}
+		}
+		pending = next
+	}
+	return s.write(syncMsgDone, nil)
+}
+
+// transfer fetches the remote entries for each range, merges them into the
+// local map, and sends the entries that the remote replica is missing.
+func (s *syncSession) transfer(ranges []syncRange) error {
+	buf, err := appendSyncRanges(nil, ranges)
+	if err != nil {
+		return err
+	} else if err := s.write(syncMsgEntries, buf); err != nil {
+		return err
+	}
+	r, err := s.expect(syncMsgEntries)
+	if err != nil {
+		return err
+	}
+
+	var puts []mapEntry
+	for _, rng := range ranges {
+		remote := r.entries()
+		if r.err != nil {
+			return r.err
+		}
+		if puts, err = s.merge(s.entries(rng), remote, puts); err != nil {
+			return err
+		}
+	}
+	if r.close(); r.err != nil {
+		return r.err
+	} else if len(puts) == 0 {
+		return nil
+	}
+
+	if buf, err = appendSyncEntries(nil, puts); err != nil {
+		return err
+	}
+	return s.write(syncMsgPut, buf)
+}
+
+// merge merges sorted remote entries into the local map and appends to puts
+// the entries that must be sent to the remote replica.
+func (s *syncSession) merge(local, remote, puts []mapEntry) ([]mapEntry, error) {
+	for len(local) > 0 || len(remote) > 0 {
+		var cmp int
+		if len(local) == 0 {
+			cmp = 1
+		} else if len(remote) == 0 {
+			cmp = -1
+		} else {
+			cmp = s.local.comparer.Compare(local[0].key, remote[0].key)
+		}
+
+		switch {
+		case cmp < 0:
+			puts, local = append(puts, local[0]), local[1:]
+		case cmp > 0:
+			s.local, remote = s.local.Set(remote[0].key, remote[0].value), remote[1:]
+		default:
+			key, lv, rv := local[0].key, local[0].value, remote[0].value
+			local, remote = local[1:], remote[1:]
+
+			ld, err := entryDigest(key, lv)
+			if err != nil {
+				return nil, err
+			}
+			rd, err := entryDigest(key, rv)
+			if err != nil {
+				return nil, err
+			} else if ld == rd {
+				continue
+			}
+
+			value := s.resolve(key, lv, rv)
+			d, err := entryDigest(key, value)
+			if err != nil {
+				return nil, err
+			}
+			if d != ld {
+				s.local = s.local.Set(key, value)
+			}
+			if d != rd {
+				puts = append(puts, mapEntry{key: key, value: value})
+			}
+		}
+	}
+	return puts, nil
+}
+
+// follow responds to requests from the leader until the exchange completes.
+func (s *syncSession) follow() error {
+	for {
+		typ, data, err := s.read()
+		if err != nil {
+			return err
+		}
+		r := &syncReader{data: data}
+
+		switch typ {
+		case syncMsgSummaries:
+			var buf []byte
+			for _, rng := range r.ranges() {
+				d, err := s.rangeDigest(rng)
+				if err != nil {
+					return err
+				}
+				sum := d.digest()
+				buf = append(buf, sum[:]...)
+				buf = appendUvarint(buf, uint64(d.count))
+			}
+			if r.close(); r.err != nil {
+				return r.err
+			} else if err := s.write(syncMsgSummaries, buf); err != nil {
+				return err
+			}
+
+		case syncMsgEntries:
+			var buf []byte
+			for _, rng := range r.ranges() {
+				if buf, err = appendSyncEntries(buf, s.entries(rng)); err != nil {
+					return err
+				}
+			}
+			if r.close(); r.err != nil {
+				return r.err
+			} else if err := s.write(syncMsgEntries, buf); err != nil {
+				return err
+			}
+
+		case syncMsgPut:
+			for _, entry := range r.entries() {
+				s.local = s.local.Set(entry.key, entry.value)
+			}
+			if r.close(); r.err != nil {
+				return r.err
+			}
+
+		case syncMsgDone:
+			return nil
+
+		case syncMsgError:
+			return &syncRemoteError{msg: string(data)}
+
+		default:
+			return fmt.Errorf("immutable.Sync: unexpected message type %d", typ)
+		}
+	}
+}
+
+// rangeDigest returns the digest & count of local keys within rng.
+func (s *syncSession) rangeDigest(rng syncRange) (nodeDigest, error) {
+	if s.local.root == nil {
+		return nodeDigest{}, nil
+	}
+	return sortedMapRangeDigest(s.local.root, rng, s.local.comparer)
+}
+
+// entries returns the local key/value pairs within rng.
+func (s *syncSession) entries(rng syncRange) []mapEntry {
+	var entries []mapEntry
+	itr := s.local.Iterator()
+	if rng.lo != nil {
+		itr.Seek(rng.lo)
+	}
+	for !itr.Done() {
+		k, v := itr.Next()
+		if rng.hi != nil && s.local.comparer.Compare(k, rng.hi) >= 0 {
+			break
+		}
+		entries = append(entries, mapEntry{key: k, value: v})
+	}
+	return entries
+}
+
+// median returns the middle local key within rng which contains n keys.
+func (s *syncSession) median(rng syncRange, n int) (interface{}, error) {
+	var offset int
+	if rng.lo != nil {
+		before, err := s.rangeDigest(syncRange{hi: rng.lo})
+		if err != nil {
+			return nil, err
+		}
+		offset = before.count
+	}
+	return sortedMapKeyAt(s.local.root, offset+n/2)
+}
+
+// expect reads the next message and returns a reader for its payload.
+// Returns an error if the message is not of the given type.
+func (s *syncSession) expect(typ byte) (*syncReader, error) {
+	other, data, err := s.read()
+	if err != nil {
+		return nil, err
+	} else if other == syncMsgError {
+		return nil, &syncRemoteError{msg: string(data)}
+	} else if other != typ {
+		return nil, fmt.Errorf("immutable.Sync: unexpected message type %d", other)
+	}
+	return &syncReader{data: data}, nil
+}
+
+// abort notifies the remote replica of an error. Write errors are ignored.
+func (s *syncSession) abort(err error) {
+	s.write(syncMsgError, []byte(err.Error()))
+}
+
+// write writes a message as one or more length-prefixed frames. Every frame
+// except the last has the syncMsgContinue type.
+func (s *syncSession) write(typ byte, data []byte) error {
+	for {
+		frameTyp, chunk := typ, data
+		if len(chunk) > maxSyncFrameSize-1 {
+			frameTyp, chunk = syncMsgContinue, chunk[:maxSyncFrameSize-1]
+		}
+		data = data[len(chunk):]
+
+		buf := appendUvarint(nil, uint64(len(chunk)+1))
+		buf = append(append(buf, frameTyp), chunk...)
+		if _, err := s.w.Write(buf); err != nil {
+			return err
+		} else if frameTyp == typ {
+			return nil
+		}
+	}
+}
+
+// read reads a message written by write.
+func (s *syncSession) read() (typ byte, data []byte, err error) {
+	for {
+		n, err := binary.ReadUvarint(s.r)
+		if err != nil {
+			return 0, nil, err
+		} else if n == 0 || n > maxSyncFrameSize {
+			return 0, nil, fmt.Errorf("immutable.Sync: invalid message size %d", n)
+		}
+
+		// Read incrementally so memory is only allocated for data received.
+		var buf bytes.Buffer
+		if _, err := io.CopyN(&buf, s.r, int64(n)); err == io.EOF {
+			return 0, nil, io.ErrUnexpectedEOF
+		} else if err != nil {
+			return 0, nil, err
+		}
+
+		frame := buf.Bytes()
+		if frame[0] != syncMsgContinue && data == nil {
+			return frame[0], frame[1:], nil
+		} else if data = append(data, frame[1:]...); frame[0] != syncMsgContinue {
+			return frame[0], data, nil
+		}
+	}
+}
+
+// sortedMapRangeDigest returns the digest & count of keys under n within rng.
+// Child nodes entirely within the range use their cached digest.
+func sortedMapRangeDigest(n sortedMapNode, rng syncRange, c Comparer) (nodeDigest, error) {
+	var d nodeDigest
+	switch n := n.(type) {
+	case *sortedMapBranchNode:
+		for i, elem := range n.elems {
+			// Each child contains keys from its key up to the next child's key.
+			var next interface{}
+			if i+1 < len(n.elems) {
+				next = n.elems[i+1].key
+			}
+			if rng.hi != nil && c.Compare(elem.key, rng.hi) >= 0 {
+				break
+			} else if next != nil && rng.lo != nil && c.Compare(next, rng.lo) <= 0 {
+				continue
+			}
+
+			var other nodeDigest
+			var err error
+			if (rng.lo == nil || c.Compare(elem.key, rng.lo) >= 0) && (rng.hi == nil || (next != nil && c.Compare(next, rng.hi) <= 0)) {
+				other, err = sortedMapNodeDigest(elem.node)
+			} else {
+				other, err = sortedMapRangeDigest(elem.node, rng, c)
+			}
+			if err != nil {
+				return d, err
+			}
+			d.add(other)
+		}
+
+	case *sortedMapLeafNode:
+		for _, entry := range n.entries {
+			if rng.lo != nil && c.Compare(entry.key, rng.lo) < 0 {
+				continue
+			} else if rng.hi != nil && c.Compare(entry.key, rng.hi) >= 0 {
+				break
+			}
+			if err := d.addEntries([]mapEntry{entry}); err != nil {
+				return d, err
+			}
+		}
+	}
+	return d, nil
+}
+
+// sortedMapKeyAt returns the key at index i under n using cached key counts.
+func sortedMapKeyAt(n sortedMapNode, i int) (interface{}, error) {
+	for {
+		switch node := n.(type) {
+		case *sortedMapBranchNode:
+			for _, elem := range node.elems {
+				d, err := sortedMapNodeDigest(elem.node)
+				if err != nil {
+					return nil, err
+				} else if n = elem.node; i < d.count {
+					break
+				}
+				i -= d.count
+			}
+		case *sortedMapLeafNode:
+			return node.entries[i].key, nil
+		}
+	}
+}
+
+// appendSyncRanges appends a count followed by the bounds of each range.
+func appendSyncRanges(dst []byte, ranges []syncRange) (_ []byte, err error) {
+	dst = appendUvarint(dst, uint64(len(ranges)))
+	for _, rng := range ranges {
+		if dst, err = DefaultCodec.AppendValue(dst, rng.lo); err != nil {
+			return nil, err
+		} else if dst, err = DefaultCodec.AppendValue(dst, rng.hi); err != nil {
+			return nil, err
+		}
+	}
+	return dst, nil
+}
+
+// appendSyncEntries appends a count followed by each key/value pair.
+func appendSyncEntries(dst []byte, entries []mapEntry) (_ []byte, err error) {
+	dst = appendUvarint(dst, uint64(len(entries)))
+	for _, entry := range entries {
+		if dst, err = DefaultCodec.AppendValue(dst, entry.key); err != nil {
+			return nil, err
+		} else if dst, err = DefaultCodec.AppendValue(dst, entry.value); err != nil {
+			return nil, err
+		}
+	}
+	return dst, nil
+}
+
+// syncReader reads fields from a sync message. The first error encountered
+// is retained and subsequent reads return zero values.
+type syncReader struct {
+	data []byte
+	err  error
+}
+
+// close records an error if unread bytes remain.
+func (r *syncReader) close() {
+	if r.err == nil && len(r.data) != 0 {
+		r.err = errors.New("immutable.Sync: unexpected trailing data")
+	}
+}
+
+// fail records err if no error has been recorded yet.
+func (r *syncReader) fail(err error) {
+	if r.err == nil {
+		r.err, r.data = err, nil
+	}
+}
+
+// uvarint reads a variable-length unsigned integer.
+func (r *syncReader) uvarint() uint64 {
+	x, n := binary.Uvarint(r.data)
+	if n <= 0 {
+		r.fail(errors.New("immutable.Sync: invalid uvarint"))
+		return 0
+	}
+	r.data = r.data[n:]
+	return x
+}
+
+// bytes reads n bytes.
+func (r *syncReader) bytes(n int) []byte {
+	if len(r.data) < n {
+		r.fail(io.ErrUnexpectedEOF)
+		return make([]byte, n)
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+// value reads a single key or value.
+func (r *syncReader) value() interface{} {
+	if r.err != nil {
+		return nil
+	}
+	v, n, err := DefaultCodec.ReadValue(r.data)
+	if err != nil {
+		r.fail(err)
+		return nil
+	}
+	r.data = r.data[n:]
+	return v
+}
+
+// ranges reads a list of ranges written by appendSyncRanges.
+func (r *syncReader) ranges() []syncRange {
+	n := r.uvarint()
+	if n > uint64(len(r.data)) {
+		r.fail(io.ErrUnexpectedEOF)
+		return nil
+	}
+	ranges := make([]syncRange, n)
+	for i := range ranges {
+		ranges[i].lo, ranges[i].hi = r.value(), r.value()
+	}
+	return ranges
+}
+
+// entries reads a list of entries written by appendSyncEntries.
+func (r *syncReader) entries() []mapEntry {
+	n := r.uvarint()
+	if n > uint64(len(r.data)) {
+		r.fail(io.ErrUnexpectedEOF)
+		return nil
+	}
+	entries := make([]mapEntry, n)
+	for i := range entries {
+		entries[i].key, entries[i].value = r.value(), r.value()
+	}
+	return entries
+}
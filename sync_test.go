@@ -0,0 +1,358 @@
+package immutable
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSync(t *testing.T) {
+	t.Run("Disjoint", func(t *testing.T) {
+		a := NewSortedMap(nil).Set(1, "a").Set(3, "c")
+		b := NewSortedMap(nil).Set(2, "b").Set(4, "d")
+
+		a, b, err := runSync(a, b, maxStringResolver)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range []*SortedMap{a, b} {
+			if got, exp := sortedMapString(m), "1=a 2=b 3=c 4=d"; got != exp {
+				t.Fatalf("got %q, expected %q", got, exp)
+			}
+		}
+	})
+
+	t.Run("Conflict", func(t *testing.T) {
+		a := NewSortedMap(nil).Set(1, "x").Set(2, "a")
+		b := NewSortedMap(nil).Set(1, "y").Set(2, "z")
+
+		a, b, err := runSync(a, b, maxStringResolver)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range []*SortedMap{a, b} {
+			if got, exp := sortedMapString(m), "1=y 2=z"; got != exp {
+				t.Fatalf("got %q, expected %q", got, exp)
+			}
+		}
+	})
+
+	t.Run("Empty", func(t *testing.T) {
+		b := NewSortedMap(nil)
+		for i := 0; i < 1000; i++ {
+			b = b.Set(i, fmt.Sprint(i))
+		}
+
+		a, b, err := runSync(NewSortedMap(nil), b, maxStringResolver)
+		if err != nil {
+			t.Fatal(err)
+		} else if a.Len() != 1000 || b.Len() != 1000 {
+			t.Fatalf("unexpected len: %d, %d", a.Len(), b.Len())
+		} else if sortedMapString(a) != sortedMapString(b) {
+			t.Fatal("replica mismatch")
+		}
+	})
+
+	// Ensure replicas with a small difference only exchange a small amount of data.
+	t.Run("SmallDifference", func(t *testing.T) {
+		a := NewSortedMap(nil)
+		for i := 0; i < 100000; i++ {
+			a = a.Set(i, fmt.Sprint(i))
+		}
+		b := a.Set(50000, "foo").Set(100000, "bar")
+		a = a.Set(25000, "baz")
+
+		var n int64
+		a, b, err := runSyncCounting(a, b, maxStringResolver, &n)
+		if err != nil {
+			t.Fatal(err)
+		} else if sortedMapString(a) != sortedMapString(b) {
+			t.Fatal("replica mismatch")
+		} else if v, _ := a.Get(50000); v != "foo" {
+			t.Fatalf("unexpected value: %v", v)
+		} else if v, _ := b.Get(25000); v != "baz" {
+			t.Fatalf("unexpected value: %v", v)
+		} else if v, _ := b.Get(100000); v != "bar" {
+			t.Fatalf("unexpected value: %v", v)
+		} else if n > 20000 {
+			t.Fatalf("too many bytes exchanged: %d", n)
+		}
+	})
+
+	t.Run("Equal", func(t *testing.T) {
+		a := NewSortedMap(nil)
+		for i := 0; i < 1000; i++ {
+			a = a.Set(i, i)
+		}
+
+		var n int64
+		if _, _, err := runSyncCounting(a, a, maxStringResolver, &n); err != nil {
+			t.Fatal(err)
+		} else if n > 200 {
+			t.Fatalf("too many bytes exchanged: %d", n)
+		}
+	})
+
+	t.Run("ErrResolverRequired", func(t *testing.T) {
+		if _, err := Sync(NewSortedMap(nil), nil, nil); err == nil || err.Error() != `immutable.Sync: resolver required` {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("ErrUnsupportedType", func(t *testing.T) {
+		a := NewSortedMap(nil).Set(1, struct{}{})
+		b := NewSortedMap(nil).Set(2, "b")
+		if _, _, err := runSync(a, b, maxStringResolver); err == nil || !strings.Contains(err.Error(), "unsupported type struct {}") {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	// Ensure the leader is notified instead of blocking when the follower fails.
+	t.Run("ErrFollower", func(t *testing.T) {
+		c0, c1 := net.Pipe()
+		defer c0.Close()
+		defer c1.Close()
+
+		errc := make(chan error, 1)
+		go func() {
+			_, err := Sync(NewSortedMap(nil).Set(1, "a"), c1, maxStringResolver)
+			errc <- err
+		}()
+
+		// Elect the raw session as leader with the largest possible nonce.
+		leader := &syncSession{r: bufio.NewReader(c0), w: c0}
+		go leader.write(syncMsgHello, []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF})
+		if typ, _, err := leader.read(); err != nil {
+			t.Fatal(err)
+		} else if typ != syncMsgHello {
+			t.Fatalf("unexpected message type: %d", typ)
+		}
+
+		// Send a summary request with trailing data which the follower rejects.
+		go leader.write(syncMsgSummaries, []byte{0, 0})
+		if _, err := leader.expect(syncMsgSummaries); err == nil || err.Error() != `immutable.Sync: remote error: immutable.Sync: unexpected trailing data` {
+			t.Fatalf("unexpected error: %v", err)
+		} else if err := <-errc; err == nil || err.Error() != `immutable.Sync: unexpected trailing data` {
+			t.Fatalf("unexpected follower error: %v", err)
+		}
+	})
+
+	// Ensure a frame larger than the maximum size is rejected before reading it.
+	t.Run("ErrFrameTooLarge", func(t *testing.T) {
+		buf := appendUvarint(nil, maxSyncFrameSize+1)
+		s := &syncSession{r: bufio.NewReader(bytes.NewReader(append(buf, syncMsgPut)))}
+		if _, _, err := s.read(); err == nil || err.Error() != fmt.Sprintf("immutable.Sync: invalid message size %d", maxSyncFrameSize+1) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	// Ensure messages larger than a frame are split & reassembled.
+	t.Run("Continue", func(t *testing.T) {
+		data := bytes.Repeat([]byte("x"), 2*maxSyncFrameSize)
+		var buf bytes.Buffer
+		if err := (&syncSession{w: &buf}).write(syncMsgPut, data); err != nil {
+			t.Fatal(err)
+		}
+
+		s := &syncSession{r: bufio.NewReader(&buf)}
+		if typ, other, err := s.read(); err != nil {
+			t.Fatal(err)
+		} else if typ != syncMsgPut {
+			t.Fatalf("unexpected message type: %d", typ)
+		} else if !bytes.Equal(other, data) {
+			t.Fatal("unexpected data")
+		}
+	})
+
+	// Ensure both replicas return when a resolver returns an unsupported value.
+	t.Run("ErrResolver", func(t *testing.T) {
+		c0, c1 := net.Pipe()
+		defer c0.Close()
+		defer c1.Close()
+
+		resolve := func(key, local, remote interface{}) interface{} { return struct{}{} }
+		errc := make(chan error, 2)
+		go func() {
+			_, err := Sync(NewSortedMap(nil).Set(1, "a"), c0, resolve)
+			errc <- err
+		}()
+		go func() {
+			_, err := Sync(NewSortedMap(nil).Set(1, "b"), c1, resolve)
+			errc <- err
+		}()
+
+		for i := 0; i < 2; i++ {
+			select {
+			case err := <-errc:
+				if err == nil || !strings.Contains(err.Error(), "unsupported type struct {}") {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatal("timeout")
+			}
+		}
+	})
+
+	RunRandom(t, "Random", func(t *testing.T, rand *rand.Rand) {
+		a, b := NewSortedMap(nil), NewSortedMap(nil)
+		exp := make(map[int]string)
+		for i := 0; i < 5000; i++ {
+			k, v := rand.Intn(10000), fmt.Sprint(rand.Intn(100))
+			switch rand.Intn(3) {
+			case 0:
+				a = a.Set(k, v)
+			case 1:
+				b = b.Set(k, v)
+			default:
+				a, b = a.Set(k, v), b.Set(k, v)
+			}
+		}
+		for _, m := range []*SortedMap{a, b} {
+			for itr := m.Iterator(); !itr.Done(); {
+				k, v := itr.Next()
+				if other, ok := exp[k.(int)]; !ok || v.(string) > other {
+					exp[k.(int)] = v.(string)
+				}
+			}
+		}
+
+		a, b, err := runSync(a, b, maxStringResolver)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range []*SortedMap{a, b} {
+			if m.Len() != len(exp) {
+				t.Fatalf("unexpected len: %d, expected %d", m.Len(), len(exp))
+			}
+			for k, v := range exp {
+				if other, _ := m.Get(k); other != v {
+					t.Fatalf("unexpected value for %d: %v, expected %v", k, other, v)
+				}
+			}
+		}
+	})
+}
+
+// maxStringResolver resolves conflicts by choosing the greater string value.
+func maxStringResolver(key, local, remote interface{}) interface{} {
+	if local.(string) > remote.(string) {
+		return local
+	}
+	return remote
+}
+
+// runSync syncs a & b over an in-memory connection and returns both results.
+func runSync(a, b *SortedMap, resolve SyncResolver) (*SortedMap, *SortedMap, error) {
+	var n int64
+	return runSyncCounting(a, b, resolve, &n)
+}
+
+// runSyncCounting syncs a & b and adds the number of bytes written to n.
+func runSyncCounting(a, b *SortedMap, resolve SyncResolver, n *int64) (*SortedMap, *SortedMap, error) {
+	c0, c1 := net.Pipe()
+	defer c0.Close()
+	defer c1.Close()
+
+	type result struct {
+		m   *SortedMap
+		err error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		m, err := Sync(b, &countingConn{Conn: c1, n: n}, resolve)
+		if err != nil {
+			c1.Close()
+		}
+		ch <- result{m, err}
+	}()
+
+	a, err := Sync(a, &countingConn{Conn: c0, n: n}, resolve)
+	if err != nil {
+		c0.Close()
+	}
+	res := <-ch
+	if err == nil {
+		err = res.err
+	}
+	return a, res.m, err
+}
+
+// countingConn counts the number of bytes written to a connection.
+type countingConn struct {
+	net.Conn
+	n *int64
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
+
+var _ io.ReadWriter = (*countingConn)(nil)
+
+// sortedMapString returns a string of all key/value pairs in m.
+func sortedMapString(m *SortedMap) string {
+	var a []string
+	for itr := m.Iterator(); !itr.Done(); {
+		k, v := itr.Next()
+		a = append(a, fmt.Sprintf("%v=%v", k, v))
+	}
+	return strings.Join(a, " ")
+}
+
+func BenchmarkSync(b *testing.B) {
+	m := NewSortedMap(nil)
+	for i := 0; i < 100000; i++ {
+		m = m.Set(i, i)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		other := m.Set(i%100000, -1)
+		if _, _, err := runSync(m, other, func(key, local, remote interface{}) interface{} {
+			if local.(int) > remote.(int) {
+				return local
+			}
+			return remote
+		}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func ExampleSync() {
+	a := NewSortedMap(nil).Set("foo", 1)
+	b := NewSortedMap(nil).Set("bar", 2)
+
+	c0, c1 := net.Pipe()
+	defer c0.Close()
+	defer c1.Close()
+
+	resolve := func(key, local, remote interface{}) interface{} {
+		if local.(int) > remote.(int) {
+			return local
+		}
+		return remote
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		b, _ = Sync(b, c1, resolve)
+	}()
+	a, _ = Sync(a, c0, resolve)
+	<-done
+
+	fmt.Println(a.Len(), b.Len())
+	// Output:
+	// 2 2
+}
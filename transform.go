@@ -0,0 +1,279 @@
+package immutable
+
+import (
+	"context"
+)
+
+// Map returns a new list with each element replaced by the result of fn. The
+// new list has the same internal shape as l so only nodes are copied, not
+// individual elements. Stops and returns the error if fn returns an error.
+func (l *List) Map(fn func(index int, value interface{}) (interface{}, error)) (*List, error) {
+	root, err := mapListNode(l.root, 0, l.origin, l.origin+l.size, func(i int, v interface{}) (interface{}, error) {
+		return fn(i-l.origin, v)
+	})
+	if err != nil {
+		return nil, err
+	}
+	other := *l
+	other.root = root
+	return &other, nil
+}
+
+// mapListNode returns a copy of n with each element at an index within
+// [lo, hi) replaced by fn. The base is the index of the first slot in n.
+func mapListNode(n listNode, base, lo, hi int, fn func(index int, value interface{}) (interface{}, error)) (_ listNode, err error) {
+	switch n := n.(type) {
+	case *listBranchNode:
+		other := &listBranchNode{d: n.d}
+		span := 1 << (n.d * listNodeBits)
+		for i, child := range n.children {
+			if start := base + i*span; child == nil || start >= hi || start+span <= lo {
+				other.children[i] = child
+			} else if other.children[i], err = mapListNode(child, start, lo, hi, fn); err != nil {
+				return nil, err
+			}
+		}
+		return other, nil
+
+	case *listLeafNode:
+		other := &listLeafNode{children: n.children}
+		for i := range n.children {
+			if index := base + i; index >= lo && index < hi {
+				if other.children[i], err = fn(index, n.children[i]); err != nil {
+					return nil, err
+				}
+			}
+		}
+		return other, nil
+	}
+	return n, nil
+}
+
+// Filter returns a new list containing only the elements for which fn returns
+// true, in their original order. The new list is built directly from its leaf
+// nodes. Returns the original list if no elements are removed. Stops and
+// returns the error if fn returns an error.
+func (l *List) Filter(fn func(index int, value interface{}) (bool, error)) (*List, error) {
+	var b listBuilder
+	for itr := l.Iterator(); !itr.Done(); {
+		index, value := itr.Next()
+		if ok, err := fn(index, value); err != nil {
+			return nil, err
+		} else if ok {
+			b.append(value)
+		}
+	}
+
+	if b.size == l.size {
+		return l, nil
+	}
+	other := b.list()
+	other.equaler = l.equaler
+	return other, nil
+}
+
+// Reduce calls fn for each element of the list in order, passing the result of
+// the previous call as acc, and returns the final result. The first call
+// receives initial. Stops and returns the error if fn returns an error.
+func (l *List) Reduce(initial interface{}, fn func(acc interface{}, index int, value interface{}) (interface{}, error)) (interface{}, error) {
+	acc := initial
+	for itr := l.Iterator(); !itr.Done(); {
+		index, value := itr.Next()
+
+		var err error
+		if acc, err = fn(acc, index, value); err != nil {
+			return nil, err
+		}
+	}
+	return acc, nil
+}
+
+// listBuilder builds a list by filling leaf nodes in order and then building
+// the branch nodes above them.
+type listBuilder struct {
+	leaves []listNode
+	leaf   *listLeafNode // current leaf, if not full
+	size   int
+}
+
+// append adds value to the end of the list.
+func (b *listBuilder) append(value interface{}) {
+	if b.leaf == nil {
+		b.leaf = &listLeafNode{}
+		b.leaves = append(b.leaves, b.leaf)
+	}
+
+	b.leaf.children[b.size&listNodeMask] = value
+	if b.size++; b.size&listNodeMask == 0 {
+		b.leaf = nil
+	}
+}
+
+// list returns a list of the appended values. The tree has the same depth as
+// a list built by calling List.Append() for each value.
+func (b *listBuilder) list() *List {
+	if b.size == 0 {
+		return NewList()
+	}
+
+	// Group nodes into branches until a single root remains.
+	nodes := b.leaves
+	for depth := uint(1); len(nodes) > 1; depth++ {
+		parents := make([]listNode, 0, (len(nodes)+listNodeSize-1)/listNodeSize)
+		for len(nodes) > 0 {
+			parent := &listBranchNode{d: depth}
+			nodes = nodes[copy(parent.children[:], nodes):]
+			parents = append(parents, parent)
+		}
+		nodes = parents
+	}
+
+	// Grow the root until the list's capacity covers its size.
+	l := &List{root: nodes[0], size: b.size}
+	for l.cap() < l.size {
+		root := &listBranchNode{d: l.root.depth() + 1}
+		root.children[0] = l.root
+		l.root = root
+	}
+	return l
+}
+
+// Filter returns a new map containing only the key/value pairs for which fn
+// returns true. Subtrees without removed keys are shared with the original
+// map. Returns the original map if no keys are removed. Stops and returns the
+// error if fn returns an error.
+func (m *Map) Filter(fn func(key, value interface{}) (bool, error)) (*Map, error) {
+	if m.root == nil {
+		return m, nil
+	}
+	root, removed, err := filterMapNode(context.Background(), m.root, fn)
+	if err != nil {
+		return nil, err
+	} else if root == m.root {
+		return m, nil
+	}
+	return &Map{size: m.size - removed, root: root, hasher: m.hasher, equaler: m.equaler}, nil
+}
+
+// MapValues returns a new map with the same keys where each value is replaced
+// by the result of fn. The new map has the same shape as m so keys are not
+// rehashed. Stops and returns the error if fn returns an error.
+func (m *Map) MapValues(fn func(key, value interface{}) (interface{}, error)) (*Map, error) {
+	if m.root == nil {
+		return m, nil
+	}
+	root, err := mapValuesMapNode(context.Background(), m.root, fn)
+	if err != nil {
+		return nil, err
+	}
+	return &Map{size: m.size, root: root, hasher: m.hasher, equaler: m.equaler}, nil
+}
+
+// Filter returns a new sorted map containing only the key/value pairs for
+// which fn returns true. Leaf nodes without removed keys are shared with the
+// original map. Returns the original map if no keys are removed. Stops and
+// returns the error if fn returns an error.
+func (m *SortedMap) Filter(fn func(key, value interface{}) (bool, error)) (*SortedMap, error) {
+	if m.root == nil {
+		return m, nil
+	}
+	root, removed, err := filterSortedMapNode(m.root, fn)
+	if err != nil {
+		return nil, err
+	} else if root == m.root {
+		return m, nil
+	}
+	return &SortedMap{size: m.size - removed, root: root, comparer: m.comparer, equaler: m.equaler}, nil
+}
+
+// MapValues returns a new sorted map with the same keys where each value is
+// replaced by the result of fn. The tree keeps its shape and only leaf values
+// are rewritten so keys are not compared. Stops and returns the error if fn
+// returns an error.
+func (m *SortedMap) MapValues(fn func(key, value interface{}) (interface{}, error)) (*SortedMap, error) {
+	if m.root == nil {
+		return m, nil
+	}
+	root, err := mapValuesSortedMapNode(m.root, fn)
+	if err != nil {
+		return nil, err
+	}
+	return &SortedMap{size: m.size, root: root, comparer: m.comparer, equaler: m.equaler}, nil
+}
+
+// filterSortedMapNode returns n with the key/value pairs removed for which fn
+// returns false, along with the number of removed pairs. Returns n if no pairs
+// are removed and nil if all pairs are removed.
+func filterSortedMapNode(n sortedMapNode, fn func(key, value interface{}) (bool, error)) (sortedMapNode, int, error) {
+	switch n := n.(type) {
+	case *sortedMapBranchNode:
+		var elems []sortedMapBranchElem
+		var removed int
+		for i, elem := range n.elems {
+			child, count, err := filterSortedMapNode(elem.node, fn)
+			if err != nil {
+				return nil, 0, err
+			} else if child != elem.node && elems == nil {
+				elems = append(make([]sortedMapBranchElem, 0, len(n.elems)), n.elems[:i]...)
+			}
+
+			removed += count
+			if elems != nil && child != nil {
+				elems = append(elems, sortedMapBranchElem{key: child.minKey(), node: child})
+			}
+		}
+
+		switch {
+		case removed == 0:
+			return n, 0, nil
+		case len(elems) == 0:
+			return nil, removed, nil
+		}
+		return &sortedMapBranchNode{elems: elems}, removed, nil
+
+	case *sortedMapLeafNode:
+		var entries []mapEntry
+		for i, e := range n.entries {
+			ok, err := fn(e.key, e.value)
+			if err != nil {
+				return nil, 0, err
+			} else if !ok && entries == nil {
+				entries = append(make([]mapEntry, 0, len(n.entries)), n.entries[:i]...)
+			} else if ok && entries != nil {
+				entries = append(entries, e)
+			}
+		}
+
+		switch {
+		case entries == nil:
+			return n, 0, nil
+		case len(entries) == 0:
+			return nil, len(n.entries), nil
+		}
+		return &sortedMapLeafNode{entries: entries}, len(n.entries) - len(entries), nil
+	}
+	return n, 0, nil
+}
+
+// mapValuesSortedMapNode returns a copy of n with each value replaced by fn.
+func mapValuesSortedMapNode(n sortedMapNode, fn func(key, value interface{}) (interface{}, error)) (_ sortedMapNode, err error) {
+	switch n := n.(type) {
+	case *sortedMapBranchNode:
+		other := &sortedMapBranchNode{elems: make([]sortedMapBranchElem, len(n.elems))}
+		for i, elem := range n.elems {
+			other.elems[i].key = elem.key
+			if other.elems[i].node, err = mapValuesSortedMapNode(elem.node, fn); err != nil {
+				return nil, err
+			}
+		}
+		return other, nil
+
+	case *sortedMapLeafNode:
+		entries, err := mapValuesEntries(n.entries, fn)
+		if err != nil {
+			return nil, err
+		}
+		return &sortedMapLeafNode{entries: entries}, nil
+	}
+	return n, nil
+}
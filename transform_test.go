@@ -0,0 +1,366 @@
+package immutable
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestList_Map(t *testing.T) {
+	double := func(index int, value interface{}) (interface{}, error) { return value.(int) * 2, nil }
+
+	for _, n := range []int{0, 1, 32, 33, 1000, 40000} {
+		t.Run(fmt.Sprint(n), func(t *testing.T) {
+			l := NewList()
+			for i := 0; i < n; i++ {
+				l = l.Append(i)
+			}
+
+			other, err := l.Map(double)
+			if err != nil {
+				t.Fatal(err)
+			} else if other.Len() != n {
+				t.Fatalf("unexpected len: %d", other.Len())
+			}
+			for i := 0; i < n; i++ {
+				if v := other.Get(i); v != i*2 {
+					t.Fatalf("Get(%d)=%v", i, v)
+				} else if v := l.Get(i); v != i {
+					t.Fatalf("original list changed: Get(%d)=%v", i, v)
+				}
+			}
+		})
+	}
+
+	t.Run("Slice", func(t *testing.T) {
+		l := NewList()
+		for i := 0; i < 1000; i++ {
+			l = l.Prepend(-i).Append(i)
+		}
+		l = l.Slice(500, 1500)
+
+		var calls int
+		other, err := l.Map(func(index int, value interface{}) (interface{}, error) {
+			if calls++; l.Get(index) != value {
+				t.Fatalf("unexpected value for index %d: %v", index, value)
+			}
+			return index, nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		} else if calls != 1000 {
+			t.Fatalf("unexpected calls: %d", calls)
+		}
+		for i := 0; i < 1000; i++ {
+			if v := other.Get(i); v != i {
+				t.Fatalf("Get(%d)=%v", i, v)
+			}
+		}
+		if other = other.Prepend(-1).Append(1000); other.Get(0) != -1 || other.Get(1001) != 1000 {
+			t.Fatal("unexpected values after append")
+		}
+	})
+
+	t.Run("Error", func(t *testing.T) {
+		errMarker := errors.New("marker")
+		var calls int
+		l := NewList().Append(1).Append(2).Append(3)
+		if other, err := l.Map(func(index int, value interface{}) (interface{}, error) {
+			calls++
+			return nil, errMarker
+		}); err != errMarker || other != nil {
+			t.Fatalf("unexpected result: <%v,%v>", other, err)
+		} else if calls != 1 {
+			t.Fatalf("unexpected calls: %d", calls)
+		}
+	})
+}
+
+func TestList_Filter(t *testing.T) {
+	even := func(index int, value interface{}) (bool, error) { return value.(int)%2 == 0, nil }
+
+	for _, n := range []int{0, 1, 2, 63, 64, 65, 2048, 2049, 70000} {
+		t.Run(fmt.Sprint(n), func(t *testing.T) {
+			l := NewList()
+			for i := 0; i < n; i++ {
+				l = l.Append(i)
+			}
+
+			other, err := l.Filter(even)
+			if err != nil {
+				t.Fatal(err)
+			} else if exp := (n + 1) / 2; other.Len() != exp {
+				t.Fatalf("unexpected len: %d, expected %d", other.Len(), exp)
+			}
+
+			// The result must have the same shape as an appended list.
+			exp := NewList()
+			for i := 0; i < n; i += 2 {
+				exp = exp.Append(i)
+			}
+			for i := 0; i < exp.Len(); i++ {
+				if v := other.Get(i); v != exp.Get(i) {
+					t.Fatalf("Get(%d)=%v, expected %v", i, v, exp.Get(i))
+				}
+			}
+			if d0, err := other.Digest(); err != nil {
+				t.Fatal(err)
+			} else if d1, err := exp.Digest(); err != nil {
+				t.Fatal(err)
+			} else if d0 != d1 {
+				t.Fatal("digest mismatch")
+			}
+
+			// The result must support further writes.
+			other = other.Append(-1).Prepend(-2)
+			if other.Get(0) != -2 || other.Get(other.Len()-1) != -1 {
+				t.Fatal("unexpected values after append")
+			}
+		})
+	}
+
+	t.Run("NoChange", func(t *testing.T) {
+		l := NewList().Append(2).Append(4)
+		if other, err := l.Filter(even); err != nil || other != l {
+			t.Fatalf("expected same list: %v", err)
+		}
+	})
+
+	t.Run("Error", func(t *testing.T) {
+		errMarker := errors.New("marker")
+		l := NewList().Append(1).Append(2)
+		if other, err := l.Filter(func(index int, value interface{}) (bool, error) {
+			return false, errMarker
+		}); err != errMarker || other != nil {
+			t.Fatalf("unexpected result: <%v,%v>", other, err)
+		}
+	})
+}
+
+func TestList_Reduce(t *testing.T) {
+	l := NewList()
+	for i := 1; i <= 100; i++ {
+		l = l.Append(i)
+	}
+
+	sum := func(acc interface{}, index int, value interface{}) (interface{}, error) {
+		return acc.(int) + value.(int), nil
+	}
+	if v, err := l.Reduce(0, sum); err != nil || v != 5050 {
+		t.Fatalf("unexpected result: <%v,%v>", v, err)
+	} else if v, err := NewList().Reduce(7, sum); err != nil || v != 7 {
+		t.Fatalf("unexpected result: <%v,%v>", v, err)
+	}
+
+	errMarker := errors.New("marker")
+	if v, err := l.Reduce(0, func(acc interface{}, index int, value interface{}) (interface{}, error) {
+		if index == 10 {
+			return nil, errMarker
+		}
+		return acc, nil
+	}); err != errMarker || v != nil {
+		t.Fatalf("unexpected result: <%v,%v>", v, err)
+	}
+}
+
+func TestMap_Filter(t *testing.T) {
+	m := NewMap(nil)
+	for i := 0; i < 10000; i++ {
+		m = m.Set(i, i)
+	}
+
+	other, err := m.Filter(func(key, value interface{}) (bool, error) { return key.(int)%4 == 0, nil })
+	if err != nil {
+		t.Fatal(err)
+	} else if other.Len() != 2500 {
+		t.Fatalf("unexpected len: %d", other.Len())
+	}
+	for i := 0; i < 10000; i++ {
+		if v, ok := other.Get(i); ok != (i%4 == 0) || (ok && v != i) {
+			t.Fatalf("Get(%d)=<%v,%v>", i, v, ok)
+		}
+	}
+
+	if same, err := m.Filter(func(key, value interface{}) (bool, error) { return true, nil }); err != nil || same != m {
+		t.Fatalf("expected same map: %v", err)
+	}
+
+	errMarker := errors.New("marker")
+	if other, err := m.Filter(func(key, value interface{}) (bool, error) { return false, errMarker }); err != errMarker || other != nil {
+		t.Fatalf("unexpected result: <%v,%v>", other, err)
+	}
+}
+
+func TestMap_MapValues(t *testing.T) {
+	m := NewMap(nil)
+	for i := 0; i < 10000; i++ {
+		m = m.Set(i, i)
+	}
+
+	other, err := m.MapValues(func(key, value interface{}) (interface{}, error) { return fmt.Sprint(value), nil })
+	if err != nil {
+		t.Fatal(err)
+	} else if other.Len() != 10000 {
+		t.Fatalf("unexpected len: %d", other.Len())
+	}
+	for i := 0; i < 10000; i++ {
+		if v, ok := other.Get(i); !ok || v != fmt.Sprint(i) {
+			t.Fatalf("Get(%d)=<%v,%v>", i, v, ok)
+		}
+	}
+
+	errMarker := errors.New("marker")
+	var calls int
+	if other, err := m.MapValues(func(key, value interface{}) (interface{}, error) { calls++; return nil, errMarker }); err != errMarker || other != nil {
+		t.Fatalf("unexpected result: <%v,%v>", other, err)
+	} else if calls != 1 {
+		t.Fatalf("unexpected calls: %d", calls)
+	}
+}
+
+func TestSortedMap_Filter(t *testing.T) {
+	for _, n := range []int{0, 1, 32, 1000, 100000} {
+		t.Run(fmt.Sprint(n), func(t *testing.T) {
+			m := NewSortedMap(nil)
+			for i := 0; i < n; i++ {
+				m = m.Set(i, i)
+			}
+
+			other, err := m.Filter(func(key, value interface{}) (bool, error) { return key.(int)%3 == 1, nil })
+			if err != nil {
+				t.Fatal(err)
+			} else if exp := (n + 1) / 3; other.Len() != exp {
+				t.Fatalf("unexpected len: %d, expected %d", other.Len(), exp)
+			}
+
+			// Verify keys in order with the iterator & lookups.
+			itr := other.Iterator()
+			for i := 1; i < n; i += 3 {
+				if k, v := itr.Next(); k != i || v != i {
+					t.Fatalf("Next()=<%v,%v>, expected %d", k, v, i)
+				} else if v, ok := other.Get(i); !ok || v != i {
+					t.Fatalf("Get(%d)=<%v,%v>", i, v, ok)
+				} else if _, ok := other.Get(i - 1); ok {
+					t.Fatalf("unexpected key: %d", i-1)
+				}
+			}
+			if !itr.Done() {
+				t.Fatal("expected iterator to be done")
+			}
+
+			// The result must support further writes.
+			other = other.Set(0, 0).Delete(1)
+			if v, ok := other.Get(0); !ok || v != 0 {
+				t.Fatalf("Get(0)=<%v,%v>", v, ok)
+			}
+		})
+	}
+
+	t.Run("All", func(t *testing.T) {
+		m := NewSortedMap(nil)
+		for i := 0; i < 1000; i++ {
+			m = m.Set(i, i)
+		}
+		if same, err := m.Filter(func(key, value interface{}) (bool, error) { return true, nil }); err != nil || same != m {
+			t.Fatalf("expected same map: %v", err)
+		} else if empty, err := m.Filter(func(key, value interface{}) (bool, error) { return false, nil }); err != nil || empty.Len() != 0 {
+			t.Fatalf("expected empty map: %v", err)
+		} else if empty = empty.Set(1, 1); empty.Len() != 1 {
+			t.Fatalf("unexpected len: %d", empty.Len())
+		}
+	})
+}
+
+func TestSortedMap_MapValues(t *testing.T) {
+	m := NewSortedMap(nil)
+	for i := 0; i < 10000; i++ {
+		m = m.Set(i, i)
+	}
+
+	other, err := m.MapValues(func(key, value interface{}) (interface{}, error) { return value.(int) * 2, nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	itr := other.Iterator()
+	for i := 0; i < 10000; i++ {
+		if k, v := itr.Next(); k != i || v != i*2 {
+			t.Fatalf("Next()=<%v,%v>", k, v)
+		}
+	}
+
+	// The tree keeps its shape.
+	if a, b := m.root.(*sortedMapBranchNode), other.root.(*sortedMapBranchNode); len(a.elems) != len(b.elems) {
+		t.Fatalf("shape mismatch: %d != %d", len(a.elems), len(b.elems))
+	}
+
+	errMarker := errors.New("marker")
+	if other, err := m.MapValues(func(key, value interface{}) (interface{}, error) { return nil, errMarker }); err != errMarker || other != nil {
+		t.Fatalf("unexpected result: <%v,%v>", other, err)
+	}
+}
+
+func BenchmarkList_Filter(b *testing.B) {
+	l := NewList()
+	for i := 0; i < 10000; i++ {
+		l = l.Append(i)
+	}
+	even := func(index int, value interface{}) (bool, error) { return value.(int)%2 == 0, nil }
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := l.Filter(even); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSortedMap_MapValues(b *testing.B) {
+	m := NewSortedMap(nil)
+	for i := 0; i < 10000; i++ {
+		m = m.Set(i, i)
+	}
+	incr := func(key, value interface{}) (interface{}, error) { return value.(int) + 1, nil }
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := m.MapValues(incr); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func ExampleList_Filter() {
+	l := NewList()
+	for i := 1; i <= 6; i++ {
+		l = l.Append(i)
+	}
+
+	l, _ = l.Filter(func(index int, value interface{}) (bool, error) {
+		return value.(int)%2 == 0, nil
+	})
+	sum, _ := l.Reduce(0, func(acc interface{}, index int, value interface{}) (interface{}, error) {
+		return acc.(int) + value.(int), nil
+	})
+	fmt.Println(l.Len(), sum)
+	// Output:
+	// 3 12
+}
+
+func ExampleSortedMap_MapValues() {
+	m := NewSortedMap(nil)
+	m = m.Set("apple", 1)
+	m = m.Set("pear", 2)
+
+	m, _ = m.MapValues(func(key, value interface{}) (interface{}, error) {
+		return value.(int) * 100, nil
+	})
+	for itr := m.Iterator(); !itr.Done(); {
+		k, v := itr.Next()
+		fmt.Println(k, v)
+	}
+	// Output:
+	// apple 100
+	// pear 200
+}
@@ -0,0 +1,148 @@
+package immutable
+
+import (
+	"fmt"
+)
+
+// Tuple represents a composite key made up of one value per column. Tuples
+// are ordered by a TupleComparer so that a SortedMap can be used as a
+// multi-column index. A nil value represents a null column.
+//
+// A tuple with fewer values than columns is a prefix. A prefix sorts before
+// all tuples that begin with the same values so it can be passed to
+// SortedMapIterator.Seek to find the first key with matching leading columns.
+type Tuple []interface{}
+
+// TupleComparer compares Tuple keys column by column.
+type TupleComparer struct {
+	columns []Comparer
+}
+
+// ComposeComparer returns a comparer for Tuple keys where each column is
+// compared with the comparer at the same position. If a column's comparer is
+// nil then the built-in comparer for the column's value type is used.
+//
+// Columns can be wrapped with Desc to reverse their order, and with NullsFirst
+// or NullsLast to control where nil values are sorted. Nil values sort first
+// by default.
+func ComposeComparer(comparers ...Comparer) *TupleComparer {
+	columns := make([]Comparer, len(comparers))
+	for i, c := range comparers {
+		if _, ok := c.(*nullsComparer); !ok {
+			c = NullsFirst(c)
+		}
+		columns[i] = c
+	}
+	return &TupleComparer{columns: columns}
+}
+
+// Compare returns -1 if a is less than b, returns 1 if a is greater than b, and
+// returns 0 if a is equal to b. If one tuple is a prefix of the other then the
+// shorter tuple is less. Panics if a or b is not a Tuple or if a tuple has more
+// values than there are columns.
+func (c *TupleComparer) Compare(a, b interface{}) int {
+	x, y := a.(Tuple), b.(Tuple)
+	c.check("Compare", x)
+	c.check("Compare", y)
+
+	for i := 0; i < len(x) && i < len(y); i++ {
+		if cmp := c.columns[i].Compare(x[i], y[i]); cmp != 0 {
+			return cmp
+		}
+	}
+
+	if len(x) < len(y) {
+		return -1
+	} else if len(x) > len(y) {
+		return 1
+	}
+	return 0
+}
+
+// HasPrefix returns true if key begins with the values in prefix. This can be
+// used to stop iterating after seeking to a prefix. Panics if prefix has more
+// values than there are columns.
+func (c *TupleComparer) HasPrefix(key interface{}, prefix Tuple) bool {
+	c.check("HasPrefix", prefix)
+
+	t := key.(Tuple)
+	if len(t) < len(prefix) {
+		return false
+	}
+	for i := range prefix {
+		if c.columns[i].Compare(t[i], prefix[i]) != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// check panics if t has more values than there are columns. The method name
+// is included in the panic message.
+func (c *TupleComparer) check(method string, t Tuple) {
+	if len(t) > len(c.columns) {
+		panic(fmt.Sprintf("immutable.TupleComparer.%s: tuple has %d values, expected at most %d", method, len(t), len(c.columns)))
+	}
+}
+
+// Desc returns a comparer that reverses the order of c. If c is nil then the
+// built-in comparer for the value type is reversed. Wrap the result with
+// NullsFirst or NullsLast to sort nil values independently of the direction.
+func Desc(c Comparer) Comparer {
+	return &descComparer{c: c}
+}
+
+// descComparer reverses the order of another comparer.
+type descComparer struct {
+	c Comparer
+}
+
+// Compare returns the reverse of the wrapped comparer.
+func (c *descComparer) Compare(a, b interface{}) int {
+	return -compareWith(c.c, a, b)
+}
+
+// NullsFirst returns a comparer that sorts nil values before all other values
+// and compares other values with c. If c is nil then the built-in comparer for
+// the value type is used.
+func NullsFirst(c Comparer) Comparer {
+	return &nullsComparer{c: c, last: false}
+}
+
+// NullsLast returns a comparer that sorts nil values after all other values
+// and compares other values with c. If c is nil then the built-in comparer for
+// the value type is used.
+func NullsLast(c Comparer) Comparer {
+	return &nullsComparer{c: c, last: true}
+}
+
+// nullsComparer sorts nil values before or after all other values.
+type nullsComparer struct {
+	c    Comparer
+	last bool
+}
+
+// Compare returns -1 if a is less than b, returns 1 if a is greater than b, and
+// returns 0 if a is equal to b.
+func (c *nullsComparer) Compare(a, b interface{}) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil && c.last, b == nil && !c.last:
+		return 1
+	case a == nil, b == nil:
+		return -1
+	}
+	return compareWith(c.c, a, b)
+}
+
+// compareWith compares a & b with c, or with the built-in comparer for the
+// type of a if c is nil. Panics if no built-in comparer exists.
+func compareWith(c Comparer, a, b interface{}) int {
+	if c == nil {
+		if c = defaultComparer(a); c == nil {
+			panic(fmt.Sprintf("immutable.TupleComparer.Compare: must set comparer for %T type", a))
+		}
+	}
+	return c.Compare(a, b)
+}
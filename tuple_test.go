@@ -0,0 +1,164 @@
+package immutable
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestTupleComparer_Compare(t *testing.T) {
+	c := ComposeComparer(nil, Desc(nil), NullsLast(nil))
+	for _, tt := range []struct {
+		a, b Tuple
+		exp  int
+	}{
+		{Tuple{"a", 1, "x"}, Tuple{"a", 1, "x"}, 0},
+		{Tuple{"a", 1, "x"}, Tuple{"b", 1, "x"}, -1},
+		{Tuple{"a", 2, "x"}, Tuple{"a", 1, "x"}, -1}, // descending
+		{Tuple{"a", 1, "x"}, Tuple{"a", 1, "y"}, -1},
+		{Tuple{"a", 1, nil}, Tuple{"a", 1, "y"}, 1},  // nulls last
+		{Tuple{nil, 1, "x"}, Tuple{"a", 1, "x"}, -1}, // nulls first by default
+		{Tuple{"a"}, Tuple{"a", 1, "x"}, -1},         // prefix
+		{Tuple{"b"}, Tuple{"a", 1, "x"}, 1},
+		{Tuple{}, Tuple{nil}, -1},
+	} {
+		if got := c.Compare(tt.a, tt.b); got != tt.exp {
+			t.Fatalf("Compare(%v, %v)=%d, expected %d", tt.a, tt.b, got, tt.exp)
+		} else if got := c.Compare(tt.b, tt.a); got != -tt.exp {
+			t.Fatalf("Compare(%v, %v)=%d, expected %d", tt.b, tt.a, got, -tt.exp)
+		}
+	}
+
+	t.Run("NullsFirstDesc", func(t *testing.T) {
+		c := ComposeComparer(NullsFirst(Desc(nil)))
+		if got := c.Compare(Tuple{nil}, Tuple{1}); got != -1 {
+			t.Fatalf("unexpected result: %d", got)
+		} else if got := c.Compare(Tuple{2}, Tuple{1}); got != -1 {
+			t.Fatalf("unexpected result: %d", got)
+		}
+	})
+
+	t.Run("ErrTooManyValues", func(t *testing.T) {
+		var r interface{}
+		func() {
+			defer func() { r = recover() }()
+			ComposeComparer(nil).Compare(Tuple{1, 2}, Tuple{1})
+		}()
+		if r != `immutable.TupleComparer.Compare: tuple has 2 values, expected at most 1` {
+			t.Fatalf("unexpected panic: %v", r)
+		}
+	})
+
+	t.Run("ErrNoDefaultComparer", func(t *testing.T) {
+		var r interface{}
+		func() {
+			defer func() { r = recover() }()
+			ComposeComparer(nil).Compare(Tuple{struct{}{}}, Tuple{struct{}{}})
+		}()
+		if r != `immutable.TupleComparer.Compare: must set comparer for struct {} type` {
+			t.Fatalf("unexpected panic: %v", r)
+		}
+	})
+}
+
+func TestTupleComparer_HasPrefix(t *testing.T) {
+	c := ComposeComparer(nil, nil)
+	if !c.HasPrefix(Tuple{"a", 1}, Tuple{"a"}) {
+		t.Fatal("expected prefix")
+	} else if !c.HasPrefix(Tuple{"a", 1}, Tuple{}) {
+		t.Fatal("expected empty prefix")
+	} else if c.HasPrefix(Tuple{"a", 1}, Tuple{"b"}) {
+		t.Fatal("expected no prefix")
+	} else if c.HasPrefix(Tuple{"a"}, Tuple{"a", 1}) {
+		t.Fatal("expected no prefix for longer tuple")
+	}
+
+	t.Run("ErrTooManyValues", func(t *testing.T) {
+		var r interface{}
+		func() {
+			defer func() { r = recover() }()
+			c.HasPrefix(Tuple{"a", 1}, Tuple{"a", 1, 2})
+		}()
+		if r != `immutable.TupleComparer.HasPrefix: tuple has 3 values, expected at most 2` {
+			t.Fatalf("unexpected panic: %v", r)
+		}
+	})
+}
+
+// Ensure a sorted map keyed by tuples can be scanned by prefix using Seek.
+func TestTuple_SortedMap(t *testing.T) {
+	RunRandom(t, "Seek", func(t *testing.T, rand *rand.Rand) {
+		c := ComposeComparer(nil, Desc(nil), nil)
+		m := NewSortedMap(c)
+		for i := 0; i < 1000; i++ {
+			m = m.Set(Tuple{fmt.Sprint(rand.Intn(10)), rand.Intn(100), i}, i)
+		}
+
+		// Collect keys for tenant "5" via Seek & HasPrefix.
+		var got []Tuple
+		prefix := Tuple{"5"}
+		itr := m.Iterator()
+		for itr.Seek(prefix); !itr.Done(); {
+			k, _ := itr.Next()
+			if !c.HasPrefix(k, prefix) {
+				break
+			}
+			got = append(got, k.(Tuple))
+		}
+
+		// Collect the same keys by scanning the whole map.
+		var exp []Tuple
+		for itr := m.Iterator(); !itr.Done(); {
+			if k, _ := itr.Next(); k.(Tuple)[0] == "5" {
+				exp = append(exp, k.(Tuple))
+			}
+		}
+		if !reflect.DeepEqual(got, exp) {
+			t.Fatalf("unexpected keys: %v, expected %v", got, exp)
+		}
+
+		// Ensure the second column is descending.
+		for i := 1; i < len(got); i++ {
+			if got[i-1][1].(int) < got[i][1].(int) {
+				t.Fatalf("out of order: %v, %v", got[i-1], got[i])
+			}
+		}
+	})
+}
+
+func BenchmarkTupleComparer_Compare(b *testing.B) {
+	c := ComposeComparer(nil, Desc(nil), nil)
+	x, y := Tuple{"acme", 100, 1}, Tuple{"acme", 100, 2}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.Compare(x, y)
+	}
+}
+
+func ExampleComposeComparer() {
+	// Index events by (tenant, timestamp desc, id).
+	c := ComposeComparer(nil, Desc(nil), nil)
+	m := NewSortedMap(c)
+	m = m.Set(Tuple{"acme", 100, 1}, "a")
+	m = m.Set(Tuple{"acme", 200, 2}, "b")
+	m = m.Set(Tuple{"acme", 300, 3}, "c")
+	m = m.Set(Tuple{"zeta", 400, 4}, "d")
+
+	// Iterate over events for "acme" from newest to oldest.
+	prefix := Tuple{"acme"}
+	itr := m.Iterator()
+	for itr.Seek(prefix); !itr.Done(); {
+		k, v := itr.Next()
+		if !c.HasPrefix(k, prefix) {
+			break
+		}
+		fmt.Println(k, v)
+	}
+	// Output:
+	// [acme 300 3] c
+	// [acme 200 2] b
+	// [acme 100 1] a
+}